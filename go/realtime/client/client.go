@@ -0,0 +1,487 @@
+// Package client connects Go services to the realtime gateway. A Client
+// keeps one WebSocket open to /ws, reconnecting with backoff whenever it
+// drops, and delivers what the gateway sends on a channel:
+//
+//	c, err := client.Dial("wss://rt.example.com/ws", client.Options{
+//		Topics: []string{"orders"},
+//		Token:  jwt,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	for msg := range c.Messages() {
+//		handle(msg.Data)
+//	}
+//
+// It speaks the gateway's wire protocol: it answers application pings,
+// follows reconnect hints, unpacks batches, acknowledges messages in ack mode
+// and resumes sessions, so callers only see messages.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Message is one message the gateway delivered.
+type Message struct {
+	// Data is the payload as published. In ack mode it is the gateway's
+	// JSON rendering of it: JSON as is, other text as a JSON string and
+	// binary payloads as a base64 JSON string.
+	Data []byte
+	// Binary is set for payloads the gateway sent as binary frames.
+	Binary bool
+	// ID and Topic are only known in ack mode, where the gateway wraps each
+	// message with them.
+	ID    string
+	Topic string
+}
+
+// Options configure a Client. The zero value connects without topics or
+// authentication and reconnects forever.
+type Options struct {
+	// Topics are joined on connect, and joined again on every reconnect
+	// together with those added by Subscribe.
+	Topics []string
+	// Token is sent as "Authorization: Bearer <token>".
+	Token string
+	// Header is added to the handshake request, e.g. for tenant headers.
+	Header http.Header
+	// ClientID is sent as ?client_id=. It must be stable for ack mode to
+	// resume from the last acknowledged message after a reconnect.
+	ClientID string
+	// Ack connects with ?ack=1; every message is acknowledged once the
+	// receiver has taken it from Messages.
+	Ack bool
+	// PublishToken is sent as X-Publish-Token by Publish.
+	PublishToken string
+
+	// MinBackoff and MaxBackoff bound the randomized exponential delay
+	// between reconnect attempts; they default to 500ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// ReadTimeout is how long the connection may stay silent, pings
+	// included, before it is considered dead; it defaults to 75s, above the
+	// gateway's default PONG_TIMEOUT.
+	ReadTimeout time.Duration
+	// HandshakeTimeout defaults to 10s.
+	HandshakeTimeout time.Duration
+	// Buffer is the capacity of the Messages channel, 64 by default.
+	Buffer int
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+func (o *Options) defaults() {
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 500 * time.Millisecond
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = max(30*time.Second, o.MinBackoff)
+	}
+	if o.ReadTimeout <= 0 {
+		o.ReadTimeout = 75 * time.Second
+	}
+	if o.HandshakeTimeout <= 0 {
+		o.HandshakeTimeout = 10 * time.Second
+	}
+	if o.Buffer <= 0 {
+		o.Buffer = 64
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+}
+
+// Client is a connection to the gateway that survives disconnects. Its
+// methods are safe for concurrent use.
+type Client struct {
+	url      *url.URL
+	opts     Options
+	dialer   websocket.Dialer
+	messages chan Message
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	mu sync.Mutex
+	// conn is the current connection, nil while reconnecting.
+	conn   *websocket.Conn
+	topics map[string]struct{}
+	// id and session come from the last welcome frame; session is sent as
+	// ?resume= on reconnect when the gateway offers resumption.
+	id      string
+	session string
+
+	// wmu serializes writes, which gorilla requires.
+	wmu sync.Mutex
+}
+
+// ErrClosed is returned for calls on a closed Client.
+var ErrClosed = errors.New("client: closed")
+
+// Dial connects to the gateway's /ws URL, e.g. "wss://host/ws", and keeps
+// the connection up until Close. Only the first connection attempt is made
+// synchronously; if it fails, Dial returns its error, including refusals
+// such as 401 or 503.
+func Dial(rawURL string, opts Options) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("client: url scheme must be ws or wss, not %q", u.Scheme)
+	}
+	opts.defaults()
+	c := &Client{
+		url:      u,
+		opts:     opts,
+		dialer:   websocket.Dialer{HandshakeTimeout: opts.HandshakeTimeout, Proxy: http.ProxyFromEnvironment},
+		messages: make(chan Message, opts.Buffer),
+		done:     make(chan struct{}),
+		topics:   make(map[string]struct{}),
+	}
+	for _, t := range opts.Topics {
+		c.topics[t] = struct{}{}
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	conn, err := c.connect()
+	if err != nil {
+		c.cancel()
+		return nil, err
+	}
+	go c.run(conn)
+	return c, nil
+}
+
+// Messages returns the channel messages are delivered on. It is closed by
+// Close. A receiver that falls behind holds up reading from the gateway,
+// which eventually drops the connection as too slow.
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+// ID returns the connection ID from the gateway's latest welcome frame.
+func (c *Client) ID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+// Close disconnects and stops reconnecting, then closes Messages.
+func (c *Client) Close() error {
+	c.cancel()
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		c.wmu.Lock()
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		c.wmu.Unlock()
+		conn.Close()
+	}
+	<-c.done
+	return nil
+}
+
+// Subscribe joins topic now if connected, and on every reconnect.
+func (c *Client) Subscribe(topic string) error {
+	c.mu.Lock()
+	c.topics[topic] = struct{}{}
+	c.mu.Unlock()
+	return c.send(map[string]string{"action": "subscribe", "topic": topic})
+}
+
+// Unsubscribe leaves topic.
+func (c *Client) Unsubscribe(topic string) error {
+	c.mu.Lock()
+	delete(c.topics, topic)
+	c.mu.Unlock()
+	return c.send(map[string]string{"action": "unsubscribe", "topic": topic})
+}
+
+// Publish sends data to topic through the gateway's POST /publish/{topic},
+// which needs Options.PublishToken to match the gateway's PUBLISH_TOKEN.
+// where, when not empty, narrows delivery to the clients whose
+// connection tags match the expression.
+func (c *Client) Publish(ctx context.Context, topic string, data []byte, where string) error {
+	u := *c.url
+	u.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	u.Path = strings.TrimSuffix(u.Path, "/ws") + "/publish/" + url.PathEscape(topic)
+	u.RawQuery = ""
+	if where != "" {
+		u.RawQuery = url.Values{"where": {where}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Publish-Token", c.opts.PublishToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("client: publish to %s: %s: %s", topic, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// send writes a control message on the current connection. It is dropped
+// while reconnecting, when the next connection's ?topics= catch up anyway.
+func (c *Client) send(msg any) error {
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return c.write(conn, msg)
+}
+
+func (c *Client) write(conn *websocket.Conn, msg any) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// connect dials once with the current topics and session.
+func (c *Client) connect() (*websocket.Conn, error) {
+	u := *c.url
+	q := u.Query()
+	c.mu.Lock()
+	if len(c.topics) > 0 {
+		topics := make([]string, 0, len(c.topics))
+		for t := range c.topics {
+			topics = append(topics, t)
+		}
+		q.Set("topics", strings.Join(topics, ","))
+	}
+	if c.session != "" {
+		q.Set("resume", c.session)
+	}
+	c.mu.Unlock()
+	if c.opts.ClientID != "" {
+		q.Set("client_id", c.opts.ClientID)
+	}
+	if c.opts.Ack {
+		q.Set("ack", "1")
+	}
+	u.RawQuery = q.Encode()
+	header := c.opts.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if c.opts.Token != "" {
+		header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	conn, resp, err := c.dialer.DialContext(c.ctx, u.String(), header)
+	if err != nil {
+		if resp != nil {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			return nil, fmt.Errorf("client: dial %s: %s: %s", c.url.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+		}
+		return nil, fmt.Errorf("client: dial %s: %w", c.url.Redacted(), err)
+	}
+	conn.SetReadDeadline(time.Now().Add(c.opts.ReadTimeout))
+	// The welcome frame comes first; reading it here means ID is known as
+	// soon as Dial returns.
+	var welcome frame
+	if _, data, err := conn.ReadMessage(); err != nil || json.Unmarshal(data, &welcome) != nil || welcome.Type != "welcome" {
+		conn.Close()
+		return nil, fmt.Errorf("client: dial %s: no welcome frame", c.url.Redacted())
+	}
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(c.opts.ReadTimeout))
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(10*time.Second))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+	c.mu.Lock()
+	c.conn = conn
+	c.id, c.session = welcome.ID, welcome.Session
+	c.mu.Unlock()
+	return conn, nil
+}
+
+// run reads from conn and reconnects after it ends, until Close.
+func (c *Client) run(conn *websocket.Conn) {
+	defer close(c.done)
+	defer close(c.messages)
+	attempt := 0
+	for {
+		if conn != nil {
+			start := time.Now()
+			wait, err := c.read(conn)
+			conn.Close()
+			c.mu.Lock()
+			c.conn = nil
+			c.mu.Unlock()
+			if c.ctx.Err() != nil {
+				return
+			}
+			c.opts.Logger.Info("realtime connection lost; reconnecting", "err", err)
+			// A connection that held up for a while starts the backoff
+			// over.
+			if time.Since(start) > c.opts.MaxBackoff {
+				attempt = 0
+			}
+			if wait > 0 {
+				if !c.sleep(wait) {
+					return
+				}
+				attempt = 0
+				conn = nil
+				continue
+			}
+		}
+		if !c.sleep(c.backoff(attempt)) {
+			return
+		}
+		attempt++
+		var err error
+		if conn, err = c.connect(); err != nil {
+			c.opts.Logger.Warn("realtime reconnect failed", "attempt", attempt, "err", err)
+		}
+	}
+}
+
+// backoff picks a random delay of up to MinBackoff doubled attempt times,
+// capped at MaxBackoff, and at least MinBackoff.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.opts.MaxBackoff
+	if attempt < 30 {
+		d = min(c.opts.MinBackoff<<attempt, c.opts.MaxBackoff)
+	}
+	return c.opts.MinBackoff + rand.N(d)
+}
+
+func (c *Client) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// frame holds the fields of every gateway frame the client acts on.
+type frame struct {
+	Type     string            `json:"type"`
+	ID       string            `json:"id"`
+	Topic    string            `json:"topic"`
+	Data     json.RawMessage   `json:"data"`
+	Session  string            `json:"session"`
+	AfterMS  int64             `json:"after_ms"`
+	Code     string            `json:"code"`
+	Message  string            `json:"message"`
+	Action   string            `json:"action"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// read handles frames until the connection fails. A reconnect frame ends it
+// early, returning how long the gateway asked to wait.
+func (c *Client) read(conn *websocket.Conn) (time.Duration, error) {
+	var wait time.Duration
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			return wait, err
+		}
+		conn.SetReadDeadline(time.Now().Add(c.opts.ReadTimeout))
+		if kind == websocket.BinaryMessage {
+			if !c.deliver(conn, Message{Data: data, Binary: true}) {
+				return 0, ErrClosed
+			}
+			continue
+		}
+		var f frame
+		if len(data) == 0 || data[0] != '{' || json.Unmarshal(data, &f) != nil {
+			f = frame{}
+		}
+		switch f.Type {
+		case "welcome":
+			c.mu.Lock()
+			c.id, c.session = f.ID, f.Session
+			c.mu.Unlock()
+		case "ping":
+			c.write(conn, map[string]string{"type": "pong"})
+		case "reconnect":
+			// The close frame follows; wait as asked once it arrives.
+			wait = time.Duration(f.AfterMS) * time.Millisecond
+		case "error":
+			c.opts.Logger.Warn("realtime gateway error", "action", f.Action, "code", f.Code, "message", f.Message)
+		case "ack", "flow":
+			// Confirmations of subscribe and unsubscribe, and queue state;
+			// nothing the receiver needs.
+		case "batch":
+			for _, m := range f.Messages {
+				if !c.deliverText(conn, m) {
+					return 0, ErrClosed
+				}
+			}
+		default:
+			if !c.deliverText(conn, data) {
+				return 0, ErrClosed
+			}
+		}
+	}
+}
+
+// deliverText delivers one text message, unwrapping an ack-mode message
+// frame.
+func (c *Client) deliverText(conn *websocket.Conn, data []byte) bool {
+	if c.opts.Ack {
+		var f frame
+		if json.Unmarshal(data, &f) == nil && f.Type == "message" && f.ID != "" {
+			return c.deliver(conn, Message{Data: f.Data, ID: f.ID, Topic: f.Topic})
+		}
+	}
+	return c.deliver(conn, Message{Data: data})
+}
+
+// deliver hands msg to the receiver, then acknowledges it if it has an ID.
+// It blocks while Messages is full and reports false once the client is
+// closed.
+func (c *Client) deliver(conn *websocket.Conn, msg Message) bool {
+	select {
+	case c.messages <- msg:
+	case <-c.ctx.Done():
+		return false
+	}
+	if msg.ID != "" {
+		c.write(conn, map[string]string{"action": "ack", "id": msg.ID})
+	}
+	return true
+}
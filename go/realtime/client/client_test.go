@@ -0,0 +1,302 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"realtime/gateway"
+)
+
+const (
+	testSecret       = "client-test-secret"
+	testPublishToken = "publish"
+)
+
+// startGateway runs an in-memory gateway with env on top of the defaults and
+// returns its ws:// URL for /ws.
+func startGateway(t *testing.T, env map[string]string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	defaults := map[string]string{
+		"BACKEND":              "memory",
+		"BIND_ADDR":            addr,
+		"PUBLISH_TOKEN":        testPublishToken,
+		"CLIENT_CLOSE_TIMEOUT": "200ms",
+		"CLOSE_TIMEOUT":        "200ms",
+	}
+	for k, v := range defaults {
+		if _, ok := env[k]; !ok {
+			t.Setenv(k, v)
+		}
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := gateway.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := gateway.New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.Run(ctx) }()
+	t.Cleanup(func() {
+		// The transport may have dialed a spare connection for a publish
+		// without sending on it, and Shutdown gives those 5s to speak up.
+		http.DefaultClient.CloseIdleConnections()
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("gateway did not shut down")
+		}
+	})
+	waitFor(t, "gateway to listen", func() bool {
+		resp, err := http.Get("http://" + addr + "/healthz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	})
+	return "ws://" + addr + "/ws"
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// dial connects with fast reconnects and closes the client when the test
+// ends.
+func dial(t *testing.T, url string, opts Options) *Client {
+	t.Helper()
+	opts.PublishToken = testPublishToken
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff, opts.MaxBackoff = 10*time.Millisecond, 50*time.Millisecond
+	}
+	c, err := Dial(url, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// next returns the next message, failing the test after two seconds.
+func next(t *testing.T, c *Client) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-c.Messages():
+		if !ok {
+			t.Fatal("Messages closed")
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return Message{}
+}
+
+// publish publishes data to topic through c and fails the test on error.
+func publish(t *testing.T, c *Client, topic, data string) {
+	t.Helper()
+	if err := c.Publish(context.Background(), topic, []byte(data), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectNothing fails the test if a message arrives within d.
+func expectNothing(t *testing.T, c *Client, d time.Duration) {
+	t.Helper()
+	select {
+	case msg := <-c.Messages():
+		t.Fatalf("unexpected message %s", msg.Data)
+	case <-time.After(d):
+	}
+}
+
+func TestDialAndPublish(t *testing.T) {
+	url := startGateway(t, nil)
+	c := dial(t, url, Options{Topics: []string{"orders"}})
+	if c.ID() == "" {
+		t.Fatal("ID empty after Dial")
+	}
+	publish(t, c, "news", `{"n":0}`)
+	publish(t, c, "orders", `{"n":1}`)
+	if msg := next(t, c); string(msg.Data) != `{"n":1}` || msg.Binary || msg.ID != "" {
+		t.Fatalf("message = %+v, want the orders payload as published", msg)
+	}
+	expectNothing(t, c, 50*time.Millisecond)
+}
+
+func TestSubscribeAndUnsubscribe(t *testing.T) {
+	url := startGateway(t, nil)
+	c := dial(t, url, Options{})
+	if err := c.Subscribe("orders"); err != nil {
+		t.Fatal(err)
+	}
+	// The gateway handles control messages in order, so once one publish
+	// arrives the subscription is known to be in place.
+	waitFor(t, "the subscription", func() bool {
+		publish(t, c, "orders", `{}`)
+		select {
+		case <-c.Messages():
+			return true
+		case <-time.After(20 * time.Millisecond):
+			return false
+		}
+	})
+	if err := c.Unsubscribe("orders"); err != nil {
+		t.Fatal(err)
+	}
+	// Drain anything published before the unsubscribe took effect.
+	time.Sleep(50 * time.Millisecond)
+	for len(c.Messages()) > 0 {
+		<-c.Messages()
+	}
+	publish(t, c, "orders", `{}`)
+	expectNothing(t, c, 50*time.Millisecond)
+}
+
+func TestDialRefused(t *testing.T) {
+	url := startGateway(t, map[string]string{"JWT_SECRET": testSecret})
+	_, err := Dial(url, Options{})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Dial without a token = %v, want a 401 error", err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "svc", "exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial(t, url, Options{Token: token})
+}
+
+func TestDialBadURL(t *testing.T) {
+	for _, raw := range []string{"http://localhost/ws", "://", "localhost/ws"} {
+		if _, err := Dial(raw, Options{}); err == nil {
+			t.Errorf("Dial(%q) succeeded", raw)
+		}
+	}
+}
+
+func TestReconnectKeepsTopics(t *testing.T) {
+	url := startGateway(t, map[string]string{
+		"MAX_CONNECTION_LIFETIME": "200ms", "MAX_CONNECTION_LIFETIME_JITTER": "0",
+		"RECONNECT_DELAY": "20ms", "RECONNECT_JITTER": "0",
+	})
+	c := dial(t, url, Options{Topics: []string{"orders"}})
+	if err := c.Subscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+	first := c.ID()
+	waitFor(t, "a reconnect", func() bool { id := c.ID(); return id != "" && id != first })
+	// Both the initial topic and the one added later are joined again.
+	waitFor(t, "both topics on the new connection", func() bool {
+		publish(t, c, "orders", `"o"`)
+		publish(t, c, "news", `"n"`)
+		got := map[string]bool{}
+		for range 2 {
+			select {
+			case msg := <-c.Messages():
+				got[string(msg.Data)] = true
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+		return got[`"o"`] && got[`"n"`]
+	})
+}
+
+func TestAckMode(t *testing.T) {
+	// Unacknowledged messages would get the connection dropped after
+	// ACK_TIMEOUT; acknowledging them keeps it open.
+	url := startGateway(t, map[string]string{"ACK_TIMEOUT": "200ms"})
+	c := dial(t, url, Options{Topics: []string{"orders"}, Ack: true})
+	id := c.ID()
+	publish(t, c, "orders", `{"n":1}`)
+	publish(t, c, "orders", "plain")
+	if msg := next(t, c); string(msg.Data) != `{"n":1}` || msg.ID == "" || msg.Topic != "orders" {
+		t.Fatalf("message = %+v, want the unwrapped payload with its id and topic", msg)
+	}
+	if msg := next(t, c); string(msg.Data) != `"plain"` {
+		t.Fatalf("message = %+v, want the text as a JSON string", msg)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if c.ID() != id {
+		t.Fatal("connection dropped despite acknowledging every message")
+	}
+}
+
+func TestAnswersAppPings(t *testing.T) {
+	url := startGateway(t, map[string]string{"PING_MODE": "app", "APP_PING_INTERVAL": "30ms", "APP_PONG_MISSES": "1"})
+	c := dial(t, url, Options{Topics: []string{"orders"}})
+	id := c.ID()
+	time.Sleep(200 * time.Millisecond)
+	if c.ID() != id {
+		t.Fatal("connection dropped for missed pongs")
+	}
+	// Pings are answered, not delivered.
+	publish(t, c, "orders", `{}`)
+	if msg := next(t, c); string(msg.Data) != `{}` {
+		t.Fatalf("message = %s, want only the published one", msg.Data)
+	}
+}
+
+func TestClose(t *testing.T) {
+	url := startGateway(t, nil)
+	c, err := Dial(url, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, ok := <-c.Messages(); ok {
+		t.Fatal("Messages still open after Close")
+	}
+	if err := c.Subscribe("orders"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Subscribe after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestPublishRefused(t *testing.T) {
+	url := startGateway(t, nil)
+	c := dial(t, url, Options{})
+	c.opts.PublishToken = "wrong"
+	if err := c.Publish(context.Background(), "orders", []byte(`{}`), ""); err == nil {
+		t.Fatal("Publish with the wrong token succeeded")
+	}
+	c.opts.PublishToken = testPublishToken
+	if err := c.Publish(context.Background(), "orders", []byte(`{}`), "platform =="); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("Publish with a malformed where = %v, want a 400 error", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := &Client{opts: Options{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}}
+	for attempt := range 40 {
+		d := c.backoff(attempt)
+		ceiling := c.opts.MinBackoff + min(c.opts.MinBackoff<<min(attempt, 30), c.opts.MaxBackoff)
+		if d < c.opts.MinBackoff || d >= ceiling {
+			t.Fatalf("backoff(%d) = %v, want within [%v, %v)", attempt, d, c.opts.MinBackoff, ceiling)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// ackSaveTimeout bounds the Redis write that records a disconnecting
+// client's unacknowledged position.
+const ackSaveTimeout = 2 * time.Second
+
+// ackTracker holds the messages queued for an ack-mode client (?ack=1) that
+// it has not acknowledged yet, oldest first. Messages count from the moment
+// they are queued, so ones still waiting in the send queue when the client
+// disconnects are redelivered too.
+type ackTracker struct {
+	// next numbers Pub/Sub messages; stream entries use their entry ID.
+	next atomic.Uint64
+	// key is where the oldest unacked stream ID is kept across reconnects;
+	// empty when the client has no stable ID to reconnect with.
+	key string
+
+	mu      sync.Mutex
+	pending []pendingAck
+}
+
+type pendingAck struct {
+	id   string
+	sent time.Time
+}
+
+// nextID returns an ID for a message that has none of its own.
+func (t *ackTracker) nextID() string {
+	return "m" + strconv.FormatUint(t.next.Add(1), 10)
+}
+
+// track records that the message id was queued.
+func (t *ackTracker) track(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, pendingAck{id: id, sent: time.Now()})
+}
+
+// outstanding returns how many messages are unacknowledged.
+func (t *ackTracker) outstanding() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// ack forgets id and reports whether it was outstanding.
+func (t *ackTracker) ack(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, p := range t.pending {
+		if p.id == id {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// oldest returns the longest outstanding message, if any.
+func (t *ackTracker) oldest() (pendingAck, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) == 0 {
+		return pendingAck{}, false
+	}
+	return t.pending[0], true
+}
+
+// ackableMessage is what an ack-mode client receives instead of the bare
+// payload. JSON payloads are embedded as-is, text as a string and binary as
+// base64.
+type ackableMessage struct {
+	Type  string          `json:"type"`
+	ID    string          `json:"id"`
+	Topic string          `json:"topic,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// ackable returns the frame that carries data to c. For an ack-mode client
+// the payload is wrapped with an ID to acknowledge and tracked until it is;
+// id is the stream entry ID, or empty to number the message.
+func (c *client) ackable(messageType int, topic, id string, data []byte) frame {
+	if c.acks == nil {
+		return frame{messageType: messageType, data: data, payload: true}
+	}
+	if id == "" {
+		id = c.acks.nextID()
+	}
+	if c.format == formatMsgpack {
+		c.acks.track(id)
+		return frame{messageType: websocket.BinaryMessage, data: encodeMsgpackWrapped("message", id, c.unscope(topic), data)}
+	}
+	var raw json.RawMessage
+	switch {
+	case messageType == websocket.TextMessage && json.Valid(data):
+		raw = data
+	case messageType == websocket.TextMessage:
+		raw, _ = json.Marshal(string(data))
+	default:
+		raw, _ = json.Marshal(data)
+	}
+	b, _ := json.Marshal(ackableMessage{Type: "message", ID: id, Topic: c.unscope(topic), Data: raw})
+	c.acks.track(id)
+	return frame{messageType: websocket.TextMessage, data: b}
+}
+
+// handleAck processes {"action":"ack","id":"..."}. Unknown IDs, such as a
+// repeated ack, are ignored.
+func (h *hub) handleAck(c *client, msg controlMessage) bool {
+	if c.acks == nil {
+		h.enqueue(c, encodeError(msg.Action, "bad_request", "acknowledgments are not enabled; connect with ?ack=1"))
+		return false
+	}
+	if msg.ID == "" {
+		h.enqueue(c, encodeError(msg.Action, "bad_request", "id is required"))
+		return false
+	}
+	if !c.acks.ack(msg.ID) {
+		c.logger.Debug("ws ack for unknown message", "id", msg.ID)
+	}
+	return true
+}
+
+// ackProblem reports why c should be disconnected for missing acks: more
+// than ackWindow messages outstanding, or one older than ackTimeout. It
+// returns "" while the client keeps up.
+func (h *hub) ackProblem(c *client) string {
+	if c.acks.outstanding() > h.ackWindow {
+		return "too many unacknowledged messages"
+	}
+	if p, ok := c.acks.oldest(); ok && h.ackTimeout > 0 && time.Since(p.sent) > h.ackTimeout {
+		return "ack timeout"
+	}
+	return ""
+}
+
+// closeForAcks disconnects an ack-mode client that fell too far behind.
+func (c *client) closeForAcks(reason string) {
+	c.logger.Warn("ws client disconnected for missing acks", "reason", reason)
+	c.sendClose(websocket.ClosePolicyViolation, reason, disconnectSlowConsumer, time.Second)
+}
+
+// saveAckCursor stores the oldest stream entry c never acknowledged so a
+// reconnect with the same client_id and ?ack=1 is replayed from it. A client
+// that acknowledged everything has its cursor cleared.
+func (h *hub) saveAckCursor(c *client) {
+	ctx, cancel := context.WithTimeout(context.Background(), ackSaveTimeout)
+	defer cancel()
+	var err error
+	if p, ok := c.acks.oldest(); ok {
+		err = h.rdb.Set(ctx, c.acks.key, p.id, h.ackStateTTL).Err()
+	} else {
+		err = h.rdb.Del(ctx, c.acks.key).Err()
+	}
+	if err != nil {
+		c.logger.Warn("saving ack position failed", "err", err)
+	}
+}
+
+// loadAckCursor returns the stream entry a reconnecting ack-mode client must
+// be replayed from, or "" when it left nothing unacknowledged.
+func (h *hub) loadAckCursor(ctx context.Context, key string) (string, error) {
+	id, err := h.rdb.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return id, err
+}
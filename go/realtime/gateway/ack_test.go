@@ -0,0 +1,135 @@
+package gateway
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAckMode(t *testing.T) {
+	tg := startGateway(t, nil)
+	conn, id := tg.connect("/ws?ack=1", nil)
+	tg.hub.broadcast(websocket.TextMessage, []byte(`{"price":1}`))
+	tg.hub.broadcast(websocket.TextMessage, []byte("plain"))
+	first, second := readJSON(t, conn), readJSON(t, conn)
+	if first["type"] != "message" || first["id"] != "m1" || first["data"].(map[string]any)["price"] != 1.0 {
+		t.Fatalf("first = %v, want message m1 with the JSON payload embedded", first)
+	}
+	if second["id"] != "m2" || second["data"] != "plain" {
+		t.Fatalf("second = %v, want message m2 with the text as a string", second)
+	}
+	c, _ := tg.hub.get(id)
+	if n := c.acks.outstanding(); n != 2 {
+		t.Fatalf("outstanding = %d, want 2", n)
+	}
+	sendJSON(t, conn, map[string]string{"action": "ack", "id": "m1"})
+	waitFor(t, "ack to register", func() bool { return c.acks.outstanding() == 1 })
+	if p, _ := c.acks.oldest(); p.id != "m2" {
+		t.Fatalf("oldest unacked = %s, want m2", p.id)
+	}
+	sendJSON(t, conn, map[string]string{"action": "ack"})
+	if msg := readJSON(t, conn); msg["code"] != "bad_request" {
+		t.Fatalf("ack without id: reply = %v, want bad_request", msg)
+	}
+	// A repeated ack is ignored rather than answered with an error.
+	sendJSON(t, conn, map[string]string{"action": "ack", "id": "m1"})
+	expectSilence(t, conn, 100*time.Millisecond)
+}
+
+func TestAckWithoutAckMode(t *testing.T) {
+	tg := startGateway(t, nil)
+	conn, _ := tg.connect("/ws", nil)
+	tg.hub.broadcast(websocket.TextMessage, []byte(`{"price":1}`))
+	if _, data := readFrame(t, conn); string(data) != `{"price":1}` {
+		t.Fatalf("frame = %s, want the bare payload", data)
+	}
+	sendJSON(t, conn, map[string]string{"action": "ack", "id": "m1"})
+	if msg := readJSON(t, conn); msg["code"] != "bad_request" {
+		t.Fatalf("reply = %v, want bad_request", msg)
+	}
+}
+
+func TestAckDisconnects(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		sent int
+	}{
+		{name: "window exceeded", env: map[string]string{"ACK_WINDOW": "2", "ACK_TIMEOUT": "10s"}, sent: 3},
+		{name: "ack timeout", env: map[string]string{"ACK_TIMEOUT": "200ms"}, sent: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := startGateway(t, tt.env)
+			conn, _ := tg.connect("/ws?ack=1", nil)
+			// A client that acknowledges keeps going.
+			acked, ackedID := tg.connect("/ws?ack=1", nil)
+			c, _ := tg.hub.get(ackedID)
+			for range tt.sent {
+				tg.hub.broadcast(websocket.TextMessage, []byte(`{}`))
+				msg := readJSON(t, acked)
+				sendJSON(t, acked, map[string]any{"action": "ack", "id": msg["id"]})
+				waitFor(t, "ack to register", func() bool { return c.acks.outstanding() == 0 })
+			}
+			start := time.Now()
+			if code := closeCode(t, conn); code != websocket.ClosePolicyViolation {
+				t.Fatalf("close code = %d, want %d", code, websocket.ClosePolicyViolation)
+			}
+			if tt.name == "ack timeout" && time.Since(start) < 100*time.Millisecond {
+				t.Fatalf("closed after %v, before ACK_TIMEOUT", time.Since(start))
+			}
+			tg.hub.broadcast(websocket.TextMessage, []byte(`{}`))
+			if msg := readJSON(t, acked); msg["type"] != "message" {
+				t.Fatalf("acknowledging client got %v", msg)
+			}
+		})
+	}
+}
+
+func TestAckRedeliveryOnReconnect(t *testing.T) {
+	mr, url := startRedis(t)
+	defer mr.Close()
+	tg := startGateway(t, map[string]string{"BACKEND": "stream", "REDIS_URL": url})
+	waitFor(t, "stream reader", tg.hub.subscribed.Load)
+	const path = "/ws?ack=1&client_id=dev1"
+
+	conn, _ := tg.connect(path, nil)
+	ids := make([]string, 3)
+	for i := range ids {
+		ids[i], _ = mr.XAdd("realtime:stream", "*", []string{"data", fmt.Sprintf(`{"n":%d}`, i)})
+	}
+	for _, want := range ids {
+		if msg := readJSON(t, conn); msg["id"] != want {
+			t.Fatalf("message = %v, want entry %s", msg, want)
+		}
+	}
+	sendJSON(t, conn, map[string]string{"action": "ack", "id": ids[0]})
+	sendJSON(t, conn, map[string]string{"action": "ack", "id": ids[2]})
+	sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "sync"})
+	readJSON(t, conn)
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	waitFor(t, "ack position to be saved", func() bool {
+		v, err := mr.Get("realtime:acks:dev1")
+		return err == nil && v == ids[1]
+	})
+
+	// Everything from the oldest unacknowledged entry on comes again.
+	conn, _ = tg.connect(path, nil)
+	for _, want := range ids[1:] {
+		if msg := readJSON(t, conn); msg["id"] != want {
+			t.Fatalf("redelivered %v, want entry %s", msg, want)
+		}
+	}
+	for _, id := range ids[1:] {
+		sendJSON(t, conn, map[string]string{"action": "ack", "id": id})
+	}
+	sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "sync"})
+	readJSON(t, conn)
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	waitFor(t, "ack position to be cleared", func() bool { return !mr.Exists("realtime:acks:dev1") })
+
+	conn, _ = tg.connect(path, nil)
+	expectSilence(t, conn, 100*time.Millisecond)
+}
@@ -0,0 +1,135 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// adminTokenHeader carries ADMIN_TOKEN on admin requests.
+const adminTokenHeader = "X-Admin-Token"
+
+// publishTokenHeader carries PUBLISH_TOKEN on publish requests.
+const publishTokenHeader = "X-Publish-Token"
+
+// requireAdmin rejects requests that don't present the admin token.
+func requireAdmin(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get(adminTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			slog.Warn("admin request rejected", "path", r.URL.Path, "remote", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requirePublisher lets through requests that present either the admin token
+// or the publish token; an empty token never matches.
+func requirePublisher(adminToken, publishToken string, next http.HandlerFunc) http.HandlerFunc {
+	matches := func(got, token string) bool {
+		return token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !matches(r.Header.Get(adminTokenHeader), adminToken) && !matches(r.Header.Get(publishTokenHeader), publishToken) {
+			slog.Warn("publish request rejected", "path", r.URL.Path, "remote", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientInfo is one entry of the /admin/clients listing.
+type clientInfo struct {
+	ID          string            `json:"id"`
+	RemoteAddr  string            `json:"remote_addr"`
+	IP          string            `json:"ip"`
+	Tenant      string            `json:"tenant,omitempty"`
+	User        string            `json:"user,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	ConnectedAt time.Time         `json:"connected_at"`
+	Topics      []string          `json:"topics"`
+	Patterns    []string          `json:"patterns,omitempty"`
+	BytesSent   int64             `json:"bytes_sent"`
+	// QueueDepth is the send queue's current length out of QueueCapacity,
+	// MaxQueueDepth the deepest it has been and Overflows the frames that
+	// didn't fit.
+	QueueDepth    int   `json:"queue_depth"`
+	QueueCapacity int   `json:"queue_capacity"`
+	MaxQueueDepth int64 `json:"max_queue_depth"`
+	Overflows     int64 `json:"overflows"`
+	// MessagesReceived, BytesReceived and LastMessageAt describe what the
+	// client sent; MessageRate is its recent messages per second.
+	MessagesReceived int64      `json:"messages_received"`
+	BytesReceived    int64      `json:"bytes_received"`
+	LastMessageAt    *time.Time `json:"last_message_at,omitempty"`
+	MessageRate      float64    `json:"message_rate"`
+}
+
+func (c *client) info() clientInfo {
+	return clientInfo{
+		ID:          c.id,
+		RemoteAddr:  c.remoteAddr,
+		IP:          c.ip,
+		Tenant:      c.tenant,
+		User:        c.userID,
+		Tags:        c.tags,
+		ConnectedAt: c.connectedAt,
+		Topics:      c.topicList(),
+		Patterns:    c.patternList(),
+		BytesSent:   c.bytesSent.Load(),
+
+		QueueDepth:    len(c.send),
+		QueueCapacity: cap(c.send),
+		MaxQueueDepth: c.maxQueueDepth.Load(),
+		Overflows:     c.overflows.Load(),
+
+		MessagesReceived: c.messagesIn.Load(),
+		BytesReceived:    c.bytesIn.Load(),
+		LastMessageAt:    c.lastMessageAt(),
+		MessageRate:      math.Round(c.messageRate()*100) / 100,
+	}
+}
+
+// lastMessageAt returns when the client last sent a message, or nil if it
+// never has.
+func (c *client) lastMessageAt() *time.Time {
+	last := c.lastMessage.Load()
+	if last == 0 {
+		return nil
+	}
+	t := time.Unix(0, last).UTC()
+	return &t
+}
+
+// listClients serves GET /admin/clients.
+func (h *hub) listClients(w http.ResponseWriter, r *http.Request) {
+	clients := h.snapshot()
+	infos := make([]clientInfo, 0, len(clients))
+	for _, c := range clients {
+		infos = append(infos, c.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ConnectedAt.Before(infos[j].ConnectedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"clients": infos})
+}
+
+// disconnectClient serves POST /admin/clients/{id}/disconnect.
+func (h *hub) disconnectClient(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	c, ok := h.get(id)
+	if !ok {
+		http.Error(w, "client not found", http.StatusNotFound)
+		return
+	}
+	c.logger.Info("ws client disconnected by admin", "remote", r.RemoteAddr)
+	h.removeWithReason(c, disconnectAdminKick)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,189 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// audience restricts a message to clients whose JWT claims match it, e.g.
+// {"tenant_id":"t1","role":["admin","owner"]}. Every key must match; a list
+// value matches any of its elements, and a list claim matches if it contains
+// the value.
+type audience map[string]any
+
+// envelope is the optional payload shape that carries delivery rules:
+// {"audience":{...},"sample":0.1,"id":"...","origin":"...","ttl_ms":60000,
+// "where":"...","receipt":true,"data":...}. Only data is delivered.
+type envelope struct {
+	Audience audience `json:"audience,omitempty"`
+	Sample   *float64 `json:"sample,omitempty"`
+	ID       string   `json:"id,omitempty"`
+	// TTLMS is how long after it was written a stream entry may still be
+	// replayed.
+	TTLMS int64 `json:"ttl_ms,omitempty"`
+	// Traceparent is the publisher's W3C trace context, handed to the
+	// Tracer.
+	Traceparent string `json:"traceparent,omitempty"`
+	// Origin is the ID of the client that published the message with
+	// echo disabled; that client is skipped.
+	Origin string `json:"origin,omitempty"`
+	// Where is a filter over the client's tags; see whereExpr.
+	Where string `json:"where,omitempty"`
+	// Receipt asks for a delivery receipt on RECEIPTS_CHANNEL.
+	Receipt bool            `json:"receipt,omitempty"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// deliveryFilter holds an envelope's rules. A nil filter matches every
+// client.
+type deliveryFilter struct {
+	audience audience
+	sample   *sampler
+	origin   string
+	// ttl doesn't restrict live delivery; replay skips entries older than it.
+	ttl time.Duration
+	// traceparent doesn't restrict delivery either; it links the
+	// broadcast's span to the publisher's trace.
+	traceparent string
+	where       *whereExpr
+	// id is the envelope's id, which the message log samples on.
+	id string
+	// receipt doesn't restrict delivery; the broadcast ends with a receipt.
+	receipt bool
+}
+
+// parseEnvelope unwraps an envelope. Payloads that aren't one are returned
+// unchanged with a nil filter. Sampling is keyed on the envelope's id, or
+// on defaultID when it has none.
+func parseEnvelope(payload []byte, defaultID string) (*deliveryFilter, []byte) {
+	trimmed := bytes.TrimSpace(payload)
+	if !looksLikeEnvelope(trimmed) {
+		return nil, payload
+	}
+	var env envelope
+	if err := json.Unmarshal(trimmed, &env); err != nil || (len(env.Audience) == 0 && env.Sample == nil && env.Origin == "" && env.TTLMS <= 0 && env.Traceparent == "" && env.Where == "" && !env.Receipt) {
+		return nil, payload
+	}
+	f := &deliveryFilter{origin: env.Origin, ttl: time.Duration(env.TTLMS) * time.Millisecond, traceparent: env.Traceparent, id: env.ID, receipt: env.Receipt}
+	if len(env.Audience) > 0 {
+		f.audience = env.Audience
+	}
+	if env.Sample != nil {
+		id := env.ID
+		if id == "" {
+			id = defaultID
+		}
+		f.sample = newSampler(*env.Sample, id)
+	}
+	if env.Where != "" {
+		w, err := compileWhere(env.Where)
+		if err != nil {
+			slog.Warn("invalid where in envelope; delivering to no one", "where", env.Where, "err", err)
+			w = neverWhere
+		}
+		f.where = w
+	}
+	return f, env.Data
+}
+
+// looksLikeEnvelope is the cheap check that lets most payloads skip JSON
+// decoding.
+func looksLikeEnvelope(trimmed []byte) bool {
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return false
+	}
+	for _, key := range []string{`"audience"`, `"sample"`, `"origin"`, `"ttl_ms"`, `"traceparent"`, `"where"`, `"receipt"`} {
+		if bytes.Contains(trimmed, []byte(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// withOrigin marks data as published by the client with the given ID. An
+// existing envelope gains an origin field; anything else is wrapped in one.
+func withOrigin(data json.RawMessage, origin string) []byte {
+	return withEnvelopeField(data, "origin", origin)
+}
+
+// withWhere restricts data to the clients matching the where expression,
+// the same way withOrigin adds an origin. data must be JSON.
+func withWhere(data json.RawMessage, where string) []byte {
+	return withEnvelopeField(data, "where", where)
+}
+
+func withEnvelopeField(data json.RawMessage, key, value string) []byte {
+	encoded, _ := json.Marshal(value)
+	if f, _ := parseEnvelope(data, ""); f != nil {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(data, &fields) == nil {
+			fields[key] = encoded
+			out, _ := json.Marshal(fields)
+			return out
+		}
+	}
+	if len(data) == 0 {
+		data = json.RawMessage("null")
+	}
+	out, _ := json.Marshal(map[string]json.RawMessage{key: encoded, "data": data})
+	return out
+}
+
+// messageID returns the envelope's id; a nil filter has none.
+func (f *deliveryFilter) messageID() string {
+	if f == nil {
+		return ""
+	}
+	return f.id
+}
+
+// matches reports whether c passes every rule of f.
+func (f *deliveryFilter) matches(c *client) bool {
+	if f == nil {
+		return true
+	}
+	if f.origin != "" && c.id == f.origin {
+		return false
+	}
+	if f.audience != nil && !f.audience.matches(c.claims) {
+		return false
+	}
+	if f.where != nil && !f.where.matches(c.tags) {
+		return false
+	}
+	return f.sample == nil || f.sample.includes(c.id)
+}
+
+// matches reports whether claims satisfy every key of a.
+func (a audience) matches(claims jwt.MapClaims) bool {
+	for key, want := range a {
+		if !claimMatches(claims[key], want) {
+			return false
+		}
+	}
+	return true
+}
+
+func claimMatches(have, want any) bool {
+	if wants, ok := want.([]any); ok {
+		for _, w := range wants {
+			if claimMatches(have, w) {
+				return true
+			}
+		}
+		return false
+	}
+	if haves, ok := have.([]any); ok {
+		for _, h := range haves {
+			if h == want {
+				return true
+			}
+		}
+		return false
+	}
+	return have != nil && have == want
+}
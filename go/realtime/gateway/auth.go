@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var errMissingToken = errors.New("missing token")
+
+// authenticator admits or refuses an upgrade request and returns the claims
+// of an admitted client.
+type authenticator interface {
+	authenticate(r *http.Request) (jwt.MapClaims, error)
+}
+
+// jwtAuth validates HMAC-signed bearer tokens presented on the upgrade request.
+type jwtAuth struct {
+	secret []byte
+	parser *jwt.Parser
+}
+
+func newJWTAuth(secret []byte) *jwtAuth {
+	return &jwtAuth{
+		secret: secret,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}),
+			jwt.WithExpirationRequired(),
+		),
+	}
+}
+
+// authenticate extracts the token from the Authorization header or the
+// ?token= query parameter and returns its claims when the signature and
+// expiry are valid.
+func (a *jwtAuth) authenticate(r *http.Request) (jwt.MapClaims, error) {
+	raw := bearerToken(r)
+	if raw == "" {
+		return nil, errMissingToken
+	}
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(raw, claims, func(*jwt.Token) (any, error) {
+		return a.secret, nil
+	}); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if scheme, token, ok := strings.Cut(h, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.URL.Query().Get("token")
+}
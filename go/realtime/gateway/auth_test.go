@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "test-secret"
+
+func signToken(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestJWTAuth(t *testing.T) {
+	valid := signToken(t, testSecret, jwt.MapClaims{"sub": "u1", "exp": time.Now().Add(time.Hour).Unix()})
+	tests := []struct {
+		name    string
+		header  string
+		query   string
+		wantSub string
+		wantErr error
+	}{
+		{name: "bearer header", header: "Bearer " + valid, wantSub: "u1"},
+		{name: "query param", query: "?token=" + valid, wantSub: "u1"},
+		{name: "missing token", wantErr: errMissingToken},
+		{name: "non-bearer scheme", header: "Basic " + valid, wantErr: errMissingToken},
+		{name: "expired", header: "Bearer " + signToken(t, testSecret, jwt.MapClaims{"sub": "u1", "exp": time.Now().Add(-time.Minute).Unix()}), wantErr: jwt.ErrTokenExpired},
+		{name: "no expiry", header: "Bearer " + signToken(t, testSecret, jwt.MapClaims{"sub": "u1"}), wantErr: jwt.ErrTokenRequiredClaimMissing},
+		{name: "wrong signature", header: "Bearer " + signToken(t, "other-secret", jwt.MapClaims{"sub": "u1", "exp": time.Now().Add(time.Hour).Unix()}), wantErr: jwt.ErrTokenSignatureInvalid},
+		{name: "garbage", header: "Bearer not.a.token", wantErr: jwt.ErrTokenMalformed},
+	}
+	auth := newJWTAuth([]byte(testSecret))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws"+tt.query, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			claims, err := auth.authenticate(r)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims["sub"] != tt.wantSub {
+				t.Fatalf("sub = %v, want %s", claims["sub"], tt.wantSub)
+			}
+		})
+	}
+}
+
+func TestJWTAuthAlgorithmConfusion(t *testing.T) {
+	// An unsigned token must not pass, whatever the secret.
+	raw, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "u1", "exp": time.Now().Add(time.Hour).Unix()}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/ws?token="+raw, nil)
+	if _, err := newJWTAuth([]byte(testSecret)).authenticate(r); err == nil {
+		t.Fatal("alg=none token accepted")
+	}
+}
+
+func TestUpgradeRequiresValidToken(t *testing.T) {
+	tg := startGateway(t, map[string]string{"JWT_SECRET": testSecret})
+	expired := signToken(t, testSecret, jwt.MapClaims{"sub": "u1", "exp": time.Now().Add(-time.Minute).Unix()})
+	forged := signToken(t, "other-secret", jwt.MapClaims{"sub": "u1", "exp": time.Now().Add(time.Hour).Unix()})
+	for name, query := range map[string]string{"missing": "", "expired": "?token=" + expired, "wrong signature": "?token=" + forged} {
+		t.Run(name, func(t *testing.T) {
+			_, resp, err := tg.tryDial("/ws"+query, nil)
+			if err == nil {
+				t.Fatal("upgrade succeeded")
+			}
+			if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("response = %v, want 401", resp)
+			}
+		})
+	}
+
+	valid := signToken(t, testSecret, jwt.MapClaims{"sub": "u1", "exp": time.Now().Add(time.Hour).Unix()})
+	_, id := tg.connect("/ws", http.Header{"Authorization": {"Bearer " + valid}})
+	c, ok := tg.hub.get(id)
+	if !ok {
+		t.Fatalf("client %s not registered", id)
+	}
+	if c.subject != "u1" || c.claims["sub"] != "u1" {
+		t.Fatalf("subject = %q, claims = %v", c.subject, c.claims)
+	}
+}
+
+func TestUpgradeWithoutSecretSkipsAuth(t *testing.T) {
+	tg := startGateway(t, nil)
+	tg.connect("/ws", nil)
+}
@@ -0,0 +1,163 @@
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// authCacheMax bounds the cached auth responses; past it new ones are not
+// cached until old ones expire.
+const authCacheMax = 10000
+
+// maxAuthResponse bounds the claims document read from the auth service.
+const maxAuthResponse = 64 << 10
+
+// errAuthUnavailable marks failures of the auth service itself, as opposed
+// to a refusal, so the upgrade can be answered with 503 instead of 401.
+var errAuthUnavailable = errors.New("auth service unavailable")
+
+// callbackAuth delegates authentication to an existing auth service: each
+// upgrade's credentials are forwarded to url, and a 200 answer admits the
+// client with the JSON object in the body as its claims. Successful answers
+// are cached for cacheTTL per set of credentials.
+type callbackAuth struct {
+	url      string
+	headers  []string
+	client   *http.Client
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]cachedAuth
+}
+
+type cachedAuth struct {
+	claims  jwt.MapClaims
+	expires time.Time
+}
+
+func newCallbackAuth(url string, headers []string, timeout, cacheTTL time.Duration) *callbackAuth {
+	return &callbackAuth{
+		url:      url,
+		headers:  headers,
+		client:   &http.Client{Timeout: timeout},
+		cacheTTL: cacheTTL,
+		cache:    make(map[[sha256.Size]byte]cachedAuth),
+	}
+}
+
+// authenticate forwards the configured headers of r to the auth service,
+// plus ?token= as a bearer token for clients that cannot set headers.
+func (a *callbackAuth) authenticate(r *http.Request) (jwt.MapClaims, error) {
+	forward := make(http.Header)
+	for _, name := range a.headers {
+		for _, v := range r.Header.Values(name) {
+			forward.Add(name, v)
+		}
+	}
+	if forward.Get("Authorization") == "" {
+		if token := r.URL.Query().Get("token"); token != "" {
+			forward.Set("Authorization", "Bearer "+token)
+		}
+	}
+	key := credentialsKey(forward)
+	if claims, ok := a.cached(key); ok {
+		authRequests.WithLabelValues("cached").Inc()
+		return claims, nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url, nil)
+	if err != nil {
+		authRequests.WithLabelValues("error").Inc()
+		return nil, fmt.Errorf("%w: %v", errAuthUnavailable, err)
+	}
+	req.Header = forward
+	resp, err := a.client.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			authRequests.WithLabelValues("timeout").Inc()
+		} else {
+			authRequests.WithLabelValues("error").Inc()
+		}
+		return nil, fmt.Errorf("%w: %v", errAuthUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxAuthResponse))
+		if resp.StatusCode >= 500 {
+			authRequests.WithLabelValues("error").Inc()
+			return nil, fmt.Errorf("%w: status %d", errAuthUnavailable, resp.StatusCode)
+		}
+		authRequests.WithLabelValues("denied").Inc()
+		return nil, fmt.Errorf("auth service answered %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAuthResponse))
+	if err != nil {
+		authRequests.WithLabelValues("error").Inc()
+		return nil, fmt.Errorf("%w: %v", errAuthUnavailable, err)
+	}
+	claims := jwt.MapClaims{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &claims); err != nil {
+			authRequests.WithLabelValues("error").Inc()
+			return nil, fmt.Errorf("%w: invalid claims: %v", errAuthUnavailable, err)
+		}
+	}
+	authRequests.WithLabelValues("allowed").Inc()
+	a.store(key, claims)
+	return claims, nil
+}
+
+// credentialsKey hashes the forwarded headers so the cache never holds
+// tokens or cookies in the clear.
+func credentialsKey(h http.Header) [sha256.Size]byte {
+	b, _ := json.Marshal(h)
+	return sha256.Sum256(b)
+}
+
+func (a *callbackAuth) cached(key [sha256.Size]byte) (jwt.MapClaims, bool) {
+	if a.cacheTTL <= 0 {
+		return nil, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(a.cache, key)
+		return nil, false
+	}
+	return e.claims, true
+}
+
+func (a *callbackAuth) store(key [sha256.Size]byte, claims jwt.MapClaims) {
+	if a.cacheTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.cache) >= authCacheMax {
+		for k, e := range a.cache {
+			if now.After(e.expires) {
+				delete(a.cache, k)
+			}
+		}
+		if len(a.cache) >= authCacheMax {
+			return
+		}
+	}
+	a.cache[key] = cachedAuth{claims: claims, expires: now.Add(a.cacheTTL)}
+}
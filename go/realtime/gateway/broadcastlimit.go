@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// broadcastLimiter caps how many broadcasts fan out at once across every
+// source: the Redis subscription, the broadcast workers and the publish
+// endpoints. Each broadcast visits the shards on the shared fanout pool or
+// itself, so the cap together with FANOUT_WORKERS bounds the goroutines
+// delivering at any moment.
+type broadcastLimiter struct {
+	slots chan struct{}
+	// shed drops a broadcast that finds every slot taken instead of waiting
+	// for one.
+	shed bool
+	// shedding is set from the first shed broadcast until one gets a slot
+	// again, so a storm logs once rather than per message.
+	shedding atomic.Bool
+}
+
+func newBroadcastLimiter(limit int, shed bool) *broadcastLimiter {
+	return &broadcastLimiter{slots: make(chan struct{}, limit), shed: shed}
+}
+
+// beginBroadcast takes a broadcast slot, waiting for one unless the policy
+// sheds, and reports whether the broadcast for topic may go ahead. A caller
+// that gets true must call endBroadcast once the fan-out is done.
+func (h *hub) beginBroadcast(topic string) bool {
+	l := h.broadcastLimit
+	if l != nil {
+		select {
+		case l.slots <- struct{}{}:
+			l.shedding.Store(false)
+		default:
+			if l.shed {
+				h.shedBroadcast(topic)
+				return false
+			}
+			select {
+			case l.slots <- struct{}{}:
+			case <-h.ctx.Done():
+				h.shedBroadcast(topic)
+				return false
+			}
+		}
+	}
+	broadcastsInFlight.Inc()
+	return true
+}
+
+func (h *hub) shedBroadcast(topic string) {
+	broadcastsShed.Inc()
+	if !h.broadcastLimit.shedding.Swap(true) {
+		slog.Warn("MAX_CONCURRENT_BROADCASTS reached; shedding broadcasts until a slot frees up", "topic", topic)
+	}
+}
+
+// endBroadcast releases the slot taken by beginBroadcast.
+func (h *hub) endBroadcast() {
+	broadcastsInFlight.Dec()
+	if h.broadcastLimit != nil {
+		<-h.broadcastLimit.slots
+	}
+}
@@ -0,0 +1,917 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// priorityBuffer is the capacity of each client's priority lane, which only
+// ever holds a few control frames.
+const priorityBuffer = 16
+
+// frame is an outbound WebSocket message: text or binary.
+type frame struct {
+	messageType int
+	data        []byte
+	// id is the stream entry the frame carries, if any, so writing it can
+	// move the client's cursor.
+	id string
+	// payload is set on frames that carry a relayed message as it was
+	// published, rather than one the gateway built; a msgpack client gets
+	// them unconverted.
+	payload bool
+}
+
+// client wraps a connection with its outbound queue. gorilla/websocket allows
+// only one concurrent writer, so writePump is the sole caller of the
+// connection's write methods and everything else goes through send.
+type client struct {
+	// id identifies the connection in logs, frames and admin tooling.
+	id string
+	// conn is nil for SSE clients, which ssePump writes to instead.
+	conn *websocket.Conn
+	send chan frame
+	// priority carries control frames (welcome, acks, errors, presence)
+	// that writePump sends ahead of whatever is waiting in send.
+	priority chan frame
+	// readDone is closed when readPump returns, e.g. once the client has
+	// answered the gateway's close frame.
+	readDone chan struct{}
+	// protocol is the negotiated wire protocol version.
+	protocol string
+	// format is how frames are encoded on the wire, formatJSON or
+	// formatMsgpack; empty for SSE clients, which are always JSON.
+	format string
+	// compress is set when COMPRESSION_MIN_SIZE applies: only frames that
+	// large are compressed, and only if the client negotiated it.
+	compress bool
+	// logger carries the connection's identifying fields.
+	logger *slog.Logger
+	// ctx is cancelled when the client is removed or the server shuts down;
+	// both pumps exit once it is done.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	remoteAddr string
+	// ip is the client address counted against MAX_CONN_PER_IP.
+	ip          string
+	connectedAt time.Time
+	// bytesSent counts payload bytes written to the socket.
+	bytesSent atomic.Int64
+	// maxQueueDepth is the deepest the send queue has been; overflows
+	// counts the frames that found a lane full, and overflowed is set by
+	// the first of them.
+	maxQueueDepth atomic.Int64
+	overflows     atomic.Int64
+	overflowed    atomic.Bool
+	// messagesIn and bytesIn count the messages the peer sent and their
+	// payload bytes; lastMessage is the UnixNano time of the newest and
+	// inRate the decaying messages-per-second estimate as of then, as
+	// float64 bits. Only readPump writes them.
+	messagesIn  atomic.Int64
+	bytesIn     atomic.Int64
+	lastMessage atomic.Int64
+	inRate      atomic.Uint64
+	// congested is set between the congested and ok flow frames; only
+	// writePump touches it.
+	congested bool
+	// lastActivity is the UnixNano time of the last message read or written;
+	// pings and pongs don't count.
+	lastActivity atomic.Int64
+	// lastHeard is the UnixNano time the peer last sent a message or a pong;
+	// the reaper uses it to spot connections the pumps failed to clean up.
+	lastHeard atomic.Int64
+	// unansweredPings counts the app pings sent since the last app pong.
+	unansweredPings atomic.Int32
+	// closing is the disconnect reason of a close the gateway started. It is
+	// set before the close frame goes out, so the peer answering that frame
+	// isn't taken for the reason.
+	closing atomic.Pointer[string]
+	// shed is set when the memory guard takes the client out of the hub.
+	// The guard then writes the close frame and closes the socket itself,
+	// so writePump leaves both alone on its way out.
+	shed atomic.Bool
+
+	// subject and claims come from the JWT presented on upgrade; both are
+	// empty when authentication is disabled.
+	subject string
+	claims  jwt.MapClaims
+	// tenant scopes the client's topics and publishes; empty without
+	// tenant routing.
+	tenant string
+	// userID groups the connections of one user for to_user messages;
+	// empty when the upgrade named no user.
+	userID string
+	// admin is set when the upgrade presented the admin token, which
+	// unlocks the firehose.
+	admin bool
+	// session is what the client reconnects with to resume after a drop;
+	// empty unless RESUME_WINDOW is set.
+	session string
+	// tags holds the allowlisted query params and headers captured on
+	// upgrade; nil when none were configured or present.
+	tags map[string]string
+
+	// lifecycleMu orders the connect and disconnect announcements that add
+	// and remove make outside the shard lock.
+	lifecycleMu sync.Mutex
+
+	mu sync.Mutex
+	// topics is the set of rooms the client joined, either via ?topics= or
+	// later subscribe actions.
+	topics map[string]struct{}
+	// patterns holds glob subscriptions such as "orders.*"; nil until the
+	// client subscribes to one.
+	patterns map[string]struct{}
+	// latest holds the pending message per TOPIC_COALESCE topic; nil until
+	// the first one is queued.
+	latest map[string]*latestSlot
+	// holds keeps the live messages of topics whose SNAPSHOT_URL fetch is
+	// in flight; nil until the first one.
+	holds map[string]*snapshotHold
+
+	// acks tracks unacknowledged broadcasts when the client connected with
+	// ?ack=1; nil otherwise.
+	acks *ackTracker
+	// batched is set for clients that connected with ?batch=1 while
+	// BATCH_WINDOW is enabled; writePump then coalesces text frames.
+	batched bool
+
+	// Stream backend state: while replaying, live entries are held in
+	// pending, or counted in dropped once pending is full; lastID is the
+	// newest entry delivered so overlaps are skipped.
+	streamMu  sync.Mutex
+	replaying bool
+	pending   []streamEntry
+	dropped   gapMessage
+	lastID    string
+	// cursorKey, with CURSOR_SAVE_INTERVAL, is where the client's position
+	// is saved; delivered is the newest entry written to it, and cursorSaved
+	// and cursorSavedAt, under streamMu, the position last saved and when.
+	cursorKey     string
+	delivered     atomic.Pointer[string]
+	cursorSaved   string
+	cursorSavedAt time.Time
+}
+
+// publishTimeout bounds how long a client publish may wait on Redis.
+const publishTimeout = 5 * time.Second
+
+func newClient(ctx context.Context, id, remoteAddr string, conn *websocket.Conn, sendBuffer int) *client {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &client{
+		id:     id,
+		conn:   conn,
+		send:   make(chan frame, sendBuffer),
+		logger: slog.With("client", id, "remote", remoteAddr),
+		ctx:    ctx,
+		cancel: cancel,
+		topics: make(map[string]struct{}),
+
+		priority:    make(chan frame, priorityBuffer),
+		readDone:    make(chan struct{}),
+		remoteAddr:  remoteAddr,
+		connectedAt: time.Now(),
+	}
+	c.touch()
+	c.heard()
+	return c
+}
+
+// touch records message activity for the idle timeout.
+func (c *client) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// inRateWindow is the time constant of a client's inbound rate estimate:
+// each message weighs in for roughly this long.
+const inRateWindow = 10 * time.Second
+
+// received records an inbound message of n bytes.
+func (c *client) received(n int) {
+	now := time.Now().UnixNano()
+	last := c.lastMessage.Swap(now)
+	est := decayRate(math.Float64frombits(c.inRate.Load()), now-last)
+	c.inRate.Store(math.Float64bits(est + 1/inRateWindow.Seconds()))
+	c.messagesIn.Add(1)
+	c.bytesIn.Add(int64(n))
+}
+
+// messageRate estimates how many messages per second the peer has been
+// sending lately.
+func (c *client) messageRate() float64 {
+	last := c.lastMessage.Load()
+	if last == 0 {
+		return 0
+	}
+	return decayRate(math.Float64frombits(c.inRate.Load()), time.Now().UnixNano()-last)
+}
+
+// decayRate lets the estimate est fade for elapsed nanoseconds without messages.
+func decayRate(est float64, elapsed int64) float64 {
+	return est * math.Exp(-float64(elapsed)/float64(inRateWindow))
+}
+
+// heard records that the peer showed signs of life.
+func (c *client) heard() {
+	c.lastHeard.Store(time.Now().UnixNano())
+}
+
+// silentFor returns how long ago the peer last sent a message or a pong.
+func (c *client) silentFor() time.Duration {
+	return time.Since(time.Unix(0, c.lastHeard.Load()))
+}
+
+// idleFor returns how long the client has gone without sending or receiving
+// a message.
+func (c *client) idleFor() time.Duration {
+	return time.Since(time.Unix(0, c.lastActivity.Load()))
+}
+
+// subscribed reports whether the client joined topic.
+// A topic matched by both an exact subscription and a pattern, or by
+// several patterns, is still delivered once.
+func (c *client) subscribed(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.topics[topic]; ok {
+		return true
+	}
+	return c.matchesPattern(topic)
+}
+
+// hasTopic reports whether c is subscribed to exactly topic.
+func (c *client) hasTopic(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.topics[topic]
+	return ok
+}
+
+// topicList returns the client's topics in sorted order.
+func (c *client) topicList() []string {
+	c.mu.Lock()
+	topics := make([]string, 0, len(c.topics))
+	for t := range c.topics {
+		topics = append(topics, t)
+	}
+	c.mu.Unlock()
+	sort.Strings(topics)
+	return topics
+}
+
+// validClientID restricts client-supplied IDs to a safe, log-friendly shape.
+var validClientID = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+// clientID returns the ID requested via ?client_id=, or a fresh UUID when
+// none was given. It fails when the requested ID is malformed.
+func clientID(requested string) (string, error) {
+	if requested == "" {
+		return uuid.NewString(), nil
+	}
+	if !validClientID.MatchString(requested) {
+		return "", errors.New("client_id must be 1-64 characters of letters, digits, '_', '.', ':' or '-'")
+	}
+	return requested, nil
+}
+
+// parseTopics turns a comma-separated topic list into a set, ignoring blanks.
+func parseTopics(raw string) map[string]struct{} {
+	topics := make(map[string]struct{})
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			topics[t] = struct{}{}
+		}
+	}
+	return topics
+}
+
+// readPump handles client control messages and drains inbound frames so close
+// and ping control frames are processed, dropping the connection as soon as
+// the peer goes away.
+// Every pong pushes the read deadline forward, so a peer that stops answering
+// pings fails the read and is removed; with PING_MODE=app there is no read
+// deadline and writePump counts unanswered app pings instead. Once the
+// client's context is cancelled writePump closes the socket, which ends a
+// blocked read straight away.
+func (h *hub) readPump(c *client) {
+	reason := disconnectReadError
+	defer func() { h.removeWithReason(c, reason) }()
+	defer close(c.readDone)
+
+	// The limit covers a whole message, continuation frames included.
+	c.conn.SetReadLimit(h.maxMessageSize)
+	if h.pingMode != pingModeApp {
+		c.conn.SetReadDeadline(time.Now().Add(h.pongTimeout))
+	}
+	c.conn.SetPongHandler(func(string) error {
+		c.heard()
+		return c.conn.SetReadDeadline(time.Now().Add(h.pongTimeout))
+	})
+	// Answer a client's close frame with the same code to complete the
+	// closing handshake; ReadMessage then returns the *CloseError.
+	c.conn.SetCloseHandler(func(code int, text string) error {
+		msg := websocket.FormatCloseMessage(code, "")
+		err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(h.writeTimeout))
+		if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+			return err
+		}
+		return nil
+	})
+
+	var limiter *rate.Limiter
+	if h.clientRate > 0 {
+		limiter = rate.NewLimiter(h.clientRate, h.clientBurst)
+	}
+	violations := 0
+	protocolErrors := 0
+
+	for {
+		// ReadMessage reassembles fragmented messages, so data is always a
+		// complete message.
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			switch {
+			case c.ctx.Err() != nil:
+				// Removed or shutting down; the socket error is expected.
+				if h.ctx.Err() != nil {
+					reason = disconnectShutdown
+				}
+			case errors.Is(err, websocket.ErrReadLimit):
+				// gorilla has already sent close code 1009 (message too big).
+				c.logger.Warn("ws message too large", "limit", h.maxMessageSize)
+				reason = disconnectPolicyViolation
+			case errors.As(err, &closeErr):
+				switch closeErr.Code {
+				case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived:
+					c.logger.Debug("ws client closed", "code", closeErr.Code, "reason", closeErr.Text)
+					reason = disconnectClientClose
+				case websocket.CloseAbnormalClosure:
+					// gorilla's code for a peer that vanished without a close frame.
+					c.logger.Debug("ws client disconnected", "err", err)
+				default:
+					c.logger.Warn("ws client closed with error", "code", closeErr.Code, "reason", closeErr.Text)
+					reason = disconnectClientClose
+				}
+			case isTimeout(err):
+				// The read deadline only runs out when pongs stop coming.
+				c.logger.Debug("ws client stopped answering pings", "timeout", h.pongTimeout)
+				reason = disconnectPingTimeout
+			default:
+				// Usually the peer vanished without a close frame.
+				c.logger.Debug("ws read error", "err", err)
+			}
+			return
+		}
+		if data, err = c.incoming(messageType, data); err != nil {
+			c.logger.Info("ws invalid msgpack message", "err", err)
+			h.enqueue(c, encodeError("", "bad_request", "invalid MessagePack: "+err.Error()))
+			if protocolErrors++; h.maxProtocolErrors > 0 && protocolErrors >= h.maxProtocolErrors {
+				c.logger.Warn("ws client disconnected for protocol errors", "errors", protocolErrors)
+				c.sendClose(websocket.ClosePolicyViolation, "too many protocol errors", disconnectPolicyViolation, time.Second)
+				return
+			}
+			continue
+		}
+		// App pongs are liveness, like control pongs: they neither count as
+		// activity nor go through rate limiting.
+		if h.pingMode != pingModeControl && isPong(data) {
+			c.heard()
+			c.unansweredPings.Store(0)
+			continue
+		}
+		c.touch()
+		c.heard()
+		c.received(len(data))
+
+		if limiter != nil && !limiter.Allow() {
+			rateLimited.WithLabelValues("client").Inc()
+			violations++
+			if h.maxRateViolations > 0 && violations >= h.maxRateViolations {
+				c.logger.Warn("ws client disconnected for rate limit violations", "violations", violations)
+				c.sendClose(websocket.ClosePolicyViolation, "rate limit exceeded", disconnectPolicyViolation, time.Second)
+				return
+			}
+			h.enqueue(c, encodeError("", "rate_limited", "too many messages"))
+			continue
+		}
+		violations = 0
+		if h.globalLimiter != nil && !h.globalLimiter.Allow() {
+			rateLimited.WithLabelValues("global").Inc()
+			h.enqueue(c, encodeError("", "rate_limited", "gateway is busy"))
+			continue
+		}
+
+		if h.handleControl(c, data) {
+			protocolErrors = 0
+			continue
+		}
+		protocolErrors++
+		if h.maxProtocolErrors > 0 && protocolErrors >= h.maxProtocolErrors {
+			c.logger.Warn("ws client disconnected for protocol errors", "errors", protocolErrors)
+			c.sendClose(websocket.ClosePolicyViolation, "too many protocol errors", disconnectPolicyViolation, time.Second)
+			return
+		}
+	}
+}
+
+// handleControl dispatches a client control message and acknowledges it. A
+// malformed message is answered with a bad_request error frame and reported
+// as false so readPump can count consecutive protocol errors.
+func (h *hub) handleControl(c *client, data []byte) bool {
+	msg, err := decodeControl(c.protocol, data)
+	if err != nil {
+		c.logger.Info("ws invalid control message", "err", err)
+		h.enqueue(c, encodeError("", "bad_request", describeJSONError(err)))
+		return false
+	}
+	switch msg.Action {
+	case actionSubscribe, actionUnsubscribe:
+		if msg.Pattern != "" {
+			return h.handlePattern(c, msg)
+		}
+		if msg.Topic == "" {
+			c.logger.Info("ws control message without topic", "action", msg.Action)
+			h.enqueue(c, encodeError(msg.Action, "bad_request", "topic or pattern is required"))
+			return false
+		}
+		if len(msg.Topic) > maxTopicLength {
+			h.enqueue(c, encodeError(msg.Action, "bad_request", fmt.Sprintf("topic exceeds %d bytes", maxTopicLength)))
+			return false
+		}
+		if msg.Topic == firehoseTopic {
+			return h.handleFirehose(c, msg)
+		}
+		if msg.Action == actionUnsubscribe {
+			h.unsubscribe(c, c.scope(msg.Topic))
+			h.enqueue(c, encodeAck(msg))
+			return true
+		}
+		if h.topicAuth != nil && !h.topicAuth.allowed(c.ctx, c.claims, c.tenant, msg.Topic) {
+			c.logger.Info("ws topic subscription denied", "topic", msg.Topic)
+			h.enqueue(c, encodeError(msg.Action, "forbidden", "not authorized for topic "+strconv.Quote(msg.Topic)))
+			return true
+		}
+		return h.subscribeTopic(c, msg, c.scope(msg.Topic))
+	case actionPublish:
+		if len(msg.Channel) > maxTopicLength {
+			h.enqueue(c, encodeError(msg.Action, "bad_request", fmt.Sprintf("channel exceeds %d bytes", maxTopicLength)))
+			return false
+		}
+		h.handlePublish(c, msg)
+	case actionAck:
+		return h.handleAck(c, msg)
+	case "":
+		h.enqueue(c, encodeError("", "bad_request", "action is required"))
+		return false
+	default:
+		c.logger.Info("ws unknown action", "action", msg.Action)
+		h.enqueue(c, encodeError(msg.Action, "bad_request", "unknown action "+strconv.Quote(msg.Action)))
+		return false
+	}
+	return true
+}
+
+// subscribeTopic subscribes c to topic for msg and acknowledges it, then
+// queues the topic's retained message or starts its snapshot fetch.
+func (h *hub) subscribeTopic(c *client, msg controlMessage, topic string) bool {
+	// A retained topic stays locked from the subscription until its last
+	// message is queued, so that message is not delivered live as well.
+	retained := h.retain.get(topic)
+	if retained != nil {
+		retained.mu.Lock()
+		defer retained.mu.Unlock()
+	}
+	fresh := !c.hasTopic(topic)
+	// Live messages are held back from before the subscription starts
+	// until the snapshot is queued, so none slip in ahead of it.
+	snapshot := h.snapshots != nil && !c.hasTopic(topic) && c.holdTopic(topic)
+	if err := h.subscribe(c, topic); err != nil {
+		if snapshot {
+			c.mu.Lock()
+			delete(c.holds, topic)
+			c.mu.Unlock()
+		}
+		h.enqueue(c, encodeError(msg.Action, "limit_exceeded", err.Error()))
+		return true
+	}
+	h.enqueue(c, encodeAck(msg))
+	if retained != nil && fresh {
+		h.queueRetained(c, topic, retained)
+	}
+	if snapshot {
+		go h.sendSnapshot(c, topic)
+	}
+	return true
+}
+
+// handleFirehose handles a subscribe or unsubscribe for firehoseTopic.
+func (h *hub) handleFirehose(c *client, msg controlMessage) bool {
+	switch {
+	case h.firehose == nil:
+		h.enqueue(c, encodeError(msg.Action, "unsupported", "the firehose is not enabled"))
+	case !c.admin:
+		c.logger.Warn("ws firehose subscription refused")
+		h.enqueue(c, encodeError(msg.Action, "forbidden", "the firehose requires the admin token"))
+	case msg.Action == actionSubscribe:
+		c.logger.Info("ws client tailing the firehose")
+		h.firehose.join(c)
+		h.enqueue(c, encodeAck(msg))
+	default:
+		h.firehose.leave(c)
+		h.enqueue(c, encodeAck(msg))
+	}
+	return true
+}
+
+// handlePattern handles a subscribe or unsubscribe carrying a pattern.
+func (h *hub) handlePattern(c *client, msg controlMessage) bool {
+	if h.maxPatterns == 0 {
+		h.enqueue(c, encodeError(msg.Action, "unsupported", "pattern subscriptions are not enabled"))
+		return true
+	}
+	if len(msg.Pattern) > maxTopicLength {
+		h.enqueue(c, encodeError(msg.Action, "bad_request", fmt.Sprintf("pattern exceeds %d bytes", maxTopicLength)))
+		return false
+	}
+	if err := validPattern(msg.Pattern); err != nil {
+		h.enqueue(c, encodeError(msg.Action, "bad_request", err.Error()))
+		return false
+	}
+	// A pattern can match topics no rule grants, so with topic
+	// authorization only exact topics may be subscribed to.
+	if h.topicAuth != nil && msg.Action == actionSubscribe {
+		h.enqueue(c, encodeError(msg.Action, "forbidden", "pattern subscriptions are not allowed with topic authorization"))
+		return true
+	}
+	if msg.Action == actionUnsubscribe {
+		h.unsubscribePattern(c, c.scope(msg.Pattern))
+	} else if err := h.subscribePattern(c, c.scope(msg.Pattern)); err != nil {
+		h.enqueue(c, encodeError(msg.Action, "limit_exceeded", err.Error()))
+		return true
+	}
+	h.enqueue(c, encodeAck(msg))
+	return true
+}
+
+// handlePublish relays a client message to Redis so every gateway instance
+// and other subscribers receive it. Only channels under publishPrefix are
+// writable by clients.
+func (h *hub) handlePublish(c *client, msg controlMessage) {
+	if h.rdb == nil {
+		h.enqueue(c, encodeError(msg.Action, "unsupported", "publishing is not enabled"))
+		return
+	}
+	if msg.Channel == "" || !strings.HasPrefix(msg.Channel, h.publishPrefix) {
+		h.enqueue(c, encodeError(msg.Action, "forbidden", "channel must start with "+h.publishPrefix))
+		return
+	}
+	// A tenant may only publish to its own topics.
+	channel := msg.Channel
+	if c.tenant != "" {
+		topic, ok := strings.CutPrefix(msg.Channel, h.topicPrefix)
+		if !ok || topic == "" {
+			h.enqueue(c, encodeError(msg.Action, "forbidden", "channel must start with "+h.topicPrefix))
+			return
+		}
+		channel = h.topicPrefix + c.scope(topic)
+	}
+	if topic, ok := strings.CutPrefix(channel, h.topicPrefix); ok {
+		if err := h.checkSchema(topic, msg.Data); err != nil {
+			schemaRejections.WithLabelValues("publish").Inc()
+			c.logger.Info("ws publish refused: schema mismatch", "channel", channel, "err", err)
+			h.enqueue(c, encodeError(msg.Action, "invalid_message", "data does not match the schema of "+c.unscope(topic)+": "+err.Error()))
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, publishTimeout)
+	defer cancel()
+	// With echo disabled the payload names its origin, so no instance
+	// delivers it back to this client.
+	var origin string
+	if msg.Echo != nil && !*msg.Echo {
+		origin = c.id
+	}
+	var seq int64
+	var err error
+	switch {
+	case h.sequencer != nil:
+		seq, err = h.sequencer.publish(ctx, channel, msg.Data, origin)
+	case origin != "":
+		err = h.rdb.Publish(ctx, channel, withOrigin(msg.Data, origin)).Err()
+	default:
+		err = h.rdb.Publish(ctx, channel, []byte(msg.Data)).Err()
+	}
+	if err != nil {
+		c.logger.Error("redis publish error", "channel", channel, "err", err)
+		h.enqueue(c, encodeError(msg.Action, "publish_failed", "could not publish message"))
+		return
+	}
+	h.enqueue(c, encodePublishAck(msg.Channel, seq))
+}
+
+// writePump delivers queued messages and periodic pings until the send
+// channel is closed by hub.remove, a write fails or the client's context is
+// cancelled. Every write carries a writeTimeout deadline so a peer that stops
+// reading cannot stall it. With idleTimeout set, a client that neither sends
+// nor receives a message for that long is closed, and with maxLifetime set a
+// client that has been connected that long is asked to reconnect, unless the
+// gateway is draining. An ack-mode client is closed once it falls behind on
+// acknowledgments, and with app pings one that leaves appPongMisses of them
+// in a row unanswered.
+func (h *hub) writePump(c *client) {
+	var pingCheck, appPingCheck, idleCheck, ackCheck, lifetimeEnd <-chan time.Time
+	if h.pingMode != pingModeApp {
+		t := time.NewTicker(h.pingInterval)
+		defer t.Stop()
+		pingCheck = t.C
+	}
+	if h.pingMode != pingModeControl {
+		t := time.NewTicker(h.appPingInterval)
+		defer t.Stop()
+		appPingCheck = t.C
+	}
+	if h.idleTimeout > 0 {
+		t := time.NewTicker(h.idleTimeout / 4)
+		defer t.Stop()
+		idleCheck = t.C
+	}
+	if c.acks != nil && h.ackTimeout > 0 {
+		t := time.NewTicker(h.ackTimeout / 4)
+		defer t.Stop()
+		ackCheck = t.C
+	}
+	if h.maxLifetime > 0 {
+		t := time.NewTimer(h.lifetime())
+		defer t.Stop()
+		lifetimeEnd = t.C
+	}
+	defer func() {
+		if !c.shed.Load() {
+			h.removeWithReason(c, disconnectWriteError)
+		}
+	}()
+
+	for {
+		// Drain the priority lane first so control frames never wait
+		// behind a backlog of messages.
+		select {
+		case f := <-c.priority:
+			if !h.writeFrame(c, f) {
+				return
+			}
+			continue
+		default:
+		}
+		select {
+		case f := <-c.priority:
+			if !h.writeFrame(c, f) {
+				return
+			}
+		case f, ok := <-c.send:
+			f = c.take(f)
+			var next *frame
+			closed := !ok
+			if ok && c.batched && c.batchable(f) {
+				f, next, closed = h.collectBatch(c, f)
+			}
+			if ok && !h.writeFrame(c, f) {
+				return
+			}
+			if next != nil && !h.writeFrame(c, *next) {
+				return
+			}
+			if closed && c.shed.Load() {
+				return
+			}
+			if closed {
+				// Already removed, with its reason.
+				c.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+		case <-ackCheck:
+			if problem := h.ackProblem(c); problem != "" {
+				c.closeForAcks(problem)
+				return
+			}
+		case <-idleCheck:
+			if idle := c.idleFor(); idle >= h.idleTimeout {
+				c.logger.Info("ws client idle; disconnecting", "idle", idle.Round(time.Second))
+				c.sendClose(websocket.CloseGoingAway, "idle timeout", disconnectIdleTimeout, h.writeTimeout)
+				return
+			}
+		case <-lifetimeEnd:
+			// A draining instance closes everyone soon anyway.
+			if h.draining.Load() {
+				continue
+			}
+			c.logger.Info("ws client reached MAX_CONNECTION_LIFETIME; asking it to reconnect", "connected_for", time.Since(c.connectedAt).Round(time.Second))
+			c.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+			c.writeText(encodeReconnect(h.reconnectAfter(), "max_lifetime"))
+			c.sendClose(websocket.CloseGoingAway, "connection lifetime reached", disconnectMaxLifetime, h.writeTimeout)
+			return
+		case <-pingCheck:
+			deadline := time.Now().Add(h.writeTimeout)
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.logger.Warn("ws ping error", "err", err)
+				return
+			}
+		case <-appPingCheck:
+			if missed := c.unansweredPings.Add(1) - 1; missed >= h.appPongMisses {
+				c.logger.Info("ws client missed app pongs; disconnecting", "missed", missed)
+				c.sendClose(websocket.CloseGoingAway, "pong timeout", disconnectPingTimeout, h.writeTimeout)
+				return
+			}
+			// Written directly rather than through writeFrame, so pings
+			// don't count as activity for IDLE_TIMEOUT.
+			c.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+			if err := c.writeText(encodePing(time.Now())); err != nil {
+				c.logger.Warn("ws ping error", "err", err)
+				return
+			}
+		case <-c.ctx.Done():
+			if h.ctx.Err() != nil {
+				// Tell the client when to come back before closing, so a
+				// fleet of clients doesn't reconnect all at once.
+				c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+				c.writeText(encodeReconnect(h.reconnectAfter(), "server_shutdown"))
+				c.sendClose(websocket.CloseGoingAway, "server shutting down", disconnectShutdown, h.closeTimeout)
+				// Give the client CLOSE_TIMEOUT to answer with its own close
+				// frame before the connection is torn down; one that never
+				// does only costs that long.
+				t := time.NewTimer(h.closeTimeout)
+				select {
+				case <-c.readDone:
+				case <-t.C:
+					c.logger.Debug("ws client did not complete the close handshake", "timeout", h.closeTimeout)
+				}
+				t.Stop()
+			}
+			return
+		}
+	}
+}
+
+// sendClose writes a close frame with code and text, recording reason as why
+// the gateway is closing the connection unless another close came first.
+func (c *client) sendClose(code int, text, reason string, timeout time.Duration) {
+	c.closing.CompareAndSwap(nil, &reason)
+	if c.conn == nil {
+		return
+	}
+	msg := websocket.FormatCloseMessage(code, text)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(timeout))
+}
+
+// writeMessage writes f to the socket in the client's format. Large messages
+// are streamed through NextWriter so the connection never holds more than
+// one chunk beyond its write buffer, e.g. while compressing; the rest use
+// WriteMessage.
+func (h *hub) writeMessage(c *client, f frame) error {
+	f = c.outgoing(f)
+	if c.compress && len(f.data) >= h.compressionMinSize {
+		// Everything else written to the socket is small, so compression
+		// goes back off straight after.
+		c.conn.EnableWriteCompression(true)
+		defer c.conn.EnableWriteCompression(false)
+	}
+	if h.streamThreshold <= 0 || len(f.data) < h.streamThreshold {
+		return c.conn.WriteMessage(f.messageType, f.data)
+	}
+	w, err := c.conn.NextWriter(f.messageType)
+	if err != nil {
+		return err
+	}
+	for data := f.data; len(data) > 0; {
+		n := min(len(data), h.streamChunk)
+		if _, err := w.Write(data[:n]); err != nil {
+			w.Close()
+			return err
+		}
+		data = data[n:]
+	}
+	return w.Close()
+}
+
+// writeFrame writes one queued frame and reports whether writePump should
+// carry on.
+func (h *hub) writeFrame(c *client, f frame) bool {
+	c.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+	if err := h.writeMessage(c, f); err != nil {
+		broadcastErrors.Inc()
+		if isTimeout(err) {
+			writeTimeouts.Inc()
+			c.logger.Warn("ws write timed out; disconnecting", "timeout", h.writeTimeout)
+		} else {
+			c.logger.Warn("ws write error", "err", err)
+		}
+		return false
+	}
+	c.bytesSent.Add(int64(len(f.data)))
+	c.touch()
+	if f.id != "" && c.cursorKey != "" {
+		id := f.id
+		c.delivered.Store(&id)
+	}
+	if err := h.signalFlow(c); err != nil {
+		c.logger.Warn("ws write error", "err", err)
+		return false
+	}
+	if c.acks != nil {
+		if problem := h.ackProblem(c); problem != "" {
+			c.closeForAcks(problem)
+			return false
+		}
+	}
+	return true
+}
+
+// collectBatch gathers the frames queued within batchWindow of first into a
+// single batch frame. It stops early after maxBatchMessages, at a frame that
+// can't be batched, which it returns as next to be written after the batch,
+// or when the send channel is closed, which it reports as closed.
+func (h *hub) collectBatch(c *client, first frame) (batch frame, next *frame, closed bool) {
+	frames := []frame{first}
+	// The batch carries the newest stream entry among its messages.
+	id := first.id
+	done := func() frame {
+		var b frame
+		if c.format == formatMsgpack {
+			b = encodeMsgpackBatch(frames)
+		} else {
+			b = encodeBatch(frames)
+		}
+		b.id = id
+		return b
+	}
+	timer := time.NewTimer(h.batchWindow)
+	defer timer.Stop()
+	for len(frames) < maxBatchMessages {
+		select {
+		case f, ok := <-c.send:
+			if !ok {
+				return done(), nil, true
+			}
+			f = c.take(f)
+			if !c.batchable(f) {
+				return done(), &f, false
+			}
+			frames = append(frames, f)
+			if f.id != "" {
+				id = f.id
+			}
+		case <-timer.C:
+			return done(), nil, false
+		case <-c.ctx.Done():
+			return done(), nil, false
+		}
+	}
+	return done(), nil, false
+}
+
+// signalFlow tells the client when its send queue crosses flowHigh and when
+// it drains back to flowLow. writePump writes the frames directly, ahead of
+// the backlog they warn about.
+func (h *hub) signalFlow(c *client) error {
+	if h.flowHigh == 0 {
+		return nil
+	}
+	queued := len(c.send)
+	var state string
+	switch {
+	case !c.congested && queued >= h.flowHigh:
+		c.congested, state = true, flowCongested
+	case c.congested && queued <= h.flowLow:
+		c.congested, state = false, flowOK
+	default:
+		return nil
+	}
+	c.logger.Debug("ws client flow", "state", state, "queued", queued)
+	c.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+	return c.writeText(encodeFlow(state))
+}
+
+// isTimeout reports whether err is a network deadline error.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
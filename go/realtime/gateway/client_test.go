@@ -0,0 +1,445 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMalformedControlMessages(t *testing.T) {
+	tg := startGateway(t, map[string]string{"MAX_PROTOCOL_ERRORS": "0"})
+	conn, _ := tg.connect("/ws", nil)
+	tests := []struct {
+		name, frame, wantMessage string
+	}{
+		{name: "truncated", frame: `{"action":"subscribe","topic":"a"`, wantMessage: "malformed JSON"},
+		{name: "not JSON", frame: `subscribe a`, wantMessage: "malformed JSON"},
+		{name: "not an object", frame: `["subscribe","a"]`, wantMessage: "message must be a JSON object"},
+		{name: "wrong field type", frame: `{"action":"subscribe","topic":42}`, wantMessage: `field "topic" must be a string`},
+		{name: "missing action", frame: `{"topic":"a"}`, wantMessage: "action is required"},
+		{name: "unknown action", frame: `{"action":"jump"}`, wantMessage: `unknown action "jump"`},
+		{name: "missing topic", frame: `{"action":"subscribe"}`, wantMessage: "topic or pattern is required"},
+		{name: "oversized topic", frame: `{"action":"subscribe","topic":"` + strings.Repeat("t", maxTopicLength+1) + `"}`, wantMessage: "topic exceeds 256 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.frame)); err != nil {
+				t.Fatal(err)
+			}
+			msg := readJSON(t, conn)
+			if msg["type"] != "error" || msg["code"] != "bad_request" || !strings.Contains(msg["message"].(string), tt.wantMessage) {
+				t.Fatalf("reply = %v, want a bad_request error mentioning %q", msg, tt.wantMessage)
+			}
+			if strings.Contains(msg["message"].(string), tt.frame) {
+				t.Fatalf("error echoes the payload: %v", msg)
+			}
+		})
+	}
+	// The connection survived all of it.
+	sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "a"})
+	if msg := readJSON(t, conn); msg["type"] != "ack" {
+		t.Fatalf("reply = %v, want an ack", msg)
+	}
+}
+
+func TestMaxProtocolErrors(t *testing.T) {
+	tg := startGateway(t, map[string]string{"MAX_PROTOCOL_ERRORS": "3"})
+	conn, _ := tg.connect("/ws", nil)
+	bad := func() {
+		t.Helper()
+		conn.WriteMessage(websocket.TextMessage, []byte("{"))
+		if msg := readJSON(t, conn); msg["code"] != "bad_request" {
+			t.Fatalf("reply = %v, want bad_request", msg)
+		}
+	}
+	// Only consecutive errors count: a valid message resets the tally.
+	bad()
+	bad()
+	sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "a"})
+	if msg := readJSON(t, conn); msg["type"] != "ack" {
+		t.Fatalf("reply = %v, want an ack", msg)
+	}
+	bad()
+	bad()
+	conn.WriteMessage(websocket.TextMessage, []byte("{"))
+	if code := closeCode(t, conn); code != websocket.ClosePolicyViolation {
+		t.Fatalf("close code = %d, want %d", code, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestOversizedMessageCloses(t *testing.T) {
+	tg := startGateway(t, map[string]string{"MAX_MESSAGE_SIZE": "1024"})
+	conn, _ := tg.connect("/ws", nil)
+	big := `{"action":"publish","channel":"a","data":"` + strings.Repeat("x", 2048) + `"}`
+	conn.WriteMessage(websocket.TextMessage, []byte(big))
+	if code := closeCode(t, conn); code != websocket.CloseMessageTooBig {
+		t.Fatalf("close code = %d, want %d", code, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	tg := startGateway(t, map[string]string{"IDLE_TIMEOUT": "300ms"})
+	idle, _ := tg.connect("/ws", nil)
+	sender, senderID := tg.connect("/ws", nil)
+	receiver, receiverID := tg.connect("/ws", nil)
+
+	// Keep one client sending and another receiving for well past the
+	// timeout.
+	for range 8 {
+		sendJSON(t, sender, map[string]string{"action": "subscribe", "topic": "a"})
+		readJSON(t, sender)
+		tg.hub.sendTo(receiverID, websocket.TextMessage, []byte("tick"))
+		readFrame(t, receiver)
+		time.Sleep(100 * time.Millisecond)
+	}
+	if code := closeCode(t, idle); code != websocket.CloseGoingAway {
+		t.Fatalf("idle client closed with %d, want %d", code, websocket.CloseGoingAway)
+	}
+	for _, id := range []string{senderID, receiverID} {
+		if _, ok := tg.hub.get(id); !ok {
+			t.Fatalf("active client %s was disconnected", id)
+		}
+	}
+}
+
+func TestClientCloseHandshake(t *testing.T) {
+	tg := startGateway(t, nil)
+	tests := []struct {
+		name string
+		code int
+	}{
+		{name: "normal", code: websocket.CloseNormalClosure},
+		{name: "going away", code: websocket.CloseGoingAway},
+		{name: "internal error", code: websocket.CloseInternalServerErr},
+		{name: "registered", code: 3000},
+		{name: "private", code: 4000},
+		{name: "no status", code: websocket.CloseNoStatusReceived},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(disconnects.WithLabelValues(disconnectClientClose))
+			conn, id := tg.connect("/ws", nil)
+			// Our close is already sent, so don't answer the gateway's.
+			conn.SetCloseHandler(func(int, string) error { return nil })
+			// 1005 can't be sent; an empty close frame stands for it.
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(tt.code, "bye"))
+			if code := closeCode(t, conn); code != tt.code {
+				t.Fatalf("gateway answered with %d, want %d echoed", code, tt.code)
+			}
+			waitFor(t, "client to be removed", func() bool {
+				_, ok := tg.hub.get(id)
+				return !ok
+			})
+			if got := testutil.ToFloat64(disconnects.WithLabelValues(disconnectClientClose)) - before; got != 1 {
+				t.Fatalf("client_close disconnects grew by %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestAbnormalDisconnect(t *testing.T) {
+	tg := startGateway(t, nil)
+	before := testutil.ToFloat64(disconnects.WithLabelValues(disconnectReadError))
+	conn, id := tg.connect("/ws", nil)
+	// Drop the TCP connection without a close frame.
+	conn.NetConn().Close()
+	waitFor(t, "client to be removed", func() bool {
+		_, ok := tg.hub.get(id)
+		return !ok
+	})
+	if got := testutil.ToFloat64(disconnects.WithLabelValues(disconnectReadError)) - before; got != 1 {
+		t.Fatalf("read_error disconnects grew by %v, want 1", got)
+	}
+}
+
+// Frame opcodes, RFC 6455 section 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opPing         = 0x9
+)
+
+// writeRawFrame writes one client frame straight to conn's socket, bypassing
+// the WebSocket library so the test chooses the fragmentation. The mask key
+// is zero, which leaves the payload as it is.
+func writeRawFrame(t *testing.T, conn *websocket.Conn, fin bool, opcode byte, payload []byte) {
+	t.Helper()
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		t.Fatalf("payload of %d bytes is too long for writeRawFrame", n)
+	}
+	frame = append(frame, 0, 0, 0, 0)
+	frame = append(frame, payload...)
+	if _, err := conn.NetConn().Write(frame); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func TestFragmentedMessageReassembled(t *testing.T) {
+	tg := startGateway(t, nil)
+	conn, id := tg.connect("/ws", nil)
+	msg := []byte(`{"action":"subscribe","topic":"news"}`)
+	// The first fragment on its own is neither valid JSON nor a control
+	// message, and a ping arrives between the fragments.
+	writeRawFrame(t, conn, false, opText, msg[:10])
+	writeRawFrame(t, conn, false, opContinuation, msg[10:20])
+	writeRawFrame(t, conn, true, opPing, []byte("mid-message"))
+	writeRawFrame(t, conn, true, opContinuation, msg[20:])
+	if reply := readJSON(t, conn); reply["type"] != "ack" || reply["topic"] != "news" {
+		t.Fatalf("reply = %v, want an ack for news", reply)
+	}
+	c, _ := tg.hub.get(id)
+	if !c.subscribed("news") {
+		t.Fatal("the reassembled subscribe didn't take effect")
+	}
+}
+
+func TestFragmentedMessageOverLimitCloses(t *testing.T) {
+	tg := startGateway(t, map[string]string{"MAX_MESSAGE_SIZE": "1024"})
+	conn, _ := tg.connect("/ws", nil)
+	// Every fragment fits the limit; the message doesn't.
+	chunk := []byte(strings.Repeat("x", 600))
+	writeRawFrame(t, conn, false, opText, chunk)
+	writeRawFrame(t, conn, true, opContinuation, chunk)
+	if code := closeCode(t, conn); code != websocket.CloseMessageTooBig {
+		t.Fatalf("close code = %d, want %d", code, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestMaxSubscriptionsPerClient(t *testing.T) {
+	tg := startGateway(t, map[string]string{"MAX_SUBSCRIPTIONS_PER_CLIENT": "3"})
+	conn, id := tg.connect("/ws", nil)
+	send := func(msg map[string]string) map[string]any {
+		t.Helper()
+		sendJSON(t, conn, msg)
+		return readJSON(t, conn)
+	}
+	for _, msg := range []map[string]string{
+		{"action": "subscribe", "topic": "a"},
+		{"action": "subscribe", "topic": "b"},
+		{"action": "subscribe", "pattern": "c.*"},
+		// Subscribing again to one it holds takes no more room.
+		{"action": "subscribe", "topic": "a"},
+	} {
+		if reply := send(msg); reply["type"] != "ack" {
+			t.Fatalf("%v: reply = %v, want an ack", msg, reply)
+		}
+	}
+	before := testutil.ToFloat64(subscriptionsRejected)
+	for _, msg := range []map[string]string{
+		{"action": "subscribe", "topic": "d"},
+		{"action": "subscribe", "pattern": "e.*"},
+	} {
+		if reply := send(msg); reply["type"] != "error" || reply["code"] != "limit_exceeded" {
+			t.Fatalf("%v over the limit: reply = %v, want a limit_exceeded error", msg, reply)
+		}
+	}
+	if got := testutil.ToFloat64(subscriptionsRejected) - before; got != 2 {
+		t.Fatalf("realtime_subscriptions_rejected_total rose by %v, want 2", got)
+	}
+	c, _ := tg.hub.get(id)
+	if topics, patterns := c.topicList(), c.patternList(); strings.Join(topics, ",") != "a,b" || strings.Join(patterns, ",") != "c.*" {
+		t.Fatalf("subscriptions = %v %v after refusals, want [a b] [c.*]", topics, patterns)
+	}
+
+	// Unsubscribing frees room.
+	send(map[string]string{"action": "unsubscribe", "topic": "a"})
+	if reply := send(map[string]string{"action": "subscribe", "topic": "d"}); reply["type"] != "ack" {
+		t.Fatalf("subscribe after unsubscribing: reply = %v, want an ack", reply)
+	}
+}
+
+func TestMaxSubscriptionsOnUpgrade(t *testing.T) {
+	tg := startGateway(t, map[string]string{"MAX_SUBSCRIPTIONS_PER_CLIENT": "2"})
+	if _, resp, err := tg.tryDial("/ws?topics=a,b,c", nil); err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("three ?topics= over a limit of two: err = %v, response = %v; want 400", err, resp)
+	}
+	tg.connect("/ws?topics=a,b", nil)
+}
+
+func TestInboundCountersInAdminListing(t *testing.T) {
+	tg := startGateway(t, map[string]string{"ADMIN_TOKEN": "admin"})
+	conn, _ := tg.connect("/ws", nil)
+	frames := []string{
+		`{"action":"subscribe","topic":"a"}`,
+		`{"action":"subscribe","topic":"bb"}`,
+		`{"action":"unsubscribe","topic":"a"}`,
+	}
+	sent := 0
+	for _, f := range frames {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(f)); err != nil {
+			t.Fatal(err)
+		}
+		readJSON(t, conn)
+		sent += len(f)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, tg.url("/admin/clients"), nil)
+	req.Header.Set(adminTokenHeader, "admin")
+	code, body := status(t, req)
+	var listing struct{ Clients []clientInfo }
+	if err := json.Unmarshal([]byte(body), &listing); code != http.StatusOK || err != nil || len(listing.Clients) != 1 {
+		t.Fatalf("GET /admin/clients = %d %s", code, body)
+	}
+	info := listing.Clients[0]
+	if info.MessagesReceived != 3 || info.BytesReceived != int64(sent) {
+		t.Fatalf("received %d messages, %d bytes; want 3, %d", info.MessagesReceived, info.BytesReceived, sent)
+	}
+	if info.LastMessageAt == nil || time.Since(*info.LastMessageAt) > 5*time.Second {
+		t.Fatalf("last_message_at = %v, want just now", info.LastMessageAt)
+	}
+	if info.MessageRate <= 0 {
+		t.Fatalf("message_rate = %v, want a positive estimate", info.MessageRate)
+	}
+	if info.BytesSent == 0 {
+		t.Fatal("bytes_sent = 0 after the welcome and acks")
+	}
+}
+
+func TestInboundRateEstimate(t *testing.T) {
+	c := testClient("c1", 1)
+	if c.messageRate() != 0 || c.lastMessageAt() != nil {
+		t.Fatal("a client that sent nothing has a rate")
+	}
+	for i := 0; i < 50; i++ {
+		c.received(10)
+	}
+	// Fifty messages at once weigh in as five a second over inRateWindow.
+	if rate := c.messageRate(); rate < 4.9 || rate > 5.01 {
+		t.Fatalf("rate after a burst of 50 = %v, want about 5", rate)
+	}
+	if c.messagesIn.Load() != 50 || c.bytesIn.Load() != 500 {
+		t.Fatalf("counted %d messages, %d bytes", c.messagesIn.Load(), c.bytesIn.Load())
+	}
+	// The estimate fades by 1/e per inRateWindow of silence.
+	if got := decayRate(5, int64(inRateWindow)); got < 1.83 || got > 1.85 {
+		t.Fatalf("decayRate(5, window) = %v, want 5/e", got)
+	}
+}
+
+// TestDisconnectReasons checks the reason each way of losing a client is
+// counted under in realtime_disconnects_total.
+func TestDisconnectReasons(t *testing.T) {
+	tests := []struct {
+		reason string
+		env    map[string]string
+		// trigger makes the gateway drop the client connected as conn.
+		trigger func(tg *testGateway, conn *websocket.Conn, id string)
+	}{
+		{reason: disconnectIdleTimeout, env: map[string]string{"IDLE_TIMEOUT": "100ms"}},
+		{reason: disconnectPingTimeout, env: map[string]string{"PING_INTERVAL": "50ms", "PONG_TIMEOUT": "150ms"}},
+		{reason: disconnectMaxLifetime, env: map[string]string{"MAX_CONNECTION_LIFETIME": "100ms", "MAX_CONNECTION_LIFETIME_JITTER": "0"}},
+		{reason: disconnectPolicyViolation, env: map[string]string{"MAX_MESSAGE_SIZE": "64"}, trigger: func(tg *testGateway, conn *websocket.Conn, id string) {
+			conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 128)))
+		}},
+		{reason: disconnectAdminKick, env: map[string]string{"ADMIN_TOKEN": "admin"}, trigger: func(tg *testGateway, conn *websocket.Conn, id string) {
+			req, _ := http.NewRequest(http.MethodPost, tg.url("/admin/clients/"+id+"/disconnect"), nil)
+			req.Header.Set(adminTokenHeader, "admin")
+			if code, body := status(t, req); code != http.StatusNoContent {
+				t.Fatalf("kick = %d %s", code, body)
+			}
+		}},
+		{reason: disconnectReplaced, env: map[string]string{"DUPLICATE_ID_POLICY": "replace"}, trigger: func(tg *testGateway, conn *websocket.Conn, id string) {
+			tg.connect("/ws?client_id="+id, nil)
+		}},
+		{reason: disconnectSlowConsumer, env: map[string]string{"SEND_BUFFER": "1"}, trigger: func(tg *testGateway, conn *websocket.Conn, id string) {
+			// Nothing reads conn, so its queue fills once the socket does.
+			payload := []byte(strings.Repeat("x", 64<<10))
+			for i := 0; i < 500; i++ {
+				if _, ok := tg.hub.get(id); !ok {
+					return
+				}
+				tg.hub.broadcast(websocket.TextMessage, payload)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			tg := startGateway(t, tt.env)
+			before := testutil.ToFloat64(disconnects.WithLabelValues(tt.reason))
+			conn, id := tg.connect("/ws?client_id=c1", nil)
+			if tt.trigger != nil {
+				tt.trigger(tg, conn, id)
+			}
+			waitFor(t, "the disconnect to be counted", func() bool {
+				return testutil.ToFloat64(disconnects.WithLabelValues(tt.reason))-before == 1
+			})
+		})
+	}
+}
+
+func TestShutdownDisconnectReason(t *testing.T) {
+	tg, stop := startStoppable(t, map[string]string{"CLOSE_TIMEOUT": "200ms"})
+	tg.connect("/ws", nil)
+	before := testutil.ToFloat64(disconnects.WithLabelValues(disconnectShutdown))
+	stop()
+	if got := testutil.ToFloat64(disconnects.WithLabelValues(disconnectShutdown)) - before; got != 1 {
+		t.Fatalf("shutdown disconnects rose by %v, want 1", got)
+	}
+}
+
+func TestMaxLifetimeCycles(t *testing.T) {
+	tg := startGateway(t, map[string]string{"MAX_CONNECTION_LIFETIME": "100ms", "MAX_CONNECTION_LIFETIME_JITTER": "0", "RECONNECT_DELAY": "250ms", "RECONNECT_JITTER": "0"})
+	start := time.Now()
+	conn, _ := tg.connect("/ws", nil)
+	var ce *websocket.CloseError
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(data) != `{"type":"reconnect","after_ms":250,"reason":"max_lifetime"}` {
+		t.Fatalf("frame = %s, want a max_lifetime reconnect hint", data)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("cycled after %v, before MAX_CONNECTION_LIFETIME", elapsed)
+	}
+	_, _, err = conn.ReadMessage()
+	if !errors.As(err, &ce) || ce.Code != websocket.CloseGoingAway || ce.Text != "connection lifetime reached" {
+		t.Fatalf("after the hint: %v, want close 1001 connection lifetime reached", err)
+	}
+}
+
+func TestMaxLifetimeSkippedWhileDraining(t *testing.T) {
+	tg := startGateway(t, map[string]string{"MAX_CONNECTION_LIFETIME": "50ms", "MAX_CONNECTION_LIFETIME_JITTER": "0"})
+	conn, id := tg.connect("/ws", nil)
+	tg.hub.draining.Store(true)
+	time.Sleep(150 * time.Millisecond)
+	if _, ok := tg.hub.get(id); !ok {
+		t.Fatal("client cycled while draining")
+	}
+	expectSilence(t, conn, 50*time.Millisecond)
+}
+
+func TestLifetimeJitter(t *testing.T) {
+	if h := newTestHub(t, map[string]string{"MAX_CONNECTION_LIFETIME": "1h"}); h.lifetimeJitter != 6*time.Minute {
+		t.Fatalf("default jitter = %v, want a tenth of the lifetime", h.lifetimeJitter)
+	}
+	h := newTestHub(t, map[string]string{"MAX_CONNECTION_LIFETIME": "1h", "MAX_CONNECTION_LIFETIME_JITTER": "10m"})
+	seen := make(map[time.Duration]bool)
+	for range 100 {
+		d := h.lifetime()
+		if d < time.Hour || d >= time.Hour+10*time.Minute {
+			t.Fatalf("lifetime %v outside 1h..1h10m", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 90 {
+		t.Fatalf("only %d distinct lifetimes in 100, want them spread", len(seen))
+	}
+}
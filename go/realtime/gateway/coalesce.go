@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// coalescedMessage is the messageType of a queued placeholder for a
+// coalesced topic; its data is the topic, whose newest message take
+// substitutes when the frame is written.
+const coalescedMessage = -1
+
+// latestSlot holds the newest undelivered message of a coalesced topic for
+// one client. At most one placeholder for the topic is queued at a time;
+// newer messages replace the slot's contents instead of queueing behind it.
+type latestSlot struct {
+	mu     sync.Mutex
+	f      frame
+	queued bool
+}
+
+// take returns the frame to write for f: the topic's newest message for a
+// coalesced placeholder, f itself otherwise.
+func (c *client) take(f frame) frame {
+	if f.messageType != coalescedMessage {
+		return f
+	}
+	c.mu.Lock()
+	s := c.latest[string(f.data)]
+	c.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.f
+	s.f, s.queued = frame{}, false
+	return out
+}
+
+// pushLatest queues f for c on a coalesced topic. While an earlier message
+// of the topic is still waiting in c's queue, f replaces it there. Like push,
+// the caller must hold c's shard lock.
+func (h *hub) pushLatest(c *client, topic string, f frame) {
+	c.mu.Lock()
+	s := c.latest[topic]
+	if s == nil {
+		if c.latest == nil {
+			c.latest = make(map[string]*latestSlot)
+		}
+		s = &latestSlot{}
+		c.latest[topic] = s
+	}
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	s.f = f
+	replaced := s.queued
+	s.queued = true
+	s.mu.Unlock()
+	if replaced {
+		messagesCoalesced.Inc()
+		return
+	}
+	h.push(c, frame{messageType: coalescedMessage, data: []byte(topic)})
+}
+
+// parseTopicCoalesce reads per-topic coalescing modes such as
+// "prices:latest,scores:latest". latest is the only mode. Each entry splits
+// at its last ':', so topic names may contain colons.
+func parseTopicCoalesce(raw string) (map[string]bool, error) {
+	topics := make(map[string]bool)
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndexByte(pair, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid TOPIC_COALESCE entry %q; expected topic:latest", pair)
+		}
+		topic, mode := pair[:i], pair[i+1:]
+		if strings.TrimSpace(mode) != "latest" {
+			return nil, fmt.Errorf("invalid coalesce mode %q; expected latest", mode)
+		}
+		topics[topic] = true
+	}
+	return topics, nil
+}
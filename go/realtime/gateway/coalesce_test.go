@@ -0,0 +1,125 @@
+package gateway
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseTopicCoalesce(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{raw: ""},
+		{raw: "prices:latest, scores:latest", want: []string{"prices", "scores"}},
+		{raw: "orders:eu:latest", want: []string{"orders:eu"}},
+		{raw: "tenant:acme:prices:latest", want: []string{"tenant:acme:prices"}},
+		{raw: "prices", wantErr: true},
+		{raw: ":latest", wantErr: true},
+		{raw: "prices:newest", wantErr: true},
+		{raw: "tenant:acme:prices", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTopicCoalesce(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTopicCoalesce(%q) = %v, want an error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tt.want) {
+			t.Errorf("parseTopicCoalesce(%q) = %v, %v; want %v", tt.raw, got, err, tt.want)
+			continue
+		}
+		for _, topic := range tt.want {
+			if !got[topic] {
+				t.Errorf("parseTopicCoalesce(%q) lacks %q", tt.raw, topic)
+			}
+		}
+	}
+}
+
+// drain returns what c's writePump would write from its queue, in order.
+func drain(c *client) []string {
+	var out []string
+	for len(c.send) > 0 {
+		out = append(out, string(c.take(<-c.send).data))
+	}
+	return out
+}
+
+func TestCoalescedTopicKeepsLatest(t *testing.T) {
+	h := newTestHub(t, map[string]string{"TOPIC_COALESCE": "prices:latest"})
+	tests := []struct {
+		name  string
+		topic string
+		acks  bool
+		want  []string
+	}{
+		{name: "coalesced", topic: "prices", want: []string{"3", "n"}},
+		{name: "scoped topic follows the unscoped entry", topic: "tenant:acme:prices", want: []string{"3", "n"}},
+		{name: "other topics queue", topic: "quotes", want: []string{"1", "2", "n", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testClient(tt.name, 16)
+			c.topics[tt.topic] = struct{}{}
+			c.topics["news"] = struct{}{}
+			h.add(c)
+			defer h.removeWithReason(c, disconnectWriteError)
+			for _, msg := range []string{"1", "2"} {
+				h.broadcastTopic(tt.topic, websocket.TextMessage, []byte(msg))
+			}
+			h.broadcastTopic("news", websocket.TextMessage, []byte("n"))
+			h.broadcastTopic(tt.topic, websocket.TextMessage, []byte("3"))
+			// The newest message goes out at the place of the first.
+			if got := drain(c); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("written %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoalesceSkipsAckModeClients(t *testing.T) {
+	h := newTestHub(t, map[string]string{"TOPIC_COALESCE": "prices:latest"})
+	c := testClient("c1", 16)
+	c.acks = &ackTracker{}
+	c.topics["prices"] = struct{}{}
+	h.add(c)
+	for _, msg := range []string{"1", "2", "3"} {
+		h.broadcastTopic("prices", websocket.TextMessage, []byte(msg))
+	}
+	if len(c.send) != 3 {
+		t.Fatalf("queued %d frames, want every message for an ack-mode client", len(c.send))
+	}
+}
+
+func TestCoalesceRefillsAfterWrite(t *testing.T) {
+	h := newTestHub(t, map[string]string{"TOPIC_COALESCE": "prices:latest"})
+	c := testClient("c1", 16)
+	c.topics["prices"] = struct{}{}
+	h.add(c)
+	h.broadcastTopic("prices", websocket.TextMessage, []byte("1"))
+	if got := drain(c); len(got) != 1 || got[0] != "1" {
+		t.Fatalf("written %v, want [1]", got)
+	}
+	// Once the slot is written, the next message queues a new one.
+	h.broadcastTopic("prices", websocket.TextMessage, []byte("2"))
+	if got := drain(c); len(got) != 1 || got[0] != "2" {
+		t.Fatalf("written %v, want [2]", got)
+	}
+}
+
+func TestStreamEntryCoalescesScopedTopic(t *testing.T) {
+	h := newTestHub(t, map[string]string{"TOPIC_COALESCE": "prices:latest"})
+	c := newClient(context.Background(), "c1", "test", nil, 16)
+	h.queueEntry(c, streamEntry{id: "1-0", topic: "tenant:acme:prices", data: []byte("1")})
+	h.queueEntry(c, streamEntry{id: "2-0", topic: "tenant:acme:prices", data: []byte("2")})
+	if got := drain(c); len(got) != 1 || got[0] != "2" {
+		t.Fatalf("written %v, want only the newest entry", got)
+	}
+}
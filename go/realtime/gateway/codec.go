@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Magic numbers that open a compressed payload.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// zstdMinMemory is the least the zstd decoder may use for a payload, enough
+// for the 8 MiB window of common encoder settings.
+const zstdMinMemory = 8 << 20
+
+// payloadDecoder decompresses Redis payloads that publishers compressed with
+// its encoding, gzip or zstd. Payloads without a compression header are left
+// alone, so compressed and plain publishers can share a channel.
+type payloadDecoder struct {
+	encoding string
+	// maxSize bounds the decompressed size, so a small payload can't
+	// expand into gigabytes.
+	maxSize int64
+	// passthrough forwards compressed payloads to clients untouched, as
+	// binary frames, instead of decoding them.
+	passthrough bool
+	// zstd is shared by every payload; DecodeAll is safe for concurrent
+	// use.
+	zstd *zstd.Decoder
+}
+
+// newPayloadDecoder returns a decoder for encoding, gzip or zstd.
+func newPayloadDecoder(encoding string, maxSize int64, passthrough bool) *payloadDecoder {
+	d := &payloadDecoder{encoding: encoding, maxSize: maxSize, passthrough: passthrough}
+	if encoding == "zstd" && !passthrough {
+		// The memory bound stops decoding a frame that grows past it, and
+		// also caps the window, which publishers' encoders often set
+		// larger than the payload; hence the floor. decodeZstd applies
+		// maxSize itself. NewReader only fails on invalid options.
+		d.zstd, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(max(maxSize, zstdMinMemory))), zstd.WithDecoderConcurrency(1))
+	}
+	return d
+}
+
+// compressed reports whether payload starts with a gzip or zstd header.
+func compressed(payload string) bool {
+	return strings.HasPrefix(payload, string(gzipMagic)) || strings.HasPrefix(payload, string(zstdMagic))
+}
+
+// decode returns payload decompressed if it is in the decoder's encoding,
+// and unchanged if it isn't compressed at all. A payload compressed the
+// other way is an error.
+func (d *payloadDecoder) decode(payload string) (string, error) {
+	var encoding string
+	switch {
+	case strings.HasPrefix(payload, string(gzipMagic)):
+		encoding = "gzip"
+	case strings.HasPrefix(payload, string(zstdMagic)):
+		encoding = "zstd"
+	default:
+		return payload, nil
+	}
+	if encoding != d.encoding {
+		return "", fmt.Errorf("%s payload with PAYLOAD_ENCODING=%s", encoding, d.encoding)
+	}
+	if encoding == "zstd" {
+		return d.decodeZstd(payload)
+	}
+	zr, err := gzip.NewReader(strings.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, io.LimitReader(zr, d.maxSize+1)); err != nil {
+		return "", err
+	}
+	if int64(b.Len()) > d.maxSize {
+		return "", fmt.Errorf("decompressed payload exceeds %d bytes", d.maxSize)
+	}
+	return b.String(), nil
+}
+
+func (d *payloadDecoder) decodeZstd(payload string) (string, error) {
+	out, err := d.zstd.DecodeAll([]byte(payload), nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || int64(len(out)) > d.maxSize {
+		return "", fmt.Errorf("decompressed payload exceeds %d bytes", d.maxSize)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,130 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipped(t testing.TB, s string) string {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte(s))
+	zw.Close()
+	return b.String()
+}
+
+// zstded compresses s as one frame. Streamed frames don't record their
+// content size up front, so the decoder can't refuse them before decoding.
+func zstded(t testing.TB, s string, streamed bool) string {
+	t.Helper()
+	var b bytes.Buffer
+	zw, err := zstd.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !streamed {
+		return string(zw.EncodeAll([]byte(s), nil))
+	}
+	zw.Write([]byte(s))
+	zw.Close()
+	return b.String()
+}
+
+func TestPayloadDecoderRoundTrip(t *testing.T) {
+	const maxSize = 1 << 10
+	tests := []struct {
+		name, encoding string
+		compress       func(string) string
+	}{
+		{name: "gzip", encoding: "gzip", compress: func(s string) string { return gzipped(t, s) }},
+		{name: "zstd", encoding: "zstd", compress: func(s string) string { return zstded(t, s, false) }},
+		{name: "zstd streamed", encoding: "zstd", compress: func(s string) string { return zstded(t, s, true) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newPayloadDecoder(tt.encoding, maxSize, false)
+			for _, payload := range []string{`{"a":1}`, "", strings.Repeat("x", maxSize)} {
+				if got, err := d.decode(tt.compress(payload)); err != nil || got != payload {
+					t.Fatalf("decode of %d compressed bytes = %d bytes, %v", len(payload), len(got), err)
+				}
+			}
+			if _, err := d.decode(tt.compress(strings.Repeat("x", maxSize+1))); err == nil || !strings.Contains(err.Error(), "exceeds") {
+				t.Fatalf("decode past MAX_DECOMPRESSED_SIZE: err = %v", err)
+			}
+			// Uncompressed payloads pass unchanged.
+			for _, payload := range []string{`{"a":1}`, "hello", ""} {
+				if got, err := d.decode(payload); err != nil || got != payload {
+					t.Fatalf("decode(%q) = %q, %v; want it unchanged", payload, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPayloadDecoderBombs(t *testing.T) {
+	const maxSize = 8 << 20
+	huge := strings.Repeat("\x00", 64<<20)
+	for name, payload := range map[string]string{
+		"gzip":          gzipped(t, huge),
+		"zstd":          zstded(t, huge, false),
+		"zstd streamed": zstded(t, huge, true),
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := newPayloadDecoder(strings.Fields(name)[0], maxSize, false)
+			if _, err := d.decode(payload); err == nil {
+				t.Fatalf("%d bytes expanding to %d decoded with a %d byte limit", len(payload), len(huge), maxSize)
+			}
+		})
+	}
+}
+
+func TestPayloadDecoderWrongEncoding(t *testing.T) {
+	if _, err := newPayloadDecoder("gzip", 1<<10, false).decode(zstded(t, "x", false)); err == nil {
+		t.Fatal("gzip decoder accepted a zstd payload")
+	}
+	if _, err := newPayloadDecoder("zstd", 1<<10, false).decode(gzipped(t, "x")); err == nil {
+		t.Fatal("zstd decoder accepted a gzip payload")
+	}
+	if _, err := newPayloadDecoder("zstd", 1<<10, false).decode(string(zstdMagic) + "garbage"); err == nil {
+		t.Fatal("corrupt zstd payload decoded")
+	}
+}
+
+func TestCompressedPubSubPayloads(t *testing.T) {
+	for _, tt := range []struct {
+		encoding, passthrough string
+		payload               func(string) string
+		wantType              int
+	}{
+		{encoding: "gzip", passthrough: "false", payload: func(s string) string { return gzipped(t, s) }, wantType: websocket.TextMessage},
+		{encoding: "zstd", passthrough: "false", payload: func(s string) string { return zstded(t, s, false) }, wantType: websocket.TextMessage},
+		{encoding: "zstd", passthrough: "true", payload: func(s string) string { return zstded(t, s, false) }, wantType: websocket.BinaryMessage},
+	} {
+		t.Run(tt.encoding+" passthrough="+tt.passthrough, func(t *testing.T) {
+			mr, url := startRedis(t)
+			tg := startGateway(t, map[string]string{"BACKEND": "pubsub", "REDIS_URL": url, "PAYLOAD_ENCODING": tt.encoding, "PAYLOAD_PASSTHROUGH": tt.passthrough})
+			waitFor(t, "subscription", tg.hub.subscribed.Load)
+			conn, _ := tg.connect("/ws?topics=news", nil)
+
+			compressed := tt.payload(`{"title":"hello"}`)
+			mr.Publish("realtime:topic:news", compressed)
+			mr.Publish("realtime:topic:news", `{"title":"plain"}`)
+			want := `{"title":"hello"}`
+			if tt.wantType == websocket.BinaryMessage {
+				want = compressed
+			}
+			if mt, data := readFrame(t, conn); mt != tt.wantType || string(data) != want {
+				t.Fatalf("compressed payload arrived as type %d %q, want type %d %q", mt, data, tt.wantType, want)
+			}
+			if _, data := readFrame(t, conn); string(data) != `{"title":"plain"}` {
+				t.Fatalf("plain payload arrived as %q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,783 @@
+package gateway
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the gateway's startup configuration. Each field corresponds to
+// one environment variable documented in README.md; LoadConfig maps them.
+type Config struct {
+	LogLevel  string
+	LogFormat string
+	// ConfigFile is the CONFIG_FILE path, which ReloadTopics re-reads.
+	ConfigFile string
+	// TopicSection is the file's topics section, per-topic settings that
+	// add to the TOPIC_* variables.
+	TopicSection map[string]topicOptions
+
+	Backend             string // pubsub, stream or memory
+	RedisURL            string
+	RedisURLs           []string // several endpoints, deduplicated; the first is used for publishing
+	DedupeTTL           time.Duration
+	DedupWindow         time.Duration // 0 disables content deduplication
+	DedupMaxEntries     int
+	RedisChannels       []string
+	LegacyBroadcastAll  bool // false stops subscribing to RedisChannels
+	DirectChannel       string
+	TopicPrefix         string
+	RedisStream         string
+	ReplayMax           int
+	KeyspacePrefix      string // empty disables the keyspace bridge
+	KeyspaceTopicPrefix string
+	RedisMaxBackoff     time.Duration
+	RedisHealthInterval time.Duration // 0 disables client rebuilds
+	RedisRebuildAfter   int
+	MaxBroadcastSize    int    // 0 is unlimited
+	PayloadEncoding     string // none, gzip or zstd
+	MaxDecompressedSize int
+	PayloadPassthrough  bool // forward compressed payloads as binary frames
+	DiagChannel         string
+	DiagTimeout         time.Duration
+	BroadcastQueue      int // 0 broadcasts from the subscription goroutine
+	BroadcastWorkers    int
+	OverflowPolicy      string // drop or block
+	// MaxConcurrentBroadcasts caps fan-outs in flight, 0 leaving them
+	// unbounded; BroadcastLimitPolicy is queue or shed.
+	MaxConcurrentBroadcasts int
+	BroadcastLimitPolicy    string
+
+	BindAddr              string
+	RoutePrefix           string
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPIdleTimeout       time.Duration
+	HTTPMaxHeaderBytes    int
+	HandshakeTimeout      time.Duration
+	HealthTimeout         time.Duration
+	StartupTimeout        time.Duration // 0 accepts connections right away
+	FailFast              bool
+	ShutdownTimeout       time.Duration
+	ClientCloseTimeout    time.Duration
+	CloseTimeout          time.Duration
+	DrainTimeout          time.Duration // 0 waits for a second SIGUSR1
+	ReconnectDelay        time.Duration
+	ReconnectJitter       time.Duration
+	TLSCert               string
+	TLSKey                string
+	TLSMinVersion         string
+	ReusePort             bool
+
+	AllowedOrigins []string
+	AllowNoOrigin  bool
+	TenantFrom     []string
+	TenantHeader   string
+	TenantDomain   string
+	RequireTenant  bool
+	JWTSecret      string
+	AuthURL        string // empty disables the auth callback
+	AuthHeaders    []string
+	AuthTimeout    time.Duration
+	AuthCacheTTL   time.Duration // 0 disables the cache
+	UserIDClaim    string
+	AdminToken     string
+	PublishToken   string
+	EnablePprof    bool
+	PprofAddr      string
+
+	ShardCount        int // 0 uses one shard per CPU
+	FanoutWorkers     int // 1 walks the shards one after another
+	PingInterval      time.Duration
+	PongTimeout       time.Duration
+	PingMode          string // control, app or both
+	AppPingInterval   time.Duration
+	AppPongMisses     int
+	WriteTimeout      time.Duration
+	WriteRetries      int
+	WriteRetryBackoff time.Duration
+	IdleTimeout       time.Duration // 0 disables the idle check
+	MaxLifetime       time.Duration // 0 is unlimited
+	LifetimeJitter    time.Duration
+	ReapInterval      time.Duration // 0 disables the reaper
+	ReapAfter         time.Duration
+	MemSoftLimit      uint64 // 0 disables the limit, as for MemHardLimit
+	MemHardLimit      uint64
+	MemCheckInterval  time.Duration
+	SendBuffer        int
+	FlowHighWater     float64
+	FlowLowWater      float64
+	BatchWindow       time.Duration // 0 disables batching
+	EnableCompression bool
+	CompressionLevel  int
+	CompressMinSize   int // 0 compresses every frame
+	ReadBufferSize    int
+	WriteBufferSize   int
+	WriteBufferPool   bool
+	StreamThreshold   int // 0 always uses WriteMessage
+	StreamChunkSize   int
+	WarmupDuration    time.Duration // 0 disables the warmup
+	WarmupBatch       int
+	WarmupBatchDelay  time.Duration
+	MessageType       int // websocket.TextMessage or BinaryMessage
+	TopicMessageTypes map[string]int
+	TopicCoalesce     map[string]bool
+	TopicRetain       []string
+	RetainTTL         time.Duration // 0 keeps a message until the next one
+	TopicSchemas      map[string]*jsonschema.Schema
+	CheckBroadcasts   bool   // also check backend messages against TopicSchemas
+	SnapshotURL       string // empty disables snapshots on subscribe
+	SnapshotTimeout   time.Duration
+	TopicAuthRules    []topicRule // nil with an empty TopicAuthURL allows every topic
+	TopicAuthURL      string
+	TopicAuthTimeout  time.Duration
+	// Transformer rewrites or drops broadcasts before fan-out. LoadConfig
+	// sets it from TOPIC_FIELDS_ALLOW and TOPIC_FIELDS_DENY; embedders may
+	// supply their own.
+	Transformer    Transformer
+	Tracer         Tracer // set by embedders; nil disables tracing
+	OnOverflow     OverflowHandler
+	MaxMessageSize int
+	MaxConnections int // 0 is unlimited
+	MaxConnPerIP   int // 0 disables the per-IP limit
+	TrustProxy     bool
+	TrustedProxies []netip.Prefix
+	TagQueryParams []string
+	MaxPatterns    int // 0 disables pattern subscriptions
+	TagHeaders     []string
+
+	ClientRate          float64
+	ClientBurst         int
+	ClientMaxViolations int
+	MaxProtocolErrors   int
+	MaxSubscriptions    int     // topics and patterns per client; 0 is unlimited
+	GlobalRate          float64 // 0 disables the global limit
+	GlobalBurst         int
+	AcceptRate          float64 // 0 disables the accept limit
+	AcceptBurst         int
+	FirehoseRate        float64 // copies per second across all firehose clients
+	FirehoseBurst       int
+	RejectWithClose     bool // refuse capacity and rate limits with a close frame
+	CapacityCloseCode   int
+	RateLimitCloseCode  int
+	DuplicateIDPolicy   string // reject or replace
+
+	EventsChannel     string
+	EventsIncludeTags bool
+	ReceiptsChannel   string
+	MessageLogAlways  []string
+	MessageLogRates   []logSampleRule
+	MessageLogPath    string        // empty disables the message log
+	MessageLogMaxMB   int           // 0 disables rotation
+	MessageLogSample  float64       // rate for topics without a rule
+	StatsInterval     time.Duration // 0 disables stats
+	StatsChannel      string
+	InstanceID        string
+	PresenceEnabled   bool
+	PresenceTTL       time.Duration
+	PublishPrefix     string
+	SequenceEnabled   bool
+	SequenceKeyPrefix string
+
+	AckWindow    int
+	AckTimeout   time.Duration
+	AckKeyPrefix string
+	AckStateTTL  time.Duration
+	ResumeWindow time.Duration // 0 disables session resume
+	ResumeBuffer int
+	ResumePrefix string
+
+	CursorInterval   time.Duration // 0 disables stream cursors
+	CursorTTL        time.Duration
+	CursorKeyPrefix  string
+	CursorMaxCatchUp int
+}
+
+// LoadConfig reads the configuration from the environment, falling back to
+// the YAML or JSON file named by CONFIG_FILE and then to the defaults. All
+// problems are reported together so a bad deployment can be fixed in one go.
+func LoadConfig() (Config, error) {
+	src := &configSource{}
+	var cfg Config
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		file, section, err := readConfigFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		src.file = file
+		cfg.ConfigFile, cfg.TopicSection = path, section
+	}
+
+	cfg.LogLevel = src.string("LOG_LEVEL", "info")
+	cfg.LogFormat = src.string("LOG_FORMAT", "text")
+
+	cfg.Backend = src.string("BACKEND", "pubsub")
+	cfg.RedisURL = src.string("REDIS_URL", "redis://localhost:6379/0")
+	cfg.RedisURLs = src.list("REDIS_URLS", "")
+	cfg.DedupeTTL = src.duration("DEDUPE_TTL", 30*time.Second)
+	cfg.DedupWindow = src.optionalDuration("DEDUP_WINDOW")
+	cfg.DedupMaxEntries = src.int("DEDUP_MAX_ENTRIES", 100000)
+	cfg.RedisChannels = src.list("REDIS_CHANNEL", "realtime:broadcast")
+	cfg.LegacyBroadcastAll = src.bool("LEGACY_BROADCAST_ALL", true)
+	cfg.DirectChannel = src.string("DIRECT_CHANNEL", "realtime:direct")
+	// Topic messages arrive on prefixed channels, e.g. realtime:topic:room1.
+	cfg.TopicPrefix = src.string("REDIS_TOPIC_PREFIX", "realtime:topic:")
+	cfg.RedisStream = src.string("REDIS_STREAM", "realtime:stream")
+	cfg.ReplayMax = src.int("REPLAY_MAX", 1000)
+	cfg.KeyspacePrefix = src.string("KEYSPACE_PREFIX", "")
+	cfg.KeyspaceTopicPrefix = src.string("KEYSPACE_TOPIC_PREFIX", "keyspace:")
+	cfg.RedisMaxBackoff = src.duration("REDIS_MAX_BACKOFF", 30*time.Second)
+	// The health check is on by default; "0" turns it off.
+	if v, _ := src.lookup("REDIS_HEALTH_INTERVAL"); v != "0" {
+		cfg.RedisHealthInterval = src.duration("REDIS_HEALTH_INTERVAL", 10*time.Second)
+	}
+	cfg.RedisRebuildAfter = src.int("REDIS_REBUILD_AFTER", 3)
+	cfg.MaxBroadcastSize = src.int("MAX_BROADCAST_SIZE", 1<<20)
+	cfg.PayloadEncoding = src.string("PAYLOAD_ENCODING", "none")
+	cfg.MaxDecompressedSize = src.int("MAX_DECOMPRESSED_SIZE", 8<<20)
+	cfg.PayloadPassthrough = src.bool("PAYLOAD_PASSTHROUGH", false)
+	cfg.DiagChannel = src.string("DIAG_CHANNEL", "realtime:diag")
+	cfg.DiagTimeout = src.duration("DIAG_TIMEOUT", 5*time.Second)
+	cfg.BroadcastQueue = src.int("BROADCAST_QUEUE", 0)
+	cfg.BroadcastWorkers = src.int("BROADCAST_WORKERS", 4)
+	cfg.OverflowPolicy = src.string("OVERFLOW_POLICY", "drop")
+	cfg.MaxConcurrentBroadcasts = src.int("MAX_CONCURRENT_BROADCASTS", 0)
+	cfg.BroadcastLimitPolicy = src.string("BROADCAST_LIMIT_POLICY", "queue")
+
+	cfg.BindAddr = src.string("BIND_ADDR", ":8081")
+	cfg.RoutePrefix = src.string("ROUTE_PREFIX", "")
+	cfg.HTTPReadHeaderTimeout = src.duration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second)
+	cfg.HTTPReadTimeout = src.duration("HTTP_READ_TIMEOUT", 10*time.Second)
+	cfg.HTTPIdleTimeout = src.duration("HTTP_IDLE_TIMEOUT", 2*time.Minute)
+	cfg.HTTPMaxHeaderBytes = src.int("HTTP_MAX_HEADER_BYTES", 16<<10)
+	cfg.HandshakeTimeout = src.duration("HANDSHAKE_TIMEOUT", 10*time.Second)
+	cfg.HealthTimeout = src.duration("HEALTH_TIMEOUT", 2*time.Second)
+	cfg.StartupTimeout = src.optionalDuration("STARTUP_TIMEOUT")
+	cfg.FailFast = src.bool("FAIL_FAST", false)
+	cfg.ShutdownTimeout = src.duration("SHUTDOWN_TIMEOUT", 15*time.Second)
+	cfg.ClientCloseTimeout = src.duration("CLIENT_CLOSE_TIMEOUT", time.Second)
+	cfg.CloseTimeout = src.duration("CLOSE_TIMEOUT", 5*time.Second)
+	cfg.DrainTimeout = src.optionalDuration("DRAIN_TIMEOUT")
+	// Both may be "0": no delay, or the same delay for everyone.
+	if v, _ := src.lookup("RECONNECT_DELAY"); v != "0" {
+		cfg.ReconnectDelay = src.duration("RECONNECT_DELAY", time.Second)
+	}
+	if v, _ := src.lookup("RECONNECT_JITTER"); v != "0" {
+		cfg.ReconnectJitter = src.duration("RECONNECT_JITTER", 5*time.Second)
+	}
+	cfg.TLSCert = src.string("TLS_CERT", "")
+	cfg.TLSKey = src.string("TLS_KEY", "")
+	cfg.TLSMinVersion = src.string("TLS_MIN_VERSION", "1.2")
+	cfg.ReusePort = src.bool("REUSE_PORT", false)
+
+	cfg.AllowedOrigins = src.list("ALLOWED_ORIGINS", "")
+	cfg.AllowNoOrigin = src.bool("ALLOW_NO_ORIGIN", false)
+	cfg.TenantFrom = src.list("TENANT_FROM", "")
+	cfg.TenantHeader = src.string("TENANT_HEADER", "X-Tenant-ID")
+	cfg.TenantDomain = src.string("TENANT_DOMAIN", "")
+	cfg.RequireTenant = src.bool("REQUIRE_TENANT", false)
+	cfg.JWTSecret = src.string("JWT_SECRET", "")
+	cfg.AuthURL = src.string("AUTH_URL", "")
+	cfg.AuthHeaders = src.list("AUTH_FORWARD_HEADERS", "Authorization,Cookie")
+	cfg.AuthTimeout = src.duration("AUTH_TIMEOUT", 2*time.Second)
+	cfg.AuthCacheTTL = src.optionalDuration("AUTH_CACHE_TTL")
+	cfg.UserIDClaim = src.string("USER_ID_CLAIM", "sub")
+	cfg.AdminToken = src.string("ADMIN_TOKEN", "")
+	cfg.PublishToken = src.string("PUBLISH_TOKEN", "")
+	cfg.EnablePprof = src.bool("ENABLE_PPROF", false)
+	cfg.PprofAddr = src.string("PPROF_ADDR", "")
+
+	cfg.ShardCount = src.int("SHARD_COUNT", 0)
+	cfg.FanoutWorkers = src.int("FANOUT_WORKERS", runtime.NumCPU())
+	cfg.PingInterval = src.duration("PING_INTERVAL", 30*time.Second)
+	cfg.PongTimeout = src.duration("PONG_TIMEOUT", 60*time.Second)
+	cfg.PingMode = src.string("PING_MODE", pingModeControl)
+	cfg.AppPingInterval = src.duration("APP_PING_INTERVAL", cfg.PingInterval)
+	cfg.AppPongMisses = src.int("APP_PONG_MISSES", 2)
+	cfg.WriteTimeout = src.duration("WRITE_TIMEOUT", 10*time.Second)
+	cfg.WriteRetries = src.int("WRITE_RETRIES", 0)
+	cfg.WriteRetryBackoff = src.duration("WRITE_RETRY_BACKOFF", 50*time.Millisecond)
+	cfg.IdleTimeout = src.optionalDuration("IDLE_TIMEOUT")
+	cfg.MaxLifetime = src.optionalDuration("MAX_CONNECTION_LIFETIME")
+	// Jitter defaults to a tenth of the lifetime; "0" turns it off.
+	if v, _ := src.lookup("MAX_CONNECTION_LIFETIME_JITTER"); v != "0" {
+		cfg.LifetimeJitter = src.duration("MAX_CONNECTION_LIFETIME_JITTER", cfg.MaxLifetime/10)
+	}
+	// The reaper is on by default; "0" turns it off.
+	if v, _ := src.lookup("REAP_INTERVAL"); v != "0" {
+		cfg.ReapInterval = src.duration("REAP_INTERVAL", time.Minute)
+	}
+	cfg.ReapAfter = src.duration("REAP_AFTER", 2*cfg.PongTimeout)
+	cfg.MemSoftLimit = src.byteSize("MEM_SOFT_LIMIT")
+	cfg.MemHardLimit = src.byteSize("MEM_HARD_LIMIT")
+	cfg.MemCheckInterval = src.duration("MEM_CHECK_INTERVAL", time.Second)
+	cfg.SendBuffer = src.int("SEND_BUFFER", 256)
+	cfg.FlowHighWater = src.float("FLOW_HIGH_WATER", 0.8)
+	cfg.FlowLowWater = src.float("FLOW_LOW_WATER", 0.5)
+	cfg.BatchWindow = src.optionalDuration("BATCH_WINDOW")
+	cfg.EnableCompression = src.bool("ENABLE_COMPRESSION", false)
+	cfg.CompressionLevel = src.int("COMPRESSION_LEVEL", flate.BestSpeed)
+	cfg.CompressMinSize = src.int("COMPRESSION_MIN_SIZE", 1024)
+	cfg.ReadBufferSize = src.int("READ_BUFFER_SIZE", 4096)
+	cfg.WriteBufferSize = src.int("WRITE_BUFFER_SIZE", 4096)
+	cfg.WriteBufferPool = src.bool("WRITE_BUFFER_POOL", false)
+	cfg.StreamThreshold = src.int("STREAM_WRITE_THRESHOLD", 0)
+	cfg.StreamChunkSize = src.int("STREAM_CHUNK_SIZE", 32<<10)
+	cfg.WarmupDuration = src.optionalDuration("WARMUP_DURATION")
+	cfg.WarmupBatch = src.int("WARMUP_BATCH", 500)
+	cfg.WarmupBatchDelay = src.duration("WARMUP_BATCH_DELAY", 2*time.Millisecond)
+	var err error
+	if cfg.MessageType, err = parseMessageType(src.string("MESSAGE_TYPE", "text")); err != nil {
+		src.fail("MESSAGE_TYPE", err)
+	}
+	if cfg.TopicMessageTypes, err = parseTopicTypes(src.string("TOPIC_MESSAGE_TYPES", "")); err != nil {
+		src.fail("TOPIC_MESSAGE_TYPES", err)
+	}
+	cfg.SnapshotURL = src.string("SNAPSHOT_URL", "")
+	cfg.SnapshotTimeout = src.duration("SNAPSHOT_TIMEOUT", 2*time.Second)
+	if cfg.TopicAuthRules, err = parseTopicAuthRules(src.string("TOPIC_AUTH_RULES", "")); err != nil {
+		src.fail("TOPIC_AUTH_RULES", err)
+	}
+	cfg.TopicAuthURL = src.string("TOPIC_AUTH_URL", "")
+	cfg.TopicAuthTimeout = src.duration("TOPIC_AUTH_TIMEOUT", 2*time.Second)
+	if cfg.TopicCoalesce, err = parseTopicCoalesce(src.string("TOPIC_COALESCE", "")); err != nil {
+		src.fail("TOPIC_COALESCE", err)
+	}
+	if cfg.TopicRetain, err = parseTopicRetain(src.string("TOPIC_RETAIN", "")); err != nil {
+		src.fail("TOPIC_RETAIN", err)
+	}
+	cfg.RetainTTL = src.optionalDuration("RETAIN_TTL")
+	if cfg.TopicSchemas, err = loadTopicSchemas(src.string("TOPIC_SCHEMAS", "")); err != nil {
+		src.fail("TOPIC_SCHEMAS", err)
+	}
+	cfg.CheckBroadcasts = src.bool("VALIDATE_BROADCASTS", false)
+	var fields fieldFilter
+	if fields.allow, err = parseTopicFields(src.string("TOPIC_FIELDS_ALLOW", "")); err != nil {
+		src.fail("TOPIC_FIELDS_ALLOW", err)
+	}
+	if fields.deny, err = parseTopicFields(src.string("TOPIC_FIELDS_DENY", "")); err != nil {
+		src.fail("TOPIC_FIELDS_DENY", err)
+	}
+	if len(fields.allow) > 0 || len(fields.deny) > 0 {
+		cfg.Transformer = &fields
+	}
+	cfg.MaxMessageSize = src.int("MAX_MESSAGE_SIZE", 512<<10)
+	cfg.MaxConnections = src.int("MAX_CONNECTIONS", 0)
+	cfg.MaxConnPerIP = src.int("MAX_CONN_PER_IP", 0)
+	cfg.TrustProxy = src.bool("TRUST_PROXY", false)
+	if cfg.TrustedProxies, err = parseTrustedProxies(src.list("TRUSTED_PROXIES", "")); err != nil {
+		src.fail("TRUSTED_PROXIES", err)
+	}
+	cfg.MaxPatterns = src.int("MAX_PATTERNS", 16)
+	cfg.MaxSubscriptions = src.int("MAX_SUBSCRIPTIONS_PER_CLIENT", 100)
+	cfg.TagQueryParams = src.list("TAG_QUERY_PARAMS", "")
+	cfg.TagHeaders = src.list("TAG_HEADERS", "")
+
+	cfg.ClientRate = src.float("CLIENT_RATE", 10)
+	cfg.ClientBurst = src.int("CLIENT_BURST", 20)
+	cfg.ClientMaxViolations = src.int("CLIENT_MAX_VIOLATIONS", 10)
+	cfg.MaxProtocolErrors = src.int("MAX_PROTOCOL_ERRORS", 5)
+	cfg.GlobalRate = src.float("GLOBAL_RATE", 0)
+	cfg.GlobalBurst = src.int("GLOBAL_BURST", int(cfg.GlobalRate)+1)
+	cfg.AcceptRate = src.float("ACCEPT_RATE", 0)
+	cfg.AcceptBurst = src.int("ACCEPT_BURST", int(cfg.AcceptRate)+1)
+	cfg.FirehoseRate = src.float("FIREHOSE_RATE", 100)
+	cfg.FirehoseBurst = src.int("FIREHOSE_BURST", int(cfg.FirehoseRate)+1)
+	cfg.RejectWithClose = src.bool("REJECT_WITH_CLOSE", false)
+	cfg.CapacityCloseCode = src.int("CAPACITY_CLOSE_CODE", 1013)
+	cfg.RateLimitCloseCode = src.int("RATE_LIMIT_CLOSE_CODE", 4029)
+	cfg.DuplicateIDPolicy = src.string("DUPLICATE_ID_POLICY", "replace")
+
+	cfg.EventsChannel = src.string("EVENTS_CHANNEL", "")
+	cfg.EventsIncludeTags = src.bool("EVENTS_INCLUDE_TAGS", false)
+	cfg.ReceiptsChannel = src.string("RECEIPTS_CHANNEL", "")
+	cfg.MessageLogPath = src.string("MESSAGE_LOG_PATH", "")
+	cfg.MessageLogMaxMB = src.int("MESSAGE_LOG_MAX_MB", 100)
+	cfg.MessageLogSample = src.float("MESSAGE_LOG_SAMPLE_RATE", 1)
+	if cfg.MessageLogRates, err = parseLogSampleRates(src.string("MESSAGE_LOG_TOPIC_RATES", "")); err != nil {
+		src.fail("MESSAGE_LOG_TOPIC_RATES", err)
+	}
+	cfg.MessageLogAlways = src.list("MESSAGE_LOG_ALWAYS", "")
+	cfg.StatsInterval = src.optionalDuration("STATS_INTERVAL")
+	cfg.StatsChannel = src.string("STATS_CHANNEL", "")
+	hostname, _ := os.Hostname()
+	cfg.InstanceID = src.string("INSTANCE_ID", hostname)
+	cfg.PresenceEnabled = src.bool("PRESENCE_ENABLED", false)
+	cfg.PresenceTTL = src.duration("PRESENCE_TTL", time.Minute)
+	cfg.PublishPrefix = src.string("PUBLISH_PREFIX", "realtime:")
+	cfg.SequenceEnabled = src.bool("SEQUENCE_ENABLED", false)
+	cfg.SequenceKeyPrefix = src.string("SEQUENCE_KEY_PREFIX", "realtime:seq:")
+	cfg.AckWindow = src.int("ACK_WINDOW", 100)
+	cfg.AckTimeout = src.duration("ACK_TIMEOUT", 30*time.Second)
+	cfg.AckKeyPrefix = src.string("ACK_KEY_PREFIX", "realtime:acks:")
+	cfg.AckStateTTL = src.duration("ACK_STATE_TTL", time.Hour)
+	cfg.ResumeWindow = src.optionalDuration("RESUME_WINDOW")
+	cfg.ResumeBuffer = src.int("RESUME_BUFFER", 100)
+	cfg.ResumePrefix = src.string("RESUME_KEY_PREFIX", "realtime:resume:")
+	cfg.CursorInterval = src.optionalDuration("CURSOR_SAVE_INTERVAL")
+	cfg.CursorTTL = src.duration("CURSOR_TTL", 24*time.Hour)
+	cfg.CursorKeyPrefix = src.string("CURSOR_KEY_PREFIX", "realtime:cursors:")
+	cfg.CursorMaxCatchUp = src.int("CURSOR_MAX_CATCHUP", 1000)
+
+	src.unused()
+	cfg.validate(src)
+	return cfg, errors.Join(src.errs...)
+}
+
+// validate checks constraints that span several settings.
+func (cfg *Config) validate(src *configSource) {
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			src.fail(key, fmt.Errorf(format, args...))
+		}
+	}
+	switch cfg.Backend {
+	case "pubsub", "stream", "memory":
+	default:
+		check(false, "BACKEND", "%q is not one of pubsub, stream or memory", cfg.Backend)
+	}
+	usesRedis := cfg.Backend != "memory"
+	check(len(cfg.RedisURLs) < 2 || cfg.Backend == "pubsub", "REDIS_URLS", "several endpoints require BACKEND=pubsub")
+	check(cfg.DedupWindow == 0 || cfg.Backend == "pubsub", "DEDUP_WINDOW", "only applies to BACKEND=pubsub")
+	check(cfg.DedupMaxEntries > 0, "DEDUP_MAX_ENTRIES", "must be positive")
+	check(cfg.BroadcastQueue >= 0, "BROADCAST_QUEUE", "must not be negative")
+	check(cfg.BroadcastQueue == 0 || cfg.Backend == "pubsub", "BROADCAST_QUEUE", "requires BACKEND=pubsub")
+	check(!slices.Contains(cfg.RedisChannels, cfg.DiagChannel) && cfg.DiagChannel != cfg.DirectChannel && !strings.HasPrefix(cfg.DiagChannel, cfg.TopicPrefix),
+		"DIAG_CHANNEL", "must not be a broadcast, direct or topic channel")
+	check(cfg.MaxPatterns >= 0, "MAX_PATTERNS", "must not be negative")
+	check(cfg.DuplicateIDPolicy == "reject" || cfg.DuplicateIDPolicy == "replace", "DUPLICATE_ID_POLICY", "%q is not one of reject or replace", cfg.DuplicateIDPolicy)
+	check(validRejectCode(cfg.CapacityCloseCode), "CAPACITY_CLOSE_CODE", "must be 1008, 1011, 1012, 1013 or between 4000 and 4999")
+	check(validRejectCode(cfg.RateLimitCloseCode), "RATE_LIMIT_CLOSE_CODE", "must be 1008, 1011, 1012, 1013 or between 4000 and 4999")
+	check(cfg.MaxSubscriptions >= 0, "MAX_SUBSCRIPTIONS_PER_CLIENT", "must not be negative")
+	check(cfg.RedisRebuildAfter > 0, "REDIS_REBUILD_AFTER", "must be positive")
+	check(cfg.MessageLogMaxMB >= 0, "MESSAGE_LOG_MAX_MB", "must not be negative")
+	check(cfg.MessageLogSample >= 0 && cfg.MessageLogSample <= 1, "MESSAGE_LOG_SAMPLE_RATE", "must be between 0 and 1")
+	check(cfg.MessageLogPath != "" || cfg.MessageLogSample == 1, "MESSAGE_LOG_SAMPLE_RATE", "requires MESSAGE_LOG_PATH")
+	check(cfg.MessageLogPath != "" || len(cfg.MessageLogRates) == 0, "MESSAGE_LOG_TOPIC_RATES", "requires MESSAGE_LOG_PATH")
+	check(cfg.MessageLogPath != "" || len(cfg.MessageLogAlways) == 0, "MESSAGE_LOG_ALWAYS", "requires MESSAGE_LOG_PATH")
+	check(cfg.FanoutWorkers > 0, "FANOUT_WORKERS", "must be positive")
+	check(cfg.BroadcastWorkers > 0, "BROADCAST_WORKERS", "must be positive")
+	check(cfg.PayloadEncoding == "none" || cfg.PayloadEncoding == "gzip" || cfg.PayloadEncoding == "zstd", "PAYLOAD_ENCODING", "%q is not one of none, gzip or zstd", cfg.PayloadEncoding)
+	check(cfg.PayloadEncoding == "none" || cfg.Backend == "pubsub", "PAYLOAD_ENCODING", "only applies to BACKEND=pubsub")
+	check(cfg.MaxDecompressedSize > 0, "MAX_DECOMPRESSED_SIZE", "must be positive")
+	check(!cfg.PayloadPassthrough || cfg.PayloadEncoding != "none", "PAYLOAD_PASSTHROUGH", "requires PAYLOAD_ENCODING=gzip or zstd")
+	check(cfg.OverflowPolicy == "drop" || cfg.OverflowPolicy == "block", "OVERFLOW_POLICY", "%q is not one of drop or block", cfg.OverflowPolicy)
+	check(cfg.MaxConcurrentBroadcasts >= 0, "MAX_CONCURRENT_BROADCASTS", "must not be negative")
+	check(cfg.BroadcastLimitPolicy == "queue" || cfg.BroadcastLimitPolicy == "shed", "BROADCAST_LIMIT_POLICY", "%q is not one of queue or shed", cfg.BroadcastLimitPolicy)
+	check(cfg.Backend != "pubsub" || !cfg.LegacyBroadcastAll || len(cfg.RedisChannels) > 0, "REDIS_CHANNEL", "must name at least one channel")
+	check(usesRedis || cfg.EventsChannel == "", "EVENTS_CHANNEL", "requires a Redis backend")
+	check(usesRedis || cfg.ReceiptsChannel == "", "RECEIPTS_CHANNEL", "requires a Redis backend")
+	check(cfg.TrustProxy || len(cfg.TrustedProxies) == 0, "TRUSTED_PROXIES", "requires TRUST_PROXY")
+	check(!cfg.EventsIncludeTags || cfg.EventsChannel != "", "EVENTS_INCLUDE_TAGS", "requires EVENTS_CHANNEL")
+	check(usesRedis || cfg.StatsChannel == "", "STATS_CHANNEL", "requires a Redis backend")
+	check(cfg.StatsChannel == "" || cfg.StatsInterval > 0, "STATS_CHANNEL", "requires STATS_INTERVAL")
+	check(!slices.Contains(cfg.TagQueryParams, "token"), "TAG_QUERY_PARAMS", "must not capture the token param")
+	check(!slices.ContainsFunc(cfg.TagHeaders, isCredentialHeader), "TAG_HEADERS", "must not capture credential headers")
+	check(usesRedis || !cfg.PresenceEnabled, "PRESENCE_ENABLED", "requires a Redis backend")
+	check(cfg.CursorInterval == 0 || cfg.Backend == "stream", "CURSOR_SAVE_INTERVAL", "requires BACKEND=stream")
+	check(cfg.CursorMaxCatchUp > 0, "CURSOR_MAX_CATCHUP", "must be positive")
+	check(usesRedis || !cfg.SequenceEnabled, "SEQUENCE_ENABLED", "requires a Redis backend")
+	check(usesRedis || cfg.KeyspacePrefix == "", "KEYSPACE_PREFIX", "requires a Redis backend")
+	check(!cfg.FailFast || cfg.StartupTimeout > 0, "FAIL_FAST", "requires STARTUP_TIMEOUT")
+	check(cfg.PongTimeout > cfg.PingInterval, "PONG_TIMEOUT", "must be greater than PING_INTERVAL (%s)", cfg.PingInterval)
+	check(cfg.PingMode == pingModeControl || cfg.PingMode == pingModeApp || cfg.PingMode == pingModeBoth, "PING_MODE", "%q is not one of control, app or both", cfg.PingMode)
+	check(cfg.AppPingInterval > 0, "APP_PING_INTERVAL", "must be positive")
+	check(cfg.AppPongMisses > 0, "APP_PONG_MISSES", "must be positive")
+	check(cfg.WriteRetries >= 0 && cfg.WriteRetries <= 10, "WRITE_RETRIES", "must be between 0 and 10")
+	check(cfg.LifetimeJitter == 0 || cfg.MaxLifetime > 0, "MAX_CONNECTION_LIFETIME_JITTER", "requires MAX_CONNECTION_LIFETIME")
+	check(cfg.ReapInterval == 0 || cfg.ReapAfter > cfg.PongTimeout, "REAP_AFTER", "must be greater than PONG_TIMEOUT (%s)", cfg.PongTimeout)
+	check(cfg.MemSoftLimit == 0 || cfg.MemHardLimit == 0 || cfg.MemHardLimit > cfg.MemSoftLimit, "MEM_HARD_LIMIT", "must be greater than MEM_SOFT_LIMIT")
+	for _, from := range cfg.TenantFrom {
+		check(from == "header" || from == "subdomain", "TENANT_FROM", "%q is not one of header or subdomain", from)
+		check(from != "subdomain" || cfg.TenantDomain != "", "TENANT_DOMAIN", "is required with TENANT_FROM=subdomain")
+	}
+	check(cfg.AuthURL == "" || cfg.JWTSecret == "", "AUTH_URL", "cannot be combined with JWT_SECRET")
+	if cfg.AuthURL != "" {
+		if u, err := url.Parse(cfg.AuthURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			check(false, "AUTH_URL", "must be an http:// or https:// URL")
+		}
+	}
+	if cfg.SnapshotURL != "" {
+		u, err := url.Parse(strings.ReplaceAll(cfg.SnapshotURL, "{topic}", "topic"))
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "SNAPSHOT_URL", "must be an http:// or https:// URL")
+		check(strings.Contains(cfg.SnapshotURL, "{topic}"), "SNAPSHOT_URL", "must contain the {topic} placeholder")
+	}
+	if cfg.TopicAuthURL != "" {
+		if u, err := url.Parse(cfg.TopicAuthURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			check(false, "TOPIC_AUTH_URL", "must be an http:// or https:// URL")
+		}
+	}
+	check(!cfg.RequireTenant || len(cfg.TenantFrom) > 0, "REQUIRE_TENANT", "requires TENANT_FROM")
+	check(cfg.SendBuffer > 0, "SEND_BUFFER", "must be positive")
+	check(cfg.StreamThreshold >= 0, "STREAM_WRITE_THRESHOLD", "must not be negative")
+	check(cfg.StreamChunkSize > 0, "STREAM_CHUNK_SIZE", "must be positive")
+	check(cfg.WarmupBatch > 0, "WARMUP_BATCH", "must be positive")
+	check(cfg.AckWindow > 0, "ACK_WINDOW", "must be positive")
+	check(len(cfg.TopicRetain) == 0 || cfg.Backend != "stream", "TOPIC_RETAIN", "does not apply to BACKEND=stream; late joiners replay with ?since=")
+	check(len(cfg.TopicRetain) == 0 || cfg.SnapshotURL == "", "TOPIC_RETAIN", "cannot be combined with SNAPSHOT_URL")
+	check(cfg.ResumeWindow == 0 || cfg.Backend == "pubsub", "RESUME_WINDOW", "requires BACKEND=pubsub; the stream backend resumes with ?since= and ?ack=1")
+	// Buffered messages are queued in one go on resume, ahead of live ones.
+	check(cfg.ResumeWindow == 0 || (cfg.ResumeBuffer > 0 && cfg.ResumeBuffer < cfg.SendBuffer), "RESUME_BUFFER", "must be positive and below SEND_BUFFER (%d)", cfg.SendBuffer)
+	check(cfg.FlowHighWater <= 1 && (cfg.FlowHighWater == 0 || cfg.FlowLowWater < cfg.FlowHighWater),
+		"FLOW_HIGH_WATER", "must satisfy FLOW_LOW_WATER (%g) < FLOW_HIGH_WATER (%g) <= 1", cfg.FlowLowWater, cfg.FlowHighWater)
+	check(!cfg.EnableCompression || (cfg.CompressionLevel >= flate.BestSpeed && cfg.CompressionLevel <= flate.BestCompression),
+		"COMPRESSION_LEVEL", "must be between 1 and 9")
+	check(cfg.CompressMinSize >= 0, "COMPRESSION_MIN_SIZE", "must not be negative")
+	check((cfg.TLSCert == "") == (cfg.TLSKey == ""), "TLS_CERT", "must be set together with TLS_KEY")
+	check(!cfg.ReusePort || reusePortSupported, "REUSE_PORT", "is not supported on this platform")
+	// These parsers name the offending key in their errors already.
+	if _, err := tlsConfig(cfg.TLSMinVersion); err != nil {
+		src.errs = append(src.errs, err)
+	}
+	if _, err := newTopicSettings(*cfg, cfg.TopicSection); err != nil {
+		src.errs = append(src.errs, fmt.Errorf("CONFIG_FILE: %w", err))
+	}
+	if _, err := NewLogger(io.Discard, cfg.LogLevel, cfg.LogFormat); err != nil {
+		src.errs = append(src.errs, err)
+	}
+}
+
+// configSource resolves settings from the environment first and the config
+// file second, collecting every invalid value instead of stopping at the
+// first. As with plain env vars, an empty value counts as unset.
+type configSource struct {
+	// file holds the config file's values keyed like the env vars.
+	file map[string]string
+	used map[string]bool
+	errs []error
+}
+
+func (s *configSource) lookup(key string) (string, bool) {
+	if s.used == nil {
+		s.used = make(map[string]bool)
+	}
+	s.used[key] = true
+	if v := os.Getenv(key); v != "" {
+		return v, true
+	}
+	v, ok := s.file[key]
+	return v, ok && v != ""
+}
+
+func (s *configSource) fail(key string, err error) {
+	s.errs = append(s.errs, fmt.Errorf("%s: %w", key, err))
+}
+
+func (s *configSource) invalid(key, value, want string) {
+	s.fail(key, fmt.Errorf("invalid value %q; expected %s", value, want))
+}
+
+func (s *configSource) string(key, fallback string) string {
+	if v, ok := s.lookup(key); ok {
+		return v
+	}
+	return fallback
+}
+
+// list reads a comma-separated value (or a list in the config file).
+func (s *configSource) list(key, fallback string) []string {
+	return splitList(s.string(key, fallback))
+}
+
+func (s *configSource) int(key string, fallback int) int {
+	v, ok := s.lookup(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		s.invalid(key, v, "a non-negative integer")
+		return fallback
+	}
+	return n
+}
+
+func (s *configSource) float(key string, fallback float64) float64 {
+	v, ok := s.lookup(key)
+	if !ok {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		s.invalid(key, v, "a non-negative number")
+		return fallback
+	}
+	return f
+}
+
+func (s *configSource) bool(key string, fallback bool) bool {
+	v, ok := s.lookup(key)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		s.invalid(key, v, "true or false")
+		return fallback
+	}
+	return b
+}
+
+func (s *configSource) duration(key string, fallback time.Duration) time.Duration {
+	v, ok := s.lookup(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		s.invalid(key, v, "a positive duration such as 30s")
+		return fallback
+	}
+	return d
+}
+
+// optionalDuration is a duration where unset or "0" turns the feature off.
+func (s *configSource) optionalDuration(key string) time.Duration {
+	if v, ok := s.lookup(key); !ok || v == "0" {
+		return 0
+	}
+	return s.duration(key, 0)
+}
+
+// byteSize is a size such as 512MiB or a byte count, where unset or "0"
+// turns the feature off.
+func (s *configSource) byteSize(key string) uint64 {
+	v, ok := s.lookup(key)
+	if !ok {
+		return 0
+	}
+	n, err := parseByteSize(v)
+	if err != nil {
+		s.invalid(key, v, "a byte count or a size such as 512MiB or 2GiB")
+		return 0
+	}
+	return n
+}
+
+// unused reports config file keys that no setting reads, which are usually
+// typos.
+func (s *configSource) unused() {
+	var keys []string
+	for k := range s.file {
+		if !s.used[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.errs = append(s.errs, fmt.Errorf("CONFIG_FILE: unknown setting %s", k))
+	}
+}
+
+// readConfigFile loads a .json, .yaml or .yml file and flattens it to env
+// var names: nested keys are joined with "_" and upper-cased, so
+// {"redis": {"url": "..."}} sets REDIS_URL, and lists become comma-separated
+// values. The topics section is returned separately, by topic.
+func readConfigFile(path string) (map[string]string, map[string]topicOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+	var doc map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &doc)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	default:
+		return nil, nil, fmt.Errorf("CONFIG_FILE: %s must end in .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("CONFIG_FILE: parsing %s: %w", path, err)
+	}
+	var section map[string]topicOptions
+	for k, v := range doc {
+		if strings.EqualFold(k, "topics") {
+			if section, err = parseTopicSection(v); err != nil {
+				return nil, nil, fmt.Errorf("CONFIG_FILE: %w", err)
+			}
+			delete(doc, k)
+		}
+	}
+	out := make(map[string]string)
+	if err := flattenConfig("", doc, out); err != nil {
+		return nil, nil, fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+	return out, section, nil
+}
+
+func flattenConfig(prefix string, doc map[string]any, out map[string]string) error {
+	for k, v := range doc {
+		key := strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		if nested, ok := v.(map[string]any); ok {
+			if err := flattenConfig(key, nested, out); err != nil {
+				return err
+			}
+			continue
+		}
+		s, err := configScalar(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		out[key] = s
+	}
+	return nil
+}
+
+// configScalar renders a decoded file value the way it would be written in
+// the environment.
+func configScalar(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configScalar(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// splitList splits a comma-separated value, dropping blank entries.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
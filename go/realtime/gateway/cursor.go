@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// cursorStore keeps the stream position of every client that connected with
+// a client_id (CURSOR_SAVE_INTERVAL), so a reconnect under the same ID
+// catches up on what it missed without tracking stream IDs itself. Ack-mode
+// clients resume from their oldest unacknowledged entry instead.
+type cursorStore struct {
+	rdb        *redis.Client
+	prefix     string
+	ttl        time.Duration
+	interval   time.Duration
+	maxCatchUp int64
+}
+
+// load returns the position saved under key, or "" when there is none.
+func (s *cursorStore) load(ctx context.Context, key string) (string, error) {
+	id, err := s.rdb.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return id, err
+}
+
+// cursorFor returns the stream ID c has caught up to: the newest entry
+// written to it or, once everything queued for it has been written, the
+// newest entry the gateway has read, since c wanted nothing in between. The
+// stream head is read first so no entry up to it can still be on its way to
+// c's queue.
+func (h *hub) cursorFor(c *client) string {
+	var head, delivered string
+	if p := h.stream.head.Load(); p != nil {
+		head = *p
+	}
+	if p := c.delivered.Load(); p != nil {
+		delivered = *p
+	}
+	c.streamMu.Lock()
+	caughtUp := !c.replaying && !streamIDAfter(c.lastID, delivered)
+	c.streamMu.Unlock()
+	if caughtUp && streamIDAfter(head, delivered) {
+		return head
+	}
+	return delivered
+}
+
+// runCursorSaver saves the cursors that moved every interval until ctx is
+// done. An unchanged cursor is saved again once half its TTL has passed, so
+// a quiet client's key doesn't run out while it is connected.
+func (h *hub) runCursorSaver(ctx context.Context) {
+	t := time.NewTicker(h.cursors.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.saveCursors(ctx)
+		}
+	}
+}
+
+func (h *hub) saveCursors(ctx context.Context) {
+	type pending struct {
+		c  *client
+		id string
+	}
+	var saves []pending
+	now := time.Now()
+	for _, c := range h.snapshot() {
+		if c.cursorKey == "" {
+			continue
+		}
+		id := h.cursorFor(c)
+		c.streamMu.Lock()
+		due := id != "" && (id != c.cursorSaved || now.Sub(c.cursorSavedAt) >= h.cursors.ttl/2)
+		if due {
+			c.cursorSaved, c.cursorSavedAt = id, now
+		}
+		c.streamMu.Unlock()
+		if due {
+			saves = append(saves, pending{c, id})
+		}
+	}
+	if len(saves) == 0 {
+		return
+	}
+	_, err := h.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, s := range saves {
+			p.Set(ctx, s.c.cursorKey, s.id, h.cursors.ttl)
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		slog.Warn("saving stream cursors failed; retrying next interval", "clients", len(saves), "err", err)
+		for _, s := range saves {
+			s.c.streamMu.Lock()
+			s.c.cursorSaved = ""
+			s.c.streamMu.Unlock()
+		}
+	}
+}
+
+// saveCursor stores c's final position when it disconnects.
+func (h *hub) saveCursor(c *client) {
+	id := h.cursorFor(c)
+	if id == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ackSaveTimeout)
+	defer cancel()
+	if err := h.rdb.Set(ctx, c.cursorKey, id, h.cursors.ttl).Err(); err != nil {
+		c.logger.Warn("saving stream cursor failed", "err", err)
+	}
+}
+
+// catchUp loads the entries after cursor for a reconnecting client, at most
+// limit of them, oldest first. When some it should have had are gone, because
+// they were trimmed or deleted from the stream or there are more than limit,
+// it returns the newest ones it can and a gap notice for the rest.
+func (s *streamBackend) catchUp(ctx context.Context, cursor string, limit int64) ([]streamEntry, gapMessage, error) {
+	var trimmed bool
+	info, err := s.rdb.XInfoStream(ctx, s.key).Result()
+	switch {
+	case err != nil && strings.Contains(err.Error(), "no such key"):
+		trimmed = true
+	case err != nil:
+		return nil, gapMessage{}, err
+	case info.MaxDeletedEntryID != "":
+		// Redis 7 and later remember the newest entry removed.
+		trimmed = streamIDAfter(info.MaxDeletedEntryID, cursor)
+	default:
+		// Older servers: the cursor's own entry being gone is the best sign.
+		trimmed = info.Length == 0 || streamIDAfter(info.FirstEntry.ID, cursor)
+	}
+	msgs, err := s.rdb.XRevRangeN(ctx, s.key, "+", "("+cursor, limit+1).Result()
+	if err != nil {
+		return nil, gapMessage{}, err
+	}
+	slices.Reverse(msgs)
+	var gap gapMessage
+	if truncated := int64(len(msgs)) > limit; truncated || trimmed {
+		if truncated {
+			msgs = msgs[1:]
+		}
+		gap = gapMessage{Type: "gap", Reason: "truncated", From: cursor}
+		if trimmed {
+			gap.Reason = "trimmed"
+		}
+		if len(msgs) > 0 {
+			gap.To = msgs[0].ID
+		}
+	}
+	entries := make([]streamEntry, 0, len(msgs))
+	for _, m := range msgs {
+		if e := decodeEntry(m); e.diag == "" {
+			entries = append(entries, e)
+		}
+	}
+	return entries, gap, nil
+}
@@ -0,0 +1,244 @@
+package gateway
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startCursorGateway runs a stream gateway saving cursors and returns it with
+// its Redis.
+func startCursorGateway(t *testing.T, env map[string]string) (*testGateway, *miniredis.Miniredis) {
+	t.Helper()
+	mr, url := startRedis(t)
+	cfg := map[string]string{"BACKEND": "stream", "REDIS_URL": url, "CURSOR_SAVE_INTERVAL": "20ms"}
+	for k, v := range env {
+		cfg[k] = v
+	}
+	tg := startGateway(t, cfg)
+	// Closing Redis first ends the stream reader's blocking read rather
+	// than shutdown waiting it out.
+	t.Cleanup(mr.Close)
+	waitFor(t, "stream reader", tg.hub.subscribed.Load)
+	return tg, mr
+}
+
+// savedCursor returns the position saved for clientID, or "" when there is
+// none.
+func savedCursor(mr *miniredis.Miniredis, clientID string) string {
+	id, _ := mr.Get("realtime:cursors:" + clientID)
+	return id
+}
+
+// disconnect closes conn and waits for the gateway to let the client go.
+func (tg *testGateway) disconnect(conn *websocket.Conn) {
+	tg.t.Helper()
+	conn.Close()
+	waitFor(tg.t, "the client to leave", func() bool { return tg.hub.count() == 0 })
+}
+
+// expectData reads a frame per entry in want and checks each holds it.
+func expectData(t *testing.T, conn *websocket.Conn, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		if _, data := readFrame(t, conn); string(data) != w {
+			t.Fatalf("got %q, want %q", data, w)
+		}
+	}
+}
+
+func TestCursorResume(t *testing.T) {
+	tg, mr := startCursorGateway(t, map[string]string{"CURSOR_TTL": "1h"})
+	resumed := testutil.ToFloat64(cursorResumes.WithLabelValues("resumed"))
+	conn, _ := tg.connect("/ws?client_id=dev1&topics=orders", nil)
+	var last string
+	for i := 1; i <= 3; i++ {
+		last, _ = mr.XAdd("realtime:stream", "*", []string{"topic", "orders", "data", fmt.Sprintf("m%d", i)})
+	}
+	expectData(t, conn, "m1", "m2", "m3")
+	waitFor(t, "the cursor to be saved", func() bool { return savedCursor(mr, "dev1") == last })
+	if ttl := mr.TTL("realtime:cursors:dev1"); ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("cursor TTL = %v, want CURSOR_TTL", ttl)
+	}
+	tg.disconnect(conn)
+
+	mr.XAdd("realtime:stream", "*", []string{"topic", "orders", "data", "m4"})
+	mr.XAdd("realtime:stream", "*", []string{"topic", "orders", "data", "m5"})
+	conn, _ = tg.connect("/ws?client_id=dev1&topics=orders", nil)
+	expectData(t, conn, "m4", "m5")
+	mr.XAdd("realtime:stream", "*", []string{"topic", "orders", "data", "live"})
+	expectData(t, conn, "live")
+	if got := testutil.ToFloat64(cursorResumes.WithLabelValues("resumed")) - resumed; got != 1 {
+		t.Fatalf("resumed cursors rose by %v, want 1", got)
+	}
+}
+
+func TestCursorSkipsUnwantedEntries(t *testing.T) {
+	tg, mr := startCursorGateway(t, nil)
+	conn, _ := tg.connect("/ws?client_id=dev1&topics=orders", nil)
+	mr.XAdd("realtime:stream", "*", []string{"topic", "orders", "data", "m1"})
+	expectData(t, conn, "m1")
+	// Entries on other topics move the cursor on once the client is caught
+	// up, so a quiet client isn't replayed them for nothing.
+	var head string
+	for range 3 {
+		head, _ = mr.XAdd("realtime:stream", "*", []string{"topic", "news", "data", "n"})
+	}
+	waitFor(t, "the cursor to reach the stream head", func() bool { return savedCursor(mr, "dev1") == head })
+	expectSilence(t, conn, 30*time.Millisecond)
+}
+
+func TestCursorSavedOnDisconnect(t *testing.T) {
+	tg, mr := startCursorGateway(t, map[string]string{"CURSOR_SAVE_INTERVAL": "1h"})
+	conn, _ := tg.connect("/ws?client_id=dev1", nil)
+	id, _ := mr.XAdd("realtime:stream", "*", []string{"data", "m1"})
+	expectData(t, conn, "m1")
+	if got := savedCursor(mr, "dev1"); got != "" {
+		t.Fatalf("cursor %s saved before the interval", got)
+	}
+	tg.disconnect(conn)
+	if got := savedCursor(mr, "dev1"); got != id {
+		t.Fatalf("cursor = %q after disconnect, want %s", got, id)
+	}
+}
+
+func TestCursorNotUsed(t *testing.T) {
+	tg, mr := startCursorGateway(t, nil)
+	mr.Set("realtime:cursors:dev1", "1-0")
+	for i := 1; i <= 3; i++ {
+		mr.XAdd("realtime:stream", fmt.Sprintf("%d-0", i), []string{"data", fmt.Sprintf("m%d", i)})
+	}
+	// An explicit ?since= wins over the saved cursor.
+	conn, _ := tg.connect("/ws?client_id=dev1&since=2-0", nil)
+	expectData(t, conn, "m3")
+	expectSilence(t, conn, 30*time.Millisecond)
+	tg.disconnect(conn)
+
+	// Without a client_id there is nothing to resume or save.
+	conn, _ = tg.connect("/ws", nil)
+	expectSilence(t, conn, 50*time.Millisecond)
+	if keys := mr.Keys(); len(keys) != 2 {
+		t.Fatalf("keys = %v, want only the stream and dev1's cursor", keys)
+	}
+}
+
+// streamInfo answers XINFO STREAM from mr with length and the one other
+// field given, standing in for the fields miniredis leaves out.
+func streamInfo(mr *miniredis.Miniredis, length int, field, value string) {
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd != "XINFO" || len(args) == 0 || !strings.EqualFold(args[0], "STREAM") {
+			return false
+		}
+		c.WriteMapLen(2)
+		c.WriteBulk("length")
+		c.WriteInt(length)
+		c.WriteBulk(field)
+		if field == "first-entry" {
+			c.WriteLen(2)
+			c.WriteBulk(value)
+			c.WriteStrings([]string{"data", "x"})
+		} else {
+			c.WriteBulk(value)
+		}
+		return true
+	})
+}
+
+func TestCursorTrimmed(t *testing.T) {
+	tests := []struct {
+		name, field, value string
+		trimmed            bool
+	}{
+		{name: "deleted past the cursor", field: "max-deleted-entry-id", value: "4-0", trimmed: true},
+		{name: "deleted before the cursor", field: "max-deleted-entry-id", value: "1-0"},
+		{name: "nothing deleted", field: "max-deleted-entry-id", value: "0-0"},
+		// Without max-deleted-entry-id only a first entry after the cursor
+		// gives trimming away.
+		{name: "older server, cursor gone", field: "first-entry", value: "5-0", trimmed: true},
+		{name: "older server, cursor kept", field: "first-entry", value: "2-0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg, mr := startCursorGateway(t, nil)
+			// dev1 got as far as 2-0.
+			mr.Set("realtime:cursors:dev1", "2-0")
+			mr.XAdd("realtime:stream", "5-0", []string{"data", "m5"})
+			mr.XAdd("realtime:stream", "6-0", []string{"data", "m6"})
+			streamInfo(mr, 2, tt.field, tt.value)
+			trimmed := testutil.ToFloat64(cursorResumes.WithLabelValues("trimmed"))
+
+			conn, _ := tg.connect("/ws?client_id=dev1", nil)
+			if tt.trimmed {
+				msg := readJSON(t, conn)
+				if msg["type"] != "gap" || msg["reason"] != "trimmed" || msg["from"] != "2-0" || msg["to"] != "5-0" {
+					t.Fatalf("got %v, want a trimmed gap from 2-0 to 5-0", msg)
+				}
+				if _, ok := msg["count"]; ok {
+					t.Fatalf("gap %v carries a count", msg)
+				}
+			}
+			expectData(t, conn, "m5", "m6")
+			want := 0.0
+			if tt.trimmed {
+				want = 1
+			}
+			if got := testutil.ToFloat64(cursorResumes.WithLabelValues("trimmed")) - trimmed; got != want {
+				t.Fatalf("trimmed cursors rose by %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCursorStreamGone(t *testing.T) {
+	tg, mr := startCursorGateway(t, nil)
+	mr.Set("realtime:cursors:dev1", "2-0")
+	// Nothing after the position is left, so the notice has no to.
+	conn, _ := tg.connect("/ws?client_id=dev1", nil)
+	msg := readJSON(t, conn)
+	if _, ok := msg["to"]; msg["type"] != "gap" || msg["reason"] != "trimmed" || msg["from"] != "2-0" || ok {
+		t.Fatalf("got %v, want a trimmed gap from 2-0 without to", msg)
+	}
+	mr.XAdd("realtime:stream", "*", []string{"data", "live"})
+	expectData(t, conn, "live")
+}
+
+func TestCursorTruncated(t *testing.T) {
+	tg, mr := startCursorGateway(t, map[string]string{"CURSOR_MAX_CATCHUP": "2"})
+	for i := 1; i <= 5; i++ {
+		mr.XAdd("realtime:stream", fmt.Sprintf("%d-0", i), []string{"data", fmt.Sprintf("m%d", i)})
+	}
+	mr.Set("realtime:cursors:dev1", "1-0")
+	truncated := testutil.ToFloat64(cursorResumes.WithLabelValues("truncated"))
+
+	// Four entries are due but only the newest two are sent.
+	conn, _ := tg.connect("/ws?client_id=dev1", nil)
+	if msg := readJSON(t, conn); msg["type"] != "gap" || msg["reason"] != "truncated" || msg["from"] != "1-0" || msg["to"] != "4-0" {
+		t.Fatalf("got %v, want a truncated gap from 1-0 to 4-0", msg)
+	}
+	expectData(t, conn, "m4", "m5")
+	expectSilence(t, conn, 30*time.Millisecond)
+	if got := testutil.ToFloat64(cursorResumes.WithLabelValues("truncated")) - truncated; got != 1 {
+		t.Fatalf("truncated cursors rose by %v, want 1", got)
+	}
+}
+
+func TestCursorConfig(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"BACKEND": "memory", "CURSOR_SAVE_INTERVAL": "1s"},
+		{"BACKEND": "pubsub", "CURSOR_SAVE_INTERVAL": "1s"},
+		{"BACKEND": "stream", "CURSOR_SAVE_INTERVAL": "1s", "CURSOR_MAX_CATCHUP": "0"},
+	} {
+		for k, v := range env {
+			t.Setenv(k, v)
+		}
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("LoadConfig accepted %v", env)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"container/list"
+	"encoding/json"
+	"hash/maphash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deduper suppresses a Redis message seen again within ttl on the same
+// channel: the same message published to every REDIS_URLS endpoint, or a
+// publisher retry. Messages are told apart by their envelope id, or with
+// hashContent by a hash of the payload when they have none; without either
+// a message always passes. At most maxEntries are remembered, oldest
+// evicted first.
+type deduper struct {
+	ttl         time.Duration
+	maxEntries  int
+	hashContent bool
+	seed        maphash.Seed
+
+	mu sync.Mutex
+	// order holds *dedupeEntry, most recently seen first.
+	order *list.List
+	seen  map[string]*list.Element
+}
+
+type dedupeEntry struct {
+	key string
+	at  time.Time
+}
+
+func newDeduper(ttl time.Duration, maxEntries int, hashContent bool) *deduper {
+	return &deduper{
+		ttl:         ttl,
+		maxEntries:  maxEntries,
+		hashContent: hashContent,
+		seed:        maphash.MakeSeed(),
+		order:       list.New(),
+		seen:        make(map[string]*list.Element),
+	}
+}
+
+// first reports whether the message with this channel and payload has not
+// been seen within the TTL, and remembers it.
+func (d *deduper) first(channel, payload string) bool {
+	key := d.key(channel, payload)
+	if key == "" {
+		return true
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if el, ok := d.seen[key]; ok {
+		e := el.Value.(*dedupeEntry)
+		if now.Sub(e.at) <= d.ttl {
+			duplicatesSuppressed.Inc()
+			return false
+		}
+		e.at = now
+		d.order.MoveToFront(el)
+		return true
+	}
+	d.seen[key] = d.order.PushFront(&dedupeEntry{key: key, at: now})
+	// The list is ordered by time seen, so expired entries and, past
+	// maxEntries, the oldest live ones sit at the back.
+	for back := d.order.Back(); back != nil; back = d.order.Back() {
+		e := back.Value.(*dedupeEntry)
+		if now.Sub(e.at) <= d.ttl && d.order.Len() <= d.maxEntries {
+			break
+		}
+		d.order.Remove(back)
+		delete(d.seen, e.key)
+	}
+	return true
+}
+
+func (d *deduper) key(channel, payload string) string {
+	if id := envelopeID(payload); id != "" {
+		return channel + "\x00i" + id
+	}
+	if d.hashContent {
+		return channel + "\x00h" + strconv.FormatUint(maphash.String(d.seed, payload), 16)
+	}
+	return ""
+}
+
+// envelopeID returns the top-level "id" of a JSON object payload, or "".
+func envelopeID(payload string) string {
+	if len(payload) == 0 || payload[0] != '{' || !strings.Contains(payload, `"id"`) {
+		return ""
+	}
+	var env struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal([]byte(payload), &env) != nil {
+		return ""
+	}
+	return env.ID
+}
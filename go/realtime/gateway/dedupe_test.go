@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeduperWindow(t *testing.T) {
+	d := newDeduper(50*time.Millisecond, 100, true)
+	before := testutil.ToFloat64(duplicatesSuppressed)
+	if !d.first("c", `{"a":1}`) {
+		t.Fatal("first sighting suppressed")
+	}
+	if d.first("c", `{"a":1}`) {
+		t.Fatal("repeat within the window delivered")
+	}
+	if !d.first("other", `{"a":1}`) {
+		t.Fatal("same payload on another channel suppressed")
+	}
+	if got := testutil.ToFloat64(duplicatesSuppressed) - before; got != 1 {
+		t.Fatalf("realtime_duplicates_suppressed_total rose by %v, want 1", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !d.first("c", `{"a":1}`) {
+		t.Fatal("repeat after the window suppressed")
+	}
+	if d.first("c", `{"a":1}`) {
+		t.Fatal("the window didn't restart from the last delivery")
+	}
+}
+
+func TestDeduperEnvelopeID(t *testing.T) {
+	for _, hashContent := range []bool{false, true} {
+		d := newDeduper(time.Minute, 100, hashContent)
+		if !d.first("c", `{"id":"m1","data":1}`) || d.first("c", `{"id":"m1","data":2}`) {
+			t.Fatalf("hashContent=%v: a different payload under the same id wasn't suppressed", hashContent)
+		}
+		if !d.first("c", `{"id":"m2","data":1}`) {
+			t.Fatalf("hashContent=%v: another id was suppressed", hashContent)
+		}
+	}
+	// Without content hashing, messages without an id always pass.
+	d := newDeduper(time.Minute, 100, false)
+	if !d.first("c", "plain") || !d.first("c", "plain") {
+		t.Fatal("payload without an id suppressed without content hashing")
+	}
+}
+
+func TestDeduperBounded(t *testing.T) {
+	const limit = 10
+	d := newDeduper(time.Minute, limit, true)
+	for i := range 3 * limit {
+		d.first("c", strconv.Itoa(i))
+	}
+	if d.order.Len() != limit || len(d.seen) != limit {
+		t.Fatalf("remembers %d entries (%d indexed), want %d", d.order.Len(), len(d.seen), limit)
+	}
+	// The oldest were forgotten, the newest are still suppressed.
+	if !d.first("c", "0") {
+		t.Fatal("evicted entry still suppressed")
+	}
+	if d.first("c", strconv.Itoa(3*limit-1)) {
+		t.Fatal("newest entry forgotten")
+	}
+}
+
+func TestDedupWindowOnTheWire(t *testing.T) {
+	mr, url := startRedis(t)
+	tg := startGateway(t, map[string]string{"BACKEND": "pubsub", "REDIS_URL": url, "DEDUP_WINDOW": "100ms"})
+	waitFor(t, "subscription", tg.hub.subscribed.Load)
+	conn, _ := tg.connect("/ws?topics=news", nil)
+
+	mr.Publish("realtime:topic:news", `{"n":1}`)
+	mr.Publish("realtime:topic:news", `{"n":1}`)
+	mr.Publish("realtime:topic:news", `{"n":2}`)
+	for _, want := range []string{`{"n":1}`, `{"n":2}`} {
+		if _, data := readFrame(t, conn); string(data) != want {
+			t.Fatalf("got %s, want %s", data, want)
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+	mr.Publish("realtime:topic:news", `{"n":1}`)
+	if _, data := readFrame(t, conn); string(data) != `{"n":1}` {
+		t.Fatalf("repeat after DEDUP_WINDOW arrived as %s", data)
+	}
+}
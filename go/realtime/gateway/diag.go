@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// diagProbe runs /diag round trips: it publishes a unique marker through
+// the configured backend and waits for the subscription to hand it back.
+type diagProbe struct {
+	rdb     *redis.Client
+	backend string
+	// channel is the Pub/Sub channel the markers travel on; with the stream
+	// backend they are added to stream as entries with a diag field.
+	channel string
+	stream  string
+	timeout time.Duration
+
+	mu      sync.Mutex
+	waiters map[string]chan struct{}
+}
+
+// diagResponse is the /diag body.
+type diagResponse struct {
+	Status    string  `json:"status"`
+	Backend   string  `json:"backend"`
+	Channel   string  `json:"channel,omitempty"`
+	Stream    string  `json:"stream,omitempty"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+func newDiagProbe(rdb *redis.Client, backend, channel, stream string, timeout time.Duration) *diagProbe {
+	return &diagProbe{rdb: rdb, backend: backend, channel: channel, stream: stream, timeout: timeout, waiters: make(map[string]chan struct{})}
+}
+
+// receive is called by the subscription for every marker it sees. Markers
+// from other instances' probes have no waiter here and are ignored.
+func (p *diagProbe) receive(marker string) {
+	p.mu.Lock()
+	ch, ok := p.waiters[marker]
+	delete(p.waiters, marker)
+	p.mu.Unlock()
+	if ok {
+		close(ch)
+	}
+}
+
+// roundTrip publishes a marker and returns how long it took to come back.
+func (p *diagProbe) roundTrip(ctx context.Context) (time.Duration, error) {
+	marker := uuid.NewString()
+	back := make(chan struct{})
+	p.mu.Lock()
+	p.waiters[marker] = back
+	p.mu.Unlock()
+	// Drops the waiter if the marker never comes back.
+	defer p.receive(marker)
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	start := time.Now()
+	var err error
+	if p.backend == "stream" {
+		err = p.rdb.XAdd(ctx, &redis.XAddArgs{Stream: p.stream, Values: map[string]any{"diag": marker}}).Err()
+	} else {
+		err = p.rdb.Publish(ctx, p.channel, marker).Err()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("publishing marker: %w", err)
+	}
+	select {
+	case <-back:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return 0, fmt.Errorf("marker not received within %s; the subscription is not delivering messages", p.timeout)
+		}
+		return 0, ctx.Err()
+	}
+}
+
+// serveDiag serves GET /diag: 200 with the round-trip latency when the
+// marker came back, 503 with the reason otherwise.
+func (p *diagProbe) serveDiag(w http.ResponseWriter, r *http.Request) {
+	resp := diagResponse{Status: "pass", Backend: p.backend}
+	if p.backend == "stream" {
+		resp.Stream = p.stream
+	} else {
+		resp.Channel = p.channel
+	}
+	status := http.StatusOK
+	latency, err := p.roundTrip(r.Context())
+	if err != nil {
+		resp.Status = "fail"
+		resp.Error = err.Error()
+		status = http.StatusServiceUnavailable
+	} else {
+		resp.LatencyMS = float64(latency.Microseconds()) / 1000
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
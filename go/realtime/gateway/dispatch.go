@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// dispatcher decouples the Redis subscription from client fan-out: the
+// subscription goroutine queues each message and a small pool of workers
+// broadcasts them. Messages are routed to a worker by channel, so each
+// channel keeps its order.
+type dispatcher struct {
+	queues []chan func()
+	// block makes dispatch wait for room instead of dropping, which stops
+	// the subscription from reading and leaves the backlog in Redis's
+	// output buffer.
+	block bool
+	ctx   context.Context
+	// dropping is set from the first dropped message until one is queued
+	// again, so a burst logs once rather than per message.
+	dropping atomic.Bool
+}
+
+// newDispatcher splits size queued messages across workers queues.
+func newDispatcher(workers, size int, block bool) *dispatcher {
+	per := (size + workers - 1) / workers
+	d := &dispatcher{queues: make([]chan func(), workers), block: block, ctx: context.Background()}
+	for i := range d.queues {
+		d.queues[i] = make(chan func(), per)
+	}
+	return d
+}
+
+// run starts the workers under wg. They return once ctx is done, dropping
+// whatever is still queued, and a blocked dispatch gives up at that point.
+// It must be called before the first dispatch.
+func (d *dispatcher) run(ctx context.Context, wg *sync.WaitGroup) {
+	d.ctx = ctx
+	for _, q := range d.queues {
+		wg.Add(1)
+		go func(q chan func()) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-q:
+					broadcastQueueDepth.Dec()
+					job()
+				}
+			}
+		}(q)
+	}
+}
+
+// dispatch queues job on the worker for channel.
+func (d *dispatcher) dispatch(channel string, job func()) {
+	h := fnv.New32a()
+	h.Write([]byte(channel))
+	q := d.queues[h.Sum32()%uint32(len(d.queues))]
+	broadcastQueueDepth.Inc()
+	select {
+	case q <- job:
+		d.dropping.Store(false)
+		return
+	default:
+	}
+	if d.block {
+		select {
+		case q <- job:
+			return
+		case <-d.ctx.Done():
+		}
+	} else if !d.dropping.Swap(true) {
+		slog.Warn("broadcast queue full; dropping messages until it drains", "channel", channel)
+	}
+	broadcastQueueDepth.Dec()
+	broadcastQueueDropped.Inc()
+}
@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// lifecycleEvent is published to EVENTS_CHANNEL when a client connects or
+// disconnects, so consumers can aggregate churn across instances.
+type lifecycleEvent struct {
+	Event    string            `json:"event"`
+	ClientID string            `json:"client_id"`
+	Instance string            `json:"instance"`
+	TS       int64             `json:"ts"`
+	Reason   string            `json:"reason,omitempty"` // disconnects only
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// eventPublisher sends lifecycle events from a background goroutine so
+// hub.add and hub.remove never wait on Redis.
+type eventPublisher struct {
+	rdb      *redis.Client
+	channel  string
+	instance string
+	// includeTags adds each client's connection tags to its events.
+	includeTags bool
+	queue       chan lifecycleEvent
+}
+
+func newEventPublisher(rdb *redis.Client, channel, instance string, includeTags bool) *eventPublisher {
+	return &eventPublisher{
+		rdb:         rdb,
+		channel:     channel,
+		instance:    instance,
+		includeTags: includeTags,
+		queue:       make(chan lifecycleEvent, 1024),
+	}
+}
+
+func (p *eventPublisher) emit(event string, c *client, reason string) {
+	ev := lifecycleEvent{Event: event, ClientID: c.id, Instance: p.instance, TS: time.Now().UnixMilli(), Reason: reason}
+	if p.includeTags {
+		ev.Tags = c.tags
+	}
+	select {
+	case p.queue <- ev:
+	default:
+		slog.Warn("lifecycle event queue full, dropping event", "event", event, "client", c.id)
+	}
+}
+
+func (p *eventPublisher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-p.queue:
+			payload, _ := json.Marshal(ev)
+			if err := p.rdb.Publish(ctx, p.channel, payload).Err(); err != nil && ctx.Err() == nil {
+				slog.Error("lifecycle event publish failed", "channel", p.channel, "err", err)
+			}
+		}
+	}
+}
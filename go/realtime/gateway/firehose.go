@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// firehoseTopic is the internal topic that receives a copy of every
+// broadcast. Only clients that presented the admin token on upgrade may
+// join it.
+const firehoseTopic = "__firehose__"
+
+// firehoseMessage is a broadcast as seen on the firehose. Topic is the full
+// topic name, tenant prefix included, and empty for broadcasts to everyone.
+type firehoseMessage struct {
+	Type  string          `json:"type"`
+	Topic string          `json:"topic,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// firehose copies broadcasts to the clients tailing them. It is always the
+// first thing to give way: copies beyond the rate limit are dropped, and so
+// are copies for a client whose send queue is half full, keeping room for
+// its regular messages.
+type firehose struct {
+	adminToken string
+	limiter    *rate.Limiter
+
+	mu      sync.RWMutex
+	clients map[*client]struct{}
+}
+
+func newFirehose(adminToken string, limit float64, burst int) *firehose {
+	return &firehose{
+		adminToken: adminToken,
+		limiter:    rate.NewLimiter(rate.Limit(limit), burst),
+		clients:    make(map[*client]struct{}),
+	}
+}
+
+// authorized reports whether the upgrade request carries the admin token.
+func (f *firehose) authorized(r *http.Request) bool {
+	got := r.Header.Get(adminTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(got), []byte(f.adminToken)) == 1
+}
+
+// join adds c unless it has already been removed from the hub, whose remove
+// cancels the client before calling leave.
+func (f *firehose) join(c *client) {
+	f.mu.Lock()
+	if c.ctx.Err() == nil {
+		f.clients[c] = struct{}{}
+	}
+	f.mu.Unlock()
+}
+
+func (f *firehose) leave(c *client) {
+	f.mu.Lock()
+	delete(f.clients, c)
+	f.mu.Unlock()
+}
+
+// firehoseCopy sends a broadcast on topic to every firehose client.
+func (h *hub) firehoseCopy(topic string, messageType int, data []byte) {
+	f := h.firehose
+	if f == nil {
+		return
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if len(f.clients) == 0 {
+		return
+	}
+	if !f.limiter.Allow() {
+		firehoseDropped.Add(float64(len(f.clients)))
+		return
+	}
+	var raw json.RawMessage
+	switch {
+	case messageType == websocket.TextMessage && json.Valid(data):
+		raw = data
+	case messageType == websocket.TextMessage:
+		raw, _ = json.Marshal(string(data))
+	default:
+		raw, _ = json.Marshal(data)
+	}
+	b, _ := json.Marshal(firehoseMessage{Type: "firehose", Topic: topic, Data: raw})
+	fr := frame{messageType: websocket.TextMessage, data: b}
+	// msgpack clients get the message as raw bytes, built the first time
+	// one of them needs it.
+	var packed *frame
+	for c := range f.clients {
+		out := fr
+		if c.format == formatMsgpack {
+			if packed == nil {
+				packed = &frame{messageType: websocket.BinaryMessage, data: encodeMsgpackWrapped("firehose", "", topic, data)}
+			}
+			out = *packed
+		}
+		s := h.shardFor(c.id)
+		s.mu.RLock()
+		if _, ok := s.clients[c]; ok && len(c.send) < cap(c.send)/2 {
+			select {
+			case c.send <- out:
+			default:
+				firehoseDropped.Inc()
+			}
+		} else if ok {
+			firehoseDropped.Inc()
+		}
+		s.mu.RUnlock()
+	}
+}
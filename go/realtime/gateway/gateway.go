@@ -0,0 +1,699 @@
+// Package gateway implements a Redis-backed WebSocket fanout gateway that can
+// run standalone or be embedded in a larger application.
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// Gateway is a configured gateway: its client registry, backend and routes.
+type Gateway struct {
+	cfg    Config
+	hub    *hub
+	rdb    *redis.Client
+	routes *router
+	// subs are the Pub/Sub subscriptions, one per Redis endpoint; nil for
+	// the stream and memory backends.
+	subs []*subscriber
+	// replicas are the REDIS_URLS clients after the first, which is rdb.
+	replicas []*redis.Client
+	// dispatch queues Pub/Sub messages for the broadcast workers; nil
+	// broadcasts from the subscription goroutine.
+	dispatch *dispatcher
+	// keyspace relays Redis keyspace notifications; nil when disabled.
+	keyspace *keyspaceBridge
+	// stats publishes periodic snapshots; nil when STATS_INTERVAL is unset.
+	stats *statsPublisher
+	// pprof is served on cfg.PprofAddr by Run when that is set.
+	pprof http.Handler
+	// err is a setup failure reported by Run.
+	err error
+}
+
+// New builds a gateway from cfg, normally obtained from LoadConfig. Nothing
+// is started until Run; Handler can be served or tested on its own.
+func New(cfg Config) *Gateway {
+	g := &Gateway{cfg: cfg}
+
+	// BACKEND=memory runs standalone without Redis; the other backends read
+	// Redis for external fanout.
+	if cfg.Backend != "memory" {
+		urls := cfg.RedisURLs
+		if len(urls) == 0 {
+			urls = []string{cfg.RedisURL}
+		}
+		for i, url := range urls {
+			opt, err := redis.ParseURL(url)
+			if err != nil {
+				g.err = fmt.Errorf("invalid Redis URL %q: %w", url, err)
+				opt = &redis.Options{}
+			}
+			if i == 0 {
+				g.rdb = redis.NewClient(opt)
+			} else {
+				g.replicas = append(g.replicas, redis.NewClient(opt))
+			}
+		}
+	}
+	rdb := g.rdb
+
+	h := newHub()
+	g.hub = h
+	if len(cfg.AllowedOrigins) > 0 {
+		h.upgrader.CheckOrigin = newOriginChecker(cfg.AllowedOrigins, cfg.AllowNoOrigin).check
+	} else {
+		slog.Warn("ALLOWED_ORIGINS is not set; accepting WebSocket upgrades from any origin")
+	}
+	if cfg.ShardCount > 0 {
+		h.shards = newShards(cfg.ShardCount)
+	}
+	if cfg.FanoutWorkers > 1 {
+		h.fanoutPool = newFanoutPool(cfg.FanoutWorkers)
+	}
+	if cfg.MaxConcurrentBroadcasts > 0 {
+		h.broadcastLimit = newBroadcastLimiter(cfg.MaxConcurrentBroadcasts, cfg.BroadcastLimitPolicy == "shed")
+	}
+	// Authentication is optional so local development stays frictionless.
+	if cfg.JWTSecret != "" {
+		h.auth = newJWTAuth([]byte(cfg.JWTSecret))
+	}
+	if cfg.AuthURL != "" {
+		h.auth = newCallbackAuth(cfg.AuthURL, cfg.AuthHeaders, cfg.AuthTimeout, cfg.AuthCacheTTL)
+	}
+	if len(cfg.TopicAuthRules) > 0 || cfg.TopicAuthURL != "" {
+		h.topicAuth = newTopicAuthorizer(cfg.TopicAuthRules, cfg.TopicAuthURL, cfg.TopicAuthTimeout)
+	}
+	h.starting.Store(cfg.StartupTimeout > 0)
+	h.pingInterval = cfg.PingInterval
+	h.pongTimeout = cfg.PongTimeout
+	h.pingMode = cfg.PingMode
+	h.appPingInterval = cfg.AppPingInterval
+	h.appPongMisses = int32(cfg.AppPongMisses)
+	h.writeTimeout = cfg.WriteTimeout
+	h.idleTimeout = cfg.IdleTimeout
+	h.maxLifetime = cfg.MaxLifetime
+	h.lifetimeJitter = cfg.LifetimeJitter
+	h.userClaim = cfg.UserIDClaim
+	h.reconnectDelay = cfg.ReconnectDelay
+	h.reconnectJitter = cfg.ReconnectJitter
+	h.closeTimeout = cfg.CloseTimeout
+	h.sendBuffer = cfg.SendBuffer
+	h.flowHigh = int(cfg.FlowHighWater * float64(h.sendBuffer))
+	h.flowLow = int(cfg.FlowLowWater * float64(h.sendBuffer))
+	h.batchWindow = cfg.BatchWindow
+	if cfg.EnableCompression {
+		h.upgrader.EnableCompression = true
+		h.compressionLevel = cfg.CompressionLevel
+		h.compressionMinSize = cfg.CompressMinSize
+		slog.Info("permessage-deflate enabled; trades CPU per message for lower egress bandwidth", "level", h.compressionLevel, "min_size", h.compressionMinSize)
+	}
+	// The write buffer pool lends buffers to connections only while they
+	// write, instead of each idle client holding its own.
+	h.upgrader.ReadBufferSize = cfg.ReadBufferSize
+	h.upgrader.WriteBufferSize = cfg.WriteBufferSize
+	if cfg.WriteBufferPool {
+		h.upgrader.WriteBufferPool = &sync.Pool{}
+	}
+	slog.Info("websocket buffers",
+		"read_buffer_size", h.upgrader.ReadBufferSize,
+		"write_buffer_size", h.upgrader.WriteBufferSize,
+		"write_buffer_pool", h.upgrader.WriteBufferPool != nil)
+	h.streamThreshold = cfg.StreamThreshold
+	h.streamChunk = cfg.StreamChunkSize
+	if cfg.WarmupDuration > 0 {
+		h.warmup = &warmup{batch: cfg.WarmupBatch, delay: cfg.WarmupBatchDelay}
+	}
+	h.upgrader.HandshakeTimeout = cfg.HandshakeTimeout
+	h.messageType = cfg.MessageType
+	if topics, err := newTopicSettings(cfg, cfg.TopicSection); err != nil {
+		g.err = fmt.Errorf("topic settings: %w", err)
+	} else {
+		h.topics.Store(topics)
+	}
+	// With a config file a reload can start retaining topics, so the store
+	// is there even while none are.
+	if retained := h.topicConfig().retained; len(retained) > 0 || (cfg.ConfigFile != "" && cfg.Backend != "stream" && cfg.SnapshotURL == "") {
+		h.retain = newRetainStore(retained, cfg.RetainTTL)
+	}
+	h.validateBroadcasts = cfg.CheckBroadcasts
+	if cfg.SnapshotURL != "" {
+		h.snapshots = newSnapshotSource(cfg.SnapshotURL, cfg.SnapshotTimeout)
+	}
+	h.transformer = cfg.Transformer
+	h.tracer = cfg.Tracer
+	h.onOverflow = cfg.OnOverflow
+	h.maxPatterns = cfg.MaxPatterns
+	h.maxSubscriptions = cfg.MaxSubscriptions
+	if cfg.MessageLogPath != "" {
+		h.msgLog = newMessageLog(cfg.MessageLogPath, cfg.MessageLogMaxMB, cfg.MessageLogSample, cfg.MessageLogAlways, h.topicConfig().logRates)
+	}
+	h.maxMessageSize = int64(cfg.MaxMessageSize)
+	h.clientRate = rate.Limit(cfg.ClientRate)
+	h.clientBurst = cfg.ClientBurst
+	h.maxRateViolations = cfg.ClientMaxViolations
+	h.maxProtocolErrors = cfg.MaxProtocolErrors
+	if cfg.GlobalRate > 0 {
+		h.globalLimiter = rate.NewLimiter(rate.Limit(cfg.GlobalRate), cfg.GlobalBurst)
+	}
+	if cfg.AcceptRate > 0 {
+		h.acceptLimiter = rate.NewLimiter(rate.Limit(cfg.AcceptRate), cfg.AcceptBurst)
+	}
+	if cfg.RejectWithClose {
+		h.rejectCodes = map[string]int{"capacity": cfg.CapacityCloseCode, "rate_limit": cfg.RateLimitCloseCode}
+	}
+	if cfg.DuplicateIDPolicy == "reject" {
+		h.rejectDuplicates = true
+		if h.rejectCodes == nil {
+			h.rejectCodes = make(map[string]int)
+		}
+		h.rejectCodes["duplicate"] = closeDuplicateID
+	}
+	if cfg.AdminToken != "" && cfg.FirehoseRate > 0 {
+		h.firehose = newFirehose(cfg.AdminToken, cfg.FirehoseRate, cfg.FirehoseBurst)
+	}
+	if cfg.MaxConnections > 0 {
+		h.maxConnections = int64(cfg.MaxConnections)
+	}
+	if cfg.MemSoftLimit > 0 || cfg.MemHardLimit > 0 {
+		h.memGuard = &memoryGuard{soft: cfg.MemSoftLimit, hard: cfg.MemHardLimit, interval: cfg.MemCheckInterval, usage: processMemory}
+	}
+	if cfg.MaxConnPerIP > 0 {
+		h.perIP = newIPLimiter(cfg.MaxConnPerIP)
+	}
+	h.proxies = &proxyTrust{enabled: cfg.TrustProxy, trusted: cfg.TrustedProxies}
+	if len(cfg.TagQueryParams) > 0 || len(cfg.TagHeaders) > 0 {
+		h.tags = &tagSpec{params: cfg.TagQueryParams, headers: cfg.TagHeaders}
+	}
+	h.rdb = rdb
+	if cfg.EventsChannel != "" {
+		h.events = newEventPublisher(rdb, cfg.EventsChannel, cfg.InstanceID, cfg.EventsIncludeTags)
+	}
+	if cfg.ReceiptsChannel != "" {
+		h.receipts = newReceiptPublisher(rdb, cfg.ReceiptsChannel, cfg.InstanceID)
+	}
+	if cfg.PresenceEnabled {
+		h.presence = newPresenceTracker(rdb, cfg.TopicPrefix, cfg.PresenceTTL)
+	}
+	h.publishPrefix = cfg.PublishPrefix
+	h.topicPrefix = cfg.TopicPrefix
+	if len(cfg.TenantFrom) > 0 {
+		h.tenants = &tenantResolver{
+			sources:  cfg.TenantFrom,
+			header:   cfg.TenantHeader,
+			domain:   strings.ToLower(strings.TrimPrefix(cfg.TenantDomain, ".")),
+			required: cfg.RequireTenant,
+		}
+	}
+	if cfg.SequenceEnabled {
+		h.sequencer = &sequencer{rdb: rdb, prefix: cfg.SequenceKeyPrefix}
+	}
+	h.ackWindow = cfg.AckWindow
+	h.ackTimeout = cfg.AckTimeout
+	h.ackKeyPrefix = cfg.AckKeyPrefix
+	h.ackStateTTL = cfg.AckStateTTL
+	if cfg.ResumeWindow > 0 {
+		h.resume = newResumer(rdb, cfg.ResumePrefix, cfg.ResumeWindow, cfg.ResumeBuffer)
+	}
+
+	if cfg.KeyspacePrefix != "" {
+		g.keyspace = &keyspaceBridge{
+			rdb:         rdb,
+			db:          rdb.Options().DB,
+			keyPrefix:   cfg.KeyspacePrefix,
+			topicPrefix: cfg.KeyspaceTopicPrefix,
+			maxBackoff:  cfg.RedisMaxBackoff,
+		}
+	}
+
+	if cfg.StatsInterval > 0 {
+		g.stats = &statsPublisher{rdb: rdb, channel: cfg.StatsChannel, instance: cfg.InstanceID, interval: cfg.StatsInterval}
+	}
+
+	if cfg.AdminToken != "" && cfg.Backend != "memory" {
+		h.diag = newDiagProbe(rdb, cfg.Backend, cfg.DiagChannel, cfg.RedisStream, cfg.DiagTimeout)
+	}
+
+	g.routes = g.newRoutes()
+	g.newBackend()
+	return g
+}
+
+// newRoutes registers every HTTP endpoint the configuration enables.
+func (g *Gateway) newRoutes() *router {
+	cfg, h := g.cfg, g.hub
+	routes := newRouter(cfg.RoutePrefix)
+	routes.handleFunc("/ws", h.serveWS)
+	routes.handleFunc("GET /sse", h.serveSSE)
+
+	token := cfg.AdminToken
+	if token != "" {
+		routes.handleFunc("GET /admin/clients", requireAdmin(token, h.listClients))
+		routes.handleFunc("POST /admin/clients/{id}/disconnect", requireAdmin(token, h.disconnectClient))
+		if h.diag != nil {
+			routes.handleFunc("GET /diag", requireAdmin(token, h.diag.serveDiag))
+		}
+		if cfg.Backend == "memory" {
+			routes.handleFunc("POST /publish", requireAdmin(token, h.publishHandler(cfg.MaxBroadcastSize)))
+		}
+	} else {
+		slog.Info("ADMIN_TOKEN is not set; admin endpoints are disabled")
+	}
+	if token != "" || cfg.PublishToken != "" {
+		routes.handleFunc("POST /publish/{topic}", requirePublisher(token, cfg.PublishToken, h.topicPublishHandler(cfg.TopicPrefix, cfg.MaxBroadcastSize)))
+	} else if cfg.Backend == "memory" {
+		slog.Warn("BACKEND=memory without ADMIN_TOKEN or PUBLISH_TOKEN: nothing can publish messages")
+	}
+	// Profiles expose internals, so keep them off by default and, with
+	// PPROF_ADDR, on a listener that is not reachable from outside.
+	if cfg.EnablePprof {
+		pprof := pprofHandler()
+		if token != "" {
+			pprof = requireAdmin(token, pprof.ServeHTTP)
+		}
+		if cfg.PprofAddr != "" {
+			g.pprof = pprof
+		} else {
+			routes.handle("/debug/pprof/", http.StripPrefix(routes.prefix, pprof))
+		}
+		slog.Warn("pprof enabled; only expose it on an internal interface", "admin_token", token != "")
+	}
+	routes.handle("/metrics", metricsHandler())
+	routes.handleFunc("/healthz", healthHandler(h))
+	routes.handleFunc("/ready", readyHandler(g.rdb, h, cfg.HealthTimeout))
+	return routes
+}
+
+// newBackend prepares the configured message source; Run starts it.
+func (g *Gateway) newBackend() {
+	cfg, h := g.cfg, g.hub
+	switch cfg.Backend {
+	case "pubsub":
+		topicPrefix := cfg.TopicPrefix
+		directChannel := cfg.DirectChannel
+		maxBroadcastSize := cfg.MaxBroadcastSize
+		// Every REDIS_CHANNEL message goes to every client; that's deprecated
+		// in favor of topics, but stays on until LEGACY_BROADCAST_ALL=false
+		// so publishers can move to topic channels one at a time.
+		var channels []string
+		if cfg.LegacyBroadcastAll {
+			channels = append(channels, cfg.RedisChannels...)
+		} else {
+			slog.Info("LEGACY_BROADCAST_ALL=false: not subscribing to REDIS_CHANNEL", "channels", cfg.RedisChannels)
+		}
+		channels = append(channels, directChannel)
+		legacy := &legacyNotice{}
+		diagChannel := cfg.DiagChannel
+		if h.diag != nil {
+			channels = append(channels, diagChannel)
+		}
+		slog.Info("subscribing to redis", "channels", channels, "pattern", topicPrefix+"*")
+		var decoder *payloadDecoder
+		if cfg.PayloadEncoding != "none" {
+			decoder = newPayloadDecoder(cfg.PayloadEncoding, int64(cfg.MaxDecompressedSize), cfg.PayloadPassthrough)
+		}
+		if cfg.BroadcastQueue > 0 {
+			g.dispatch = newDispatcher(cfg.BroadcastWorkers, cfg.BroadcastQueue, cfg.OverflowPolicy == "block")
+		}
+		deliver := func(msg *redis.Message) {
+			if h.diag != nil && msg.Channel == diagChannel {
+				h.diag.receive(msg.Payload)
+				return
+			}
+			if msg.Channel == directChannel {
+				h.deliverDirect([]byte(msg.Payload))
+				return
+			}
+			// Passed-through compressed payloads can only go out as binary.
+			binary := decoder != nil && decoder.passthrough && compressed(msg.Payload)
+			if msg.Pattern != "" {
+				topic := strings.TrimPrefix(msg.Channel, topicPrefix)
+				messageType := h.typeFor(topic)
+				if binary {
+					messageType = websocket.BinaryMessage
+				}
+				h.broadcastTopic(topic, messageType, []byte(msg.Payload))
+				return
+			}
+			legacy.received(msg.Channel)
+			messageType := h.typeFor("")
+			if binary {
+				messageType = websocket.BinaryMessage
+			}
+			h.broadcast(messageType, []byte(msg.Payload))
+		}
+		// With several endpoints each one gets its own subscription; a
+		// message published to all of them is delivered once by its id.
+		// DEDUP_WINDOW extends that to repeats of the same content.
+		var dedupe *deduper
+		var fo *failover
+		clients := append([]*redis.Client{g.rdb}, g.replicas...)
+		if len(clients) > 1 {
+			fo = &failover{total: len(clients), subscribed: &h.subscribed}
+		}
+		switch {
+		case cfg.DedupWindow > 0:
+			dedupe = newDeduper(cfg.DedupWindow, cfg.DedupMaxEntries, true)
+		case fo != nil:
+			dedupe = newDeduper(cfg.DedupeTTL, cfg.DedupMaxEntries, false)
+		}
+		for _, rdb := range clients {
+			addr := rdb.Options().Addr
+			sub := &subscriber{
+				rdb:        rdb,
+				channels:   channels,
+				pattern:    topicPrefix + "*",
+				maxBackoff: cfg.RedisMaxBackoff,
+				up:         &h.subscribed,
+				handle: func(msg *redis.Message) {
+					messagesReceived.Inc()
+					if maxBroadcastSize > 0 && len(msg.Payload) > maxBroadcastSize {
+						slog.Warn("skipping message over MAX_BROADCAST_SIZE", "channel", msg.Channel, "bytes", len(msg.Payload))
+						return
+					}
+					if decoder != nil && !decoder.passthrough {
+						payload, err := decoder.decode(msg.Payload)
+						if err != nil {
+							slog.Warn("skipping undecodable compressed message", "channel", msg.Channel, "bytes", len(msg.Payload), "err", err)
+							return
+						}
+						msg.Payload = payload
+					}
+					if dedupe != nil && !dedupe.first(msg.Channel, msg.Payload) {
+						return
+					}
+					if fo != nil {
+						slog.Debug("redis message", "redis", addr, "channel", msg.Channel)
+					}
+					if g.dispatch != nil {
+						g.dispatch.dispatch(msg.Channel, func() { deliver(msg) })
+						return
+					}
+					deliver(msg)
+				},
+				healthInterval: cfg.RedisHealthInterval,
+				pingTimeout:    cfg.HealthTimeout,
+				rebuildAfter:   cfg.RedisRebuildAfter,
+			}
+			if fo != nil {
+				// Each subscription tracks its own state; fo combines them.
+				sub.up = new(atomic.Bool)
+				sub.changed = fo.changed(addr)
+			}
+			g.subs = append(g.subs, sub)
+		}
+	case "stream":
+		h.stream = &streamBackend{
+			rdb:        g.rdb,
+			key:        cfg.RedisStream,
+			replayMax:  int64(cfg.ReplayMax),
+			maxBackoff: cfg.RedisMaxBackoff,
+			maxSize:    cfg.MaxBroadcastSize,
+		}
+		if cfg.CursorInterval > 0 {
+			h.cursors = &cursorStore{
+				rdb:        g.rdb,
+				prefix:     cfg.CursorKeyPrefix,
+				ttl:        cfg.CursorTTL,
+				interval:   cfg.CursorInterval,
+				maxCatchUp: int64(cfg.CursorMaxCatchUp),
+			}
+		}
+	case "memory":
+		h.subscribed.Store(true)
+		slog.Info("running without Redis; publish with POST /publish")
+	}
+}
+
+// Handler returns the gateway's routes: /ws, the probes, /metrics and
+// whichever admin and publish endpoints are enabled.
+func (g *Gateway) Handler() http.Handler {
+	return g.routes.mux
+}
+
+// ReloadTopics re-reads the topics section of CONFIG_FILE, schemas included,
+// and swaps in the per-topic settings it describes; connections and
+// subscriptions carry on unaffected. When the file is invalid the current
+// settings stay and the error says why. Other settings in the file only take
+// effect on restart.
+func (g *Gateway) ReloadTopics() error {
+	next, err := g.loadTopics()
+	if err != nil {
+		configReloads.WithLabelValues("error").Inc()
+		return err
+	}
+	prev := g.hub.topicConfig()
+	g.hub.topics.Store(next)
+	if g.hub.msgLog != nil {
+		g.hub.msgLog.setRates(next.logRates)
+	}
+	if g.hub.retain != nil {
+		g.hub.retain.relist(next.retained)
+	}
+	configReloads.WithLabelValues("ok").Inc()
+	logTopicChanges(prev.section, next.section)
+	return nil
+}
+
+func (g *Gateway) loadTopics() (*topicSettings, error) {
+	if g.cfg.ConfigFile == "" {
+		return nil, errors.New("CONFIG_FILE is not set")
+	}
+	_, section, err := readConfigFile(g.cfg.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	next, err := newTopicSettings(g.cfg, section)
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+	return next, nil
+}
+
+// Drain stops accepting new WebSocket upgrades while existing clients keep
+// being served.
+func (g *Gateway) Drain() {
+	if g.hub.drain() {
+		slog.Info("draining: rejecting new connections", "clients", g.hub.count())
+		go g.hub.reportDrain()
+	}
+}
+
+// Run starts the backend and serves Handler on cfg.BindAddr until ctx is
+// cancelled, then closes every client and shuts down. It returns early with
+// an error if the gateway cannot be set up or the listener fails.
+func (g *Gateway) Run(ctx context.Context) error {
+	if g.err != nil {
+		return g.err
+	}
+	cfg, h := g.cfg, g.hub
+	if h.tracer == nil {
+		t, err := newOTelTracer(ctx)
+		if err != nil {
+			return fmt.Errorf("opentelemetry: %w", err)
+		}
+		if t != nil {
+			h.tracer = t
+			// Deferred first, so it runs last and gets the spans of the
+			// final broadcasts.
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), otelShutdownTimeout)
+				defer cancel()
+				if err := t.shutdown(ctx); err != nil {
+					slog.Warn("opentelemetry shutdown", "err", err)
+				}
+			}()
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	h.ctx = ctx
+	// The gauge outlives a gateway whose Run has returned, and one run after
+	// it in the same process accepts upgrades again.
+	gatewayDraining.Set(0)
+	if h.warmup != nil {
+		h.warmup.start(ctx, cfg.WarmupDuration)
+	}
+
+	if h.receipts != nil {
+		go h.receipts.run(ctx)
+	}
+	if h.events != nil {
+		go h.events.run(ctx)
+	}
+	if h.presence != nil {
+		go h.presence.run(ctx)
+	}
+	if g.stats != nil {
+		go g.stats.run(ctx, h)
+	}
+	if cfg.ReapInterval > 0 {
+		go h.runReaper(ctx, cfg.ReapInterval, cfg.ReapAfter)
+	}
+	if h.memGuard != nil {
+		go h.runMemoryGuard(ctx)
+	}
+	if h.cursors != nil {
+		go h.runCursorSaver(ctx)
+	}
+	if g.pprof != nil {
+		go servePprof(cfg.PprofAddr, g.pprof)
+	}
+	// backends tracks the Redis readers, the broadcast workers and the
+	// message log so shutdown can wait for them before closing the client.
+	var backends sync.WaitGroup
+	if h.msgLog != nil {
+		if err := h.msgLog.open(); err != nil {
+			return err
+		}
+		backends.Add(1)
+		go func() {
+			defer backends.Done()
+			h.msgLog.run(ctx)
+		}()
+	}
+	if g.dispatch != nil {
+		g.dispatch.run(ctx, &backends)
+	}
+	if h.stream != nil {
+		backends.Add(1)
+		go func() {
+			defer backends.Done()
+			h.stream.run(ctx, h)
+		}()
+	}
+	if h.resume != nil {
+		backends.Add(1)
+		go func() {
+			defer backends.Done()
+			h.resume.run()
+		}()
+	}
+	for _, sub := range g.subs {
+		backends.Add(1)
+		go func(sub *subscriber) {
+			defer backends.Done()
+			sub.run(ctx)
+		}(sub)
+	}
+	if g.keyspace != nil {
+		backends.Add(1)
+		go func() {
+			defer backends.Done()
+			g.keyspace.run(ctx, h)
+		}()
+	}
+
+	// These limits only cover the HTTP phase: once a connection is upgraded it
+	// is hijacked, and the pumps manage it with their own socket deadlines.
+	server := &http.Server{
+		Addr:              cfg.BindAddr,
+		Handler:           g.Handler(),
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		MaxHeaderBytes:    cfg.HTTPMaxHeaderBytes,
+	}
+
+	// Serve wss:// directly when a certificate is configured.
+	useTLS := cfg.TLSCert != ""
+	if useTLS {
+		tc, err := tlsConfig(cfg.TLSMinVersion)
+		if err != nil {
+			cancel()
+			backends.Wait()
+			return err
+		}
+		server.TLSConfig = tc
+	}
+
+	ln, err := listen(ctx, cfg.BindAddr, cfg.ReusePort)
+	if err != nil {
+		cancel()
+		backends.Wait()
+		return fmt.Errorf("listen on %s: %w", cfg.BindAddr, err)
+	}
+	if cfg.WriteRetries > 0 {
+		ln = retryListener{Listener: ln, retries: cfg.WriteRetries, backoff: cfg.WriteRetryBackoff}
+	}
+
+	serveErr := make(chan error, 2)
+	go func() {
+		var err error
+		if useTLS {
+			slog.Info("realtime gateway listening", "addr", cfg.BindAddr, "mode", "tls", "reuse_port", cfg.ReusePort)
+			err = server.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+		} else {
+			slog.Info("realtime gateway listening", "addr", cfg.BindAddr, "mode", "plain", "reuse_port", cfg.ReusePort)
+			err = server.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- fmt.Errorf("http server error: %w", err)
+		}
+	}()
+
+	if h.starting.Load() {
+		go func() {
+			if err := h.awaitStartup(ctx, cfg.StartupTimeout, cfg.FailFast); err != nil {
+				serveErr <- err
+			}
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+	case err = <-serveErr:
+		cancel()
+	}
+	slog.Info("shutting down realtime gateway")
+	h.drain()
+	// Cancelling ctx makes every writePump send its reconnect hint and close
+	// frame; closeAll takes care of whoever is left.
+	connected := h.count()
+	h.awaitClients(cfg.ClientCloseTimeout)
+	if n := h.closeAll(websocket.CloseGoingAway, "server shutting down"); n > 0 {
+		slog.Warn("force-closed clients still connected after CLIENT_CLOSE_TIMEOUT", "clients", n, "of", connected, "timeout", cfg.ClientCloseTimeout)
+	} else {
+		slog.Info("all clients disconnected", "clients", connected)
+	}
+	if h.resume != nil {
+		// Closed clients have saved their sessions by now; flush the
+		// messages buffered for them.
+		h.resume.stop()
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("http shutdown error", "err", err)
+	}
+	backends.Wait()
+	if g.rdb != nil {
+		g.rdb.Close()
+	}
+	for _, rdb := range g.replicas {
+		rdb.Close()
+	}
+	return err
+}
+
+// listen opens the main TCP listener. With reusePort set, SO_REUSEPORT lets a
+// replacement process bind the same address while this one drains.
+func listen(ctx context.Context, addr string, reusePort bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = setReusePort
+	}
+	return lc.Listen(ctx, "tcp", addr)
+}
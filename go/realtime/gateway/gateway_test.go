@@ -0,0 +1,272 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testGateway is a gateway that startGateway runs until the test ends.
+type testGateway struct {
+	*Gateway
+	t    testing.TB
+	addr string
+}
+
+// startGateway runs a gateway configured by env, on the memory backend and a
+// free local port unless env says otherwise, and stops it when the test ends.
+func startGateway(t testing.TB, env map[string]string) *testGateway {
+	t.Helper()
+	defaults := map[string]string{
+		"BACKEND":              "memory",
+		"BIND_ADDR":            freeAddr(t),
+		"CLIENT_CLOSE_TIMEOUT": "200ms",
+		"CLOSE_TIMEOUT":        "200ms",
+	}
+	for k, v := range defaults {
+		if _, ok := env[k]; !ok {
+			t.Setenv(k, v)
+		}
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := New(cfg)
+	t.Cleanup(runGateway(t, g))
+	tg := &testGateway{Gateway: g, t: t, addr: cfg.BindAddr}
+	waitFor(t, "gateway to listen", func() bool {
+		resp, err := http.Get(tg.url("/healthz"))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	})
+	return tg
+}
+
+// runGateway runs g in the background and returns a func that stops it and
+// waits for Run to return.
+func runGateway(t testing.TB, g *Gateway) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.Run(ctx) }()
+	return func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Error("gateway did not shut down")
+		}
+	}
+}
+
+// startRedis runs an in-memory Redis for the test and returns its URL. Tests
+// of the stream backend close it before the gateway stops, since a blocked
+// XREAD would otherwise hold up shutdown for its full 5s.
+func startRedis(t testing.TB) (*miniredis.Miniredis, string) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	return mr, "redis://" + mr.Addr() + "/0"
+}
+
+func freeAddr(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// url returns the gateway's http:// URL for path.
+func (tg *testGateway) url(path string) string {
+	return "http://" + tg.addr + path
+}
+
+// dial opens a WebSocket to path, e.g. "/ws?topics=a", failing the test if
+// the upgrade is refused.
+func (tg *testGateway) dial(path string, header http.Header) *websocket.Conn {
+	tg.t.Helper()
+	conn, resp, err := tg.tryDial(path, header)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		tg.t.Fatalf("dial %s: %v (status %d)", path, err, status)
+	}
+	tg.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// tryDial opens a WebSocket to path and returns the handshake response, which
+// carries the status of a refused upgrade.
+func (tg *testGateway) tryDial(path string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	return websocket.DefaultDialer.Dial("ws://"+tg.addr+path, header)
+}
+
+// connect dials path and reads the welcome frame, returning the connection
+// and the client ID it was given.
+func (tg *testGateway) connect(path string, header http.Header) (*websocket.Conn, string) {
+	tg.t.Helper()
+	conn := tg.dial(path, header)
+	welcome := readJSON(tg.t, conn)
+	if welcome["type"] != "welcome" {
+		tg.t.Fatalf("first frame = %v, want a welcome", welcome)
+	}
+	id, _ := welcome["id"].(string)
+	return conn, id
+}
+
+// readFrame reads the next message, failing the test after a second.
+func readFrame(t testing.TB, conn *websocket.Conn) (int, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	mt, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return mt, data
+}
+
+// readJSON reads the next message as a JSON object.
+func readJSON(t testing.TB, conn *websocket.Conn) map[string]any {
+	t.Helper()
+	_, data := readFrame(t, conn)
+	var msg map[string]any
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("frame %q is not a JSON object: %v", data, err)
+	}
+	return msg
+}
+
+// expectSilence fails the test if a message arrives within d. The read
+// deadline it runs into breaks conn for further reads, so it comes last.
+func expectSilence(t testing.TB, conn *websocket.Conn, d time.Duration) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(d))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("unexpected frame %q", data)
+	}
+}
+
+// sendJSON writes v as a text frame.
+func sendJSON(t testing.TB, conn *websocket.Conn, v any) {
+	t.Helper()
+	if err := conn.WriteJSON(v); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after two seconds.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// closeCode returns the close code conn is closed with, reading past any
+// frames still in flight.
+func closeCode(t testing.TB, conn *websocket.Conn) int {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var ce *websocket.CloseError
+		if errors.As(err, &ce) {
+			return ce.Code
+		}
+		t.Fatalf("connection ended without a close frame: %v", err)
+	}
+}
+
+// status performs a request and returns its status code and body.
+func status(t testing.TB, req *http.Request) (int, string) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(string(body))
+}
+
+func TestHealthz(t *testing.T) {
+	tg := startGateway(t, nil)
+	req, _ := http.NewRequest(http.MethodGet, tg.url("/healthz"), nil)
+	code, body := status(t, req)
+	if code != http.StatusOK || !strings.Contains(body, `"status":"ok"`) {
+		t.Fatalf("GET /healthz = %d %s", code, body)
+	}
+}
+
+func TestSlowHeadersCutOff(t *testing.T) {
+	tg := startGateway(t, map[string]string{"HTTP_READ_HEADER_TIMEOUT": "200ms"})
+	conn, err := net.Dial("tcp", tg.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Start a request and never finish its headers.
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: gateway\r\nUpgrade: websocket\r\n")
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection still open after %v: %v", time.Since(start), err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("cut off after %v, before HTTP_READ_HEADER_TIMEOUT", elapsed)
+	}
+}
+
+func TestOversizedHeadersRejected(t *testing.T) {
+	tg := startGateway(t, map[string]string{"HTTP_MAX_HEADER_BYTES": "1024"})
+	req, _ := http.NewRequest(http.MethodGet, tg.url("/healthz"), nil)
+	// net/http lets headers run a few KiB past MaxHeaderBytes, so pad them
+	// well beyond it.
+	req.Header.Set("X-Padding", strings.Repeat("x", 16<<10))
+	if code, _ := status(t, req); code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("status = %d, want 431", code)
+	}
+}
+
+func TestReadTimeoutSparesUpgradedConnections(t *testing.T) {
+	tg := startGateway(t, map[string]string{"HTTP_READ_TIMEOUT": "100ms"})
+	conn, _ := tg.connect("/ws", nil)
+	time.Sleep(300 * time.Millisecond)
+	sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "a"})
+	if msg := readJSON(t, conn); msg["type"] != "ack" {
+		t.Fatalf("reply = %v, want an ack after HTTP_READ_TIMEOUT passed", msg)
+	}
+}
@@ -0,0 +1,41 @@
+package gateway
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// failover tracks which of several Redis subscriptions are established.
+// The gateway counts as subscribed while any of them is, and every change is
+// logged so operators can see delivery moving between backends.
+type failover struct {
+	total      int
+	subscribed *atomic.Bool
+
+	mu      sync.Mutex
+	healthy int
+}
+
+// changed returns the subscriber hook for the backend at addr.
+func (f *failover) changed(addr string) func(up bool) {
+	return func(up bool) {
+		f.mu.Lock()
+		if up {
+			f.healthy++
+		} else {
+			f.healthy--
+		}
+		n := f.healthy
+		f.mu.Unlock()
+		f.subscribed.Store(n > 0)
+		switch {
+		case up:
+			slog.Info("redis backend up", "redis", addr, "healthy", n, "backends", f.total)
+		case n > 0:
+			slog.Warn("redis backend down; delivering from the remaining backends", "redis", addr, "healthy", n, "backends", f.total)
+		default:
+			slog.Error("all redis backends down", "redis", addr, "backends", f.total)
+		}
+	}
+}
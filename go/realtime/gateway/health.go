@@ -0,0 +1,106 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// healthResponse is the /healthz and /ready body.
+type healthResponse struct {
+	Status  string `json:"status"`
+	Clients int    `json:"clients"`
+	Error   string `json:"error,omitempty"`
+}
+
+// healthHandler is the liveness probe: it answers 200 whenever the process
+// can serve HTTP, with the number of connected clients. Dependencies are
+// checked by readyHandler instead, so a Redis outage never gets the gateway
+// restarted.
+func healthHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := healthResponse{Status: "ok", Clients: h.count()}
+		if h.draining.Load() {
+			resp.Status = "draining"
+		}
+		writeHealth(w, http.StatusOK, resp)
+	}
+}
+
+// readyHandler is the readiness probe: 200 only while the Redis subscription
+// is established and the gateway is not draining, and 503 otherwise, e.g.
+// during reconnect backoff. rdb is nil for the memory backend, which has no
+// Redis to check; otherwise Redis must also answer a ping within timeout.
+func readyHandler(rdb *redis.Client, h *hub, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		resp := healthResponse{Status: "ok", Clients: h.count()}
+		status := http.StatusOK
+		switch err := pingRedis(ctx, rdb); {
+		case h.draining.Load():
+			resp.Status = "draining"
+			status = http.StatusServiceUnavailable
+		case h.starting.Load():
+			resp.Status = "starting"
+			status = http.StatusServiceUnavailable
+		case err != nil:
+			resp.Status = "error"
+			resp.Error = err.Error()
+			status = http.StatusServiceUnavailable
+		case !h.subscribed.Load():
+			resp.Status = "error"
+			resp.Error = "redis subscription not established"
+			status = http.StatusServiceUnavailable
+		}
+		writeHealth(w, status, resp)
+	}
+}
+
+// awaitStartup holds back /ws and /ready until the backend's first Redis
+// subscription, which it keeps retrying meanwhile, or until timeout. Past
+// timeout it returns an error when failFast is set and otherwise starts
+// accepting connections anyway.
+func (h *hub) awaitStartup(ctx context.Context, timeout time.Duration, failFast bool) error {
+	slog.Info("waiting for redis before accepting connections", "timeout", timeout)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(50 * time.Millisecond)
+	defer poll.Stop()
+	for !h.subscribed.Load() {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-deadline.C:
+			if failFast {
+				return fmt.Errorf("redis not reachable within STARTUP_TIMEOUT (%s)", timeout)
+			}
+			slog.Warn("redis not reachable within STARTUP_TIMEOUT; accepting connections in degraded mode", "timeout", timeout)
+			h.starting.Store(false)
+			return nil
+		case <-poll.C:
+		}
+	}
+	slog.Info("redis ready; accepting connections")
+	h.starting.Store(false)
+	return nil
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func pingRedis(ctx context.Context, rdb *redis.Client) error {
+	if rdb == nil {
+		return nil
+	}
+	return rdb.Ping(ctx).Err()
+}
@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ready returns the /ready status code and body.
+func (tg *testGateway) ready() (int, string) {
+	tg.t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, tg.url("/ready"), nil)
+	return status(tg.t, req)
+}
+
+func TestStartupWaitsForRedis(t *testing.T) {
+	mr, url := startRedis(t)
+	mr.Close()
+	tg := startGateway(t, map[string]string{
+		"BACKEND":           "pubsub",
+		"REDIS_URL":         url,
+		"STARTUP_TIMEOUT":   "10s",
+		"REDIS_MAX_BACKOFF": "50ms",
+	})
+	if code, body := tg.ready(); code != http.StatusServiceUnavailable || !strings.Contains(body, `"status":"starting"`) {
+		t.Fatalf("/ready before Redis = %d %s, want 503 starting", code, body)
+	}
+	_, resp, err := tg.tryDial("/ws", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("upgrade before Redis: err = %v, response = %v; want 503 with Retry-After 1", err, resp)
+	}
+
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "/ready", func() bool {
+		code, _ := tg.ready()
+		return code == http.StatusOK
+	})
+	if tg.hub.starting.Load() {
+		t.Fatal("still starting once /ready passed")
+	}
+	tg.connect("/ws", nil)
+}
+
+func TestStartupTimeoutDegraded(t *testing.T) {
+	mr, url := startRedis(t)
+	mr.Close()
+	tg := startGateway(t, map[string]string{
+		"BACKEND":           "pubsub",
+		"REDIS_URL":         url,
+		"STARTUP_TIMEOUT":   "200ms",
+		"FAIL_FAST":         "false",
+		"REDIS_MAX_BACKOFF": "50ms",
+	})
+	waitFor(t, "STARTUP_TIMEOUT to pass", func() bool { return !tg.hub.starting.Load() })
+	// Connections are accepted, but /ready still reports Redis.
+	tg.connect("/ws", nil)
+	if code, body := tg.ready(); code != http.StatusServiceUnavailable || !strings.Contains(body, `"status":"error"`) {
+		t.Fatalf("/ready in degraded mode = %d %s, want 503 error", code, body)
+	}
+}
+
+func TestStartupTimeoutFailFast(t *testing.T) {
+	mr, url := startRedis(t)
+	mr.Close()
+	t.Setenv("BACKEND", "pubsub")
+	t.Setenv("REDIS_URL", url)
+	t.Setenv("BIND_ADDR", freeAddr(t))
+	t.Setenv("STARTUP_TIMEOUT", "200ms")
+	t.Setenv("FAIL_FAST", "true")
+	t.Setenv("CLOSE_TIMEOUT", "200ms")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	err = New(cfg).Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "STARTUP_TIMEOUT") {
+		t.Fatalf("Run = %v, want the STARTUP_TIMEOUT error", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || ctx.Err() != nil {
+		t.Fatalf("Run returned after %v, want it at STARTUP_TIMEOUT", elapsed)
+	}
+}
+
+func TestReadyWithoutStartupTimeout(t *testing.T) {
+	tg := startGateway(t, nil)
+	if code, body := tg.ready(); code != http.StatusOK || !strings.Contains(body, `"status":"ok"`) {
+		t.Fatalf("/ready = %d %s, want 200 ok", code, body)
+	}
+}
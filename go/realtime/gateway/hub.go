@@ -0,0 +1,883 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// shard holds a slice of the connected clients behind its own lock, so
+// registrations and broadcasts on different shards don't contend.
+type shard struct {
+	mu      sync.RWMutex
+	clients map[*client]struct{}
+	// byID indexes clients by ID; it is kept in step with clients under mu.
+	byID map[string]*client
+}
+
+func newShards(n int) []*shard {
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = &shard{
+			clients: make(map[*client]struct{}),
+			byID:    make(map[string]*client),
+		}
+	}
+	return shards
+}
+
+// fanoutPool runs shard visits on a fixed set of goroutines, bounding how
+// many run at once across all broadcasts without starting goroutines per
+// message. A broadcast that finds every worker busy visits the shard itself.
+type fanoutPool struct {
+	jobs chan func()
+}
+
+// newFanoutPool starts workers goroutines that live as long as the process.
+func newFanoutPool(workers int) *fanoutPool {
+	p := &fanoutPool{jobs: make(chan func())}
+	for range workers {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+func (p *fanoutPool) run(job func()) {
+	select {
+	case p.jobs <- job:
+	default:
+		job()
+	}
+}
+
+// hub tracks live connections and broadcasts payloads to all clients.
+type hub struct {
+	// shards partition clients by a hash of their ID; connected counts them.
+	shards    []*shard
+	connected atomic.Int64
+	// fanoutPool walks the shards of a broadcast in parallel; nil walks them
+	// one after another.
+	fanoutPool *fanoutPool
+	// broadcastLimit caps concurrent broadcasts; nil leaves them unbounded.
+	broadcastLimit *broadcastLimiter
+	// broadcasts counts fan-outs, for the stats publisher's rate.
+	broadcasts atomic.Int64
+
+	// ctx is the parent of every client context; cancelling it makes all
+	// pumps exit. Run sets it to its own context.
+	ctx context.Context
+
+	// draining is set during shutdown so no new upgrades are accepted.
+	draining atomic.Bool
+	// reconnectDelay and reconnectJitter set the after_ms hint sent to every
+	// client on shutdown: the delay plus a random share of the jitter.
+	reconnectDelay  time.Duration
+	reconnectJitter time.Duration
+	// closeTimeout bounds how long shutdown waits for a client to answer
+	// its close frame, and for writing the close frame itself.
+	closeTimeout time.Duration
+	// subscribed is true while the backend is receiving from Redis; /ready
+	// reports it.
+	subscribed atomic.Bool
+	// starting is true until the first subscription with STARTUP_TIMEOUT
+	// set; /ws and /ready answer 503 meanwhile.
+	starting atomic.Bool
+	// memGuard, when MEM_SOFT_LIMIT or MEM_HARD_LIMIT is set, watches memory;
+	// memoryPressured is true while either is exceeded, and /ws and /sse
+	// answer 503 meanwhile.
+	memGuard        *memoryGuard
+	memoryPressured atomic.Bool
+
+	// active counts reserved connection slots, including upgrades in
+	// progress, and is capped at maxConnections. full remembers whether the
+	// cap was hit so the transitions are logged once.
+	active         atomic.Int64
+	maxConnections int64
+	full           atomic.Bool
+	// perIP, when set, caps connections per client IP; proxies resolves
+	// that IP behind reverse proxies.
+	perIP   *ipLimiter
+	proxies *proxyTrust
+
+	// pingInterval is how often each connection is pinged; pongTimeout is how
+	// long a connection may stay silent before its read deadline expires.
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	// pingMode picks control-frame pings, application-level ping frames or
+	// both. A client that leaves appPongMisses app pings in a row unanswered
+	// is disconnected.
+	pingMode        string
+	appPingInterval time.Duration
+	appPongMisses   int32
+	// writeTimeout bounds every socket write.
+	writeTimeout time.Duration
+	// Messages of at least streamThreshold bytes are written through
+	// NextWriter in streamChunk pieces rather than with WriteMessage; 0
+	// disables it.
+	streamThreshold int
+	streamChunk     int
+	// warmup paces broadcasts right after startup; nil disables it.
+	warmup *warmup
+	// firehose copies every broadcast to the admin clients that joined
+	// firehoseTopic; nil without ADMIN_TOKEN.
+	firehose *firehose
+	// resume buffers messages for disconnected sessions; nil without
+	// RESUME_WINDOW.
+	resume *resumer
+	// idleTimeout closes clients that exchange no messages for that long;
+	// 0 disables it.
+	idleTimeout time.Duration
+	// maxLifetime, plus a random share of lifetimeJitter picked per client,
+	// is how long a client may stay connected before it is asked to
+	// reconnect; 0 disables it.
+	maxLifetime    time.Duration
+	lifetimeJitter time.Duration
+	// sendBuffer is the number of outbound messages queued per client before
+	// it is considered too slow and dropped.
+	sendBuffer int
+	// flowHigh and flowLow are send queue lengths: reaching flowHigh sends
+	// the client a congested flow frame, draining to flowLow sends ok.
+	// flowHigh 0 disables flow frames.
+	flowHigh int
+	flowLow  int
+	// batchWindow is how long writePump collects text frames for a client
+	// that asked for batching; 0 disables batching.
+	batchWindow time.Duration
+	// messageType is the frame type used for broadcasts unless the topic
+	// settings override it for a topic.
+	messageType int
+	// topics holds the per-topic settings: frame types, the coalesced
+	// topics, on which a client's queued message is replaced by a newer one
+	// instead of queueing behind it, and schemas. ReloadTopics swaps them.
+	topics atomic.Pointer[topicSettings]
+	// retain keeps the last message of each TOPIC_RETAIN topic for new
+	// subscribers; nil retains nothing.
+	retain *retainStore
+	// With validateBroadcasts, backend messages must match their topic's
+	// schema as client publishes always do.
+	validateBroadcasts bool
+	// snapshots sends a topic's current state on subscribe; nil without
+	// SNAPSHOT_URL.
+	snapshots *snapshotSource
+	// compressionLevel is the flate level for outbound frames when
+	// permessage-deflate is enabled on the upgrader.
+	compressionLevel int
+	// Frames shorter than compressionMinSize go out uncompressed; 0
+	// compresses every frame.
+	compressionMinSize int
+	// maxMessageSize caps the size of a single inbound client frame.
+	maxMessageSize int64
+
+	// clientRate and clientBurst configure each client's inbound token
+	// bucket; a client that exceeds it maxRateViolations times in a row is
+	// disconnected. globalLimiter, when set, caps total inbound throughput.
+	clientRate        rate.Limit
+	clientBurst       int
+	maxRateViolations int
+	globalLimiter     *rate.Limiter
+	// acceptLimiter, when set, caps new upgrades per second so reconnect
+	// storms are spread out.
+	acceptLimiter *rate.Limiter
+	// rejectCodes maps the refusal reasons answered with a close frame
+	// instead of an HTTP status to their close code; nil with
+	// REJECT_WITH_CLOSE off, unless duplicate IDs are rejected, which is
+	// always done with closeDuplicateID.
+	rejectCodes map[string]int
+	// rejectDuplicates refuses a connection whose client_id is already
+	// connected instead of replacing the older one.
+	rejectDuplicates bool
+	// maxProtocolErrors is how many malformed control messages in a row a
+	// client may send before it is disconnected; 0 never disconnects.
+	maxProtocolErrors int
+
+	// stream is set when BACKEND=stream and enables replay on connect.
+	stream *streamBackend
+
+	// presence publishes topic membership changes; nil disables it.
+	presence *presenceTracker
+	// users indexes clients by user ID for to_user messages; userClaim is
+	// the JWT claim the ID is taken from.
+	users     *userIndex
+	userClaim string
+
+	// events publishes connect/disconnect events; nil disables them.
+	events *eventPublisher
+	// onOverflow is Config.OnOverflow; nil only logs.
+	onOverflow OverflowHandler
+	// receipts publishes delivery receipts; nil without RECEIPTS_CHANNEL.
+	receipts *receiptPublisher
+
+	// auth validates upgrade requests with JWT_SECRET or AUTH_URL; nil
+	// disables authentication.
+	auth authenticator
+	// topicAuth decides which topics each client may subscribe to; nil
+	// allows every topic.
+	topicAuth *topicAuthorizer
+
+	// rdb receives client publishes, restricted to channels starting with
+	// publishPrefix. Publishing is disabled when rdb is nil.
+	rdb           *redis.Client
+	publishPrefix string
+	// topicPrefix is the Redis channel prefix for topics; tenant publishes
+	// are confined to it.
+	topicPrefix string
+	// tenants resolves each connection's tenant; nil disables tenant
+	// routing.
+	tenants *tenantResolver
+	// tags captures connection metadata on upgrade; nil disables tagging.
+	tags *tagSpec
+	// transformer rewrites or drops broadcasts before fan-out; nil
+	// delivers them unchanged.
+	transformer Transformer
+	// tracer receives a span per broadcast; nil disables tracing.
+	tracer Tracer
+	// maxSubscriptions caps each client's topics and patterns together; 0
+	// is unlimited.
+	maxSubscriptions int
+	// maxPatterns caps each client's pattern subscriptions; 0 disables
+	// them.
+	maxPatterns int
+	// diag answers /diag round trips; nil without ADMIN_TOKEN or Redis.
+	diag *diagProbe
+	// msgLog records every broadcast to MESSAGE_LOG_PATH; nil disables it.
+	msgLog *messageLog
+	// upgrader performs the WebSocket handshakes for serveWS.
+	upgrader websocket.Upgrader
+
+	// sequencer, when set, numbers client publishes per channel.
+	sequencer *sequencer
+
+	// ackWindow is how many messages an ack-mode client may leave
+	// unacknowledged, and ackTimeout how long any one of them may wait. With
+	// the stream backend the oldest unacked entry is kept at
+	// ackKeyPrefix+<client id> for ackStateTTL so a reconnect resumes from it.
+	ackWindow    int
+	ackTimeout   time.Duration
+	ackKeyPrefix string
+	ackStateTTL  time.Duration
+	// cursors, when set, saves every client_id's stream position so a
+	// reconnect catches up from it.
+	cursors *cursorStore
+}
+
+func newHub() *hub {
+	return &hub{
+		// Allow cross-origin WS connections by default; New narrows this to
+		// ALLOWED_ORIGINS when it is set.
+		upgrader: websocket.Upgrader{
+			CheckOrigin:  func(r *http.Request) bool { return true },
+			Subprotocols: subprotocols,
+			Error:        upgradeError,
+		},
+		ctx:            context.Background(),
+		shards:         newShards(runtime.NumCPU()),
+		users:          newUserIndex(),
+		pingInterval:   30 * time.Second,
+		pongTimeout:    60 * time.Second,
+		pingMode:       pingModeControl,
+		writeTimeout:   10 * time.Second,
+		maxConnections: 1 << 62,
+		sendBuffer:     256,
+		messageType:    websocket.TextMessage,
+		maxMessageSize: 512 << 10,
+
+		clientRate:        10,
+		clientBurst:       20,
+		maxRateViolations: 10,
+		maxProtocolErrors: 5,
+
+		ackWindow:   100,
+		ackTimeout:  30 * time.Second,
+		ackStateTTL: time.Hour,
+	}
+}
+
+// noTopicSettings stands in until New stores the configured ones.
+var noTopicSettings = &topicSettings{}
+
+// topicConfig returns the per-topic settings in effect.
+func (h *hub) topicConfig() *topicSettings {
+	if s := h.topics.Load(); s != nil {
+		return s
+	}
+	return noTopicSettings
+}
+
+// shardFor returns the shard that holds the client with the given ID.
+func (h *hub) shardFor(id string) *shard {
+	f := fnv.New32a()
+	f.Write([]byte(id))
+	return h.shards[f.Sum32()%uint32(len(h.shards))]
+}
+
+// closeDuplicateID closes a connection that lost its client_id to another:
+// the newer one under DUPLICATE_ID_POLICY=reject, the older under replace.
+const closeDuplicateID = 4009
+
+// add registers c. When another connection already holds c's ID, checked
+// and claimed under the shard lock so concurrent connects cannot both win,
+// DUPLICATE_ID_POLICY decides: with reject add reports false and c is not
+// registered, with replace the other connection is closed.
+func (h *hub) add(c *client) bool {
+	s := h.shardFor(c.id)
+	s.mu.Lock()
+	old := s.byID[c.id]
+	if old != nil && h.rejectDuplicates {
+		s.mu.Unlock()
+		return false
+	}
+	s.clients[c] = struct{}{}
+	s.byID[c.id] = c
+	if c.userID != "" {
+		h.users.add(c)
+	}
+	n := h.connected.Add(1)
+	connectedClients.Set(float64(n))
+	c.logger.Debug("ws client added", "clients", n)
+	// The connect event and presence joins go out after the shard is
+	// unlocked, but before a removal can send their counterparts.
+	c.lifecycleMu.Lock()
+	s.mu.Unlock()
+	h.announce(c, "connect", "")
+	c.lifecycleMu.Unlock()
+	if old != nil {
+		// remove leaves byID alone now that it points at c.
+		old.logger.Info("ws client replaced by a new connection with its client_id")
+		old.sendClose(closeDuplicateID, "replaced by a newer connection", disconnectReplaced, time.Second)
+		h.removeWithReason(old, disconnectReplaced)
+	}
+	return true
+}
+
+// count returns the number of connected clients.
+func (h *hub) count() int {
+	return int(h.connected.Load())
+}
+
+// drain makes /ws refuse new upgrades from now on, for Drain and shutdown.
+// It reports false when the hub was already draining.
+func (h *hub) drain() bool {
+	gatewayDraining.Set(1)
+	return !h.draining.Swap(true)
+}
+
+// get returns the connected client with the given ID.
+func (h *hub) get(id string) (*client, bool) {
+	s := h.shardFor(id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.byID[id]
+	return c, ok
+}
+
+// snapshot returns the clients connected right now.
+func (h *hub) snapshot() []*client {
+	clients := make([]*client, 0, h.count())
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for c := range s.clients {
+			clients = append(clients, c)
+		}
+		s.mu.RUnlock()
+	}
+	return clients
+}
+
+// each calls fn for every client. Each shard's clients are copied out under
+// its read lock and delivered to once it is released, so a large fan-out
+// doesn't hold up connects and disconnects; the lock is only taken again
+// around each call, through ifRegistered. With a fanout pool the shards are
+// walked concurrently; fn must only touch the client it is given.
+func (h *hub) each(fn func(c *client)) {
+	visit := func(s *shard) {
+		s.mu.RLock()
+		clients := make([]*client, 0, len(s.clients))
+		for c := range s.clients {
+			clients = append(clients, c)
+		}
+		s.mu.RUnlock()
+		for _, c := range clients {
+			h.ifRegistered(c, fn)
+		}
+	}
+	if len(h.shards) == 1 || h.fanoutPool == nil {
+		for _, s := range h.shards {
+			visit(s)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, s := range h.shards {
+		wg.Add(1)
+		h.fanoutPool.run(func() {
+			defer wg.Done()
+			visit(s)
+		})
+	}
+	wg.Wait()
+}
+
+// ifRegistered calls fn with c under its shard's read lock, which push needs
+// to keep the send channel open, unless c has left since it was looked up.
+func (h *hub) ifRegistered(c *client, fn func(c *client)) {
+	s := h.shardFor(c.id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.clients[c]; ok {
+		fn(c)
+	}
+}
+
+// Why a client was removed, as logged, counted in realtime_disconnects_total
+// and sent with disconnect lifecycle events. A close the gateway starts names
+// its reason up front; otherwise the first removal of a client does, which is
+// the pump that noticed first when both exit.
+const (
+	disconnectClientClose     = "client_close"
+	disconnectReadError       = "read_error"
+	disconnectWriteError      = "write_error"
+	disconnectPingTimeout     = "ping_timeout"
+	disconnectIdleTimeout     = "idle_timeout"
+	disconnectMaxLifetime     = "max_lifetime"
+	disconnectSlowConsumer    = "slow_consumer"
+	disconnectPolicyViolation = "policy_violation"
+	disconnectAdminKick       = "admin_kick"
+	disconnectReplaced        = "replaced"
+	disconnectShutdown        = "shutdown"
+	disconnectMemoryPressure  = "memory_pressure"
+	disconnectUnknown         = "unknown"
+)
+
+var disconnectReasons = []string{
+	disconnectClientClose, disconnectReadError, disconnectWriteError, disconnectPingTimeout,
+	disconnectIdleTimeout, disconnectMaxLifetime, disconnectSlowConsumer, disconnectPolicyViolation, disconnectAdminKick,
+	disconnectReplaced, disconnectShutdown, disconnectMemoryPressure, disconnectUnknown,
+}
+
+// remove is removeWithReason for callers that don't know why the client
+// has to go.
+func (h *hub) remove(c *client) {
+	h.removeWithReason(c, disconnectUnknown)
+}
+
+// removeWithReason unregisters c, closes its send channel and cancels its
+// context, which tells both pumps to exit, then closes its socket. It is safe
+// to call more than once for the same client; the first call's reason is
+// recorded, or the reason the gateway gave when it started closing the
+// connection.
+func (h *hub) removeWithReason(c *client, reason string) {
+	h.closeRemoved(c, h.unregister(c, reason))
+}
+
+// unregister is the first half of removeWithReason: it takes c out of the hub
+// and releases everything held for it apart from the socket. It reports
+// whether c was still registered.
+func (h *hub) unregister(c *client, reason string) bool {
+	if r := c.closing.Load(); r != nil {
+		reason = *r
+	}
+	s := h.shardFor(c.id)
+	s.mu.Lock()
+	_, ok := s.clients[c]
+	if ok {
+		delete(s.clients, c)
+		if s.byID[c.id] == c {
+			delete(s.byID, c.id)
+		}
+		close(c.send)
+		c.cancel()
+		n := h.connected.Add(-1)
+		connectedClients.Set(float64(n))
+		connectionAge.Observe(time.Since(c.connectedAt).Seconds())
+		sendQueueMaxDepth.Observe(float64(c.maxQueueDepth.Load()))
+		disconnects.WithLabelValues(reason).Inc()
+		h.release()
+		if h.perIP != nil {
+			h.perIP.release(c.ip)
+		}
+		if h.firehose != nil {
+			h.firehose.leave(c)
+		}
+		if c.userID != "" {
+			h.users.remove(c)
+		}
+		c.logger.Debug("ws client removed", "reason", reason, "clients", n, "connected_for", time.Since(c.connectedAt).Round(time.Millisecond),
+			"messages_received", c.messagesIn.Load(), "bytes_received", c.bytesIn.Load(), "bytes_sent", c.bytesSent.Load(),
+			"max_queue_depth", c.maxQueueDepth.Load(), "overflows", c.overflows.Load())
+	}
+	s.mu.Unlock()
+	if ok {
+		c.lifecycleMu.Lock()
+		h.announce(c, "disconnect", reason)
+		c.lifecycleMu.Unlock()
+	}
+	return ok
+}
+
+// closeRemoved is the second half of removeWithReason: it closes c's socket
+// and, when removed is set, saves what a reconnect resumes from.
+func (h *hub) closeRemoved(c *client, removed bool) {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	if !removed {
+		return
+	}
+	if c.session != "" {
+		h.resume.detach(c)
+	}
+	if c.acks != nil && c.acks.key != "" {
+		h.saveAckCursor(c)
+	}
+	if c.cursorKey != "" {
+		h.saveCursor(c)
+	}
+}
+
+// announce emits c's lifecycle event and joins or leaves the presence of
+// each of its topics. The caller holds c.lifecycleMu so a connection's
+// connect and disconnect go out in order.
+func (h *hub) announce(c *client, event, reason string) {
+	if h.events != nil {
+		h.events.emit(event, c, reason)
+	}
+	if h.presence == nil {
+		return
+	}
+	for _, t := range c.topicList() {
+		if event == "connect" {
+			h.presence.join(t, c.id)
+		} else {
+			h.presence.leave(t, c.id)
+		}
+	}
+}
+
+// acquire reserves a connection slot, failing once maxConnections slots are
+// in use.
+func (h *hub) acquire() bool {
+	for {
+		n := h.active.Load()
+		if n >= h.maxConnections {
+			if h.full.CompareAndSwap(false, true) {
+				slog.Warn("connection limit reached; rejecting new upgrades", "limit", h.maxConnections)
+			}
+			return false
+		}
+		if h.active.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release frees a slot taken by acquire.
+func (h *hub) release() {
+	if h.active.Add(-1) < h.maxConnections && h.full.CompareAndSwap(true, false) {
+		slog.Info("connection capacity available again", "limit", h.maxConnections)
+	}
+}
+
+// reconnectAfter picks the delay a client is told to wait before
+// reconnecting.
+func (h *hub) reconnectAfter() time.Duration {
+	d := h.reconnectDelay
+	if h.reconnectJitter > 0 {
+		d += rand.N(h.reconnectJitter)
+	}
+	return d
+}
+
+// lifetime picks how long a new client may stay connected.
+func (h *hub) lifetime() time.Duration {
+	d := h.maxLifetime
+	if h.lifetimeJitter > 0 {
+		d += rand.N(h.lifetimeJitter)
+	}
+	return d
+}
+
+// awaitClients waits up to timeout for every client to disconnect, logging
+// how many are left every second.
+func (h *hub) awaitClients(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	report := time.Now().Add(time.Second)
+	for h.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		if now := time.Now(); now.After(report) && now.Before(deadline) {
+			slog.Info("waiting for clients to disconnect", "clients", h.count(), "remaining", deadline.Sub(now).Round(time.Second))
+			report = report.Add(time.Second)
+		}
+	}
+}
+
+// reportDrain logs how many clients are still connected every second of a
+// drain, until the last one leaves or shutdown starts.
+func (h *hub) reportDrain() {
+	ctx := h.ctx
+	start := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n := h.count()
+		if n == 0 {
+			slog.Info("draining: every client has disconnected", "after", time.Since(start).Round(time.Second))
+			return
+		}
+		slog.Info("draining", "clients", n, "elapsed", time.Since(start).Round(time.Second))
+	}
+}
+
+// closeAll sends every client a close frame with code and reason, then
+// removes it for shutdown. It returns how many clients it closed. The clients
+// are closed concurrently, so a peer that stopped reading holds up shutdown
+// by CLOSE_TIMEOUT at most rather than once per stuck client.
+func (h *hub) closeAll(code int, reason string) int {
+	clients := h.snapshot()
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.sendClose(code, reason, disconnectShutdown, h.closeTimeout)
+			h.removeWithReason(c, disconnectShutdown)
+		}()
+	}
+	wg.Wait()
+	return len(clients)
+}
+
+// broadcast queues message on every client's send channel. The writePumps do
+// the actual socket writes, so a slow peer never blocks the others. A message
+// wrapped in an audience envelope only reaches clients whose claims match.
+func (h *hub) broadcast(messageType int, message []byte) {
+	if !h.beginBroadcast("") {
+		return
+	}
+	defer h.endBroadcast()
+	h.countBroadcast()
+	start := time.Now()
+	filter, message := parseEnvelope(message, "")
+	span := h.startSpan(filter, "")
+	message, ok := h.transform("", message)
+	if !ok {
+		span.End(0)
+		return
+	}
+	slog.Debug("broadcast", "bytes", len(message), "filtered", filter != nil)
+	var recipients atomic.Int64
+	h.fanout(func(c *client) {
+		if filter.matches(c) {
+			end := span.StartWrite(c.id)
+			h.push(c, c.ackable(messageType, "", "", message))
+			end()
+			recipients.Add(1)
+		}
+	})
+	if h.resume != nil {
+		h.resume.buffer(filter.matches, messageType, "", message)
+	}
+	observeBroadcast(start, recipients.Load())
+	span.End(int(recipients.Load()))
+	h.sendReceipt(filter, "", "", recipients.Load())
+	h.firehoseCopy("", messageType, message)
+	if h.msgLog != nil {
+		h.msgLog.record("", filter.messageID(), message, recipients.Load())
+	}
+}
+
+// broadcastTopic queues message for the clients subscribed to topic and
+// returns how many it was queued for.
+func (h *hub) broadcastTopic(topic string, messageType int, message []byte) int64 {
+	if !h.beginBroadcast(topic) {
+		return 0
+	}
+	defer h.endBroadcast()
+	h.countBroadcast()
+	start := time.Now()
+	filter, message := parseEnvelope(message, "")
+	span := h.startSpan(filter, topic)
+	if !h.validBroadcast(topic, message) {
+		span.End(0)
+		return 0
+	}
+	message, ok := h.transform(topic, message)
+	if !ok {
+		span.End(0)
+		return 0
+	}
+	slog.Debug("broadcast", "topic", topic, "bytes", len(message), "filtered", filter != nil)
+	// Presence changes are system messages and take the priority lane.
+	system := bytes.HasPrefix(message, presencePrefix)
+	if r := h.retain.get(topic); r != nil && !system {
+		// Holding r through the fan-out keeps a client that subscribes
+		// meanwhile from getting this message both retained and live.
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.set(messageType, message, filter)
+	}
+	coalesce, _ := topicSetting(h.topicConfig().coalesce, topic)
+	var recipients atomic.Int64
+	h.fanout(func(c *client) {
+		if c.subscribed(topic) && filter.matches(c) {
+			end := span.StartWrite(c.id)
+			// Ack-mode clients are promised every message, so they are
+			// never coalesced.
+			if system {
+				h.pushPriority(c, c.ackable(messageType, topic, "", message))
+			} else if coalesce && c.acks == nil {
+				if f := (frame{messageType: messageType, data: message, payload: true}); !h.holdBack(c, topic, f) {
+					h.pushLatest(c, topic, f)
+				}
+			} else if f := c.ackable(messageType, topic, "", message); !h.holdBack(c, topic, f) {
+				h.push(c, f)
+			}
+			end()
+			recipients.Add(1)
+		}
+	})
+	if h.resume != nil {
+		h.resume.buffer(func(c *client) bool { return c.subscribed(topic) && filter.matches(c) }, messageType, topic, message)
+	}
+	observeBroadcast(start, recipients.Load())
+	span.End(int(recipients.Load()))
+	h.sendReceipt(filter, topic, "", recipients.Load())
+	h.firehoseCopy(topic, messageType, message)
+	if h.msgLog != nil {
+		h.msgLog.record(topic, filter.messageID(), message, recipients.Load())
+	}
+	return recipients.Load()
+}
+
+// sendTo queues message for the client with the given ID and reports
+// whether that client is connected to this instance.
+func (h *hub) sendTo(id string, messageType int, message []byte) bool {
+	s := h.shardFor(id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.byID[id]
+	if !ok {
+		return false
+	}
+	messagesDirect.Inc()
+	h.push(c, frame{messageType: messageType, data: message, payload: true})
+	return true
+}
+
+// deliverDirect routes a directMessage payload from Redis. Every instance
+// sees every direct message and ignores those for clients it doesn't hold.
+func (h *hub) deliverDirect(payload []byte) {
+	var msg directMessage
+	if err := json.Unmarshal(payload, &msg); err != nil || (msg.To == "" && msg.ToUser == "") {
+		slog.Warn("invalid direct message", "err", err)
+		return
+	}
+	if msg.To == "" {
+		if h.sendToUser(msg.ToUser, h.typeFor(""), msg.Data) == 0 {
+			slog.Debug("direct message for user not on this instance", "user", msg.ToUser)
+		}
+		return
+	}
+	if !h.sendTo(msg.To, h.typeFor(""), msg.Data) {
+		slog.Debug("direct message for client not on this instance", "client", msg.To)
+	}
+}
+
+// typeFor returns the frame type broadcasts on topic are sent with; the
+// untopiced broadcast channel uses topic "".
+func (h *hub) typeFor(topic string) int {
+	if t, ok := topicSetting(h.topicConfig().types, topic); ok {
+		return t
+	}
+	return h.messageType
+}
+
+// enqueue queues a text control message on a single client's priority lane
+// if it is still registered.
+func (h *hub) enqueue(c *client, message []byte) {
+	s := h.shardFor(c.id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.clients[c]; ok {
+		h.pushPriority(c, frame{messageType: websocket.TextMessage, data: message})
+	}
+}
+
+// push does a non-blocking send onto c.send; a client whose buffer is already
+// full is dropped instead of stalling the caller. The caller must hold the
+// client's shard lock so the channel cannot be closed concurrently.
+func (h *hub) push(c *client, f frame) {
+	select {
+	case c.send <- f:
+		depth := len(c.send)
+		sendQueueDepth.Observe(float64(depth))
+		c.noteDepth(depth)
+	default:
+		h.overflow(c, laneSend, len(c.send), cap(c.send))
+	}
+}
+
+// pushPriority is push for the priority lane. It is small, so a client that
+// lets it overflow is dropped as well.
+func (h *hub) pushPriority(c *client, f frame) {
+	select {
+	case c.priority <- f:
+	default:
+		h.overflow(c, lanePriority, len(c.priority), cap(c.priority))
+	}
+}
+
+// subscribe adds topic to c, failing once c holds maxSubscriptions topics
+// and patterns together.
+func (h *hub) subscribe(c *client, topic string) error {
+	c.mu.Lock()
+	_, had := c.topics[topic]
+	if !had && h.subscriptionsFull(c) {
+		c.mu.Unlock()
+		subscriptionsRejected.Inc()
+		return fmt.Errorf("at most %d subscriptions per connection", h.maxSubscriptions)
+	}
+	c.topics[topic] = struct{}{}
+	c.mu.Unlock()
+	if !had && h.presence != nil {
+		h.presence.join(topic, c.id)
+	}
+	return nil
+}
+
+// subscriptionsFull reports whether c can't take another topic or pattern.
+// The caller must hold c.mu.
+func (h *hub) subscriptionsFull(c *client) bool {
+	return h.maxSubscriptions > 0 && len(c.topics)+len(c.patterns) >= h.maxSubscriptions
+}
+
+func (h *hub) unsubscribe(c *client, topic string) {
+	c.mu.Lock()
+	_, had := c.topics[topic]
+	delete(c.topics, topic)
+	c.mu.Unlock()
+	if had && h.presence != nil {
+		h.presence.leave(topic, c.id)
+	}
+}
@@ -0,0 +1,431 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestHub returns the hub of a gateway configured by env on the memory
+// backend, without running it.
+func newTestHub(t testing.TB, env map[string]string) *hub {
+	t.Helper()
+	t.Setenv("BACKEND", "memory")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(cfg).hub
+}
+
+// testClient returns an unconnected client whose queue holds n frames.
+func testClient(id string, n int) *client {
+	return newClient(context.Background(), id, "test", nil, n)
+}
+
+// assertEmpty fails the test unless every shard is empty in both indexes.
+func assertEmpty(t *testing.T, h *hub) {
+	t.Helper()
+	for i, s := range h.shards {
+		s.mu.RLock()
+		clients, ids := len(s.clients), len(s.byID)
+		s.mu.RUnlock()
+		if clients != 0 || ids != 0 {
+			t.Fatalf("shard %d holds %d clients and %d IDs after every client left", i, clients, ids)
+		}
+	}
+	if n := h.count(); n != 0 {
+		t.Fatalf("count = %d, want 0", n)
+	}
+}
+
+func TestHubGet(t *testing.T) {
+	h := newTestHub(t, nil)
+	c := testClient("c1", 1)
+	if _, ok := h.get("c1"); ok {
+		t.Fatal("get found a client before add")
+	}
+	h.add(c)
+	if got, ok := h.get("c1"); !ok || got != c {
+		t.Fatalf("get = %v, %v; want the added client", got, ok)
+	}
+	h.remove(c)
+	if _, ok := h.get("c1"); ok {
+		t.Fatal("get found the client after remove")
+	}
+	assertEmpty(t, h)
+}
+
+func TestHubReplaceKeepsNewerID(t *testing.T) {
+	h := newTestHub(t, map[string]string{"DUPLICATE_ID_POLICY": "replace"})
+	old, c := testClient("c1", 1), testClient("c1", 1)
+	h.add(old)
+	h.add(c)
+	if got, _ := h.get("c1"); got != c {
+		t.Fatal("get returned the replaced connection")
+	}
+	select {
+	case <-old.ctx.Done():
+	default:
+		t.Fatal("replaced connection was not removed")
+	}
+	// Removing the old connection again must not unindex the new one.
+	h.remove(old)
+	if got, _ := h.get("c1"); got != c {
+		t.Fatal("removing the replaced connection dropped its successor")
+	}
+	h.remove(c)
+	assertEmpty(t, h)
+}
+
+func TestHubRejectDuplicate(t *testing.T) {
+	h := newTestHub(t, map[string]string{"DUPLICATE_ID_POLICY": "reject"})
+	first := testClient("c1", 1)
+	if !h.add(first) {
+		t.Fatal("first add rejected")
+	}
+	if h.add(testClient("c1", 1)) {
+		t.Fatal("duplicate ID accepted under DUPLICATE_ID_POLICY=reject")
+	}
+	if got, _ := h.get("c1"); got != first {
+		t.Fatal("get no longer returns the first connection")
+	}
+	h.remove(first)
+	assertEmpty(t, h)
+}
+
+// TestHubConcurrentAddRemove races connects, lookups, broadcasts and
+// disconnects, with IDs shared across goroutines so replacements happen too.
+// Run with -race.
+func TestHubConcurrentAddRemove(t *testing.T) {
+	h := newTestHub(t, map[string]string{"SHARD_COUNT": "4"})
+	const workers, perWorker = 8, 200
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				id := fmt.Sprintf("c%d", (w*perWorker+i)%(perWorker*workers/2))
+				c := testClient(id, 4)
+				h.add(c)
+				if got, ok := h.get(id); ok && got.id != id {
+					t.Errorf("get(%s) returned client %s", id, got.id)
+				}
+				if i%10 == 0 {
+					h.broadcast(1, []byte("x"))
+				}
+				h.remove(c)
+			}
+		}()
+	}
+	wg.Wait()
+	assertEmpty(t, h)
+}
+
+// BenchmarkUpgradeWriteBufferPool measures what a connection costs to
+// accept and greet with and without WRITE_BUFFER_POOL. Without the pool each
+// connection allocates its own WRITE_BUFFER_SIZE buffer; with it, buffers
+// return to the pool between writes and are shared, which B/op shows.
+func BenchmarkUpgradeWriteBufferPool(b *testing.B) {
+	for _, pool := range []string{"false", "true"} {
+		b.Run("pool="+pool, func(b *testing.B) {
+			tg := startGateway(b, map[string]string{"WRITE_BUFFER_SIZE": "16384", "WRITE_BUFFER_POOL": pool})
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				conn, _, err := tg.tryDial("/ws", nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				readFrame(b, conn)
+				conn.Close()
+			}
+		})
+	}
+}
+
+// BenchmarkBroadcastSharding compares broadcast latency across 50k clients
+// in a single shard and in 16, on an idle hub and while other connections
+// come and go; connects/op is how many of those got through per broadcast.
+// It times the fan-out onto the send queues, not the writes, and sharding
+// only pays off with several CPUs to walk the shards on.
+func BenchmarkBroadcastSharding(b *testing.B) {
+	const clients = 50000
+	msg := []byte(`{"price":101.5}`)
+	for _, shards := range []int{1, 16} {
+		for _, churn := range []bool{false, true} {
+			b.Run(fmt.Sprintf("shards=%d/churn=%v", shards, churn), func(b *testing.B) {
+				h := newTestHub(b, map[string]string{
+					"SHARD_COUNT":    strconv.Itoa(shards),
+					"FANOUT_WORKERS": strconv.Itoa(runtime.NumCPU()),
+				})
+				all := make([]*client, clients)
+				for i := range all {
+					all[i] = testClient("c"+strconv.Itoa(i), 1)
+					h.add(all[i])
+				}
+				var stop atomic.Bool
+				var connects atomic.Int64
+				var wg sync.WaitGroup
+				if churn {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; !stop.Load(); i++ {
+							c := testClient("churn"+strconv.Itoa(i), 16)
+							h.add(c)
+							h.remove(c)
+							connects.Add(1)
+						}
+					}()
+				}
+				b.ResetTimer()
+				for range b.N {
+					h.broadcast(websocket.TextMessage, msg)
+					b.StopTimer()
+					for _, c := range all {
+						<-c.send
+					}
+					b.StartTimer()
+				}
+				b.StopTimer()
+				stop.Store(true)
+				wg.Wait()
+				if churn {
+					b.ReportMetric(float64(connects.Load())/float64(b.N), "connects/op")
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkFanoutWorkers compares walking 16 shards one after another
+// (FANOUT_WORKERS=1) with walking them on a pool of 8 workers, at rising
+// client counts, for one broadcaster and for four at once. The pool only
+// shortens a broadcast given spare CPUs; goroutines/op stays at zero either
+// way, as the workers are started with the hub and no broadcast leaves any
+// behind.
+func BenchmarkFanoutWorkers(b *testing.B) {
+	msg := []byte(`{"price":101.5}`)
+	for _, clients := range []int{1000, 10000, 50000} {
+		for _, workers := range []int{1, 8} {
+			for _, broadcasters := range []int{1, 4} {
+				b.Run(fmt.Sprintf("clients=%d/workers=%d/broadcasters=%d", clients, workers, broadcasters), func(b *testing.B) {
+					h := newTestHub(b, map[string]string{
+						"SHARD_COUNT":    "16",
+						"FANOUT_WORKERS": strconv.Itoa(workers),
+					})
+					all := make([]*client, clients)
+					for i := range all {
+						// Room for every broadcaster's copy.
+						all[i] = testClient("c"+strconv.Itoa(i), broadcasters)
+						h.add(all[i])
+					}
+					goroutines := runtime.NumGoroutine()
+					b.ReportAllocs()
+					b.ResetTimer()
+					for range b.N {
+						var wg sync.WaitGroup
+						for range broadcasters {
+							wg.Add(1)
+							go func() {
+								defer wg.Done()
+								h.broadcast(websocket.TextMessage, msg)
+							}()
+						}
+						wg.Wait()
+						b.StopTimer()
+						for _, c := range all {
+							for range broadcasters {
+								<-c.send
+							}
+						}
+						b.StartTimer()
+					}
+					b.StopTimer()
+					b.ReportMetric(float64(runtime.NumGoroutine()-goroutines)/float64(b.N), "goroutines/op")
+				})
+			}
+		}
+	}
+}
+
+// countMessages returns how many broadcasts a frame carries: those in a
+// batch frame, or one.
+func countMessages(data []byte) int {
+	var batch batchMessage
+	if json.Unmarshal(data, &batch) == nil && batch.Type == "batch" {
+		return len(batch.Messages)
+	}
+	return 1
+}
+
+// BenchmarkBatching sends bursts of 100 small broadcasts to one client with
+// and without ?batch=1 under BATCH_WINDOW=1ms. Each frame is a socket write
+// on the gateway, so frames/op is the write syscalls a burst costs; ns/op
+// includes the window a batch waits out.
+func BenchmarkBatching(b *testing.B) {
+	const burst = 100
+	msg := []byte(`{"price":101.5,"qty":3}`)
+	for _, batch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batch=%v", batch), func(b *testing.B) {
+			tg := startGateway(b, map[string]string{"BATCH_WINDOW": "1ms", "SEND_BUFFER": "4096"})
+			path := "/ws"
+			if batch {
+				path += "?batch=1"
+			}
+			conn, _ := tg.connect(path, nil)
+			frames := 0
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				for range burst {
+					tg.hub.broadcast(websocket.TextMessage, msg)
+				}
+				for got := 0; got < burst; frames++ {
+					_, data := readFrame(b, conn)
+					got += countMessages(data)
+				}
+			}
+			b.ReportMetric(float64(frames)/float64(b.N), "frames/op")
+		})
+	}
+}
+
+// heapPeak samples the live heap until stop is closed and then sends the
+// largest value it saw.
+func heapPeak(stop <-chan struct{}) <-chan uint64 {
+	peak := make(chan uint64, 1)
+	go func() {
+		sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		var max uint64
+		t := time.NewTicker(time.Millisecond)
+		defer t.Stop()
+		for {
+			metrics.Read(sample)
+			if v := sample[0].Value.Uint64(); v > max {
+				max = v
+			}
+			select {
+			case <-stop:
+				peak <- max
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return peak
+}
+
+// BenchmarkLargeMessageWrites broadcasts a 5MB document to 20 clients, with
+// and without compression, writing it in one call and streaming it past
+// STREAM_WRITE_THRESHOLD. B/op covers both ends of the sockets; peak-MB is
+// the largest live heap seen during the run. gorilla/websocket's
+// WriteMessage already feeds the compressor in pieces, so the two paths
+// come out close.
+func BenchmarkLargeMessageWrites(b *testing.B) {
+	const clients = 20
+	// Compressible but not trivially so, like a JSON document.
+	var doc bytes.Buffer
+	for i := 0; doc.Len() < 5<<20; i++ {
+		fmt.Fprintf(&doc, `{"id":%d,"name":"item-%d","price":%d.%02d},`, i, i*7919%100003, i%997, i%100)
+	}
+	msg := doc.Bytes()
+	for _, tc := range []struct{ compression, threshold string }{
+		{"false", "0"}, {"false", "1048576"}, {"true", "0"}, {"true", "1048576"},
+	} {
+		b.Run("compression="+tc.compression+"/stream_threshold="+tc.threshold, func(b *testing.B) {
+			tg := startGateway(b, map[string]string{
+				"ENABLE_COMPRESSION":     tc.compression,
+				"COMPRESSION_MIN_SIZE":   "0",
+				"STREAM_WRITE_THRESHOLD": tc.threshold,
+				"MAX_BROADCAST_SIZE":     "0",
+			})
+			dialer := websocket.Dialer{EnableCompression: true}
+			var received sync.WaitGroup
+			for range clients {
+				conn, _, err := dialer.Dial("ws://"+tg.addr+"/ws", nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer conn.Close()
+				readFrame(b, conn)
+				// Compressing the document for every client takes longer
+				// than readFrame's deadline.
+				conn.SetReadDeadline(time.Time{})
+				go func() {
+					for {
+						_, r, err := conn.NextReader()
+						if err != nil {
+							return
+						}
+						io.Copy(io.Discard, r)
+						received.Done()
+					}
+				}()
+			}
+			runtime.GC()
+			stop := make(chan struct{})
+			peak := heapPeak(stop)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				received.Add(clients)
+				tg.hub.broadcast(websocket.TextMessage, msg)
+				received.Wait()
+			}
+			b.StopTimer()
+			close(stop)
+			b.ReportMetric(float64(<-peak)/(1<<20), "peak-MB")
+		})
+	}
+}
+
+func TestEachReleasesShardLock(t *testing.T) {
+	h := newTestHub(t, map[string]string{"SHARD_COUNT": "1", "FANOUT_WORKERS": "1"})
+	for i := range 5 {
+		h.add(testClient("c"+strconv.Itoa(i), 1))
+	}
+	started := make(chan struct{})
+	var visited atomic.Int64
+	var sawLate atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.each(func(c *client) {
+			if visited.Add(1) == 1 {
+				close(started)
+			}
+			sawLate.CompareAndSwap(false, c.id == "late")
+			time.Sleep(30 * time.Millisecond)
+		})
+	}()
+	<-started
+	// A connect on the shard only waits for the client being delivered to,
+	// not the rest of the walk.
+	begin := time.Now()
+	h.add(testClient("late", 1))
+	if elapsed := time.Since(begin); elapsed > 60*time.Millisecond {
+		t.Fatalf("connect waited %v for the broadcast", elapsed)
+	}
+	<-done
+	// The walk works from the clients there when it began.
+	if sawLate.Load() {
+		t.Fatal("fn called for a client that joined after the walk began")
+	}
+}
@@ -0,0 +1,38 @@
+package gateway
+
+import "sync"
+
+// ipLimiter caps concurrent connections per client IP. Entries are deleted
+// when their count drops to zero, so the map only holds connected IPs.
+type ipLimiter struct {
+	limit int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newIPLimiter(limit int) *ipLimiter {
+	return &ipLimiter{limit: limit, counts: make(map[string]int)}
+}
+
+// acquire takes a connection slot for ip, failing once limit are in use.
+func (l *ipLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[ip] >= l.limit {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+// release frees a slot taken by acquire.
+func (l *ipLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[ip] <= 1 {
+		delete(l.counts, ip)
+		return
+	}
+	l.counts[ip]--
+}
@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIPLimiter(t *testing.T) {
+	l := newIPLimiter(2)
+	if !l.acquire("10.0.0.1") || !l.acquire("10.0.0.1") {
+		t.Fatal("acquire failed under the limit")
+	}
+	if l.acquire("10.0.0.1") {
+		t.Fatal("acquire succeeded over the limit")
+	}
+	if !l.acquire("10.0.0.2") {
+		t.Fatal("another IP was refused")
+	}
+	l.release("10.0.0.1")
+	if !l.acquire("10.0.0.1") {
+		t.Fatal("acquire failed after a release")
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		l.release(ip)
+	}
+	if len(l.counts) != 0 {
+		t.Fatalf("counts = %v after every connection left, want none", l.counts)
+	}
+}
+
+func TestMaxConnPerIP(t *testing.T) {
+	tg := startGateway(t, map[string]string{"MAX_CONN_PER_IP": "2"})
+	first, _ := tg.connect("/ws", nil)
+	tg.connect("/ws", nil)
+	if _, resp, err := tg.tryDial("/ws", nil); err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third connection: err = %v, response = %v; want 429", err, resp)
+	}
+	first.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	waitFor(t, "slot to be released", func() bool { return tg.hub.count() == 1 })
+	tg.connect("/ws", nil)
+}
+
+func TestMaxConnPerIPBehindProxy(t *testing.T) {
+	tg := startGateway(t, map[string]string{"MAX_CONN_PER_IP": "1", "TRUST_PROXY": "true"})
+	from := func(ip string) http.Header { return http.Header{"X-Forwarded-For": {ip}} }
+	tg.connect("/ws", from("203.0.113.1"))
+	tg.connect("/ws", from("203.0.113.2"))
+	if _, resp, err := tg.tryDial("/ws", from("203.0.113.1")); err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second connection from 203.0.113.1: err = %v, response = %v; want 429", err, resp)
+	}
+}
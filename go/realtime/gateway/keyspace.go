@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// keyspaceQuietWarning is how long the bridge waits for a first notification
+// before warning that Redis may not be sending any.
+const keyspaceQuietWarning = 5 * time.Minute
+
+// keyspaceBridge turns Redis keyspace notifications for keys under keyPrefix
+// into {"type":"keyspace","key":"...","event":"set"} messages on the topic
+// <topicPrefix><key>. Redis only sends them when notify-keyspace-events
+// includes K and the event classes of interest, e.g. "KA".
+type keyspaceBridge struct {
+	rdb         *redis.Client
+	db          int
+	keyPrefix   string
+	topicPrefix string
+	maxBackoff  time.Duration
+
+	// received is set once the first notification has arrived.
+	received atomic.Bool
+}
+
+// channelPrefix is the Pub/Sub channel prefix Redis uses for the bridge's
+// database.
+func (k *keyspaceBridge) channelPrefix() string {
+	return "__keyspace@" + strconv.Itoa(k.db) + "__:"
+}
+
+// run relays notifications to h until ctx is cancelled.
+func (k *keyspaceBridge) run(ctx context.Context, h *hub) {
+	k.checkConfig(ctx)
+	go k.warnIfQuiet(ctx)
+
+	prefix := k.channelPrefix()
+	slog.Info("subscribing to redis keyspace notifications", "pattern", prefix+k.keyPrefix+"*", "topic_prefix", k.topicPrefix)
+	var up atomic.Bool
+	sub := &subscriber{
+		rdb:        k.rdb,
+		pattern:    prefix + k.keyPrefix + "*",
+		maxBackoff: k.maxBackoff,
+		up:         &up,
+		handle: func(msg *redis.Message) {
+			k.received.Store(true)
+			key := strings.TrimPrefix(msg.Channel, prefix)
+			topic := k.topicPrefix + key
+			h.broadcastTopic(topic, websocket.TextMessage, encodeKeyspace(key, msg.Payload))
+		},
+	}
+	sub.run(ctx)
+}
+
+// checkConfig warns when notify-keyspace-events would suppress the
+// notifications the bridge listens for. Managed Redis services often block
+// CONFIG; the quiet warning covers those.
+func (k *keyspaceBridge) checkConfig(ctx context.Context) {
+	res, err := k.rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		slog.Debug("cannot read notify-keyspace-events", "err", err)
+		return
+	}
+	flags := res["notify-keyspace-events"]
+	if !strings.Contains(flags, "K") {
+		slog.Warn("redis notify-keyspace-events does not include K; no keyspace notifications will arrive (set it to e.g. KA)", "notify_keyspace_events", flags)
+	}
+}
+
+// warnIfQuiet logs once if no notification arrived within
+// keyspaceQuietWarning.
+func (k *keyspaceBridge) warnIfQuiet(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(keyspaceQuietWarning):
+		if !k.received.Load() {
+			slog.Warn("no redis keyspace notifications received; check notify-keyspace-events and KEYSPACE_PREFIX",
+				"waited", keyspaceQuietWarning, "pattern", k.channelPrefix()+k.keyPrefix+"*")
+		}
+	}
+}
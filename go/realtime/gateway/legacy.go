@@ -0,0 +1,33 @@
+package gateway
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// legacyWarnInterval spaces out the deprecation warnings for REDIS_CHANNEL
+// messages, which would otherwise be logged once per message.
+const legacyWarnInterval = time.Minute
+
+// legacyNotice logs that messages still arrive on the deprecated broadcast
+// channels: on the first one, then at most once per legacyWarnInterval with
+// the count since the last warning.
+type legacyNotice struct {
+	mu     sync.Mutex
+	last   time.Time
+	unseen int
+}
+
+func (n *legacyNotice) received(channel string) {
+	legacyMessages.Inc()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.unseen++
+	if !n.last.IsZero() && time.Since(n.last) < legacyWarnInterval {
+		return
+	}
+	slog.Warn("message on deprecated REDIS_CHANNEL broadcast to every client; publish to <REDIS_TOPIC_PREFIX><topic> instead, then set LEGACY_BROADCAST_ALL=false",
+		"channel", channel, "messages", n.unseen)
+	n.last, n.unseen = time.Now(), 0
+}
@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLegacyAndTopicDelivery(t *testing.T) {
+	mr, url := startRedis(t)
+	tg := startGateway(t, map[string]string{"BACKEND": "pubsub", "REDIS_URL": url})
+	waitFor(t, "subscription", tg.hub.subscribed.Load)
+	subscriber, _ := tg.connect("/ws?topics=news", nil)
+	other, _ := tg.connect("/ws", nil)
+
+	before := testutil.ToFloat64(legacyMessages)
+	mr.Publish("realtime:broadcast", `{"legacy":1}`)
+	if msg := readJSON(t, subscriber); msg["legacy"] != float64(1) {
+		t.Fatalf("subscriber got %v, want the legacy broadcast", msg)
+	}
+	if msg := readJSON(t, other); msg["legacy"] != float64(1) {
+		t.Fatalf("unsubscribed client got %v, want the legacy broadcast", msg)
+	}
+	if got := testutil.ToFloat64(legacyMessages) - before; got != 1 {
+		t.Fatalf("legacy messages rose by %v, want 1", got)
+	}
+
+	mr.Publish("realtime:topic:news", `{"topic":1}`)
+	if msg := readJSON(t, subscriber); msg["topic"] != float64(1) {
+		t.Fatalf("subscriber got %v, want the topic message", msg)
+	}
+	expectSilence(t, other, 100*time.Millisecond)
+	if got := testutil.ToFloat64(legacyMessages) - before; got != 1 {
+		t.Fatalf("legacy messages rose by %v counting a topic message", got)
+	}
+}
+
+func TestLegacyBroadcastOff(t *testing.T) {
+	mr, url := startRedis(t)
+	tg := startGateway(t, map[string]string{"BACKEND": "pubsub", "REDIS_URL": url, "LEGACY_BROADCAST_ALL": "false"})
+	waitFor(t, "subscription", tg.hub.subscribed.Load)
+	conn, _ := tg.connect("/ws?topics=news", nil)
+
+	if n := mr.PubSubNumSub("realtime:broadcast")["realtime:broadcast"]; n != 0 {
+		t.Fatalf("%d subscribers on realtime:broadcast with LEGACY_BROADCAST_ALL=false", n)
+	}
+	mr.Publish("realtime:broadcast", `{"legacy":1}`)
+	mr.Publish("realtime:topic:news", `{"topic":1}`)
+	if msg := readJSON(t, conn); msg["topic"] != float64(1) {
+		t.Fatalf("first frame = %v, want only the topic message", msg)
+	}
+	expectSilence(t, conn, 100*time.Millisecond)
+}
+
+func TestLegacyNoticeSpacesWarnings(t *testing.T) {
+	var n legacyNotice
+	n.received("realtime:broadcast")
+	first := n.last
+	if first.IsZero() || n.unseen != 0 {
+		t.Fatalf("first message not warned about: last %v, unseen %d", n.last, n.unseen)
+	}
+	n.received("realtime:broadcast")
+	n.received("realtime:broadcast")
+	if n.last != first || n.unseen != 2 {
+		t.Fatalf("warned again within legacyWarnInterval: last %v, unseen %d", n.last, n.unseen)
+	}
+	n.last = time.Now().Add(-legacyWarnInterval)
+	n.received("realtime:broadcast")
+	if n.unseen != 0 || !n.last.After(first) {
+		t.Fatalf("no warning after legacyWarnInterval: unseen %d", n.unseen)
+	}
+}
@@ -0,0 +1,151 @@
+package gateway
+
+import (
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitGoroutines waits for the number of goroutines to fall to at most n.
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines still running, want at most %d:\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownStopsClientGoroutines(t *testing.T) {
+	t.Setenv("BACKEND", "memory")
+	t.Setenv("BIND_ADDR", freeAddr(t))
+	t.Setenv("CLOSE_TIMEOUT", "200ms")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := &testGateway{Gateway: New(cfg), t: t, addr: cfg.BindAddr}
+	// Counted after New, whose fanout workers live as long as the process.
+	http.DefaultClient.CloseIdleConnections()
+	before := runtime.NumGoroutine()
+	stop := runGateway(t, tg.Gateway)
+	waitFor(t, "gateway to listen", func() bool {
+		conn, _, err := tg.tryDial("/ws", nil)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	waitFor(t, "probe connection to go", func() bool { return tg.hub.count() == 0 })
+
+	const n = 50
+	for range n {
+		tg.connect("/ws", nil)
+	}
+	if got := tg.hub.count(); got != n {
+		t.Fatalf("%d clients connected, want %d", got, n)
+	}
+	with := runtime.NumGoroutine()
+	stop()
+	waitGoroutines(t, before)
+	// Compared with the count after shutdown rather than before, which can
+	// include goroutines of earlier tests still winding down.
+	if stopped := with - runtime.NumGoroutine(); stopped < 2*n {
+		t.Fatalf("shutdown stopped %d goroutines of %d clients, want a read and write pump each", stopped, n)
+	}
+}
+
+func TestRemoveStopsClientGoroutines(t *testing.T) {
+	tg := startGateway(t, nil)
+	tg.connect("/ws", nil)
+	_, id := tg.connect("/ws", nil)
+	// Let the pumps of both clients start before counting.
+	time.Sleep(50 * time.Millisecond)
+	with := runtime.NumGoroutine()
+	c, _ := tg.hub.get(id)
+	tg.hub.removeWithReason(c, disconnectAdminKick)
+	select {
+	case <-c.ctx.Done():
+	default:
+		t.Fatal("remove did not cancel the client's context")
+	}
+	waitGoroutines(t, with-2)
+	if tg.hub.count() != 1 {
+		t.Fatalf("count = %d, want the other client to stay", tg.hub.count())
+	}
+}
+
+// startStoppable runs a gateway configured by env and returns it with the
+// func that shuts it down, for tests that time shutdown itself.
+func startStoppable(t *testing.T, env map[string]string) (*testGateway, func()) {
+	t.Helper()
+	t.Setenv("BACKEND", "memory")
+	t.Setenv("BIND_ADDR", freeAddr(t))
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := &testGateway{Gateway: New(cfg), t: t, addr: cfg.BindAddr}
+	stop := runGateway(t, tg.Gateway)
+	waitFor(t, "gateway to listen", func() bool {
+		resp, err := http.Get(tg.url("/healthz"))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	})
+	return tg, stop
+}
+
+func TestShutdownBoundedByCloseTimeout(t *testing.T) {
+	// CLIENT_CLOSE_TIMEOUT is well above CLOSE_TIMEOUT, so it's the handshake
+	// timing out that lets the clients go.
+	tg, stop := startStoppable(t, map[string]string{"CLOSE_TIMEOUT": "300ms", "CLIENT_CLOSE_TIMEOUT": "3s"})
+	// None of these read again, so none answers the close frame.
+	const n = 20
+	for range n {
+		tg.connect("/ws", nil)
+	}
+	start := time.Now()
+	stop()
+	elapsed := time.Since(start)
+	if elapsed < 300*time.Millisecond {
+		t.Fatalf("shutdown took %v, less than CLOSE_TIMEOUT", elapsed)
+	}
+	// The handshakes time out together, not one after another, which would
+	// take n*CLOSE_TIMEOUT.
+	if elapsed > 1500*time.Millisecond {
+		t.Fatalf("shutdown took %v with %d clients ignoring the close frame", elapsed, n)
+	}
+	if got := tg.hub.count(); got != 0 {
+		t.Fatalf("%d clients left after shutdown", got)
+	}
+}
+
+func TestShutdownCloseHandshakeAnswered(t *testing.T) {
+	tg, stop := startStoppable(t, map[string]string{"CLOSE_TIMEOUT": "5s", "CLIENT_CLOSE_TIMEOUT": "5s"})
+	closed := make(chan int, 1)
+	conn, _ := tg.connect("/ws", nil)
+	go func() {
+		// Reading is what makes gorilla answer the close frame.
+		closed <- closeCode(t, conn)
+	}()
+	start := time.Now()
+	stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("shutdown took %v although the client answered the close frame", elapsed)
+	}
+	if code := <-closed; code != websocket.CloseGoingAway {
+		t.Fatalf("close code = %d, want %d", code, websocket.CloseGoingAway)
+	}
+}
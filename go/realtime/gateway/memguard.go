@@ -0,0 +1,169 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Memory pressure levels, as exported by realtime_memory_pressure.
+const (
+	memoryOK = iota
+	memorySoft
+	memoryHard
+)
+
+// memShedFraction is the share of connected clients the guard disconnects
+// per check while over MEM_HARD_LIMIT, so memory has a chance to come down
+// before more clients are cut off.
+const memShedFraction = 0.05
+
+// memShedCloseTimeout bounds the write of a shed client's close frame.
+const memShedCloseTimeout = time.Second
+
+// memoryGuard watches the process's memory. Over soft it refuses new
+// connections; over hard it also sheds existing ones, slowest first.
+type memoryGuard struct {
+	soft, hard uint64 // 0 disables that limit
+	interval   time.Duration
+	// usage reports the bytes in use; processMemory outside of tests.
+	usage func() uint64
+	level int
+}
+
+// processMemory is the memory the Go runtime has mapped and not returned to
+// the OS, which is what the OOM killer sees apart from non-Go allocations.
+func processMemory() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// runMemoryGuard checks memory every interval until ctx is done.
+func (h *hub) runMemoryGuard(ctx context.Context) {
+	g := h.memGuard
+	t := time.NewTicker(g.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.checkMemory()
+		}
+	}
+}
+
+// checkMemory runs one check: it updates the pressure level, logging each
+// change, and sheds clients while over the hard limit.
+func (h *hub) checkMemory() {
+	g := h.memGuard
+	used := g.usage()
+	memoryBytes.Set(float64(used))
+	level := memoryOK
+	switch {
+	case g.hard > 0 && used >= g.hard:
+		level = memoryHard
+	case g.soft > 0 && used >= g.soft:
+		level = memorySoft
+	}
+	if level != g.level {
+		switch level {
+		case memoryHard:
+			slog.Error("memory above MEM_HARD_LIMIT; refusing new connections and shedding clients", "used", formatBytes(used), "limit", formatBytes(g.hard), "clients", h.count())
+		case memorySoft:
+			slog.Warn("memory above MEM_SOFT_LIMIT; refusing new connections", "used", formatBytes(used), "limit", formatBytes(g.soft), "clients", h.count())
+		default:
+			slog.Info("memory back under its limits; accepting connections again", "used", formatBytes(used))
+		}
+		g.level = level
+		memoryPressure.Set(float64(level))
+		h.memoryPressured.Store(level != memoryOK)
+	}
+	if level == memoryHard {
+		h.shedForMemory(used)
+	}
+}
+
+// shedForMemory disconnects memShedFraction of the clients, at least one.
+// The ones with the fullest send queues go first, since a backlog is memory
+// the gateway holds on their behalf; among equals the oldest connections go
+// first, as they have had the longest run. They are all taken out of the hub
+// before any close frame is written, and the close frames then go out
+// concurrently with a deadline of memShedCloseTimeout, so a client stuck on
+// a write holds the guard up by that long at most.
+func (h *hub) shedForMemory(used uint64) {
+	clients := h.snapshot()
+	if len(clients) == 0 {
+		return
+	}
+	depth := make(map[*client]int, len(clients))
+	for _, c := range clients {
+		depth[c] = len(c.send)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if di, dj := depth[clients[i]], depth[clients[j]]; di != dj {
+			return di > dj
+		}
+		return clients[i].connectedAt.Before(clients[j].connectedAt)
+	})
+	reason := disconnectMemoryPressure
+	var shed []*client
+	for _, c := range clients[:max(1, int(float64(len(clients))*memShedFraction))] {
+		c.closing.CompareAndSwap(nil, &reason)
+		c.shed.Store(true)
+		if h.unregister(c, reason) {
+			c.logger.Warn("shedding ws client under memory pressure", "queue_depth", depth[c], "connected_for", time.Since(c.connectedAt).Round(time.Second))
+			shed = append(shed, c)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, c := range shed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.sendClose(websocket.CloseTryAgainLater, "server under memory pressure", reason, memShedCloseTimeout)
+			h.closeRemoved(c, true)
+		}()
+	}
+	wg.Wait()
+	memoryShed.Add(float64(len(shed)))
+	slog.Warn("shed clients under memory pressure", "shed", len(shed), "remaining", len(clients)-len(shed), "used", formatBytes(used), "limit", formatBytes(h.memGuard.hard))
+}
+
+// parseByteSize reads a size such as "1536MiB", "2GiB" or a plain byte
+// count.
+func parseByteSize(v string) (uint64, error) {
+	s := strings.TrimSpace(v)
+	mult := uint64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   uint64
+	}{{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > (1<<63)/mult {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return n * mult, nil
+}
+
+// formatBytes renders n for logs in MiB.
+func formatBytes(n uint64) string {
+	return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + "MiB"
+}
@@ -0,0 +1,241 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeUsage stands in for processMemory, reporting whatever the test last
+// stored.
+func fakeUsage(g *memoryGuard) *atomic.Uint64 {
+	var used atomic.Uint64
+	g.usage = used.Load
+	return &used
+}
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]uint64{
+		"0": 0, "4096": 4096, "512B": 512, "64KiB": 64 << 10, "1536MiB": 1536 << 20, " 2GiB ": 2 << 30, "1 TiB": 1 << 40,
+	} {
+		if got, err := parseByteSize(in); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "MiB", "1.5GiB", "-1", "2GB", "16777216TiB"} {
+		if _, err := parseByteSize(in); err == nil {
+			t.Errorf("parseByteSize(%q) succeeded", in)
+		}
+	}
+}
+
+func TestMemoryLimitsConfig(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"MEM_SOFT_LIMIT": "lots"},
+		{"MEM_SOFT_LIMIT": "2GiB", "MEM_HARD_LIMIT": "1GiB"},
+		{"MEM_SOFT_LIMIT": "1GiB", "MEM_HARD_LIMIT": "1GiB"},
+	} {
+		t.Setenv("BACKEND", "memory")
+		t.Setenv("MEM_SOFT_LIMIT", "")
+		t.Setenv("MEM_HARD_LIMIT", "")
+		for k, v := range env {
+			t.Setenv(k, v)
+		}
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("LoadConfig accepted %v", env)
+		}
+	}
+}
+
+func TestMemoryGuardLevels(t *testing.T) {
+	h := newTestHub(t, map[string]string{"MEM_SOFT_LIMIT": "100MiB", "MEM_HARD_LIMIT": "200MiB"})
+	if h.memGuard == nil {
+		t.Fatal("no memory guard with both limits set")
+	}
+	used := fakeUsage(h.memGuard)
+	for _, step := range []struct {
+		used      uint64
+		level     int
+		pressured bool
+	}{
+		{50 << 20, memoryOK, false},
+		{100 << 20, memorySoft, true},
+		{199 << 20, memorySoft, true},
+		{200 << 20, memoryHard, true},
+		{150 << 20, memorySoft, true},
+		{10 << 20, memoryOK, false},
+	} {
+		used.Store(step.used)
+		h.checkMemory()
+		if got := testutil.ToFloat64(memoryBytes); got != float64(step.used) {
+			t.Fatalf("realtime_memory_bytes = %v, want %d", got, step.used)
+		}
+		if got := testutil.ToFloat64(memoryPressure); got != float64(step.level) {
+			t.Fatalf("at %s realtime_memory_pressure = %v, want %d", formatBytes(step.used), got, step.level)
+		}
+		if got := h.memoryPressured.Load(); got != step.pressured {
+			t.Fatalf("at %s pressured = %v, want %v", formatBytes(step.used), got, step.pressured)
+		}
+	}
+}
+
+func TestMemoryGuardSoftLimitOnly(t *testing.T) {
+	h := newTestHub(t, map[string]string{"MEM_SOFT_LIMIT": "100MiB"})
+	used := fakeUsage(h.memGuard)
+	h.add(testClient("c1", 1))
+	// However far over, only new connections are refused.
+	used.Store(1 << 40)
+	h.checkMemory()
+	if got := testutil.ToFloat64(memoryPressure); got != memorySoft {
+		t.Fatalf("realtime_memory_pressure = %v, want %d", got, memorySoft)
+	}
+	if h.count() != 1 {
+		t.Fatal("client shed without MEM_HARD_LIMIT")
+	}
+}
+
+func TestShedForMemory(t *testing.T) {
+	h := newTestHub(t, map[string]string{"MEM_HARD_LIMIT": "100MiB"})
+	used := fakeUsage(h.memGuard)
+	// 40 clients, so 5% is two on the first check. Two have a backlog; the
+	// rest are idle and connected a second apart, c0 first.
+	start := time.Now().Add(-time.Minute)
+	for i := range 40 {
+		c := testClient("c"+strconv.Itoa(i), 8)
+		c.connectedAt = start.Add(time.Duration(i) * time.Second)
+		switch i {
+		case 20:
+			c.send <- frame{}
+		case 30:
+			c.send <- frame{}
+			c.send <- frame{}
+		}
+		h.add(c)
+	}
+	before := testutil.ToFloat64(memoryShed)
+	reasons := testutil.ToFloat64(disconnects.WithLabelValues(disconnectMemoryPressure))
+
+	used.Store(150 << 20)
+	h.checkMemory()
+	for _, gone := range []string{"c30", "c20"} {
+		if _, ok := h.get(gone); ok {
+			t.Fatalf("%s kept despite the fullest queue", gone)
+		}
+	}
+	// Still over: the next check takes the oldest of the idle ones, one
+	// being 5% of 38 rounded down.
+	h.checkMemory()
+	if _, ok := h.get("c0"); ok {
+		t.Fatal("c0 kept despite being the oldest")
+	}
+	if _, ok := h.get("c1"); !ok {
+		t.Fatal("c1 shed along with c0")
+	}
+	if got := testutil.ToFloat64(memoryShed) - before; got != 3 {
+		t.Fatalf("realtime_memory_shed_total rose by %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(disconnects.WithLabelValues(disconnectMemoryPressure)) - reasons; got != 3 {
+		t.Fatalf("memory_pressure disconnects rose by %v, want 3", got)
+	}
+	// Back under the limit, nobody else goes.
+	used.Store(50 << 20)
+	h.checkMemory()
+	if n := h.count(); n != 37 {
+		t.Fatalf("count = %d after memory came down, want 37", n)
+	}
+}
+
+func TestMemoryPressureRefusesConnections(t *testing.T) {
+	// The check interval is long enough that only the test's own checks run.
+	tg := startGateway(t, map[string]string{
+		"MEM_SOFT_LIMIT": "100MiB", "MEM_HARD_LIMIT": "200MiB", "MEM_CHECK_INTERVAL": "1h",
+	})
+	used := fakeUsage(tg.hub.memGuard)
+	conn, _ := tg.connect("/ws", nil)
+	refused := testutil.ToFloat64(upgradesRejected.WithLabelValues("memory"))
+
+	used.Store(150 << 20)
+	tg.hub.checkMemory()
+	_, resp, err := tg.tryDial("/ws", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("dial over MEM_SOFT_LIMIT: %v, want 503 with Retry-After", err)
+	}
+	resp, err = http.Get(tg.url("/sse?topics=orders"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("GET /sse over MEM_SOFT_LIMIT = %d, want 503", resp.StatusCode)
+	}
+	if got := testutil.ToFloat64(upgradesRejected.WithLabelValues("memory")) - refused; got != 2 {
+		t.Fatalf("memory rejections rose by %v, want 2", got)
+	}
+	// The existing connection is untouched until the hard limit.
+	sendJSON(t, conn, map[string]any{"action": "subscribe", "topic": "orders"})
+	if msg := readJSON(t, conn); msg["type"] != "ack" {
+		t.Fatalf("reply = %v, want an ack", msg)
+	}
+
+	used.Store(250 << 20)
+	tg.hub.checkMemory()
+	if code := closeCode(t, conn); code != websocket.CloseTryAgainLater {
+		t.Fatalf("close code = %d, want %d", code, websocket.CloseTryAgainLater)
+	}
+
+	used.Store(50 << 20)
+	tg.hub.checkMemory()
+	tg.connect("/ws", nil)
+}
+
+func TestShedForMemoryStuckClient(t *testing.T) {
+	tg := startGateway(t, map[string]string{"MEM_HARD_LIMIT": "100MiB", "MEM_CHECK_INTERVAL": "1h", "WRITE_TIMEOUT": "5s"})
+	used := fakeUsage(tg.hub.memGuard)
+	// 40 clients, so two are shed: the stuck one for its backlog and then
+	// the oldest, which is reading and should hear why promptly.
+	oldest, _ := tg.connect("/ws", nil)
+	closed := make(chan int, 1)
+	go func() { closed <- closeCode(t, oldest) }()
+	for range 38 {
+		tg.connect("/ws", nil)
+	}
+	_, id := tg.connect("/ws?topics=flood", nil)
+	stuck, _ := tg.hub.get(id)
+	// It never reads, so once the socket buffers fill its writePump blocks
+	// with the rest of the flood queued behind it.
+	big := make([]byte, 1<<20)
+	for range 32 {
+		tg.hub.broadcastTopic("flood", websocket.BinaryMessage, big)
+	}
+	waitFor(t, "the stuck client's writes to block", func() bool {
+		depth := len(stuck.send)
+		time.Sleep(50 * time.Millisecond)
+		return depth > 0 && len(stuck.send) == depth
+	})
+
+	used.Store(150 << 20)
+	start := time.Now()
+	tg.hub.checkMemory()
+	if elapsed := time.Since(start); elapsed > memShedCloseTimeout+500*time.Millisecond {
+		t.Fatalf("shedding took %v with one client stuck on a write", elapsed)
+	}
+	if _, ok := tg.hub.get(id); ok {
+		t.Fatal("stuck client still registered")
+	}
+	if n := tg.hub.count(); n != 38 {
+		t.Fatalf("count = %d, want 38", n)
+	}
+	select {
+	case code := <-closed:
+		if code != websocket.CloseTryAgainLater {
+			t.Fatalf("close code = %d, want %d", code, websocket.CloseTryAgainLater)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("oldest client not closed")
+	}
+}
@@ -0,0 +1,249 @@
+package gateway
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registry holds the gateway's own collectors so they never clash with
+// anything registered on the Prometheus default registry.
+var registry = prometheus.NewRegistry()
+
+var (
+	connectedClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "realtime_connected_clients",
+		Help: "Number of currently connected WebSocket clients.",
+	})
+	messagesBroadcast = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_messages_broadcast_total",
+		Help: "Messages fanned out to connected clients.",
+	})
+	messagesDirect = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_messages_direct_total",
+		Help: "Direct messages delivered to a client on this instance.",
+	})
+	broadcastErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_broadcast_errors_total",
+		Help: "Failed writes to WebSocket clients.",
+	})
+	writeTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_write_timeouts_total",
+		Help: "Clients disconnected because a write exceeded WRITE_TIMEOUT.",
+	})
+	writeRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_write_retries_total",
+		Help: "Socket writes tried again after a transient failure (WRITE_RETRIES).",
+	})
+	writeRetriesFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_write_retries_failed_total",
+		Help: "Socket writes that still failed after WRITE_RETRIES retries.",
+	})
+	messagesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_messages_received_total",
+		Help: "Messages received from the Redis subscription.",
+	})
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realtime_rate_limited_total",
+		Help: "Inbound client messages dropped by a rate limiter.",
+	}, []string{"scope"})
+	redisReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_redis_reconnects_total",
+		Help: "Attempts to re-establish the Redis subscription after it dropped.",
+	})
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realtime_config_reloads_total",
+		Help: "Reloads of CONFIG_FILE's topics section by result: ok, or error when the current settings were kept.",
+	}, []string{"result"})
+	redisClientRebuilds = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_redis_client_rebuilds_total",
+		Help: "Redis clients replaced after REDIS_REBUILD_AFTER failed health pings, moving the subscription to the new client.",
+	})
+	broadcastDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "realtime_broadcast_duration_seconds",
+		Help:    "Time to queue one broadcast for every recipient.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10), // 10us to ~2.6s
+	})
+	broadcastRecipients = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_broadcast_recipients_total",
+		Help: "Client deliveries queued by broadcasts.",
+	})
+	messagesTransformDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_messages_transform_dropped_total",
+		Help: "Broadcasts dropped by the message transformer.",
+	})
+	clientsReaped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_clients_reaped_total",
+		Help: "Stale clients removed by the periodic reaper sweep.",
+	})
+	broadcastQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "realtime_broadcast_queue_depth",
+		Help: "Redis messages waiting for a broadcast worker.",
+	})
+	broadcastQueueDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_broadcast_queue_dropped_total",
+		Help: "Redis messages dropped because the broadcast queue was full.",
+	})
+	broadcastsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "realtime_broadcasts_in_flight",
+		Help: "Broadcasts currently fanning out to clients.",
+	})
+	broadcastsShed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_broadcasts_shed_total",
+		Help: "Broadcasts dropped because MAX_CONCURRENT_BROADCASTS were already in flight.",
+	})
+	gatewayDraining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "realtime_draining",
+		Help: "1 once the gateway is draining or shutting down and refuses new upgrades, 0 otherwise.",
+	})
+	disconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realtime_disconnects_total",
+		Help: "Clients removed, by reason.",
+	}, []string{"reason"})
+	connectionAge = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "realtime_connection_age_seconds",
+		Help:    "How long WebSocket clients were connected, observed when they disconnect.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10), // 1s to ~3 days
+	})
+	upgradesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realtime_upgrade_rejected_total",
+		Help: "WebSocket upgrades refused by /ws, by reason.",
+	}, []string{"reason"})
+	upgradesSucceeded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_upgrade_success_total",
+		Help: "WebSocket upgrades completed by /ws.",
+	})
+	sseConnections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_sse_connections_total",
+		Help: "Event streams opened by /sse.",
+	})
+	receiptsPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_receipts_published_total",
+		Help: "Delivery receipts published to RECEIPTS_CHANNEL.",
+	})
+	receiptsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_receipts_dropped_total",
+		Help: "Delivery receipts lost to a full queue or a failed publish.",
+	})
+	duplicatesSuppressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_duplicates_suppressed_total",
+		Help: "Redis messages dropped as repeats within DEDUP_WINDOW or DEDUPE_TTL.",
+	})
+	messagesExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_messages_expired_total",
+		Help: "Replayed stream entries skipped because their ttl_ms ran out.",
+	})
+	subscriptionsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_subscriptions_rejected_total",
+		Help: "Subscriptions refused because the client reached MAX_SUBSCRIPTIONS_PER_CLIENT.",
+	})
+	sessionResumes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realtime_session_resumes_total",
+		Help: "Reconnects that asked to resume a session, by result: resumed, or expired when the session was unknown or had run out.",
+	}, []string{"result"})
+	cursorResumes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realtime_cursor_resumes_total",
+		Help: "Reconnects that caught up from their saved stream cursor, by result: resumed, or trimmed or truncated when a gap notice covered entries they could not get.",
+	}, []string{"result"})
+	authRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realtime_auth_requests_total",
+		Help: "AUTH_URL checks by result: allowed, denied (a 4xx answer), error, timeout, or cached when a recent success was reused.",
+	}, []string{"result"})
+	messagesCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_messages_coalesced_total",
+		Help: "TOPIC_COALESCE messages replaced in a client's queue by a newer one before being sent.",
+	})
+	snapshotsFetched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realtime_snapshots_total",
+		Help: "SNAPSHOT_URL fetches on subscribe by result: ok, missing (404) or error.",
+	}, []string{"result"})
+	topicAuthorizations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realtime_topic_authorizations_total",
+		Help: "Topic subscription checks by result: granted, denied, or error when TOPIC_AUTH_URL failed and the topic was denied.",
+	}, []string{"result"})
+	messagesRetained = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_messages_retained_total",
+		Help: "TOPIC_RETAIN messages delivered to clients on subscribe.",
+	})
+	legacyMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_legacy_messages_total",
+		Help: "Messages received on a REDIS_CHANNEL broadcast channel, which LEGACY_BROADCAST_ALL sends to every client.",
+	})
+	schemaRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realtime_schema_rejections_total",
+		Help: "Messages refused for not matching their topic's TOPIC_SCHEMAS schema, by source: publish from a client, or broadcast from the backend.",
+	}, []string{"source"})
+	schemaValidationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "realtime_schema_validation_duration_seconds",
+		Help:    "Time to decode and validate one message against its topic's schema.",
+		Buckets: prometheus.ExponentialBuckets(0.000001, 4, 10), // 1us to ~262ms
+	})
+	firehoseDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_firehose_dropped_total",
+		Help: "Firehose copies dropped by FIREHOSE_RATE or a client's full send queue.",
+	})
+	sendQueueDepth = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "realtime_send_queue_depth",
+		Help:    "Messages in a client's send queue right after a message is queued.",
+		Buckets: []float64{0, 1, 4, 16, 64, 128, 192, 256, 1024},
+	})
+	sendQueueMaxDepth = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "realtime_send_queue_max_depth",
+		Help:    "The deepest each client's send queue got, observed at disconnect.",
+		Buckets: []float64{0, 1, 4, 16, 64, 128, 192, 256, 1024},
+	})
+	sendQueueOverflows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realtime_send_queue_overflows_total",
+		Help: "Frames that found a client's queue full, by lane; the first one drops the client.",
+	}, []string{"lane"})
+	memoryBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "realtime_memory_bytes",
+		Help: "Memory in use as last read by the MEM_SOFT_LIMIT/MEM_HARD_LIMIT guard.",
+	})
+	memoryPressure = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "realtime_memory_pressure",
+		Help: "0 under the memory limits, 1 above MEM_SOFT_LIMIT (new connections refused), 2 above MEM_HARD_LIMIT (clients shed).",
+	})
+	memoryShed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realtime_memory_shed_total",
+		Help: "Clients disconnected to bring memory under MEM_HARD_LIMIT.",
+	})
+)
+
+func init() {
+	registry.MustRegister(connectedClients, messagesBroadcast, messagesDirect, broadcastErrors, writeTimeouts, writeRetries, writeRetriesFailed, messagesReceived, rateLimited, redisReconnects,
+		broadcastDuration, broadcastRecipients, messagesTransformDropped, clientsReaped, broadcastQueueDepth, broadcastQueueDropped, broadcastsInFlight, broadcastsShed, sendQueueDepth, sendQueueMaxDepth, sendQueueOverflows,
+		upgradesRejected, upgradesSucceeded, sseConnections, firehoseDropped, duplicatesSuppressed, messagesExpired,
+		subscriptionsRejected, sessionResumes, cursorResumes, authRequests, messagesCoalesced,
+		snapshotsFetched, topicAuthorizations, gatewayDraining, connectionAge, disconnects,
+		schemaRejections, schemaValidationDuration, messagesRetained, legacyMessages, redisClientRebuilds, configReloads,
+		receiptsPublished, receiptsDropped, memoryBytes, memoryPressure, memoryShed)
+	// Export every reason from the start so rate() works before the first
+	// rejection of each kind.
+	for _, reason := range []string{"origin", "auth", "capacity", "rate_limit", "starting", "draining", "handshake", "duplicate", "memory"} {
+		upgradesRejected.WithLabelValues(reason)
+	}
+	for _, lane := range []string{laneSend, lanePriority} {
+		sendQueueOverflows.WithLabelValues(lane)
+	}
+	for _, reason := range disconnectReasons {
+		disconnects.WithLabelValues(reason)
+	}
+	for _, result := range []string{"ok", "error"} {
+		configReloads.WithLabelValues(result)
+	}
+}
+
+// observeBroadcast records how long a broadcast that started at start took
+// to reach recipients clients.
+func observeBroadcast(start time.Time, recipients int64) {
+	broadcastDuration.Observe(time.Since(start).Seconds())
+	broadcastRecipients.Add(float64(recipients))
+}
+
+// metricsHandler serves the gateway registry in the Prometheus text format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
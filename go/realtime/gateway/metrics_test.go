@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// connectionAges returns how many ages realtime_connection_age_seconds holds
+// and their sum.
+func connectionAges(t *testing.T) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := connectionAge.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestConnectionAgeRecordedOnRemoval(t *testing.T) {
+	h := newTestHub(t, nil)
+	c := testClient("c1", 1)
+	c.connectedAt = time.Now().Add(-90 * time.Second)
+	h.add(c)
+	count, sum := connectionAges(t)
+	h.removeWithReason(c, disconnectWriteError)
+	// Both pumps remove a client; only the first removal counts.
+	h.removeWithReason(c, disconnectReadError)
+	gotCount, gotSum := connectionAges(t)
+	if gotCount-count != 1 {
+		t.Fatalf("connection ages rose by %d, want 1", gotCount-count)
+	}
+	if age := gotSum - sum; age < 90 || age > 91 {
+		t.Fatalf("recorded age %vs, want about 90s", age)
+	}
+}
+
+func TestConnectionAgeNotRecordedForUnregistered(t *testing.T) {
+	h := newTestHub(t, nil)
+	count, _ := connectionAges(t)
+	h.removeWithReason(testClient("c1", 1), disconnectWriteError)
+	if got, _ := connectionAges(t); got != count {
+		t.Fatalf("connection ages rose by %d for a client never added", got-count)
+	}
+}
+
+func TestDrainingGauge(t *testing.T) {
+	tg := startGateway(t, nil)
+	if got := testutil.ToFloat64(gatewayDraining); got != 0 {
+		t.Fatalf("realtime_draining = %v while serving, want 0", got)
+	}
+	tg.Drain()
+	if got := testutil.ToFloat64(gatewayDraining); got != 1 {
+		t.Fatalf("realtime_draining = %v after Drain, want 1", got)
+	}
+	req, _ := http.NewRequest(http.MethodGet, tg.url("/metrics"), nil)
+	if _, body := status(t, req); !strings.Contains(body, "\nrealtime_draining 1\n") {
+		t.Fatal("/metrics does not report realtime_draining 1")
+	}
+}
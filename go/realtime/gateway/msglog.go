@@ -0,0 +1,249 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// messageLogBackups is how many rotated files are kept: path.1 is the
+	// newest, path.5 the oldest.
+	messageLogBackups = 5
+	// messageLogFlush is how often buffered records are written out.
+	messageLogFlush = time.Second
+)
+
+// messageRecord is one line of the message log.
+type messageRecord struct {
+	TS         int64  `json:"ts"`
+	Topic      string `json:"topic,omitempty"`
+	Recipients int64  `json:"recipients"`
+	Bytes      int    `json:"bytes"`
+	// SampleRate is the fraction of the topic's messages that are logged,
+	// when it is below 1; multiply counts by 1/SampleRate to estimate totals.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	// Data is the payload as JSON when it is valid JSON, and as a string
+	// otherwise.
+	Data any `json:"data"`
+}
+
+// logSampleRule logs the given fraction of the messages on topics matching
+// pattern, a glob.
+type logSampleRule struct {
+	pattern string
+	rate    float64
+}
+
+// messageLog appends every broadcast to a JSON lines file from a background
+// goroutine, so delivery never waits on the disk. Records that arrive while
+// the queue is full are dropped.
+type messageLog struct {
+	path     string
+	maxBytes int64 // 0 disables rotation
+	queue    chan messageRecord
+	// rules pick a topic's sample rate, the first match winning: the always
+	// topics, then the rates setRates was last given. Topics no rule
+	// matches are logged at sampleRate.
+	always     []string
+	rules      atomic.Pointer[[]logSampleRule]
+	sampleRate float64
+
+	file *os.File
+	w    *bufio.Writer
+	size int64
+	// dropping is set from the first dropped record until one is queued
+	// again, so a burst logs once.
+	dropping atomic.Bool
+}
+
+// newMessageLog returns a log that records every message on the always
+// topics, the given fraction of those matching a rule, and sampleRate of the
+// rest.
+func newMessageLog(path string, maxMB int, sampleRate float64, always []string, rates []logSampleRule) *messageLog {
+	l := &messageLog{path: path, maxBytes: int64(maxMB) << 20, queue: make(chan messageRecord, 4096), always: always, sampleRate: sampleRate}
+	l.setRates(rates)
+	return l
+}
+
+// setRates replaces the per-topic sample rates, e.g. on reload.
+func (l *messageLog) setRates(rates []logSampleRule) {
+	rules := make([]logSampleRule, 0, len(l.always)+len(rates))
+	for _, pattern := range l.always {
+		rules = append(rules, logSampleRule{pattern: pattern, rate: 1})
+	}
+	rules = append(rules, rates...)
+	l.rules.Store(&rules)
+}
+
+// open opens or creates the log file for appending.
+func (l *messageLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("MESSAGE_LOG_PATH: %w", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("MESSAGE_LOG_PATH: %w", err)
+	}
+	l.file, l.w, l.size = f, bufio.NewWriterSize(f, 64<<10), st.Size()
+	return nil
+}
+
+// record queues one broadcast, unless sampling leaves it out. A JSON payload
+// is queued without copying, which is safe because broadcast payloads are
+// never modified after fan-out.
+func (l *messageLog) record(topic, id string, payload []byte, recipients int64) {
+	rate := l.rateFor(topic)
+	if !logSampled(rate, topic, id, payload) {
+		return
+	}
+	rec := messageRecord{TS: time.Now().UnixMilli(), Topic: topic, Recipients: recipients, Bytes: len(payload)}
+	if rate < 1 {
+		rec.SampleRate = rate
+	}
+	if json.Valid(payload) {
+		rec.Data = json.RawMessage(payload)
+	} else {
+		rec.Data = string(payload)
+	}
+	select {
+	case l.queue <- rec:
+		l.dropping.Store(false)
+	default:
+		if !l.dropping.Swap(true) {
+			slog.Warn("message log queue full; dropping records until it drains", "path", l.path)
+		}
+	}
+}
+
+// rateFor returns the fraction of topic's messages to log.
+func (l *messageLog) rateFor(topic string) float64 {
+	for _, r := range *l.rules.Load() {
+		if globMatch(r.pattern, topic) {
+			return r.rate
+		}
+	}
+	return l.sampleRate
+}
+
+// logSampled reports whether a message is logged at rate. The choice hashes
+// the topic with the message's id, or with its payload when it has none, so
+// every instance makes the same one for the same message.
+func logSampled(rate float64, topic, id string, payload []byte) bool {
+	switch {
+	case rate >= 1:
+		return true
+	case rate <= 0:
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	if id != "" {
+		h.Write([]byte(id))
+	} else {
+		h.Write(payload)
+	}
+	return mix64(h.Sum64()) < uint64(rate*math.MaxUint64)
+}
+
+// parseLogSampleRates reads rules such as "prices.*:0.01,chat:0.1". The
+// topic ends at the last ':', so tenant-scoped topics can be given.
+func parseLogSampleRates(raw string) ([]logSampleRule, error) {
+	var rules []logSampleRule
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndexByte(pair, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid entry %q; expected topic:rate", pair)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(pair[i+1:]), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid rate in %q; expected a number between 0 and 1", pair)
+		}
+		rules = append(rules, logSampleRule{pattern: strings.TrimSpace(pair[:i]), rate: rate})
+	}
+	return rules, nil
+}
+
+// run writes queued records until ctx is done, then writes what is left,
+// flushes and closes the file.
+func (l *messageLog) run(ctx context.Context) {
+	t := time.NewTicker(messageLogFlush)
+	defer t.Stop()
+	for {
+		select {
+		case rec := <-l.queue:
+			l.write(rec)
+		case <-t.C:
+			l.flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case rec := <-l.queue:
+					l.write(rec)
+				default:
+					l.flush()
+					l.file.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *messageLog) write(rec messageRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		l.rotate()
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		slog.Error("message log write failed", "path", l.path, "err", err)
+	}
+}
+
+func (l *messageLog) flush() {
+	if err := l.w.Flush(); err != nil {
+		slog.Error("message log flush failed", "path", l.path, "err", err)
+	}
+}
+
+// rotate shifts path.N to path.N+1, moves the current file to path.1 and
+// starts a new one. If the new file cannot be opened the log keeps writing
+// to the old handle.
+func (l *messageLog) rotate() {
+	l.flush()
+	for i := messageLogBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		slog.Error("message log rotation failed", "path", l.path, "err", err)
+		return
+	}
+	old := l.file
+	if err := l.open(); err != nil {
+		slog.Error("message log rotation failed", "path", l.path, "err", err)
+		l.size = 0
+		return
+	}
+	old.Close()
+}
@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLogSampledRate(t *testing.T) {
+	const messages = 20000
+	for _, rate := range []float64{0.01, 0.1, 0.5, 0.9} {
+		t.Run(fmt.Sprint(rate), func(t *testing.T) {
+			var n int
+			for m := range messages {
+				if logSampled(rate, "prices.eur", fmt.Sprintf("msg-%d", m), nil) {
+					n++
+				}
+			}
+			// Five standard deviations.
+			bound := 5 * math.Sqrt(rate*(1-rate)/messages)
+			if got := float64(n) / messages; math.Abs(got-rate) > bound {
+				t.Fatalf("logged %.4f of messages, want %.3f±%.4f", got, rate, bound)
+			}
+		})
+	}
+	for m := range 100 {
+		if id := fmt.Sprint(m); !logSampled(1, "t", id, nil) || logSampled(0, "t", id, nil) {
+			t.Fatalf("rate 0 or 1 is not exact for message %s", id)
+		}
+	}
+}
+
+func TestLogSampledDeterministic(t *testing.T) {
+	var differ int
+	for m := range 1000 {
+		id := fmt.Sprintf("msg-%d", m)
+		// Every instance decides the same for the same message, whatever
+		// its payload, since the id is what's hashed.
+		if logSampled(0.5, "chat", id, []byte("a")) != logSampled(0.5, "chat", id, []byte("b")) {
+			t.Fatalf("message %s sampled differently for another payload", id)
+		}
+		if logSampled(0.5, "chat", id, nil) != logSampled(0.5, "news", id, nil) {
+			differ++
+		}
+	}
+	if differ < 400 || differ > 600 {
+		t.Fatalf("%d of 1000 ids sampled differently on another topic, want about 500", differ)
+	}
+	// Without an id the payload decides.
+	payload := []byte(`{"price":101.5}`)
+	for range 10 {
+		if logSampled(0.5, "chat", "", payload) != logSampled(0.5, "chat", "", payload) {
+			t.Fatal("the same payload sampled differently")
+		}
+	}
+}
+
+func TestMessageLogRateFor(t *testing.T) {
+	l := newMessageLog("", 0, 0.5, []string{"audit.*"}, []logSampleRule{{"prices.*", 0.01}, {"prices.eur", 0.2}, {"audit.noisy", 0}})
+	for topic, want := range map[string]float64{
+		"audit.login": 1,
+		"audit.noisy": 1, // MESSAGE_LOG_ALWAYS comes first
+		"prices.eur":  0.01,
+		"chat":        0.5,
+	} {
+		if got := l.rateFor(topic); got != want {
+			t.Errorf("rateFor(%s) = %v, want %v", topic, got, want)
+		}
+	}
+	l.setRates([]logSampleRule{{"chat", 0.1}})
+	if got := l.rateFor("chat"); got != 0.1 {
+		t.Fatalf("rateFor(chat) after setRates = %v, want 0.1", got)
+	}
+	if got := l.rateFor("prices.eur"); got != 0.5 {
+		t.Fatalf("rateFor(prices.eur) kept a replaced rule: %v", got)
+	}
+}
+
+func TestParseLogSampleRates(t *testing.T) {
+	rules, err := parseLogSampleRates("prices.*:0.01, tenant:acme:chat:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0] != (logSampleRule{"prices.*", 0.01}) || rules[1] != (logSampleRule{"tenant:acme:chat", 1}) {
+		t.Fatalf("rules = %v", rules)
+	}
+	for _, raw := range []string{"prices", ":0.1", "prices:x", "prices:1.5", "prices:-0.1"} {
+		if _, err := parseLogSampleRates(raw); err == nil {
+			t.Errorf("parseLogSampleRates(%q) succeeded", raw)
+		}
+	}
+}
+
+func TestMessageLogSamplesBroadcasts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.jsonl")
+	h := newTestHub(t, map[string]string{
+		"MESSAGE_LOG_PATH":        path,
+		"MESSAGE_LOG_TOPIC_RATES": "prices:0.1",
+		"MESSAGE_LOG_ALWAYS":      "audit",
+	})
+	if err := h.msgLog.open(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.msgLog.run(ctx)
+	}()
+	const n = 2000
+	for i := range n {
+		h.broadcastTopic("prices", websocket.TextMessage, []byte(fmt.Sprintf(`{"price":%d}`, i)))
+	}
+	for i := range 10 {
+		h.broadcastTopic("audit", websocket.TextMessage, []byte(fmt.Sprintf(`{"event":%d}`, i)))
+	}
+	cancel()
+	<-done
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	counts := map[string]int{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec messageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("bad record %s: %v", scanner.Bytes(), err)
+		}
+		want := 0.0
+		if rec.Topic == "prices" {
+			want = 0.1
+		}
+		if rec.SampleRate != want {
+			t.Fatalf("%s record has sample_rate %v, want %v", rec.Topic, rec.SampleRate, want)
+		}
+		counts[rec.Topic]++
+	}
+	if counts["audit"] != 10 {
+		t.Fatalf("logged %d audit messages, want all 10", counts["audit"])
+	}
+	if got := counts["prices"]; got < 140 || got > 260 {
+		t.Fatalf("logged %d of %d prices messages, want about 200", got, n)
+	}
+}
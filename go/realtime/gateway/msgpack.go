@@ -0,0 +1,270 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Wire formats a client picks with ?format=. JSON is the default; msgpack
+// sends the gateway's own frames as MessagePack maps in binary frames.
+const (
+	formatJSON    = "json"
+	formatMsgpack = "msgpack"
+)
+
+// msgpackWrapped is an ack-mode message or firehose copy for a msgpack
+// client: the JSON wrapper's fields, with the message itself as raw bytes.
+type msgpackWrapped struct {
+	Type  string `msgpack:"type"`
+	ID    string `msgpack:"id,omitempty"`
+	Topic string `msgpack:"topic,omitempty"`
+	Data  []byte `msgpack:"data"`
+}
+
+func encodeMsgpackWrapped(typ, id, topic string, data []byte) []byte {
+	b, _ := msgpack.Marshal(msgpackWrapped{Type: typ, ID: id, Topic: topic, Data: data})
+	return b
+}
+
+// outgoing converts f to the client's format. For a msgpack client the
+// gateway's JSON frames become MessagePack maps, while the messages it
+// relays pass through untouched: text as it was published and binary
+// wrapped in a bin, so every binary frame the client receives is exactly
+// one MessagePack value. Binary frames the gateway built are MessagePack
+// already.
+func (c *client) outgoing(f frame) frame {
+	if c.format != formatMsgpack {
+		return f
+	}
+	switch {
+	case f.payload && f.messageType == websocket.BinaryMessage:
+		b, _ := msgpack.Marshal(f.data)
+		return frame{messageType: websocket.BinaryMessage, data: b}
+	case f.payload, f.messageType == websocket.BinaryMessage:
+		return f
+	}
+	if b, err := msgpackEnvelope(f.data); err == nil {
+		return frame{messageType: websocket.BinaryMessage, data: b}
+	}
+	return f
+}
+
+// writeText writes a frame the gateway built, e.g. a ping, straight to the
+// socket in the client's format. The caller sets the write deadline.
+func (c *client) writeText(data []byte) error {
+	f := c.outgoing(frame{messageType: websocket.TextMessage, data: data})
+	return c.conn.WriteMessage(f.messageType, f.data)
+}
+
+// batchable reports whether f can join a batch for c. A JSON batch only
+// holds text; a MessagePack one holds binary as well.
+func (c *client) batchable(f frame) bool {
+	return f.messageType == websocket.TextMessage || c.format == formatMsgpack
+}
+
+// msgpackEnvelope re-encodes one of the gateway's JSON objects as a
+// MessagePack map with its keys in the same order. Its data is written as a
+// bin of the raw JSON, without being converted; the other fields are the
+// gateway's own and keep their types, integers staying integers.
+func msgpackEnvelope(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("not a JSON object")
+	}
+	type field struct {
+		key   string
+		value json.RawMessage
+	}
+	var fields []field
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, field{key.(string), value})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON object")
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(true)
+	enc.SetSortMapKeys(true)
+	if err := enc.EncodeMapLen(len(fields)); err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		if err := enc.EncodeString(f.key); err != nil {
+			return nil, err
+		}
+		if f.key == "data" {
+			if err := enc.EncodeBytes(f.value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		v, err := decodeJSONNumbers(f.value)
+		if err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeJSONNumbers decodes a JSON value with its numbers as int64 or
+// uint64 where they are whole and fit, and float64 otherwise.
+func decodeJSONNumbers(raw []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return convertNumbers(v), nil
+}
+
+func convertNumbers(v any) any {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(string(t), 10, 64); err == nil {
+			return u
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]any:
+		for k, x := range t {
+			t[k] = convertNumbers(x)
+		}
+	case []any:
+		for i, x := range t {
+			t[i] = convertNumbers(x)
+		}
+	}
+	return v
+}
+
+// encodeMsgpackBatch is encodeBatch for a msgpack client. Relayed messages
+// go in as bins of their raw bytes, binary ones included, and the gateway's
+// own frames as the maps they would be on their own.
+func encodeMsgpackBatch(frames []frame) frame {
+	if len(frames) == 1 {
+		return frames[0]
+	}
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.EncodeMapLen(2)
+	enc.EncodeString("type")
+	enc.EncodeString("batch")
+	enc.EncodeString("messages")
+	enc.EncodeArrayLen(len(frames))
+	for _, f := range frames {
+		switch {
+		case f.payload:
+			enc.EncodeBytes(f.data)
+		case f.messageType == websocket.BinaryMessage:
+			enc.Encode(msgpack.RawMessage(f.data))
+		default:
+			if b, err := msgpackEnvelope(f.data); err == nil {
+				enc.Encode(msgpack.RawMessage(b))
+			} else {
+				enc.EncodeBytes(f.data)
+			}
+		}
+	}
+	return frame{messageType: websocket.BinaryMessage, data: buf.Bytes()}
+}
+
+// incoming returns a client message as JSON: a msgpack client's binary
+// frames are decoded, and text frames are taken to be JSON already, so such
+// a client may send either.
+func (c *client) incoming(messageType int, data []byte) ([]byte, error) {
+	if c.format != formatMsgpack || messageType != websocket.BinaryMessage {
+		return data, nil
+	}
+	return msgpackToJSON(data)
+}
+
+// msgpackToJSON decodes a control message sent as a MessagePack map. Its
+// data, a bin or string, is the message itself: used as is when it is
+// JSON, and as a JSON string otherwise.
+func msgpackToJSON(data []byte) ([]byte, error) {
+	r := bytes.NewReader(data)
+	dec := msgpack.NewDecoder(r)
+	var msg map[string]any
+	if err := dec.Decode(&msg); err != nil {
+		return nil, err
+	}
+	if r.Len() > 0 {
+		return nil, errors.New("trailing data after MessagePack value")
+	}
+	if msg == nil {
+		return nil, errors.New("control message must be a map")
+	}
+	for k, v := range msg {
+		if err := checkMsgpackValue(v); err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	if d, ok := msg["data"]; ok {
+		var raw []byte
+		switch t := d.(type) {
+		case []byte:
+			raw = t
+		case string:
+			raw = []byte(t)
+		default:
+			return nil, errors.New("data must be a bin or string")
+		}
+		if !json.Valid(raw) {
+			raw, _ = json.Marshal(string(raw))
+		}
+		msg["data"] = json.RawMessage(raw)
+	}
+	return json.Marshal(msg)
+}
+
+// checkMsgpackValue refuses what JSON can't carry: extension types, which
+// decode to time.Time or fail, and maps with keys other than strings.
+func checkMsgpackValue(v any) error {
+	switch t := v.(type) {
+	case time.Time:
+		return errors.New("extension types are not supported")
+	case map[string]any:
+		for _, x := range t {
+			if err := checkMsgpackValue(x); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, x := range t {
+			if err := checkMsgpackValue(x); err != nil {
+				return err
+			}
+		}
+	case map[any]any:
+		return errors.New("map keys must be strings")
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// readMsgpack reads the next frame and fails the test unless it is a binary
+// frame holding a MessagePack map.
+func readMsgpack(t testing.TB, conn *websocket.Conn) map[string]any {
+	t.Helper()
+	mt, data := readFrame(t, conn)
+	if mt != websocket.BinaryMessage {
+		t.Fatalf("got a text frame %s, want MessagePack", data)
+	}
+	return decodeMsgpack(t, data)
+}
+
+// decodeMsgpack decodes a MessagePack map, keeping bins as []byte apart
+// from strs and widening integers to int64 or uint64 whatever their size on
+// the wire.
+func decodeMsgpack(t testing.TB, data []byte) map[string]any {
+	t.Helper()
+	var msg map[string]any
+	if err := msgpack.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("frame %x is not a MessagePack map: %v", data, err)
+	}
+	return widenInts(msg).(map[string]any)
+}
+
+func widenInts(v any) any {
+	switch t := v.(type) {
+	case int8:
+		return int64(t)
+	case int16:
+		return int64(t)
+	case int32:
+		return int64(t)
+	case uint8:
+		return uint64(t)
+	case uint16:
+		return uint64(t)
+	case uint32:
+		return uint64(t)
+	case map[string]any:
+		for k, x := range t {
+			t[k] = widenInts(x)
+		}
+	case []any:
+		for i, x := range t {
+			t[i] = widenInts(x)
+		}
+	}
+	return v
+}
+
+// sendMsgpack writes v to conn as MessagePack in a binary frame.
+func sendMsgpack(t testing.TB, conn *websocket.Conn, v any) {
+	t.Helper()
+	b, err := msgpack.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+// mapKeys returns the keys of the MessagePack map in data in wire order.
+func mapKeys(t *testing.T, data []byte) []string {
+	t.Helper()
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		if keys[i], err = dec.DecodeString(); err != nil {
+			t.Fatal(err)
+		}
+		if err := dec.Skip(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func TestMsgpackEnvelope(t *testing.T) {
+	in := `{"type":"snapshot","topic":"prices","seq":7,"neg":-300,"big":18446744073709551615,"ratio":0.5,` +
+		`"ok":true,"none":null,"granted":["a","b"],"limits":{"rate":10},"data":{"eur":1.08,"n":[1,2]}}`
+	b, err := msgpackEnvelope([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"type", "topic", "seq", "neg", "big", "ratio", "ok", "none", "granted", "limits", "data"}
+	if keys := mapKeys(t, b); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("keys = %v, want the JSON order %v", keys, want)
+	}
+	msg := decodeMsgpack(t, b)
+	checks := map[string]any{
+		"type": "snapshot", "seq": int64(7), "neg": int64(-300), "big": uint64(math.MaxUint64), "ratio": 0.5,
+		"ok": true, "none": nil, "granted": []any{"a", "b"}, "limits": map[string]any{"rate": int64(10)},
+	}
+	for k, v := range checks {
+		if !reflect.DeepEqual(msg[k], v) {
+			t.Errorf("%s = %#v, want %#v", k, msg[k], v)
+		}
+	}
+	// data is the raw JSON, not converted.
+	if got, ok := msg["data"].([]byte); !ok || string(got) != `{"eur":1.08,"n":[1,2]}` {
+		t.Fatalf("data = %#v, want the raw JSON as a bin", msg["data"])
+	}
+	for _, bad := range []string{`[1]`, `"x"`, `{"a":1} {}`, `{"a":`} {
+		if _, err := msgpackEnvelope([]byte(bad)); err == nil {
+			t.Errorf("msgpackEnvelope(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestOutgoing(t *testing.T) {
+	welcome := []byte(`{"type":"welcome","id":"c1"}`)
+	tests := []struct {
+		name     string
+		f        frame
+		wantType int
+		// want is the frame's data for a msgpack client; nil means the
+		// envelope of f.data.
+		want []byte
+	}{
+		{name: "relayed JSON", f: frame{messageType: websocket.TextMessage, data: []byte(`{"type":"welcome"}`), payload: true},
+			wantType: websocket.TextMessage, want: []byte(`{"type":"welcome"}`)},
+		{name: "relayed text", f: frame{messageType: websocket.TextMessage, data: []byte("plain"), payload: true},
+			wantType: websocket.TextMessage, want: []byte("plain")},
+		{name: "relayed binary", f: frame{messageType: websocket.BinaryMessage, data: []byte{0, 1, 2}, payload: true},
+			wantType: websocket.BinaryMessage, want: []byte{0xc4, 3, 0, 1, 2}},
+		{name: "gateway JSON", f: frame{messageType: websocket.TextMessage, data: welcome}, wantType: websocket.BinaryMessage},
+		{name: "gateway MessagePack", f: frame{messageType: websocket.BinaryMessage, data: []byte{0x80}},
+			wantType: websocket.BinaryMessage, want: []byte{0x80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testClient("c1", 1)
+			c.format = formatJSON
+			if got := c.outgoing(tt.f); got.messageType != tt.f.messageType || !bytes.Equal(got.data, tt.f.data) {
+				t.Fatalf("JSON client got %d %q, want the frame unchanged", got.messageType, got.data)
+			}
+			c.format = formatMsgpack
+			want := tt.want
+			if want == nil {
+				want, _ = msgpackEnvelope(tt.f.data)
+			}
+			if got := c.outgoing(tt.f); got.messageType != tt.wantType || !bytes.Equal(got.data, want) {
+				t.Fatalf("msgpack client got %d %x, want %d %x", got.messageType, got.data, tt.wantType, want)
+			}
+		})
+	}
+}
+
+func TestMsgpackToJSON(t *testing.T) {
+	mustPack := func(v any) []byte {
+		b, err := msgpack.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	ok := []struct {
+		name string
+		in   any
+		want string
+	}{
+		{name: "subscribe", in: map[string]any{"action": "subscribe", "topic": "news"}, want: `{"action":"subscribe","topic":"news"}`},
+		{name: "pong", in: map[string]any{"type": "pong"}, want: `{"type":"pong"}`},
+		{name: "JSON data", in: map[string]any{"action": "publish", "data": []byte(`{"n":1}`)}, want: `{"action":"publish","data":{"n":1}}`},
+		{name: "text data", in: map[string]any{"action": "publish", "data": []byte("hello")}, want: `{"action":"publish","data":"hello"}`},
+		{name: "string data", in: map[string]any{"action": "publish", "data": "[1,2]"}, want: `{"action":"publish","data":[1,2]}`},
+		{name: "echo", in: map[string]any{"action": "publish", "echo": false, "data": []byte("1")}, want: `{"action":"publish","data":1,"echo":false}`},
+		{name: "other bin", in: map[string]any{"action": "x", "blob": []byte{0xff}}, want: `{"action":"x","blob":"/w=="}`},
+	}
+	for _, tt := range ok {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := msgpackToJSON(mustPack(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("msgpackToJSON = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	subscribe := mustPack(map[string]any{"action": "subscribe", "topic": "news"})
+	bad := map[string][]byte{
+		"truncated":       subscribe[:len(subscribe)-2],
+		"trailing":        append(append([]byte{}, subscribe...), 0xc0),
+		"not a map":       mustPack([]string{"subscribe"}),
+		"nil":             {0xc0},
+		"extension":       mustPack(map[string]any{"action": "x", "at": time.Unix(0, 0)}),
+		"unknown ext":     {0x81, 0xa1, 'a', 0xd4, 0x05, 0x00},
+		"integer key":     {0x81, 0x01, 0xa1, 'a'},
+		"nested int keys": {0x81, 0xa1, 'a', 0x81, 0x01, 0x02},
+		"numeric data":    mustPack(map[string]any{"action": "publish", "data": 5}),
+		"map data":        mustPack(map[string]any{"action": "publish", "data": map[string]any{"n": 1}}),
+	}
+	for name, in := range bad {
+		t.Run(name, func(t *testing.T) {
+			if got, err := msgpackToJSON(in); err == nil {
+				t.Fatalf("msgpackToJSON(%x) = %s, want an error", in, got)
+			}
+		})
+	}
+}
+
+// dialMsgpack connects with ?format=msgpack and the extra query, and returns
+// the connection once its MessagePack welcome has arrived.
+func dialMsgpack(t *testing.T, tg *testGateway, query string) *websocket.Conn {
+	t.Helper()
+	conn := tg.dial("/ws?format=msgpack"+query, nil)
+	if msg := readMsgpack(t, conn); msg["type"] != "welcome" || msg["id"] == "" {
+		t.Fatalf("welcome = %v", msg)
+	}
+	return conn
+}
+
+func TestMsgpackSession(t *testing.T) {
+	tg := startGateway(t, nil)
+	conn := dialMsgpack(t, tg, "")
+
+	sendMsgpack(t, conn, map[string]any{"action": "subscribe", "topic": "news"})
+	if msg := readMsgpack(t, conn); msg["type"] != "ack" || msg["action"] != "subscribe" || msg["topic"] != "news" {
+		t.Fatalf("reply = %v, want an ack for news", msg)
+	}
+	// JSON control messages still work, and are answered in MessagePack.
+	sendJSON(t, conn, map[string]any{"action": "subscribe", "topic": "sports"})
+	if msg := readMsgpack(t, conn); msg["type"] != "ack" || msg["topic"] != "sports" {
+		t.Fatalf("reply = %v, want an ack for sports", msg)
+	}
+
+	// Relayed messages arrive as published.
+	tg.hub.broadcastTopic("news", websocket.TextMessage, []byte(`{"title":"hi","n":1}`))
+	if mt, data := readFrame(t, conn); mt != websocket.TextMessage || string(data) != `{"title":"hi","n":1}` {
+		t.Fatalf("frame = %d %s, want the JSON text untouched", mt, data)
+	}
+	tg.hub.broadcastTopic("news", websocket.BinaryMessage, []byte{0xde, 0xad})
+	if mt, data := readFrame(t, conn); mt != websocket.BinaryMessage || !bytes.Equal(data, []byte{0xc4, 2, 0xde, 0xad}) {
+		t.Fatalf("frame = %d %x, want the bytes in a bin", mt, data)
+	}
+
+	conn.WriteMessage(websocket.BinaryMessage, []byte{0x81, 0xa1})
+	if msg := readMsgpack(t, conn); msg["type"] != "error" || msg["code"] != "bad_request" ||
+		!strings.HasPrefix(msg["message"].(string), "invalid MessagePack") {
+		t.Fatalf("reply = %v, want bad_request", msg)
+	}
+	sendMsgpack(t, conn, map[string]any{"action": "unsubscribe", "topic": "news"})
+	if msg := readMsgpack(t, conn); msg["type"] != "ack" || msg["action"] != "unsubscribe" {
+		t.Fatalf("reply = %v, want an unsubscribe ack", msg)
+	}
+}
+
+func TestJSONSession(t *testing.T) {
+	tg := startGateway(t, nil)
+	// ?format=json is the default made explicit.
+	conn, _ := tg.connect("/ws?format=json", nil)
+	sendJSON(t, conn, map[string]any{"action": "subscribe", "topic": "news"})
+	if msg := readJSON(t, conn); msg["type"] != "ack" || msg["topic"] != "news" {
+		t.Fatalf("reply = %v, want an ack for news", msg)
+	}
+	// A JSON client's binary frames aren't MessagePack.
+	b, _ := msgpack.Marshal(map[string]any{"action": "subscribe", "topic": "sports"})
+	conn.WriteMessage(websocket.BinaryMessage, b)
+	if msg := readJSON(t, conn); msg["type"] != "error" {
+		t.Fatalf("reply = %v, want an error", msg)
+	}
+	tg.hub.broadcastTopic("news", websocket.BinaryMessage, []byte{0xde, 0xad})
+	if mt, data := readFrame(t, conn); mt != websocket.BinaryMessage || !bytes.Equal(data, []byte{0xde, 0xad}) {
+		t.Fatalf("frame = %d %x, want the bytes as sent", mt, data)
+	}
+}
+
+func TestFormatRejected(t *testing.T) {
+	tg := startGateway(t, nil)
+	_, resp, err := tg.tryDial("/ws?format=cbor", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("dial with format=cbor: %v, want 400", err)
+	}
+}
+
+func TestMsgpackAckMode(t *testing.T) {
+	tg := startGateway(t, nil)
+	conn := dialMsgpack(t, tg, "&ack=1&topics=news")
+	tg.hub.broadcastTopic("news", websocket.TextMessage, []byte(`{"n":1}`))
+	tg.hub.broadcastTopic("news", websocket.BinaryMessage, []byte{0xff})
+	first, second := readMsgpack(t, conn), readMsgpack(t, conn)
+	if first["type"] != "message" || first["id"] != "m1" || first["topic"] != "news" || !bytes.Equal(first["data"].([]byte), []byte(`{"n":1}`)) {
+		t.Fatalf("first = %v, want m1 with the JSON as raw bytes", first)
+	}
+	if second["id"] != "m2" || !bytes.Equal(second["data"].([]byte), []byte{0xff}) {
+		t.Fatalf("second = %v, want m2 with the binary as raw bytes", second)
+	}
+	sendMsgpack(t, conn, map[string]any{"action": "ack", "id": "m1"})
+	sendMsgpack(t, conn, map[string]any{"action": "ack", "id": "m2"})
+	waitFor(t, "acks to register", func() bool {
+		for _, c := range tg.hub.snapshot() {
+			return c.acks.outstanding() == 0
+		}
+		return false
+	})
+}
+
+func TestMsgpackBatch(t *testing.T) {
+	tg := startGateway(t, map[string]string{"BATCH_WINDOW": "50ms"})
+	conn := dialMsgpack(t, tg, "&batch=1&topics=news")
+	tg.hub.broadcastTopic("news", websocket.TextMessage, []byte(`{"n":1}`))
+	tg.hub.broadcastTopic("news", websocket.BinaryMessage, []byte{0xff})
+	tg.hub.broadcastTopic("news", websocket.TextMessage, []byte("plain"))
+	msg := readMsgpack(t, conn)
+	want := []any{[]byte(`{"n":1}`), []byte{0xff}, []byte("plain")}
+	if msg["type"] != "batch" || !reflect.DeepEqual(msg["messages"], want) {
+		t.Fatalf("batch = %v, want all three messages as raw bytes", msg)
+	}
+}
+
+func TestEncodeBatch(t *testing.T) {
+	one := frame{messageType: websocket.TextMessage, data: []byte("plain"), payload: true}
+	if got := encodeBatch([]frame{one}); !reflect.DeepEqual(got, one) {
+		t.Fatalf("encodeBatch of one frame = %+v, want it as is", got)
+	}
+	got := encodeBatch([]frame{{messageType: websocket.TextMessage, data: []byte(`{"n":1}`)}, one})
+	var batch batchMessage
+	if err := json.Unmarshal(got.data, &batch); err != nil || batch.Type != "batch" ||
+		string(batch.Messages[0]) != `{"n":1}` || string(batch.Messages[1]) != `"plain"` {
+		t.Fatalf("encodeBatch = %s", got.data)
+	}
+}
@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originChecker validates the Origin header of upgrade requests against an
+// allowlist of hosts. Entries are host names, optionally with a port, and may
+// start with "*." to match any subdomain.
+type originChecker struct {
+	allowed       []string
+	allowNoOrigin bool
+}
+
+func newOriginChecker(allowed []string, allowNoOrigin bool) *originChecker {
+	oc := &originChecker{allowNoOrigin: allowNoOrigin}
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if i := strings.Index(a, "://"); i >= 0 {
+			a = a[i+3:]
+		}
+		if a = strings.TrimSuffix(a, "/"); a != "" {
+			oc.allowed = append(oc.allowed, a)
+		}
+	}
+	return oc
+}
+
+// check implements websocket.Upgrader.CheckOrigin.
+func (oc *originChecker) check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if !oc.allowNoOrigin {
+			slog.Warn("ws rejected request without Origin", "remote", r.RemoteAddr)
+		}
+		return oc.allowNoOrigin
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		slog.Warn("ws rejected malformed origin", "origin", origin, "remote", r.RemoteAddr)
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	hostname := strings.ToLower(u.Hostname())
+	for _, a := range oc.allowed {
+		if matchHost(a, host) || matchHost(a, hostname) {
+			return true
+		}
+	}
+	slog.Warn("ws rejected origin", "origin", origin, "remote", r.RemoteAddr)
+	return false
+}
+
+func matchHost(pattern, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return pattern == host
+}
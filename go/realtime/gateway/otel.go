@@ -0,0 +1,133 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// otelShutdownTimeout bounds the final export of batched spans at shutdown.
+const otelShutdownTimeout = 5 * time.Second
+
+// otelTracer is the Tracer Run installs when the OTEL_* variables configure
+// an OTLP exporter. Each broadcast becomes a consumer span, a child of the
+// publisher's span when the envelope carries its traceparent, with a child
+// span per client it is queued for.
+type otelTracer struct {
+	// provider is nil when the tracer was built around someone else's
+	// provider, which then isn't ours to shut down.
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// otelConfigured reports whether the environment asks for OTLP trace export:
+// an OTLP endpoint or OTEL_TRACES_EXPORTER=otlp, without OTEL_SDK_DISABLED
+// or OTEL_TRACES_EXPORTER=none.
+func otelConfigured() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "none":
+		return false
+	case "otlp":
+		return true
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// newOTelTracer returns a tracer exporting over OTLP as the OTEL_* variables
+// describe, or nil when they don't configure export. The exporters read the
+// endpoint, headers, timeout and TLS settings themselves, and the SDK reads
+// OTEL_TRACES_SAMPLER, the OTEL_BSP_* batching settings and the resource
+// variables; service.name defaults to realtime-gateway.
+func newOTelTracer(ctx context.Context) (*otelTracer, error) {
+	if !otelConfigured() {
+		return nil, nil
+	}
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch protocol {
+	case "", "http/protobuf":
+		exporter, err = otlptracehttp.New(ctx)
+	case "grpc":
+		exporter, err = otlptracegrpc.New(ctx)
+	default:
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_PROTOCOL must be grpc or http/protobuf, got %q", protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "realtime-gateway")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK())
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	t := newOTelTracerFrom(tp)
+	t.provider = tp
+	return t, nil
+}
+
+// newOTelTracerFrom returns a tracer whose spans come from tp.
+func newOTelTracerFrom(tp trace.TracerProvider) *otelTracer {
+	return &otelTracer{tracer: tp.Tracer("realtime/gateway")}
+}
+
+// shutdown flushes the spans still batched and stops the exporter.
+func (t *otelTracer) shutdown(ctx context.Context) error {
+	if t.provider == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+func (t *otelTracer) StartDelivery(traceparent, topic string) DeliverySpan {
+	ctx := context.Background()
+	if traceparent != "" {
+		ctx = propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+	}
+	ctx, span := t.tracer.Start(ctx, "realtime.broadcast",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", topic)))
+	return &otelSpan{tracer: t.tracer, ctx: ctx, span: span}
+}
+
+type otelSpan struct {
+	tracer trace.Tracer
+	ctx    context.Context
+	span   trace.Span
+}
+
+func (s *otelSpan) StartWrite(clientID string) func() {
+	// An unsampled broadcast's children are unsampled too, so they cost no
+	// more than the check.
+	if !s.span.IsRecording() {
+		return noopEnd
+	}
+	_, span := s.tracer.Start(s.ctx, "realtime.write", trace.WithAttributes(attribute.String("realtime.client_id", clientID)))
+	return func() { span.End() }
+}
+
+func (s *otelSpan) End(recipients int) {
+	s.span.SetAttributes(attribute.Int("realtime.recipients", recipients))
+	s.span.End()
+}
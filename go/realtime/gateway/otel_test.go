@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTelConfigured(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want bool
+	}{
+		{name: "unset"},
+		{name: "endpoint", env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, want: true},
+		{name: "traces endpoint", env: map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://collector:4318/v1/traces"}, want: true},
+		{name: "exporter named", env: map[string]string{"OTEL_TRACES_EXPORTER": "otlp"}, want: true},
+		{name: "exporter none", env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_TRACES_EXPORTER": "none"}},
+		{name: "sdk disabled", env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_SDK_DISABLED": "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_TRACES_EXPORTER", "OTEL_SDK_DISABLED"} {
+				t.Setenv(k, tt.env[k])
+			}
+			if got := otelConfigured(); got != tt.want {
+				t.Fatalf("otelConfigured() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoTracerWithoutOTelEnv(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	t.Setenv("OTEL_TRACES_EXPORTER", "")
+	tg := startGateway(t, nil)
+	if tg.hub.tracer != nil {
+		t.Fatalf("tracer = %T without OTEL_* variables, want none", tg.hub.tracer)
+	}
+}
+
+func TestOTelBadProtocol(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://127.0.0.1:4318")
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/json")
+	if _, err := newOTelTracer(context.Background()); err == nil {
+		t.Fatal("OTEL_EXPORTER_OTLP_PROTOCOL=http/json accepted")
+	}
+}
+
+func TestBroadcastSpans(t *testing.T) {
+	h := newTestHub(t, nil)
+	rec := tracetest.NewSpanRecorder()
+	h.tracer = newOTelTracerFrom(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	for _, id := range []string{"a", "b", "c"} {
+		c := testClient(id, 4)
+		c.topics["news"] = struct{}{}
+		h.add(c)
+	}
+	other := testClient("d", 4)
+	h.add(other)
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	h.broadcastTopic("news", websocket.TextMessage, []byte(`{"traceparent":"00-`+traceID+`-`+parentID+`-01","data":{"n":1}}`))
+
+	var broadcast sdktrace.ReadOnlySpan
+	writes := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range rec.Ended() {
+		switch s.Name() {
+		case "realtime.broadcast":
+			broadcast = s
+		case "realtime.write":
+			for _, kv := range s.Attributes() {
+				if kv.Key == "realtime.client_id" {
+					writes[kv.Value.AsString()] = s
+				}
+			}
+		}
+	}
+	if broadcast == nil {
+		t.Fatalf("no realtime.broadcast span among %d", len(rec.Ended()))
+	}
+	if got := broadcast.SpanContext().TraceID().String(); got != traceID {
+		t.Fatalf("broadcast trace ID = %s, want the publisher's %s", got, traceID)
+	}
+	if got := broadcast.Parent().SpanID().String(); got != parentID {
+		t.Fatalf("broadcast parent = %s, want the publisher's span %s", got, parentID)
+	}
+	attrs := map[string]string{}
+	for _, kv := range broadcast.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["messaging.destination.name"] != "news" || attrs["realtime.recipients"] != "3" {
+		t.Fatalf("broadcast attributes = %v, want topic news and 3 recipients", attrs)
+	}
+	if len(writes) != 3 || writes["d"] != nil {
+		t.Fatalf("write spans for %v, want a, b and c", writes)
+	}
+	for id, s := range writes {
+		if s.Parent().SpanID() != broadcast.SpanContext().SpanID() {
+			t.Fatalf("write span for %s is not a child of the broadcast span", id)
+		}
+	}
+}
+
+func TestUnsampledBroadcastHasNoWriteSpans(t *testing.T) {
+	h := newTestHub(t, nil)
+	rec := tracetest.NewSpanRecorder()
+	h.tracer = newOTelTracerFrom(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec), sdktrace.WithSampler(sdktrace.NeverSample())))
+	c := testClient("a", 4)
+	c.topics["news"] = struct{}{}
+	h.add(c)
+	h.broadcastTopic("news", websocket.TextMessage, []byte(`{"n":1}`))
+	if spans := rec.Ended(); len(spans) != 0 {
+		t.Fatalf("%d spans recorded with NeverSample", len(spans))
+	}
+	if len(c.send) != 1 {
+		t.Fatalf("queued %d frames, want the message delivered regardless", len(c.send))
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req collectortrace.ExportTraceServiceRequest
+		if r.URL.Path != "/v1/traces" || proto.Unmarshal(body, &req) != nil {
+			http.Error(w, "bad export", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					names = append(names, s.Name)
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf")
+	t.Setenv("BACKEND", "memory")
+	t.Setenv("BIND_ADDR", freeAddr(t))
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := New(cfg)
+	stop := runGateway(t, g)
+	tg := &testGateway{Gateway: g, t: t, addr: cfg.BindAddr}
+	waitFor(t, "gateway to listen", func() bool {
+		resp, err := http.Get(tg.url("/healthz"))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	})
+	tg.connect("/ws", nil)
+	waitFor(t, "client registration", func() bool { return g.hub.count() == 1 })
+	g.hub.broadcast(websocket.TextMessage, []byte(`{"n":1}`))
+	// Shutdown flushes the batch.
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	got := map[string]int{}
+	for _, n := range names {
+		got[n]++
+	}
+	if got["realtime.broadcast"] != 1 || got["realtime.write"] != 1 {
+		t.Fatalf("exported spans %v, want one broadcast and one write", got)
+	}
+}
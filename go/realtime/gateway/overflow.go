@@ -0,0 +1,81 @@
+package gateway
+
+import "time"
+
+// OverflowHandler is told about each client the gateway drops because its
+// send queue overflowed, e.g. to raise an alert or to count slow consumers
+// per tenant. ClientOverflowed runs on its own goroutine, once per client,
+// after the client has been removed. It must be safe for concurrent use.
+type OverflowHandler interface {
+	ClientOverflowed(ClientOverflow)
+}
+
+// ClientOverflow describes a client at the moment its queue overflowed.
+type ClientOverflow struct {
+	ID          string
+	RemoteAddr  string
+	IP          string
+	User        string
+	Tenant      string
+	Tags        map[string]string
+	Topics      []string
+	ConnectedAt time.Time
+	// Lane is "send" for the message queue and "priority" for the control
+	// frame lane.
+	Lane string
+	// QueueDepth and QueueCapacity are the lane's length and size when the
+	// frame that didn't fit arrived; MaxQueueDepth is the deepest the send
+	// queue ever got.
+	QueueDepth    int
+	QueueCapacity int
+	MaxQueueDepth int
+}
+
+// Queue lanes, as labeled in realtime_send_queue_overflows_total.
+const (
+	laneSend     = "send"
+	lanePriority = "priority"
+)
+
+// noteDepth records depth as the client's deepest send queue if it is.
+func (c *client) noteDepth(depth int) {
+	for {
+		seen := c.maxQueueDepth.Load()
+		if int64(depth) <= seen || c.maxQueueDepth.CompareAndSwap(seen, int64(depth)) {
+			return
+		}
+	}
+}
+
+// overflow handles a frame that found c's lane full. Every such frame is
+// counted; the first one drops the client, logs why and tells the
+// OverflowHandler. Like push, the caller holds the client's shard lock.
+func (h *hub) overflow(c *client, lane string, depth, capacity int) {
+	c.overflows.Add(1)
+	sendQueueOverflows.WithLabelValues(lane).Inc()
+	if !c.overflowed.CompareAndSwap(false, true) {
+		return
+	}
+	info := ClientOverflow{
+		ID:            c.id,
+		RemoteAddr:    c.remoteAddr,
+		IP:            c.ip,
+		User:          c.userID,
+		Tenant:        c.tenant,
+		Tags:          c.tags,
+		Topics:        c.topicList(),
+		ConnectedAt:   c.connectedAt,
+		Lane:          lane,
+		QueueDepth:    depth,
+		QueueCapacity: capacity,
+		MaxQueueDepth: int(c.maxQueueDepth.Load()),
+	}
+	c.logger.Warn("ws client too slow, dropping", "lane", lane, "queue_depth", depth, "queue_capacity", capacity,
+		"max_queue_depth", info.MaxQueueDepth, "topics", len(info.Topics), "connected_for", time.Since(c.connectedAt).Round(time.Second))
+	go func() {
+		h.removeWithReason(c, disconnectSlowConsumer)
+		if h.onOverflow != nil {
+			h.onOverflow.ClientOverflowed(info)
+		}
+	}()
+}
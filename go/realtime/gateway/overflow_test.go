@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// overflowRecorder is an OverflowHandler that passes on what it is told.
+type overflowRecorder chan ClientOverflow
+
+func (r overflowRecorder) ClientOverflowed(info ClientOverflow) { r <- info }
+
+// maxDepthsObserved returns how many clients
+// realtime_send_queue_max_depth has recorded.
+func maxDepthsObserved(t *testing.T) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := sendQueueMaxDepth.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	h := newTestHub(t, nil)
+	recorder := make(overflowRecorder, 4)
+	h.onOverflow = recorder
+	c := testClient("c1", 4)
+	c.tenant = "acme"
+	c.tags = map[string]string{"platform": "ios"}
+	c.topics["orders"] = struct{}{}
+	h.add(c)
+	lane := testutil.ToFloat64(sendQueueOverflows.WithLabelValues(laneSend))
+	slow := testutil.ToFloat64(disconnects.WithLabelValues(disconnectSlowConsumer))
+	observed := maxDepthsObserved(t)
+
+	// The fifth and sixth don't fit; only the first of them drops the
+	// client, but both are counted. Pushing under the shard lock, as a
+	// broadcast does, keeps the removal from closing the queue meanwhile.
+	s := h.shardFor(c.id)
+	s.mu.RLock()
+	for range 6 {
+		h.push(c, frame{messageType: websocket.TextMessage, data: []byte(`{}`)})
+	}
+	s.mu.RUnlock()
+	if got := c.overflows.Load(); got != 2 {
+		t.Fatalf("client overflows = %d, want 2", got)
+	}
+	if got := c.maxQueueDepth.Load(); got != 4 {
+		t.Fatalf("max queue depth = %d, want 4", got)
+	}
+	if got := testutil.ToFloat64(sendQueueOverflows.WithLabelValues(laneSend)) - lane; got != 2 {
+		t.Fatalf("send lane overflows rose by %v, want 2", got)
+	}
+
+	var info ClientOverflow
+	select {
+	case info = <-recorder:
+	case <-time.After(time.Second):
+		t.Fatal("OverflowHandler not called")
+	}
+	if info.ID != "c1" || info.Tenant != "acme" || info.Tags["platform"] != "ios" || len(info.Topics) != 1 || info.Topics[0] != "orders" {
+		t.Fatalf("overflow = %+v, want the client's identity", info)
+	}
+	if info.Lane != laneSend || info.QueueDepth != 4 || info.QueueCapacity != 4 || info.MaxQueueDepth != 4 {
+		t.Fatalf("overflow = %+v, want a full send lane of 4", info)
+	}
+	// The client is gone by the time the handler hears of it.
+	if _, ok := h.get("c1"); ok {
+		t.Fatal("overflowed client still registered")
+	}
+	if got := testutil.ToFloat64(disconnects.WithLabelValues(disconnectSlowConsumer)) - slow; got != 1 {
+		t.Fatalf("slow_consumer disconnects rose by %v, want 1", got)
+	}
+	if got := maxDepthsObserved(t) - observed; got != 1 {
+		t.Fatalf("max depth observed %d times, want once at disconnect", got)
+	}
+	select {
+	case info := <-recorder:
+		t.Fatalf("OverflowHandler called again with %+v", info)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPriorityLaneOverflow(t *testing.T) {
+	h := newTestHub(t, nil)
+	recorder := make(overflowRecorder, 1)
+	h.onOverflow = recorder
+	c := testClient("c1", 4)
+	h.add(c)
+	before := testutil.ToFloat64(sendQueueOverflows.WithLabelValues(lanePriority))
+	for range cap(c.priority) + 1 {
+		h.pushPriority(c, frame{messageType: websocket.TextMessage, data: []byte(`{}`)})
+	}
+	if got := testutil.ToFloat64(sendQueueOverflows.WithLabelValues(lanePriority)) - before; got != 1 {
+		t.Fatalf("priority lane overflows rose by %v, want 1", got)
+	}
+	select {
+	case info := <-recorder:
+		if info.Lane != lanePriority || info.QueueDepth != cap(c.priority) {
+			t.Fatalf("overflow = %+v, want a full priority lane", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OverflowHandler not called")
+	}
+}
+
+func TestOverflowWithoutHandler(t *testing.T) {
+	h := newTestHub(t, nil)
+	c := testClient("c1", 1)
+	h.add(c)
+	s := h.shardFor(c.id)
+	s.mu.RLock()
+	h.push(c, frame{messageType: websocket.TextMessage, data: []byte(`{}`)})
+	h.push(c, frame{messageType: websocket.TextMessage, data: []byte(`{}`)})
+	s.mu.RUnlock()
+	// Only logged, and the client dropped all the same.
+	waitFor(t, "the client to be dropped", func() bool {
+		_, ok := h.get("c1")
+		return !ok
+	})
+}
+
+func TestQueueStatsInAdminListing(t *testing.T) {
+	tg := startGateway(t, map[string]string{"ADMIN_TOKEN": "admin", "SEND_BUFFER": "16"})
+	conn, id := tg.connect("/ws", nil)
+	c, _ := tg.hub.get(id)
+	for range 3 {
+		tg.hub.broadcast(websocket.TextMessage, []byte(`{}`))
+	}
+	for range 3 {
+		readFrame(t, conn)
+	}
+	req, _ := http.NewRequest(http.MethodGet, tg.url("/admin/clients"), nil)
+	req.Header.Set(adminTokenHeader, "admin")
+	code, body := status(t, req)
+	var listing struct{ Clients []clientInfo }
+	if err := json.Unmarshal([]byte(body), &listing); code != http.StatusOK || err != nil || len(listing.Clients) != 1 {
+		t.Fatalf("GET /admin/clients = %d %s", code, body)
+	}
+	info := listing.Clients[0]
+	if info.QueueDepth != 0 || info.QueueCapacity != 16 || info.Overflows != 0 {
+		t.Fatalf("listing = %+v, want an empty queue of 16 that never overflowed", info)
+	}
+	if info.MaxQueueDepth < 1 || info.MaxQueueDepth != c.maxQueueDepth.Load() {
+		t.Fatalf("max_queue_depth = %d, want the deepest the queue got", info.MaxQueueDepth)
+	}
+}
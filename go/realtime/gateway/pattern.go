@@ -0,0 +1,106 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxPatternWildcards caps the "*" wildcards in one pattern.
+const maxPatternWildcards = 4
+
+// validPattern checks a subscription pattern: a topic name in which "*"
+// matches any run of characters, e.g. "orders.*" or "*.eu.*".
+func validPattern(p string) error {
+	n := strings.Count(p, "*")
+	switch {
+	case n == 0:
+		return errors.New("pattern has no * wildcard; subscribe to the topic instead")
+	case n > maxPatternWildcards:
+		return fmt.Errorf("pattern has more than %d wildcards", maxPatternWildcards)
+	}
+	return nil
+}
+
+// globMatch reports whether topic matches pattern, where "*" matches any
+// run of characters, including none. A failed match backtracks only to the
+// last "*", so the cost stays proportional to len(pattern)*len(topic).
+func globMatch(pattern, topic string) bool {
+	p, t := 0, 0
+	star, mark := -1, 0
+	for t < len(topic) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, t
+			p++
+		case p < len(pattern) && pattern[p] == topic[t]:
+			p++
+			t++
+		case star >= 0:
+			p = star + 1
+			mark++
+			t = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchesPattern reports whether topic matches one of the client's
+// patterns. Internal topics such as __stats__ need an exact subscription.
+// The caller must hold c.mu.
+func (c *client) matchesPattern(topic string) bool {
+	if len(c.patterns) == 0 || strings.HasPrefix(topic, "__") {
+		return false
+	}
+	for p := range c.patterns {
+		if globMatch(p, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// patternList returns the client's patterns in sorted order.
+func (c *client) patternList() []string {
+	c.mu.Lock()
+	patterns := make([]string, 0, len(c.patterns))
+	for p := range c.patterns {
+		patterns = append(patterns, p)
+	}
+	c.mu.Unlock()
+	sort.Strings(patterns)
+	return patterns
+}
+
+// subscribePattern adds pattern to c, failing once c holds maxPatterns.
+func (h *hub) subscribePattern(c *client, pattern string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.patterns[pattern]; ok {
+		return nil
+	}
+	if len(c.patterns) >= h.maxPatterns {
+		return fmt.Errorf("at most %d pattern subscriptions per connection", h.maxPatterns)
+	}
+	if h.subscriptionsFull(c) {
+		subscriptionsRejected.Inc()
+		return fmt.Errorf("at most %d subscriptions per connection", h.maxSubscriptions)
+	}
+	if c.patterns == nil {
+		c.patterns = make(map[string]struct{})
+	}
+	c.patterns[pattern] = struct{}{}
+	return nil
+}
+
+func (h *hub) unsubscribePattern(c *client, pattern string) {
+	c.mu.Lock()
+	delete(c.patterns, pattern)
+	c.mu.Unlock()
+}
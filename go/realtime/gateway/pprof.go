@@ -0,0 +1,27 @@
+package gateway
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+)
+
+// pprofHandler serves the net/http/pprof endpoints under /debug/pprof/.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// servePprof runs the profiling endpoints on their own listener, typically
+// bound to an internal interface such as 127.0.0.1:6060.
+func servePprof(addr string, handler http.Handler) {
+	slog.Info("pprof listening", "addr", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		slog.Error("pprof server error", "addr", addr, "err", err)
+	}
+}
@@ -0,0 +1,163 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// presenceTracker records which client IDs are online in each topic. Members
+// live in a Redis sorted set per topic, scored by the time they were last
+// refreshed, so every gateway instance sees the same roster and entries left
+// behind by a crashed instance age out after ttl. Each change is published on
+// the topic's channel so subscribers on all instances receive it.
+type presenceTracker struct {
+	rdb         *redis.Client
+	keyPrefix   string
+	topicPrefix string
+	ttl         time.Duration
+
+	// events serializes joins and leaves so they reach Redis in order.
+	events chan presenceEvent
+	// members holds the locally connected IDs per topic; only run touches it.
+	members map[string]map[string]struct{}
+}
+
+type presenceEvent struct {
+	topic  string
+	id     string
+	joined bool
+}
+
+// presencePrefix starts every encoded presenceMessage, which is how
+// broadcastTopic tells presence changes from other topic messages.
+var presencePrefix = []byte(`{"type":"presence",`)
+
+// presenceMessage is delivered to topic subscribers when membership changes.
+type presenceMessage struct {
+	Type   string   `json:"type"`
+	Topic  string   `json:"topic"`
+	Online []string `json:"online"`
+	Joined string   `json:"joined,omitempty"`
+	Left   string   `json:"left,omitempty"`
+}
+
+func newPresenceTracker(rdb *redis.Client, topicPrefix string, ttl time.Duration) *presenceTracker {
+	return &presenceTracker{
+		rdb:         rdb,
+		keyPrefix:   "realtime:presence:",
+		topicPrefix: topicPrefix,
+		ttl:         ttl,
+		events:      make(chan presenceEvent, 1024),
+		members:     make(map[string]map[string]struct{}),
+	}
+}
+
+func (p *presenceTracker) join(topic, id string)  { p.queue(presenceEvent{topic, id, true}) }
+func (p *presenceTracker) leave(topic, id string) { p.queue(presenceEvent{topic, id, false}) }
+
+func (p *presenceTracker) queue(ev presenceEvent) {
+	select {
+	case p.events <- ev:
+	default:
+		slog.Warn("presence queue full, dropping event", "topic", ev.topic, "client", ev.id)
+	}
+}
+
+// run applies presence events and refreshes local memberships every ttl/3
+// until ctx is cancelled.
+func (p *presenceTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(p.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-p.events:
+			p.apply(ctx, ev)
+		case <-ticker.C:
+			p.refresh(ctx)
+		}
+	}
+}
+
+func (p *presenceTracker) apply(ctx context.Context, ev presenceEvent) {
+	key := p.keyPrefix + ev.topic
+	now := time.Now()
+	var err error
+	if ev.joined {
+		if p.members[ev.topic] == nil {
+			p.members[ev.topic] = make(map[string]struct{})
+		}
+		p.members[ev.topic][ev.id] = struct{}{}
+		pipe := p.rdb.TxPipeline()
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixMilli()), Member: ev.id})
+		pipe.Expire(ctx, key, p.ttl)
+		_, err = pipe.Exec(ctx)
+	} else {
+		delete(p.members[ev.topic], ev.id)
+		if len(p.members[ev.topic]) == 0 {
+			delete(p.members, ev.topic)
+		}
+		err = p.rdb.ZRem(ctx, key, ev.id).Err()
+	}
+	if err != nil {
+		slog.Error("presence update failed", "topic", ev.topic, "client", ev.id, "err", err)
+		return
+	}
+
+	online, err := p.online(ctx, ev.topic, now)
+	if err != nil {
+		slog.Error("presence read failed", "topic", ev.topic, "err", err)
+		return
+	}
+	msg := presenceMessage{Type: "presence", Topic: ev.topic, Online: online}
+	if ev.joined {
+		msg.Joined = ev.id
+	} else {
+		msg.Left = ev.id
+	}
+	payload, _ := json.Marshal(msg)
+	if err := p.rdb.Publish(ctx, p.topicPrefix+ev.topic, payload).Err(); err != nil {
+		slog.Error("presence publish failed", "topic", ev.topic, "err", err)
+	}
+}
+
+// online drops expired members and returns the remaining roster.
+func (p *presenceTracker) online(ctx context.Context, topic string, now time.Time) ([]string, error) {
+	key := p.keyPrefix + topic
+	cutoff := strconv.FormatInt(now.Add(-p.ttl).UnixMilli(), 10)
+	if err := p.rdb.ZRemRangeByScore(ctx, key, "-inf", "("+cutoff).Err(); err != nil {
+		return nil, err
+	}
+	ids, err := p.rdb.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// refresh re-scores this instance's members so they don't expire.
+func (p *presenceTracker) refresh(ctx context.Context) {
+	score := float64(time.Now().UnixMilli())
+	pipe := p.rdb.Pipeline()
+	for topic, ids := range p.members {
+		key := p.keyPrefix + topic
+		for id := range ids {
+			pipe.ZAdd(ctx, key, redis.Z{Score: score, Member: id})
+		}
+		pipe.Expire(ctx, key, p.ttl)
+	}
+	if pipe.Len() == 0 {
+		return
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("presence refresh failed", "err", err)
+	}
+}
@@ -0,0 +1,366 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Actions a client may send over the socket.
+const (
+	actionSubscribe   = "subscribe"
+	actionUnsubscribe = "unsubscribe"
+	actionPublish     = "publish"
+	actionAck         = "ack"
+)
+
+// Wire protocol versions negotiated through Sec-WebSocket-Protocol. Clients
+// that offer none get protocolV1.
+const (
+	protocolV1 = "realtime.v1"
+	protocolV2 = "realtime.v2"
+)
+
+// subprotocols lists the supported versions, most preferred first.
+var subprotocols = []string{protocolV2, protocolV1}
+
+// wireProtocol holds what differs between protocol versions: how the welcome
+// frame is written and how control messages are read.
+type wireProtocol struct {
+	// namesProtocol adds the version to the welcome frame.
+	namesProtocol bool
+	// strict rejects control messages with fields the version doesn't
+	// define, where realtime.v1 ignores them.
+	strict bool
+}
+
+var wireProtocols = map[string]wireProtocol{
+	protocolV1: {},
+	protocolV2: {namesProtocol: true, strict: true},
+}
+
+// wireFor returns the rules of the negotiated protocol; anything else, as
+// for clients that offered none, is realtime.v1.
+func wireFor(protocol string) wireProtocol {
+	return wireProtocols[protocol]
+}
+
+// decodeControl reads a control message under protocol's rules.
+func decodeControl(protocol string, data []byte) (controlMessage, error) {
+	var msg controlMessage
+	if !wireFor(protocol).strict {
+		err := json.Unmarshal(data, &msg)
+		return msg, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&msg); err != nil {
+		return msg, err
+	}
+	if dec.More() {
+		return msg, errTrailingData
+	}
+	return msg, nil
+}
+
+var errTrailingData = errors.New("data after the JSON object")
+
+// supportsAny reports whether any offered subprotocol is supported.
+func supportsAny(offered []string) bool {
+	for _, o := range offered {
+		for _, p := range subprotocols {
+			if o == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxTopicLength caps topic and channel names in control messages.
+const maxTopicLength = 256
+
+// controlMessage is the JSON envelope clients send, e.g.
+// {"action":"subscribe","topic":"room5"} or
+// {"action":"publish","channel":"realtime:topic:room5","data":{...}}.
+// {"action":"ack","id":"..."} acknowledges a message in ack mode.
+type controlMessage struct {
+	Action  string          `json:"action"`
+	Topic   string          `json:"topic,omitempty"`
+	Channel string          `json:"channel,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	// Echo set to false keeps a publish from being delivered back to the
+	// publishing client.
+	Echo *bool `json:"echo,omitempty"`
+	// Pattern is a glob such as "orders.*" for subscribe and unsubscribe,
+	// used instead of Topic.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// ackMessage confirms that a control message took effect.
+type ackMessage struct {
+	Type    string `json:"type"`
+	Action  string `json:"action"`
+	Topic   string `json:"topic,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	// Seq is the sequence number assigned to a publish when SEQUENCE_ENABLED
+	// is set.
+	Seq int64 `json:"seq,omitempty"`
+	// Granted and Denied answer the ?topics= of an upgrade when topic
+	// authorization is enabled.
+	Granted []string `json:"granted,omitempty"`
+	Denied  []string `json:"denied,omitempty"`
+}
+
+// errorMessage tells the client a control message was rejected.
+type errorMessage struct {
+	Type    string `json:"type"`
+	Action  string `json:"action,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Flow states reported to a client as its send queue fills and drains.
+const (
+	flowCongested = "congested"
+	flowOK        = "ok"
+)
+
+// flowMessage warns a client that its send queue is filling up, or that it
+// has drained again.
+type flowMessage struct {
+	Type  string `json:"type"`
+	State string `json:"state"`
+}
+
+// maxBatchMessages caps how many messages one batch frame carries.
+const maxBatchMessages = 256
+
+// batchMessage coalesces the text frames queued within BATCH_WINDOW for a
+// client that asked for batching.
+type batchMessage struct {
+	Type     string            `json:"type"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// encodeBatch wraps text frames in a batch frame; a single frame is sent as
+// is. Text that is not JSON is embedded as a string.
+func encodeBatch(frames []frame) frame {
+	if len(frames) == 1 {
+		return frames[0]
+	}
+	batch := batchMessage{Type: "batch", Messages: make([]json.RawMessage, len(frames))}
+	for i, f := range frames {
+		if json.Valid(f.data) {
+			batch.Messages[i] = f.data
+		} else {
+			batch.Messages[i], _ = json.Marshal(string(f.data))
+		}
+	}
+	b, _ := json.Marshal(batch)
+	return frame{messageType: websocket.TextMessage, data: b}
+}
+
+// keyspaceMessage reports a change to a Redis key, e.g. the "set" or "del"
+// event from a keyspace notification.
+type keyspaceMessage struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Event string `json:"event"`
+}
+
+// Values of PING_MODE.
+const (
+	pingModeControl = "control"
+	pingModeApp     = "app"
+	pingModeBoth    = "both"
+)
+
+// pingMessage is the application-level ping, for clients whose WebSocket API
+// hides control frames; they answer {"type":"pong"}.
+type pingMessage struct {
+	Type string `json:"type"`
+	TS   int64  `json:"ts"` // Unix milliseconds
+}
+
+func encodePing(now time.Time) []byte {
+	b, _ := json.Marshal(pingMessage{Type: "ping", TS: now.UnixMilli()})
+	return b
+}
+
+// isPong reports whether data is a client's {"type":"pong"}.
+func isPong(data []byte) bool {
+	if !bytes.Contains(data, []byte(`"pong"`)) {
+		return false
+	}
+	var msg struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(data, &msg) == nil && msg.Type == "pong"
+}
+
+func encodeKeyspace(key, event string) []byte {
+	b, _ := json.Marshal(keyspaceMessage{Type: "keyspace", Key: key, Event: event})
+	return b
+}
+
+// reconnectMessage is sent just before the gateway closes a connection it
+// wants the client to re-establish, e.g. on shutdown. AfterMS is how long
+// the client should wait first.
+type reconnectMessage struct {
+	Type    string `json:"type"`
+	AfterMS int64  `json:"after_ms"`
+	Reason  string `json:"reason"`
+}
+
+func encodeReconnect(after time.Duration, reason string) []byte {
+	b, _ := json.Marshal(reconnectMessage{Type: "reconnect", AfterMS: after.Milliseconds(), Reason: reason})
+	return b
+}
+
+// gapMessage stands in for replayed stream entries that were skipped, e.g.
+// because their ttl_ms ran out: Count entries on Topic from ID From to To.
+// A cursor resume that can't deliver everything since the cursor reports the
+// entries after From and before To as missing instead, without a count, and
+// without To when nothing after the cursor is left.
+type gapMessage struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	Topic  string `json:"topic,omitempty"`
+	From   string `json:"from"`
+	To     string `json:"to,omitempty"`
+	Count  int    `json:"count,omitempty"`
+}
+
+func encodeGap(gap gapMessage) []byte {
+	b, _ := json.Marshal(gap)
+	return b
+}
+
+// directMessage is the Redis payload for targeted delivery, e.g.
+// {"to":"<client id>","data":{...}}, or {"to_user":"<user id>",...} for every
+// connection of a user. Only data is forwarded to the client.
+type directMessage struct {
+	To     string          `json:"to"`
+	ToUser string          `json:"to_user"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// welcomeMessage is the first frame on every connection and tells the client
+// its ID. From realtime.v2 on it also names the negotiated protocol. With
+// RESUME_WINDOW set it carries the session to resume with, whether this
+// connection resumed one, and whether the oldest buffered messages were
+// dropped to stay within RESUME_BUFFER.
+type welcomeMessage struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Protocol  string `json:"protocol,omitempty"`
+	Session   string `json:"session,omitempty"`
+	Resumed   bool   `json:"resumed,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+func encodeWelcome(id, protocol string) []byte {
+	return encodeWelcomeMessage(protocol, welcomeMessage{Type: "welcome", ID: id})
+}
+
+func encodeSessionWelcome(id, protocol, session string, resumed, truncated bool) []byte {
+	return encodeWelcomeMessage(protocol, welcomeMessage{Type: "welcome", ID: id, Session: session, Resumed: resumed, Truncated: truncated})
+}
+
+func encodeWelcomeMessage(protocol string, msg welcomeMessage) []byte {
+	if wireFor(protocol).namesProtocol {
+		msg.Protocol = protocol
+	}
+	b, _ := json.Marshal(msg)
+	return b
+}
+
+func encodeAck(msg controlMessage) []byte {
+	b, _ := json.Marshal(ackMessage{Type: "ack", Action: msg.Action, Topic: msg.Topic, Pattern: msg.Pattern, Channel: msg.Channel})
+	return b
+}
+
+func encodePublishAck(channel string, seq int64) []byte {
+	b, _ := json.Marshal(ackMessage{Type: "ack", Action: actionPublish, Channel: channel, Seq: seq})
+	return b
+}
+
+func encodeTopicsAck(granted, denied []string) []byte {
+	b, _ := json.Marshal(ackMessage{Type: "ack", Action: actionSubscribe, Granted: granted, Denied: denied})
+	return b
+}
+
+func encodeFlow(state string) []byte {
+	b, _ := json.Marshal(flowMessage{Type: "flow", State: state})
+	return b
+}
+
+func encodeError(action, code, message string) []byte {
+	b, _ := json.Marshal(errorMessage{Type: "error", Action: action, Code: code, Message: message})
+	return b
+}
+
+// describeJSONError turns a decoding failure into a message fit for an error
+// frame, without echoing the client's payload back.
+func describeJSONError(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return "malformed JSON: " + syntaxErr.Error()
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return fmt.Sprintf("field %q must be a %s", typeErr.Field, typeErr.Type)
+	case errors.As(err, &typeErr):
+		return "message must be a JSON object"
+	case errors.Is(err, errTrailingData):
+		return "malformed JSON: " + err.Error()
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// DisallowUnknownFields has no error type of its own.
+		return strings.TrimPrefix(err.Error(), "json: ")
+	default:
+		return "invalid JSON"
+	}
+}
+
+// parseMessageType maps "text" or "binary" to the WebSocket frame type.
+func parseMessageType(s string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "text":
+		return websocket.TextMessage, nil
+	case "binary":
+		return websocket.BinaryMessage, nil
+	default:
+		return 0, fmt.Errorf("invalid message type %q; expected text or binary", s)
+	}
+}
+
+// parseTopicTypes reads per-topic frame types such as
+// "telemetry:binary,chat:text". Topic names may contain ':', so the type is
+// what follows the last one.
+func parseTopicTypes(raw string) (map[string]int, error) {
+	types := make(map[string]int)
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndexByte(pair, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid TOPIC_MESSAGE_TYPES entry %q; expected topic:type", pair)
+		}
+		topic, kind := pair[:i], pair[i+1:]
+		t, err := parseMessageType(kind)
+		if err != nil {
+			return nil, err
+		}
+		types[topic] = t
+	}
+	return types, nil
+}
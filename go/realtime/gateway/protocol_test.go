@@ -0,0 +1,273 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseTopicTypes(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    map[string]int
+		wantErr bool
+	}{
+		{raw: "", want: map[string]int{}},
+		{raw: "telemetry:binary, chat:text", want: map[string]int{"telemetry": websocket.BinaryMessage, "chat": websocket.TextMessage}},
+		{raw: "tenant:acme:telemetry:binary", want: map[string]int{"tenant:acme:telemetry": websocket.BinaryMessage}},
+		{raw: "orders:eu:binary", want: map[string]int{"orders:eu": websocket.BinaryMessage}},
+		{raw: "telemetry", wantErr: true},
+		{raw: ":binary", wantErr: true},
+		{raw: "telemetry:", wantErr: true},
+		{raw: "tenant:acme:telemetry", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTopicTypes(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTopicTypes(%q) = %v, want an error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tt.want) {
+			t.Errorf("parseTopicTypes(%q) = %v, %v; want %v", tt.raw, got, err, tt.want)
+			continue
+		}
+		for topic, mt := range tt.want {
+			if got[topic] != mt {
+				t.Errorf("parseTopicTypes(%q)[%q] = %d, want %d", tt.raw, topic, got[topic], mt)
+			}
+		}
+	}
+}
+
+func TestBinaryBroadcastArrivesIntact(t *testing.T) {
+	tg := startGateway(t, map[string]string{
+		"PUBLISH_TOKEN":       "pub",
+		"TENANT_FROM":         "header",
+		"TOPIC_MESSAGE_TYPES": "telemetry:binary,tenant:beta:telemetry:text",
+	})
+	payload := []byte{0x00, 0xff, 0x10, '\n', 0x80, 0xc3, 0x28}
+	publish := func(topic string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, tg.url("/publish/"+topic), bytes.NewReader(payload))
+		req.Header.Set("X-Publish-Token", "pub")
+		if code, body := status(t, req); code != http.StatusOK && code != http.StatusAccepted {
+			t.Fatalf("publish %s = %d %s", topic, code, body)
+		}
+	}
+	tests := []struct {
+		name, tenant, topic string
+		want                int
+	}{
+		{name: "untenanted", topic: "telemetry", want: websocket.BinaryMessage},
+		{name: "scoped topic uses the unscoped entry", tenant: "acme", topic: "tenant:acme:telemetry", want: websocket.BinaryMessage},
+		{name: "scoped entry wins", tenant: "beta", topic: "tenant:beta:telemetry", want: websocket.TextMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.tenant != "" {
+				header.Set("X-Tenant-ID", tt.tenant)
+			}
+			conn, _ := tg.connect("/ws?topics=telemetry", header)
+			publish(tt.topic)
+			mt, data := readFrame(t, conn)
+			if mt != tt.want || !bytes.Equal(data, payload) {
+				t.Fatalf("got frame type %d % x, want type %d % x", mt, data, tt.want, payload)
+			}
+		})
+	}
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	tg := startGateway(t, nil)
+	tests := []struct {
+		name       string
+		offered    []string
+		want       string
+		wantStatus int
+	}{
+		{name: "none", want: ""},
+		{name: "v1 only", offered: []string{"realtime.v1"}, want: "realtime.v1"},
+		{name: "highest wins", offered: []string{"realtime.v1", "realtime.v2"}, want: "realtime.v2"},
+		{name: "unknown ones skipped", offered: []string{"realtime.v9", "realtime.v1"}, want: "realtime.v1"},
+		{name: "only unsupported", offered: []string{"realtime.v9"}, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: tt.offered}
+			conn, resp, err := dialer.Dial("ws://"+tg.addr+"/ws", nil)
+			if tt.wantStatus != 0 {
+				if err == nil {
+					conn.Close()
+					t.Fatal("upgrade succeeded")
+				}
+				if resp == nil || resp.StatusCode != tt.wantStatus {
+					t.Fatalf("response = %v, want %d", resp, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != tt.want {
+				t.Fatalf("Sec-WebSocket-Protocol = %q, want %q", got, tt.want)
+			}
+			welcome := readJSON(t, conn)
+			if tt.want == protocolV2 && welcome["protocol"] != protocolV2 {
+				t.Fatalf("v2 welcome = %v, want it to name the protocol", welcome)
+			}
+			if tt.want != protocolV2 && welcome["protocol"] != nil {
+				t.Fatalf("v1 welcome = %v, want no protocol field", welcome)
+			}
+		})
+	}
+}
+
+func TestControlDecodingByProtocol(t *testing.T) {
+	tg := startGateway(t, nil)
+	tests := []struct {
+		name, frame string
+		wantV1      string
+		wantV2      string
+	}{
+		{name: "valid", frame: `{"action":"subscribe","topic":"a"}`, wantV1: "ack", wantV2: "ack"},
+		{name: "unknown field", frame: `{"action":"subscribe","topic":"a","topics":"b"}`, wantV1: "ack", wantV2: `unknown field "topics"`},
+		{name: "trailing data", frame: `{"action":"subscribe","topic":"a"} {}`, wantV1: "malformed JSON", wantV2: "malformed JSON"},
+	}
+	for _, proto := range []string{protocolV1, protocolV2} {
+		dialer := websocket.Dialer{Subprotocols: []string{proto}}
+		conn, _, err := dialer.Dial("ws://"+tg.addr+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		readJSON(t, conn)
+		for _, tt := range tests {
+			t.Run(proto+"/"+tt.name, func(t *testing.T) {
+				want := tt.wantV1
+				if proto == protocolV2 {
+					want = tt.wantV2
+				}
+				conn.WriteMessage(websocket.TextMessage, []byte(tt.frame))
+				msg := readJSON(t, conn)
+				if want == "ack" {
+					if msg["type"] != "ack" {
+						t.Fatalf("reply = %v, want an ack", msg)
+					}
+					return
+				}
+				if msg["code"] != "bad_request" || !strings.Contains(msg["message"].(string), want) {
+					t.Fatalf("reply = %v, want bad_request mentioning %q", msg, want)
+				}
+			})
+		}
+	}
+}
+
+func TestIsPong(t *testing.T) {
+	for data, want := range map[string]bool{
+		`{"type":"pong"}`:                    true,
+		`{"type":"pong","ts":17}`:            true,
+		`{"type":"ping"}`:                    false,
+		`{"action":"publish","data":"pong"}`: false,
+		`pong`:                               false,
+	} {
+		if got := isPong([]byte(data)); got != want {
+			t.Errorf("isPong(%s) = %v, want %v", data, got, want)
+		}
+	}
+}
+
+// appPings reads conn until it closes, answering app pings when answer is
+// set, and returns how many it got and the close code.
+func appPings(t *testing.T, conn *websocket.Conn, answer bool, until time.Duration) (pings, code int) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(until))
+	for {
+		_, data, err := conn.ReadMessage()
+		var ce *websocket.CloseError
+		switch {
+		case errors.As(err, &ce):
+			return pings, ce.Code
+		case err != nil:
+			return pings, 0
+		case bytes.HasPrefix(data, []byte(`{"type":"ping","ts":`)):
+			pings++
+			if answer {
+				sendJSON(t, conn, map[string]string{"type": "pong"})
+			}
+		}
+	}
+}
+
+func TestAppPingMissedPongsDisconnect(t *testing.T) {
+	tg := startGateway(t, map[string]string{"PING_MODE": "app", "APP_PING_INTERVAL": "50ms", "APP_PONG_MISSES": "2"})
+	conn, _ := tg.connect("/ws", nil)
+	start := time.Now()
+	pings, code := appPings(t, conn, false, 2*time.Second)
+	if code != websocket.CloseGoingAway {
+		t.Fatalf("close code = %d after %d pings, want %d", code, pings, websocket.CloseGoingAway)
+	}
+	if pings != 2 {
+		t.Fatalf("closed after %d unanswered pings, want APP_PONG_MISSES=2", pings)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("closed after %v, before the pings could be answered", elapsed)
+	}
+}
+
+func TestAppPingAnsweredKeepsConnection(t *testing.T) {
+	tg := startGateway(t, map[string]string{"PING_MODE": "app", "APP_PING_INTERVAL": "30ms", "APP_PONG_MISSES": "1"})
+	conn, id := tg.connect("/ws", nil)
+	pings, code := appPings(t, conn, true, 300*time.Millisecond)
+	if code != 0 || pings < 4 {
+		t.Fatalf("got %d pings and close code %d, want a live connection", pings, code)
+	}
+	c, ok := tg.hub.get(id)
+	if !ok {
+		t.Fatal("client gone despite answering every ping")
+	}
+	// Pongs are liveness only, not client messages.
+	if n := c.messagesIn.Load(); n != 0 {
+		t.Fatalf("pongs counted as %d received messages", n)
+	}
+}
+
+func TestPingModes(t *testing.T) {
+	tests := []struct {
+		mode                 string
+		wantControl, wantApp bool
+	}{
+		{mode: "control", wantControl: true},
+		{mode: "app", wantApp: true},
+		{mode: "both", wantControl: true, wantApp: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			tg := startGateway(t, map[string]string{
+				"PING_MODE": tt.mode, "PING_INTERVAL": "30ms", "PONG_TIMEOUT": "1s", "APP_PING_INTERVAL": "30ms",
+			})
+			conn, _ := tg.connect("/ws", nil)
+			var control int
+			conn.SetPingHandler(func(string) error {
+				control++
+				return conn.WriteControl(websocket.PongMessage, nil, time.Now().Add(time.Second))
+			})
+			app, code := appPings(t, conn, true, 200*time.Millisecond)
+			if code != 0 {
+				t.Fatalf("closed with %d", code)
+			}
+			if (control > 0) != tt.wantControl || (app > 0) != tt.wantApp {
+				t.Fatalf("got %d control and %d app pings", control, app)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// proxyTrust resolves the client IP of a request that may have passed
+// through reverse proxies. Forwarding headers are only read when enabled is
+// set and the socket peer is a trusted proxy, so a client connecting
+// directly cannot spoof its address.
+type proxyTrust struct {
+	enabled bool
+	// trusted lists the proxy networks. When empty, only the socket peer is
+	// trusted, which suits a single proxy in front of the gateway.
+	trusted []netip.Prefix
+}
+
+// clientIP returns the address r came from. Behind trusted proxies that is
+// the rightmost X-Forwarded-For hop that isn't itself a trusted proxy, or
+// X-Real-IP when no X-Forwarded-For is present. Entries further left are
+// supplied by the client and can be forged, so they are never used.
+func (p *proxyTrust) clientIP(r *http.Request) string {
+	peer := remoteHost(r.RemoteAddr)
+	if p == nil || !p.enabled || !p.trusts(peer, true) {
+		return peer
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				// Garbage in the chain; don't trust anything left of it.
+				return peer
+			}
+			if i == 0 || !p.trusts(hop, false) {
+				return hop
+			}
+		}
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); real != "" {
+		if _, err := netip.ParseAddr(real); err == nil {
+			return real
+		}
+	}
+	return peer
+}
+
+// trusts reports whether ip belongs to a trusted proxy. Without a
+// TRUSTED_PROXIES list only the socket peer is.
+func (p *proxyTrust) trusts(ip string, isPeer bool) bool {
+	if len(p.trusted) == 0 {
+		return isPeer
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost strips the port from a RemoteAddr.
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// parseTrustedProxies reads a comma-separated list of CIDRs or bare IPs.
+func parseTrustedProxies(items []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(items))
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,85 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		trust  *proxyTrust
+		peer   string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{name: "trust disabled ignores headers", trust: &proxyTrust{}, peer: "10.0.0.1", xff: []string{"203.0.113.9"}, realIP: "203.0.113.8", want: "10.0.0.1"},
+		{name: "nil trust", peer: "10.0.0.1", xff: []string{"203.0.113.9"}, want: "10.0.0.1"},
+		{name: "single proxy", trust: &proxyTrust{enabled: true}, peer: "10.0.0.1", xff: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "single proxy takes the hop it added", trust: &proxyTrust{enabled: true}, peer: "10.0.0.1", xff: []string{"1.1.1.1, 203.0.113.9"}, want: "203.0.113.9"},
+		{name: "untrusted peer can't spoof", trust: &proxyTrust{enabled: true, trusted: proxies}, peer: "198.51.100.7", xff: []string{"1.1.1.1"}, realIP: "1.1.1.2", want: "198.51.100.7"},
+		{name: "chained proxies", trust: &proxyTrust{enabled: true, trusted: proxies}, peer: "10.0.0.1", xff: []string{"203.0.113.9, 192.168.1.1, 10.2.2.2"}, want: "203.0.113.9"},
+		{name: "forged hops left of the client", trust: &proxyTrust{enabled: true, trusted: proxies}, peer: "10.0.0.1", xff: []string{"1.1.1.1, 10.9.9.9, 203.0.113.9, 10.2.2.2"}, want: "203.0.113.9"},
+		{name: "several headers", trust: &proxyTrust{enabled: true, trusted: proxies}, peer: "10.0.0.1", xff: []string{"203.0.113.9", "10.2.2.2"}, want: "203.0.113.9"},
+		{name: "every hop trusted", trust: &proxyTrust{enabled: true, trusted: proxies}, peer: "10.0.0.1", xff: []string{"10.3.3.3, 10.2.2.2"}, want: "10.3.3.3"},
+		{name: "garbage in the chain", trust: &proxyTrust{enabled: true, trusted: proxies}, peer: "10.0.0.1", xff: []string{"203.0.113.9, not-an-ip, 10.2.2.2"}, want: "10.0.0.1"},
+		{name: "x-real-ip", trust: &proxyTrust{enabled: true}, peer: "10.0.0.1", realIP: "203.0.113.9", want: "203.0.113.9"},
+		{name: "invalid x-real-ip", trust: &proxyTrust{enabled: true}, peer: "10.0.0.1", realIP: "nope", want: "10.0.0.1"},
+		{name: "x-forwarded-for wins", trust: &proxyTrust{enabled: true}, peer: "10.0.0.1", xff: []string{"203.0.113.9"}, realIP: "203.0.113.8", want: "203.0.113.9"},
+		{name: "ipv4-mapped peer", trust: &proxyTrust{enabled: true, trusted: proxies}, peer: "::ffff:10.0.0.1", xff: []string{"203.0.113.9"}, want: "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			r.RemoteAddr = netip.AddrPortFrom(netip.MustParseAddr(tt.peer), 40000).String()
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := tt.trust.clientIP(r); got != tt.want {
+				t.Fatalf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	got, err := parseTrustedProxies([]string{"10.1.2.3/8", "192.168.1.1", "::ffff:172.16.0.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.1/32", "172.16.0.1/32", "2001:db8::/32"}
+	for i, p := range got {
+		if p.String() != want[i] {
+			t.Fatalf("prefix %d = %s, want %s", i, p, want[i])
+		}
+	}
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("invalid CIDR accepted")
+	}
+}
+
+func TestResolvedIPInAdminListing(t *testing.T) {
+	tg := startGateway(t, map[string]string{"TRUST_PROXY": "true", "ADMIN_TOKEN": "admin"})
+	tg.connect("/ws", http.Header{"X-Forwarded-For": {"1.1.1.1, 203.0.113.9"}})
+	req, _ := http.NewRequest(http.MethodGet, tg.url("/admin/clients"), nil)
+	req.Header.Set(adminTokenHeader, "admin")
+	code, body := status(t, req)
+	var listing struct{ Clients []clientInfo }
+	if err := json.Unmarshal([]byte(body), &listing); code != http.StatusOK || err != nil {
+		t.Fatalf("GET /admin/clients = %d %s", code, body)
+	}
+	if len(listing.Clients) != 1 || listing.Clients[0].IP != "203.0.113.9" {
+		t.Fatalf("listing = %s, want ip 203.0.113.9", body)
+	}
+}
@@ -0,0 +1,124 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// validTopicName restricts topics published over HTTP to names that are safe
+// in Redis channel names and logs; the length matches maxTopicLength.
+var validTopicName = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,256}$`)
+
+// publishHandler serves POST /publish for BACKEND=memory: the request body is
+// broadcast to every client, or to the subscribers of ?topic= when given,
+// narrowed to the clients matching ?where= when given.
+func (h *hub) publishHandler(maxSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		payload, ok := readPayload(w, r, maxSize)
+		if !ok {
+			return
+		}
+		if payload, ok = applyWhere(w, r, payload); !ok {
+			return
+		}
+		messagesReceived.Inc()
+		if topic := r.URL.Query().Get("topic"); topic != "" {
+			h.broadcastTopic(topic, h.typeFor(topic), payload)
+		} else {
+			h.broadcast(h.typeFor(""), payload)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// topicPublishHandler serves POST /publish/{topic}. With a Redis backend the
+// body is published to <topicPrefix><topic>, or added to the stream with that
+// topic, so every instance delivers it; in memory mode it is broadcast
+// directly and the response reports how many local clients it was queued for.
+// ?where= narrows delivery the same way as for POST /publish; every instance
+// evaluates it against its own clients.
+func (h *hub) topicPublishHandler(topicPrefix string, maxSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		topic := r.PathValue("topic")
+		if !validTopicName.MatchString(topic) {
+			http.Error(w, "topic must be 1-256 characters of letters, digits, '_', '.', ':' or '-'", http.StatusBadRequest)
+			return
+		}
+		payload, ok := readPayload(w, r, maxSize)
+		if !ok {
+			return
+		}
+		if payload, ok = applyWhere(w, r, payload); !ok {
+			return
+		}
+
+		if h.rdb == nil {
+			messagesReceived.Inc()
+			recipients := h.broadcastTopic(topic, h.typeFor(topic), payload)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]int64{"recipients": recipients})
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), publishTimeout)
+		defer cancel()
+		var err error
+		if h.stream != nil {
+			err = h.rdb.XAdd(ctx, &redis.XAddArgs{
+				Stream: h.stream.key,
+				Values: map[string]any{"topic": topic, "data": payload},
+			}).Err()
+		} else {
+			err = h.rdb.Publish(ctx, topicPrefix+topic, payload).Err()
+		}
+		if err != nil {
+			slog.Error("redis publish error", "topic", topic, "err", err)
+			http.Error(w, "could not publish message", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// readPayload reads a publish request body of at most maxSize bytes (0 for no
+// limit), answering the request itself when the body is unusable.
+func readPayload(w http.ResponseWriter, r *http.Request, maxSize int) ([]byte, bool) {
+	body := r.Body
+	if maxSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, int64(maxSize))
+	}
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if len(payload) == 0 {
+		http.Error(w, "empty payload", http.StatusBadRequest)
+		return nil, false
+	}
+	return payload, true
+}
+
+// applyWhere wraps payload in an envelope carrying the request's ?where=
+// expression, answering the request itself when the expression is invalid.
+func applyWhere(w http.ResponseWriter, r *http.Request, payload []byte) ([]byte, bool) {
+	where := r.URL.Query().Get("where")
+	if where == "" {
+		return payload, true
+	}
+	if _, err := compileWhere(where); err != nil {
+		http.Error(w, "invalid where: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if !json.Valid(payload) {
+		http.Error(w, "where requires a JSON payload", http.StatusBadRequest)
+		return nil, false
+	}
+	return withWhere(payload, where), true
+}
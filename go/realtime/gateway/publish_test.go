@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// publish sends a client publish of data to the chat topic.
+func publish(t *testing.T, conn *websocket.Conn, data string, echo *bool) {
+	t.Helper()
+	msg := map[string]any{"action": "publish", "channel": "realtime:topic:chat", "data": data}
+	if echo != nil {
+		msg["echo"] = *echo
+	}
+	sendJSON(t, conn, msg)
+}
+
+func TestPublishWithoutEcho(t *testing.T) {
+	_, url := startRedis(t)
+	env := map[string]string{"BACKEND": "pubsub", "REDIS_URL": url}
+	a := startGateway(t, env)
+	b := startGateway(t, env)
+	waitFor(t, "subscriptions", func() bool { return a.hub.subscribed.Load() && b.hub.subscribed.Load() })
+
+	sender, _ := a.connect("/ws?topics=chat", nil)
+	local, _ := a.connect("/ws?topics=chat", nil)
+	remote, _ := b.connect("/ws?topics=chat", nil)
+
+	echo := false
+	publish(t, sender, "no echo", &echo)
+	for name, conn := range map[string]*websocket.Conn{"same instance": local, "other instance": remote} {
+		if _, data := readFrame(t, conn); string(data) != `"no echo"` {
+			t.Fatalf("%s got %s, want the published data", name, data)
+		}
+	}
+
+	// Echo is on by default, so the next publish comes back to the sender.
+	// Redis keeps the order, so nothing but acks may arrive before it.
+	publish(t, sender, "echo", nil)
+	acks := 0
+	for {
+		_, data := readFrame(t, sender)
+		if string(data) == `"echo"` {
+			break
+		}
+		if data[0] != '{' {
+			t.Fatalf("sender got %s before its echoed message", data)
+		}
+		acks++
+	}
+	for ; acks < 2; acks++ {
+		if msg := readJSON(t, sender); msg["type"] != "ack" {
+			t.Fatalf("sender got %v, want a publish ack", msg)
+		}
+	}
+	expectSilence(t, sender, 50*time.Millisecond)
+}
+
+func TestWithOrigin(t *testing.T) {
+	sender, other := testClient("sender", 1), testClient("other", 1)
+	for _, data := range []string{`{"text":"hi"}`, `{"ttl_ms":60000,"data":{"text":"hi"}}`} {
+		tagged := withOrigin([]byte(data), "sender")
+		f, payload := parseEnvelope(tagged, "")
+		if string(payload) != `{"text":"hi"}` {
+			t.Fatalf("withOrigin(%s) delivers %s", data, payload)
+		}
+		if f.origin != "sender" {
+			t.Fatalf("withOrigin(%s) = %s, without the origin", data, tagged)
+		}
+		if f.matches(sender) {
+			t.Fatalf("%s reaches its own sender", tagged)
+		}
+		if !f.matches(other) {
+			t.Fatalf("%s skips other clients", tagged)
+		}
+	}
+}
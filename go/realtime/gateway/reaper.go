@@ -0,0 +1,46 @@
+package gateway
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// runReaper sweeps the hub every interval and removes clients that are still
+// registered although their context is done, or that the peer has not been
+// heard from in staleAfter. The read deadline normally catches silent peers
+// first; the sweep only guards against entries that slip through.
+func (h *hub) runReaper(ctx context.Context, interval, staleAfter time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.reap(staleAfter)
+		}
+	}
+}
+
+// reap runs one sweep. It only reads atomics under the shard read locks and
+// removes the stale clients after releasing them.
+func (h *hub) reap(staleAfter time.Duration) {
+	start := time.Now()
+	var stale []*client
+	for _, c := range h.snapshot() {
+		if c.ctx.Err() != nil || c.silentFor() > staleAfter {
+			stale = append(stale, c)
+		}
+	}
+	for _, c := range stale {
+		c.logger.Warn("reaping stale ws client", "silent_for", c.silentFor().Round(time.Second), "closed", c.ctx.Err() != nil)
+		h.removeWithReason(c, disconnectPingTimeout)
+	}
+	clientsReaped.Add(float64(len(stale)))
+	if len(stale) > 0 {
+		slog.Info("reaper sweep", "reaped", len(stale), "took", time.Since(start))
+	} else {
+		slog.Debug("reaper sweep", "reaped", 0, "took", time.Since(start))
+	}
+}
@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// deliveryReceipt is published to RECEIPTS_CHANNEL after a broadcast whose
+// envelope asked for one with "receipt":true. Recipients counts this
+// instance's clients only; publishers sum the receipts of every instance for
+// a message's total reach.
+type deliveryReceipt struct {
+	ID         string `json:"id"`
+	Topic      string `json:"topic,omitempty"`
+	Instance   string `json:"instance"`
+	Recipients int64  `json:"recipients"`
+	TS         int64  `json:"ts"`
+}
+
+// receiptPublisher sends receipts from a background goroutine, as
+// eventPublisher does lifecycle events, so a broadcast never waits on Redis.
+type receiptPublisher struct {
+	rdb      *redis.Client
+	channel  string
+	instance string
+	queue    chan deliveryReceipt
+}
+
+func newReceiptPublisher(rdb *redis.Client, channel, instance string) *receiptPublisher {
+	return &receiptPublisher{
+		rdb:      rdb,
+		channel:  channel,
+		instance: instance,
+		queue:    make(chan deliveryReceipt, 1024),
+	}
+}
+
+func (p *receiptPublisher) send(topic, id string, recipients int64) {
+	r := deliveryReceipt{ID: id, Topic: topic, Instance: p.instance, Recipients: recipients, TS: time.Now().UnixMilli()}
+	select {
+	case p.queue <- r:
+	default:
+		receiptsDropped.Inc()
+		slog.Warn("delivery receipt queue full, dropping receipt", "id", id, "topic", topic)
+	}
+}
+
+func (p *receiptPublisher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-p.queue:
+			payload, _ := json.Marshal(r)
+			if err := p.rdb.Publish(ctx, p.channel, payload).Err(); err != nil && ctx.Err() == nil {
+				receiptsDropped.Inc()
+				slog.Error("delivery receipt publish failed", "channel", p.channel, "id", r.ID, "err", err)
+				continue
+			}
+			receiptsPublished.Inc()
+		}
+	}
+}
+
+// sendReceipt publishes a receipt for a finished broadcast if its envelope
+// asked for one. id is used when the envelope has no id of its own, e.g. a
+// stream entry's ID.
+func (h *hub) sendReceipt(filter *deliveryFilter, topic, id string, recipients int64) {
+	if h.receipts == nil || filter == nil || !filter.receipt {
+		return
+	}
+	if filter.id != "" {
+		id = filter.id
+	}
+	if id == "" {
+		slog.Warn("receipt requested for a message without an id; skipping", "topic", topic)
+		return
+	}
+	h.receipts.send(topic, id, recipients)
+}
@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+// receiptsOn subscribes to channel on the Redis at url and returns the
+// receipts published there.
+func receiptsOn(t *testing.T, url, channel string) <-chan deliveryReceipt {
+	t.Helper()
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb := redis.NewClient(opts)
+	t.Cleanup(func() { rdb.Close() })
+	sub := rdb.Subscribe(context.Background(), channel)
+	if _, err := sub.Receive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	receipts := make(chan deliveryReceipt, 16)
+	go func() {
+		for msg := range sub.Channel() {
+			var r deliveryReceipt
+			if err := json.Unmarshal([]byte(msg.Payload), &r); err != nil {
+				t.Errorf("bad receipt %s: %v", msg.Payload, err)
+				continue
+			}
+			receipts <- r
+		}
+	}()
+	return receipts
+}
+
+// nextReceipt returns the next receipt, failing the test after a second.
+func nextReceipt(t *testing.T, receipts <-chan deliveryReceipt) deliveryReceipt {
+	t.Helper()
+	select {
+	case r := <-receipts:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("no receipt published")
+	}
+	return deliveryReceipt{}
+}
+
+func TestDeliveryReceipt(t *testing.T) {
+	mr, url := startRedis(t)
+	tg := startGateway(t, map[string]string{
+		"BACKEND":          "pubsub",
+		"REDIS_URL":        url,
+		"RECEIPTS_CHANNEL": "realtime:receipts",
+		"INSTANCE_ID":      "rt-1",
+	})
+	waitFor(t, "subscription", tg.hub.subscribed.Load)
+	receipts := receiptsOn(t, url, "realtime:receipts")
+	conns := make([]*websocket.Conn, 3)
+	for i := range conns {
+		conns[i], _ = tg.connect("/ws?topics=orders", nil)
+	}
+	other, _ := tg.connect("/ws?topics=news", nil)
+	published := testutil.ToFloat64(receiptsPublished)
+
+	// Without the flag there is no receipt, so the first one to arrive is
+	// for the second message.
+	mr.Publish("realtime:topic:orders", `{"id":"evt-1","origin":"svc","data":{"n":1}}`)
+	mr.Publish("realtime:topic:orders", `{"id":"evt-2","receipt":true,"data":{"n":2}}`)
+	for _, conn := range conns {
+		readFrame(t, conn)
+		if _, data := readFrame(t, conn); string(data) != `{"n":2}` {
+			t.Fatalf("delivered %s, want only data", data)
+		}
+	}
+	r := nextReceipt(t, receipts)
+	if r.ID != "evt-2" || r.Topic != "orders" || r.Instance != "rt-1" || r.Recipients != 3 || r.TS == 0 {
+		t.Fatalf("receipt = %+v, want evt-2 on orders from rt-1 with 3 recipients", r)
+	}
+	// The counter goes up once Redis has taken the receipt, which can be
+	// after a subscriber already has it.
+	waitFor(t, "the receipt to be counted", func() bool { return testutil.ToFloat64(receiptsPublished)-published == 1 })
+	// An instance none of whose clients wanted the message still reports.
+	mr.Publish("realtime:topic:sports", `{"id":"evt-3","receipt":true,"data":{}}`)
+	if r := nextReceipt(t, receipts); r.ID != "evt-3" || r.Recipients != 0 {
+		t.Fatalf("receipt = %+v, want evt-3 with no recipients", r)
+	}
+	expectSilence(t, other, 50*time.Millisecond)
+}
+
+func TestDeliveryReceiptStreamEntryID(t *testing.T) {
+	mr, url := startRedis(t)
+	defer mr.Close()
+	tg := startGateway(t, map[string]string{
+		"BACKEND":          "stream",
+		"REDIS_URL":        url,
+		"RECEIPTS_CHANNEL": "realtime:receipts",
+	})
+	waitFor(t, "stream reader", tg.hub.subscribed.Load)
+	receipts := receiptsOn(t, url, "realtime:receipts")
+	conn, _ := tg.connect("/ws?topics=orders", nil)
+
+	// An entry without an id of its own is receipted under its entry ID.
+	entry, _ := mr.XAdd("realtime:stream", "*", []string{"topic", "orders", "data", `{"receipt":true,"data":{"n":1}}`})
+	readFrame(t, conn)
+	if r := nextReceipt(t, receipts); r.ID != entry || r.Topic != "orders" || r.Recipients != 1 {
+		t.Fatalf("receipt = %+v, want entry %s on orders with 1 recipient", r, entry)
+	}
+}
+
+func TestSendReceipt(t *testing.T) {
+	h := newTestHub(t, nil)
+	h.receipts = newReceiptPublisher(nil, "realtime:receipts", "rt-1")
+	h.sendReceipt(nil, "orders", "", 1)
+	h.sendReceipt(&deliveryFilter{id: "evt-1"}, "orders", "", 1)
+	// Asked for, but there is no id to put on it.
+	h.sendReceipt(&deliveryFilter{receipt: true}, "orders", "", 1)
+	if n := len(h.receipts.queue); n != 0 {
+		t.Fatalf("queued %d receipts, want none", n)
+	}
+	h.sendReceipt(&deliveryFilter{receipt: true}, "orders", "1700000000000-0", 2)
+	h.sendReceipt(&deliveryFilter{receipt: true, id: "evt-2"}, "orders", "1700000000000-1", 3)
+	if r := <-h.receipts.queue; r.ID != "1700000000000-0" || r.Recipients != 2 {
+		t.Fatalf("receipt = %+v, want the fallback id", r)
+	}
+	if r := <-h.receipts.queue; r.ID != "evt-2" || r.Recipients != 3 {
+		t.Fatalf("receipt = %+v, want the envelope's id over the fallback", r)
+	}
+}
+
+func TestReceiptQueueFull(t *testing.T) {
+	p := newReceiptPublisher(nil, "realtime:receipts", "rt-1")
+	for range cap(p.queue) {
+		p.send("orders", "evt", 1)
+	}
+	before := testutil.ToFloat64(receiptsDropped)
+	p.send("orders", "evt", 1)
+	if got := testutil.ToFloat64(receiptsDropped) - before; got != 1 {
+		t.Fatalf("dropped receipts rose by %v, want 1", got)
+	}
+}
+
+func TestReceiptsChannelNeedsRedis(t *testing.T) {
+	t.Setenv("BACKEND", "memory")
+	t.Setenv("RECEIPTS_CHANNEL", "realtime:receipts")
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("RECEIPTS_CHANNEL accepted with BACKEND=memory")
+	}
+}
@@ -0,0 +1,302 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// resumeTimeout bounds each Redis call made for session resume.
+const resumeTimeout = 2 * time.Second
+
+// resumeState is what a disconnected session leaves in Redis so that any
+// instance can resume it. Topics are stored scoped, as the hub knows them.
+type resumeState struct {
+	Topics   []string `json:"topics"`
+	Patterns []string `json:"patterns"`
+}
+
+// bufferedFrame is one message kept for a disconnected session.
+type bufferedFrame struct {
+	Type  int    `json:"t"`
+	Topic string `json:"topic,omitempty"`
+	Data  []byte `json:"d"`
+}
+
+// appendScript buffers a frame for a session while its state key exists,
+// keeping only the newest ARGV[2] frames. It returns 0 once the session has
+// been resumed elsewhere or has expired, which tells the caller to stop.
+var appendScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local n = redis.call('RPUSH', KEYS[2], ARGV[1])
+if n > tonumber(ARGV[2]) then
+	redis.call('LTRIM', KEYS[2], -tonumber(ARGV[2]), -1)
+	redis.call('HSET', KEYS[1], 'truncated', '1')
+end
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+return 1
+`)
+
+// claimScript hands a session's state and buffer to the first caller whose
+// owner matches, deleting both so the session resumes only once.
+var claimScript = redis.NewScript(`
+local state = redis.call('HMGET', KEYS[1], 'state', 'owner', 'truncated')
+if not state[1] or state[2] ~= ARGV[1] then
+	return false
+end
+local frames = redis.call('LRANGE', KEYS[2], 0, -1)
+redis.call('DEL', KEYS[1], KEYS[2])
+table.insert(frames, 1, state[3] or '')
+table.insert(frames, 1, state[1])
+return frames
+`)
+
+// resumer keeps the messages of recently disconnected clients in Redis so
+// they can reconnect, to this instance or another, within window and pick up
+// where they left off. The instance a client left keeps matching broadcasts
+// against it (a "detached" client) and appends the ones it would have
+// received to a capped Redis list until the session is resumed or expires.
+type resumer struct {
+	rdb    *redis.Client
+	prefix string
+	window time.Duration
+	size   int
+
+	// jobs serializes the buffer appends so broadcasts never wait on
+	// Redis.
+	jobs chan func(context.Context)
+	done chan struct{}
+
+	mu       sync.Mutex
+	detached map[*client]time.Time
+}
+
+func newResumer(rdb *redis.Client, prefix string, window time.Duration, size int) *resumer {
+	return &resumer{
+		rdb:      rdb,
+		prefix:   prefix,
+		window:   window,
+		size:     size,
+		jobs:     make(chan func(context.Context), 4096),
+		done:     make(chan struct{}),
+		detached: make(map[*client]time.Time),
+	}
+}
+
+func (r *resumer) stateKey(session string) string  { return r.prefix + session }
+func (r *resumer) bufferKey(session string) string { return r.prefix + session + ":buffer" }
+
+func (r *resumer) queue(job func(context.Context)) {
+	select {
+	case r.jobs <- job:
+	default:
+		slog.Warn("resume queue full, dropping buffered message")
+	}
+}
+
+// run performs the queued buffer appends until stop is called, then flushes
+// what is left so the messages of clients closed at shutdown are kept.
+func (r *resumer) run() {
+	for {
+		select {
+		case job := <-r.jobs:
+			r.do(job)
+		case <-r.done:
+			for {
+				select {
+				case job := <-r.jobs:
+					r.do(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *resumer) do(job func(context.Context)) {
+	ctx, cancel := context.WithTimeout(context.Background(), resumeTimeout)
+	defer cancel()
+	job(ctx)
+}
+
+// stop ends run once the queue is flushed; call it after the clients are
+// closed.
+func (r *resumer) stop() { close(r.done) }
+
+// detach records c's session in Redis and starts buffering for it. The state
+// is written before detach returns, so a client that reconnects straight
+// away, to this instance or another, finds its session. Buffering starts
+// once the state exists, since appendScript refuses a session without it.
+func (r *resumer) detach(c *client) {
+	state, _ := json.Marshal(resumeState{Topics: c.topicList(), Patterns: c.patternList()})
+	ctx, cancel := context.WithTimeout(context.Background(), resumeTimeout)
+	defer cancel()
+	pipe := r.rdb.TxPipeline()
+	pipe.Del(ctx, r.bufferKey(c.session))
+	pipe.HSet(ctx, r.stateKey(c.session), "state", state, "owner", sessionOwner(c.subject, c.tenant))
+	pipe.PExpire(ctx, r.stateKey(c.session), r.window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("saving session failed", "session", c.session, "err", err)
+		return
+	}
+	r.mu.Lock()
+	r.detached[c] = time.Now().Add(r.window)
+	r.mu.Unlock()
+	c.logger.Debug("ws session detached", "session", c.session, "window", r.window)
+}
+
+func (r *resumer) forget(c *client) {
+	r.mu.Lock()
+	delete(r.detached, c)
+	r.mu.Unlock()
+}
+
+// buffer appends the message to the session of every detached client that
+// match accepts. Sessions past their window are dropped on the way.
+func (r *resumer) buffer(match func(c *client) bool, messageType int, topic string, data []byte) {
+	r.mu.Lock()
+	if len(r.detached) == 0 {
+		r.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	var targets []*client
+	for c, until := range r.detached {
+		if now.After(until) {
+			delete(r.detached, c)
+			continue
+		}
+		if match(c) {
+			targets = append(targets, c)
+		}
+	}
+	r.mu.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+	b, _ := json.Marshal(bufferedFrame{Type: messageType, Topic: topic, Data: data})
+	for _, c := range targets {
+		r.queue(func(ctx context.Context) {
+			keys := []string{r.stateKey(c.session), r.bufferKey(c.session)}
+			n, err := appendScript.Run(ctx, r.rdb, keys, b, r.size, r.window.Milliseconds()).Int()
+			if err != nil {
+				slog.Error("buffering session message failed", "session", c.session, "err", err)
+				return
+			}
+			if n == 0 {
+				// Resumed on some instance, or expired.
+				r.forget(c)
+			}
+		})
+	}
+}
+
+// sessionOwner identifies who may resume a session: the same JWT subject in
+// the same tenant.
+func sessionOwner(subject, tenant string) string { return subject + "\x00" + tenant }
+
+// resumedSession is what claim hands back: the subscriptions to restore and
+// the messages buffered while the client was away, oldest first.
+type resumedSession struct {
+	state     resumeState
+	frames    []bufferedFrame
+	truncated bool
+}
+
+// claim takes over session for a client authenticated as subject in tenant.
+// It returns nil when the session is unknown, expired, already resumed or
+// belongs to someone else.
+func (r *resumer) claim(ctx context.Context, session, subject, tenant string) (*resumedSession, error) {
+	ctx, cancel := context.WithTimeout(ctx, resumeTimeout)
+	defer cancel()
+	keys := []string{r.stateKey(session), r.bufferKey(session)}
+	res, err := claimScript.Run(ctx, r.rdb, keys, sessionOwner(subject, tenant)).StringSlice()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rs := &resumedSession{truncated: res[1] == "1"}
+	if err := json.Unmarshal([]byte(res[0]), &rs.state); err != nil {
+		return nil, err
+	}
+	for _, s := range res[2:] {
+		var f bufferedFrame
+		if json.Unmarshal([]byte(s), &f) == nil {
+			rs.frames = append(rs.frames, f)
+		}
+	}
+	return rs, nil
+}
+
+// startSession gives c a session and queues its welcome frame, resuming
+// session first when the client asked for one. It runs before c is
+// registered, so the buffered messages are queued ahead of any live one. It
+// reports false when they don't fit in c's queues, and c must be closed.
+func (h *hub) startSession(c *client, session string) bool {
+	var rs *resumedSession
+	if session != "" {
+		var err error
+		if rs, err = h.resume.claim(h.ctx, session, c.subject, c.tenant); err != nil {
+			c.logger.Warn("ws session resume failed", "session", session, "err", err)
+		}
+		if rs != nil {
+			sessionResumes.WithLabelValues("resumed").Inc()
+		} else {
+			sessionResumes.WithLabelValues("expired").Inc()
+		}
+	}
+	if rs == nil {
+		c.session = uuid.NewString()
+		return offer(c, lanePriority, c.priority, frame{messageType: websocket.TextMessage, data: encodeSessionWelcome(c.id, c.protocol, c.session, false, false)})
+	}
+	c.session = session
+	c.mu.Lock()
+	for _, t := range rs.state.Topics {
+		c.topics[t] = struct{}{}
+	}
+	for _, p := range rs.state.Patterns {
+		if c.patterns == nil {
+			c.patterns = make(map[string]struct{})
+		}
+		c.patterns[p] = struct{}{}
+	}
+	c.mu.Unlock()
+	c.logger.Info("ws session resumed", "session", session, "buffered", len(rs.frames), "truncated", rs.truncated)
+	// The welcome takes the priority lane like every other one. RESUME_BUFFER
+	// is validated to fit in the send queue, so a full lane means a buffer
+	// that outgrew it, e.g. written under another configuration.
+	if !offer(c, lanePriority, c.priority, frame{messageType: websocket.TextMessage, data: encodeSessionWelcome(c.id, c.protocol, session, true, rs.truncated)}) {
+		return false
+	}
+	for _, f := range rs.frames {
+		if !offer(c, laneSend, c.send, c.ackable(f.Type, f.Topic, "", f.Data)) {
+			return false
+		}
+	}
+	return true
+}
+
+// offer does a non-blocking send of f on one of c's lanes, counting and
+// logging a full one as an overflow.
+func offer(c *client, lane string, ch chan frame, f frame) bool {
+	select {
+	case ch <- f:
+		return true
+	default:
+		sendQueueOverflows.WithLabelValues(lane).Inc()
+		c.logger.Warn("ws resumed session overflows the queue; closing", "lane", lane, "queue_capacity", cap(ch))
+		return false
+	}
+}
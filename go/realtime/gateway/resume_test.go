@@ -0,0 +1,161 @@
+package gateway
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startResumeGateway runs a pubsub gateway with session resume and returns
+// it with its Redis.
+func startResumeGateway(t *testing.T, env map[string]string) (*testGateway, *miniredis.Miniredis) {
+	t.Helper()
+	mr, url := startRedis(t)
+	cfg := map[string]string{"BACKEND": "pubsub", "REDIS_URL": url, "RESUME_WINDOW": "30s"}
+	for k, v := range env {
+		cfg[k] = v
+	}
+	tg := startGateway(t, cfg)
+	waitFor(t, "subscription", tg.hub.subscribed.Load)
+	return tg, mr
+}
+
+// welcome dials path and returns the connection and its welcome frame.
+func (tg *testGateway) welcome(path string) (*websocket.Conn, map[string]any) {
+	tg.t.Helper()
+	conn := tg.dial(path, nil)
+	msg := readJSON(tg.t, conn)
+	if msg["type"] != "welcome" {
+		tg.t.Fatalf("first frame = %v, want a welcome", msg)
+	}
+	return conn, msg
+}
+
+// detach drops the client with id the way a failed write would.
+func (tg *testGateway) detach(id string) {
+	tg.t.Helper()
+	c, ok := tg.hub.get(id)
+	if !ok {
+		tg.t.Fatalf("client %s not registered", id)
+	}
+	tg.hub.removeWithReason(c, disconnectWriteError)
+}
+
+func TestResumeWithinWindow(t *testing.T) {
+	tg, mr := startResumeGateway(t, nil)
+	_, welcome := tg.welcome("/ws?topics=news")
+	session, _ := welcome["session"].(string)
+	if session == "" || welcome["resumed"] == true {
+		t.Fatalf("welcome = %v, want a fresh session", welcome)
+	}
+	tg.detach(welcome["id"].(string))
+	// The state is in Redis by the time the client is gone, so a reconnect
+	// can't beat it.
+	if !mr.Exists(tg.cfg.ResumePrefix + session) {
+		t.Fatal("session state not saved when removal returned")
+	}
+	mr.Publish("realtime:topic:news", `{"n":1}`)
+	waitFor(t, "buffered message", func() bool {
+		l, _ := mr.List(tg.cfg.ResumePrefix + session + ":buffer")
+		return len(l) == 1
+	})
+
+	before := testutil.ToFloat64(sessionResumes.WithLabelValues("resumed"))
+	conn, resumed := tg.welcome("/ws?resume=" + session)
+	if resumed["resumed"] != true || resumed["session"] != session || resumed["truncated"] == true {
+		t.Fatalf("welcome = %v, want session %s resumed in full", resumed, session)
+	}
+	if msg := readJSON(t, conn); msg["n"] != float64(1) {
+		t.Fatalf("first frame after resume = %v, want the buffered message", msg)
+	}
+	if got := testutil.ToFloat64(sessionResumes.WithLabelValues("resumed")) - before; got != 1 {
+		t.Fatalf("resumed counter rose by %v, want 1", got)
+	}
+	// The subscription came back with the session, so live messages follow.
+	mr.Publish("realtime:topic:news", `{"n":2}`)
+	if msg := readJSON(t, conn); msg["n"] != float64(2) {
+		t.Fatalf("live frame = %v, want n=2", msg)
+	}
+	if mr.Exists(tg.cfg.ResumePrefix + session) {
+		t.Fatal("session state left behind after resume")
+	}
+}
+
+func TestResumeOnce(t *testing.T) {
+	tg, _ := startResumeGateway(t, nil)
+	_, welcome := tg.welcome("/ws")
+	session := welcome["session"].(string)
+	tg.detach(welcome["id"].(string))
+	if _, msg := tg.welcome("/ws?resume=" + session); msg["resumed"] != true {
+		t.Fatalf("first resume: welcome = %v", msg)
+	}
+	if _, msg := tg.welcome("/ws?resume=" + session); msg["resumed"] == true || msg["session"] == session {
+		t.Fatalf("second resume: welcome = %v, want a new session", msg)
+	}
+}
+
+func TestResumeAfterExpiry(t *testing.T) {
+	tg, mr := startResumeGateway(t, map[string]string{"RESUME_WINDOW": "1s"})
+	_, welcome := tg.welcome("/ws?topics=news")
+	session := welcome["session"].(string)
+	tg.detach(welcome["id"].(string))
+	mr.FastForward(2 * time.Second)
+
+	before := testutil.ToFloat64(sessionResumes.WithLabelValues("expired"))
+	_, msg := tg.welcome("/ws?resume=" + session)
+	if msg["resumed"] == true || msg["session"] == session || msg["session"] == nil {
+		t.Fatalf("welcome = %v, want a new session after RESUME_WINDOW", msg)
+	}
+	if got := testutil.ToFloat64(sessionResumes.WithLabelValues("expired")) - before; got != 1 {
+		t.Fatalf("expired counter rose by %v, want 1", got)
+	}
+}
+
+func TestResumeBufferEvictsOldest(t *testing.T) {
+	tg, mr := startResumeGateway(t, map[string]string{"RESUME_BUFFER": "3"})
+	_, welcome := tg.welcome("/ws?topics=news")
+	session := welcome["session"].(string)
+	tg.detach(welcome["id"].(string))
+	for i := 1; i <= 5; i++ {
+		mr.Publish("realtime:topic:news", fmt.Sprintf(`{"n":%d}`, i))
+	}
+	waitFor(t, "the last message buffered", func() bool {
+		l, _ := mr.List(tg.cfg.ResumePrefix + session + ":buffer")
+		return len(l) == 3 && l[2] == `{"t":1,"topic":"news","d":"eyJuIjo1fQ=="}`
+	})
+
+	conn, msg := tg.welcome("/ws?resume=" + session)
+	if msg["resumed"] != true || msg["truncated"] != true {
+		t.Fatalf("welcome = %v, want a truncated resume", msg)
+	}
+	for want := 3; want <= 5; want++ {
+		if msg := readJSON(t, conn); msg["n"] != float64(want) {
+			t.Fatalf("buffered frame = %v, want n=%d", msg, want)
+		}
+	}
+	expectSilence(t, conn, 100*time.Millisecond)
+}
+
+func TestResumeOverflowingSendQueueCloses(t *testing.T) {
+	tg, mr := startResumeGateway(t, map[string]string{"SEND_BUFFER": "4", "RESUME_BUFFER": "2"})
+	// A buffer bigger than this instance's queue, as one written under a
+	// larger RESUME_BUFFER would be.
+	const session = "8f14e45f-ceea-467f-a0e6-5b6b1e5f3a9c"
+	mr.HSet(tg.cfg.ResumePrefix+session, "state", `{"topics":["news"]}`, "owner", sessionOwner("", ""))
+	for i := 0; i < 10; i++ {
+		mr.Push(tg.cfg.ResumePrefix+session+":buffer", `{"t":1,"d":"e30="}`)
+	}
+	before := testutil.ToFloat64(sendQueueOverflows.WithLabelValues(laneSend))
+	conn := tg.dial("/ws?resume="+session, nil)
+	if code := closeCode(t, conn); code != websocket.CloseTryAgainLater {
+		t.Fatalf("close code = %d, want %d", code, websocket.CloseTryAgainLater)
+	}
+	if got := testutil.ToFloat64(sendQueueOverflows.WithLabelValues(laneSend)) - before; got != 1 {
+		t.Fatalf("send overflows rose by %v, want 1", got)
+	}
+	waitFor(t, "the slot to be released", func() bool { return tg.hub.active.Load() == 0 })
+}
@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retainedMessage is the last message broadcast on a retained topic, which
+// every new subscriber receives first. mu is held while a message of the
+// topic is fanned out and while a client subscribes, so a subscriber gets a
+// given message either retained or live, never both.
+type retainedMessage struct {
+	mu          sync.Mutex
+	messageType int
+	data        []byte // nil until the topic's first message
+	filter      *deliveryFilter
+	at          time.Time
+}
+
+// retainStore keeps the last message of each retained topic, from
+// TOPIC_RETAIN or the topics section, in memory for up to ttl when it is set.
+// A listed topic is retained for every tenant, each tenant's scoped topic
+// keeping its own last message; those are created the first time the scoped
+// topic is used. A reload relists the topics.
+type retainStore struct {
+	ttl    time.Duration
+	mu     sync.Mutex
+	listed map[string]bool
+	topics map[string]*retainedMessage
+}
+
+func newRetainStore(listed map[string]bool, ttl time.Duration) *retainStore {
+	s := &retainStore{ttl: ttl, topics: make(map[string]*retainedMessage)}
+	s.relist(listed)
+	return s
+}
+
+// relist makes listed the retained topics. Topics newly listed keep their
+// next message; those no longer listed drop the one they kept.
+func (s *retainStore) relist(listed map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listed = maps.Clone(listed)
+	for t := range s.topics {
+		if _, ok := topicSetting(s.listed, t); !ok {
+			delete(s.topics, t)
+		}
+	}
+}
+
+// get returns topic's retained message, or nil when topic isn't retained.
+// A scoped topic is retained when it or its unscoped name is listed.
+func (s *retainStore) get(topic string) *retainedMessage {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := topicSetting(s.listed, topic); !ok {
+		return nil
+	}
+	r := s.topics[topic]
+	if r == nil {
+		r = &retainedMessage{}
+		s.topics[topic] = r
+	}
+	return r
+}
+
+// set replaces the retained message. The caller must hold r.mu.
+func (r *retainedMessage) set(messageType int, data []byte, filter *deliveryFilter) {
+	r.messageType, r.data, r.filter, r.at = messageType, data, filter, time.Now()
+}
+
+// queueRetained queues topic's retained message for c if there is one that
+// hasn't expired and c is in its audience. The caller must hold r.mu.
+func (h *hub) queueRetained(c *client, topic string, r *retainedMessage) {
+	if r.data == nil || !r.filter.matches(c) {
+		return
+	}
+	if h.retain.ttl > 0 && time.Since(r.at) > h.retain.ttl {
+		return
+	}
+	s := h.shardFor(c.id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.clients[c]; ok {
+		messagesRetained.Inc()
+		h.push(c, c.ackable(r.messageType, topic, "", r.data))
+	}
+}
+
+// addRetaining is add that also queues the retained messages of topics, the
+// ones c joined with ?topics=, holding those topics from before c is
+// registered until their messages are queued.
+func (h *hub) addRetaining(c *client, topics map[string]struct{}) bool {
+	var held []string
+	for t := range topics {
+		if h.retain.get(c.scope(t)) != nil {
+			held = append(held, c.scope(t))
+		}
+	}
+	// Always locking in sorted order keeps two connecting clients from
+	// deadlocking on each other's topics.
+	sort.Strings(held)
+	for _, t := range held {
+		h.retain.get(t).mu.Lock()
+	}
+	added := h.add(c)
+	for _, t := range held {
+		r := h.retain.get(t)
+		if added {
+			h.queueRetained(c, t, r)
+		}
+		r.mu.Unlock()
+	}
+	return added
+}
+
+// parseTopicRetain reads the TOPIC_RETAIN topic list.
+func parseTopicRetain(raw string) ([]string, error) {
+	var topics []string
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if strings.Contains(t, "*") {
+			return nil, fmt.Errorf("invalid TOPIC_RETAIN entry %q; wildcards are not supported", t)
+		}
+		topics = append(topics, t)
+	}
+	return topics, nil
+}
@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetainedMessageOnSubscribe(t *testing.T) {
+	tg := startGateway(t, map[string]string{"TOPIC_RETAIN": "prices"})
+	tg.hub.broadcastTopic("prices", websocket.TextMessage, []byte(`{"p":1}`))
+
+	conn, _ := tg.connect("/ws", nil)
+	sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "prices"})
+	if msg := readJSON(t, conn); msg["type"] != "ack" {
+		t.Fatalf("reply = %v, want an ack", msg)
+	}
+	if _, data := readFrame(t, conn); string(data) != `{"p":1}` {
+		t.Fatalf("retained = %s", data)
+	}
+	// Subscribing again doesn't repeat it, and the next message is live.
+	sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "prices"})
+	readJSON(t, conn)
+	tg.hub.broadcastTopic("prices", websocket.TextMessage, []byte(`{"p":2}`))
+	if _, data := readFrame(t, conn); string(data) != `{"p":2}` {
+		t.Fatalf("live = %s", data)
+	}
+	expectSilence(t, conn, 50*time.Millisecond)
+}
+
+func TestRetainedMessageOnConnect(t *testing.T) {
+	tg := startGateway(t, map[string]string{"TOPIC_RETAIN": "prices"})
+	tg.hub.broadcastTopic("prices", websocket.TextMessage, []byte(`{"p":1}`))
+	conn, _ := tg.connect("/ws?topics=prices", nil)
+	if _, data := readFrame(t, conn); string(data) != `{"p":1}` {
+		t.Fatalf("retained = %s", data)
+	}
+}
+
+// TestRetainedSubscribeRace subscribes while the topic is being broadcast;
+// each message must arrive once, retained or live, in order.
+func TestRetainedSubscribeRace(t *testing.T) {
+	tg := startGateway(t, map[string]string{"TOPIC_RETAIN": "prices", "SEND_BUFFER": "1024"})
+	tg.hub.broadcastTopic("prices", websocket.TextMessage, []byte("0"))
+	conn, _ := tg.connect("/ws", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 200; i++ {
+			tg.hub.broadcastTopic("prices", websocket.TextMessage, []byte{byte('0' + i%10)})
+		}
+	}()
+	sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "prices"})
+	<-done
+	tg.hub.broadcastTopic("prices", websocket.TextMessage, []byte("end"))
+	var got []string
+	for {
+		mt, data := readFrame(t, conn)
+		if mt == websocket.TextMessage && len(data) > 0 && data[0] == '{' {
+			continue // the ack
+		}
+		if got = append(got, string(data)); string(data) == "end" {
+			break
+		}
+	}
+	for i := 1; i < len(got)-1; i++ {
+		prev, cur := got[i-1][0], got[i][0]
+		if cur != '0'+(prev-'0'+1)%10 {
+			t.Fatalf("message %d is %q after %q: duplicated or skipped in %v", i, got[i], got[i-1], got)
+		}
+	}
+}
+
+func TestRetainedMessageExpires(t *testing.T) {
+	tg := startGateway(t, map[string]string{"TOPIC_RETAIN": "prices", "RETAIN_TTL": "50ms"})
+	tg.hub.broadcastTopic("prices", websocket.TextMessage, []byte(`{"p":1}`))
+	time.Sleep(100 * time.Millisecond)
+	before := testutil.ToFloat64(messagesRetained)
+	conn, _ := tg.connect("/ws?topics=prices", nil)
+	if got := testutil.ToFloat64(messagesRetained) - before; got != 0 {
+		t.Fatalf("retained deliveries rose by %v after RETAIN_TTL", got)
+	}
+	expectSilence(t, conn, 50*time.Millisecond)
+}
+
+func TestRetainOnlyListedTopics(t *testing.T) {
+	tg := startGateway(t, map[string]string{"TOPIC_RETAIN": "prices"})
+	tg.hub.broadcastTopic("news", websocket.TextMessage, []byte(`{"n":1}`))
+	conn, _ := tg.connect("/ws?topics=news", nil)
+	expectSilence(t, conn, 50*time.Millisecond)
+}
+
+func TestParseTopicRetain(t *testing.T) {
+	got, err := parseTopicRetain(" prices, ,status ")
+	if err != nil || len(got) != 2 || got[0] != "prices" || got[1] != "status" {
+		t.Fatalf("parseTopicRetain = %v, %v", got, err)
+	}
+	if _, err := parseTopicRetain("prices.*"); err == nil {
+		t.Fatal("wildcard topic accepted")
+	}
+}
+
+func TestRetainedPerTenant(t *testing.T) {
+	tg := startGateway(t, map[string]string{"TENANT_FROM": "header", "TOPIC_RETAIN": "status"})
+	connect := func(tenant, path string) *websocket.Conn {
+		header := http.Header{}
+		if tenant != "" {
+			header.Set("X-Tenant-ID", tenant)
+		}
+		conn, _ := tg.connect(path, header)
+		return conn
+	}
+	// Each tenant's scoped topic keeps its own last message.
+	tg.hub.broadcastTopic("tenant:acme:status", websocket.TextMessage, []byte(`{"s":"acme"}`))
+	tg.hub.broadcastTopic("tenant:globex:status", websocket.TextMessage, []byte(`{"s":"globex"}`))
+	tg.hub.broadcastTopic("status", websocket.TextMessage, []byte(`{"s":"none"}`))
+	for tenant, want := range map[string]string{"acme": `{"s":"acme"}`, "globex": `{"s":"globex"}`, "": `{"s":"none"}`} {
+		conn := connect(tenant, "/ws?topics=status")
+		if _, data := readFrame(t, conn); string(data) != want {
+			t.Fatalf("tenant %q got retained %s, want %s", tenant, data, want)
+		}
+		expectSilence(t, conn, 30*time.Millisecond)
+	}
+	// Subscribing later gets it too, and a tenant with nothing retained yet
+	// gets nothing.
+	conn := connect("acme", "/ws")
+	sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "status"})
+	readJSON(t, conn)
+	if _, data := readFrame(t, conn); string(data) != `{"s":"acme"}` {
+		t.Fatalf("retained on subscribe = %s", data)
+	}
+	expectSilence(t, connect("initech", "/ws?topics=status"), 30*time.Millisecond)
+}
+
+func TestRetainStoreScopedTopics(t *testing.T) {
+	s := newRetainStore(map[string]bool{"status": true, "tenant:acme:prices": true}, 0)
+	if s.get("status") == nil || s.get("tenant:acme:status") == nil || s.get("tenant:acme:prices") == nil {
+		t.Fatal("listed topic not retained")
+	}
+	if s.get("tenant:acme:status") == s.get("tenant:globex:status") || s.get("status") == s.get("tenant:acme:status") {
+		t.Fatal("tenants share a retained message")
+	}
+	if s.get("tenant:acme:status") != s.get("tenant:acme:status") {
+		t.Fatal("scoped topic got a new retained message on a second lookup")
+	}
+	for _, topic := range []string{"news", "prices", "tenant:globex:prices", "tenant:acme:news"} {
+		if s.get(topic) != nil {
+			t.Errorf("%s retained", topic)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestReusePortChild is the second gateway process of
+// TestReusePortAcrossProcesses; it serves until its stdin closes.
+func TestReusePortChild(t *testing.T) {
+	if os.Getenv("REUSE_PORT_CHILD") == "" {
+		t.Skip("run by TestReusePortAcrossProcesses")
+	}
+	startGateway(t, map[string]string{"BIND_ADDR": os.Getenv("BIND_ADDR"), "REUSE_PORT": "true"})
+	os.Stdout.WriteString("listening\n")
+	io.Copy(io.Discard, os.Stdin)
+}
+
+func TestReusePortAcrossProcesses(t *testing.T) {
+	addr := freeAddr(t)
+	tg := startGateway(t, map[string]string{"BIND_ADDR": addr, "REUSE_PORT": "true"})
+
+	child := exec.Command(os.Args[0], "-test.run=^TestReusePortChild$")
+	child.Env = append(os.Environ(), "REUSE_PORT_CHILD=1", "BIND_ADDR="+addr)
+	stdin, _ := child.StdinPipe()
+	stdout, _ := child.StdoutPipe()
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer child.Wait()
+	defer stdin.Close()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "listening\n" {
+		t.Fatalf("second process did not start: %q, %v", line, err)
+	}
+
+	// The kernel spreads new connections over both processes.
+	const n = 20
+	for range n {
+		conn, _ := tg.connect("/ws", nil)
+		defer conn.Close()
+	}
+	if got := tg.hub.count(); got == 0 || got == n {
+		t.Fatalf("%d of %d connections reached this process, want them shared", got, n)
+	}
+
+	// Once the second process exits, this one takes every connection.
+	stdin.Close()
+	if err := child.Wait(); err != nil {
+		t.Fatalf("second process: %v", err)
+	}
+	before := tg.hub.count()
+	tg.connect("/ws", nil)
+	tg.connect("/ws", nil)
+	if got := tg.hub.count(); got != before+2 {
+		t.Fatalf("count = %d after the other process left, want %d", got, before+2)
+	}
+}
+
+func TestListenWithoutReusePortRefusesSharedAddress(t *testing.T) {
+	addr := freeAddr(t)
+	ln, err := listen(context.Background(), addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if second, err := listen(context.Background(), addr, false); err == nil {
+		second.Close()
+		t.Fatal("second listener bound the address without REUSE_PORT")
+	}
+	if second, err := listen(context.Background(), addr, true); err == nil {
+		second.Close()
+		t.Fatal("a REUSE_PORT listener joined one that didn't opt in")
+	}
+}
@@ -0,0 +1,43 @@
+package gateway
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// router mounts handlers under a common path prefix so the gateway can share
+// an ingress with other services without path rewriting.
+type router struct {
+	mux    *http.ServeMux
+	prefix string
+}
+
+// newRouter normalizes prefix to "" or "/segment[/segment...]" without a
+// trailing slash.
+func newRouter(prefix string) *router {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix != "" {
+		prefix = "/" + prefix
+	}
+	return &router{mux: http.NewServeMux(), prefix: prefix}
+}
+
+// handle registers pattern, which may start with an HTTP method as in
+// "GET /admin/clients", under the prefix.
+func (rt *router) handle(pattern string, handler http.Handler) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, path = "", pattern
+	}
+	full := rt.prefix + path
+	if method != "" {
+		full = method + " " + full
+	}
+	rt.mux.Handle(full, handler)
+	slog.Info("route registered", "pattern", full)
+}
+
+func (rt *router) handleFunc(pattern string, handler http.HandlerFunc) {
+	rt.handle(pattern, handler)
+}
@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"hash/fnv"
+	"math"
+
+	"github.com/google/uuid"
+)
+
+// sampler selects a fraction of clients for an enveloped message. Each
+// client's inclusion depends only on the message id and the client id, so a
+// client that reconnects and is sent the same message again gets the same
+// answer.
+type sampler struct {
+	seed string
+	// threshold is the rate scaled to the uint64 range; a client is included
+	// when its hash falls below it.
+	threshold uint64
+	all       bool
+}
+
+// newSampler returns a sampler for rate, clamped to [0, 1]. Messages without
+// an id get a random seed, so they are sampled independently each time.
+func newSampler(rate float64, seed string) *sampler {
+	if seed == "" {
+		seed = uuid.NewString()
+	}
+	s := &sampler{seed: seed}
+	switch {
+	case rate >= 1:
+		s.all = true
+	case rate > 0:
+		s.threshold = uint64(rate * math.MaxUint64)
+	}
+	return s
+}
+
+func (s *sampler) includes(clientID string) bool {
+	if s.all {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(s.seed))
+	h.Write([]byte{0})
+	h.Write([]byte(clientID))
+	return mix64(h.Sum64()) < s.threshold
+}
+
+// mix64 is the splitmix64 finalizer. FNV's output is poorly distributed in
+// its high bits for inputs that differ only in their last bytes, which
+// sequential client IDs do.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
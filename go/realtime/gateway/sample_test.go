@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSamplerDistribution(t *testing.T) {
+	const messages, clients = 200, 1000
+	for _, rate := range []float64{0.01, 0.1, 0.5, 0.9} {
+		t.Run(fmt.Sprint(rate), func(t *testing.T) {
+			var total int
+			// Five standard deviations of a single message's sample.
+			bound := 5 * math.Sqrt(rate*(1-rate)/clients)
+			for m := range messages {
+				s := newSampler(rate, fmt.Sprintf("msg-%d", m))
+				var n int
+				for c := range clients {
+					if s.includes(fmt.Sprintf("client-%d", c)) {
+						n++
+					}
+				}
+				if got := float64(n) / clients; math.Abs(got-rate) > bound {
+					t.Errorf("message %d reached %.3f of clients, want %.3f±%.3f", m, got, rate, bound)
+				}
+				total += n
+			}
+			if got := float64(total) / (messages * clients); math.Abs(got-rate) > 0.005 {
+				t.Errorf("messages reached %.4f of clients on average, want %.3f", got, rate)
+			}
+		})
+	}
+}
+
+func TestSamplerBounds(t *testing.T) {
+	for _, tt := range []struct {
+		rate float64
+		want bool
+	}{{-1, false}, {0, false}, {1, true}, {2, true}} {
+		s := newSampler(tt.rate, "m")
+		for c := range 100 {
+			if got := s.includes(fmt.Sprint(c)); got != tt.want {
+				t.Fatalf("rate %v included client %d = %v", tt.rate, c, got)
+			}
+		}
+	}
+}
+
+func TestSamplerKeyedOnMessageID(t *testing.T) {
+	a, b, other := newSampler(0.5, "m1"), newSampler(0.5, "m1"), newSampler(0.5, "m2")
+	var differ int
+	for c := range 1000 {
+		id := fmt.Sprint(c)
+		if a.includes(id) != b.includes(id) {
+			t.Fatalf("client %s sampled differently for the same message id", id)
+		}
+		if a.includes(id) != other.includes(id) {
+			differ++
+		}
+	}
+	// Half the clients should land differently for another message.
+	if differ < 400 || differ > 600 {
+		t.Fatalf("%d of 1000 clients sampled differently for another id, want about 500", differ)
+	}
+}
+
+func TestSampledBroadcast(t *testing.T) {
+	h := newTestHub(t, nil)
+	const n = 1000
+	clients := make([]*client, n)
+	for i := range clients {
+		clients[i] = testClient(fmt.Sprintf("client-%d", i), 2)
+		h.add(clients[i])
+	}
+	msg := []byte(`{"sample":0.3,"id":"announce-42","data":{"text":"hi"}}`)
+	// Broadcasting the same id twice picks the same clients both times.
+	h.broadcast(websocket.TextMessage, msg)
+	h.broadcast(websocket.TextMessage, msg)
+	var reached int
+	for _, c := range clients {
+		switch len(c.send) {
+		case 0:
+		case 2:
+			reached++
+			if f := <-c.send; string(f.data) != `{"text":"hi"}` {
+				t.Fatalf("delivered %s, want the envelope's data", f.data)
+			}
+		default:
+			t.Fatalf("client %s got %d of the two broadcasts of one message id", c.id, len(c.send))
+		}
+	}
+	if reached < 0.25*n || reached > 0.35*n {
+		t.Fatalf("sampled broadcast reached %d of %d clients, want about 30%%", reached, n)
+	}
+}
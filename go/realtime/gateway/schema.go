@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// schemaPrinter renders validation errors for clients and logs.
+var schemaPrinter = message.NewPrinter(language.English)
+
+// compileSchema compiles the JSON Schema file at path. Schemas without a
+// $schema are read as draft 2020-12; a $ref may name another file relative
+// to this one, which is loaded with it.
+func compileSchema(path string) (*jsonschema.Schema, error) {
+	return jsonschema.NewCompiler().Compile(path)
+}
+
+// schemaError shortens a validation error to its first failing keyword,
+// such as "at /total: minimum: got -1, want 0". The full error nests every
+// cause and opens with the schema's file URL, which clients needn't see.
+func schemaError(err error) error {
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+	for len(ve.Causes) > 0 {
+		ve = ve.Causes[0]
+	}
+	return fmt.Errorf("at /%s: %s", strings.Join(ve.InstanceLocation, "/"), ve.ErrorKind.LocalizedString(schemaPrinter))
+}
+
+// checkSchema validates a message for topic against the topic's schema, if
+// it has one, from TOPIC_SCHEMAS or the topics section; a tenant's copy of a
+// topic falls back to the unscoped topic's schema. Messages that are not
+// JSON fail.
+func (h *hub) checkSchema(topic string, data []byte) error {
+	s, ok := topicSetting(h.topicConfig().schemas, topic)
+	if !ok {
+		return nil
+	}
+	start := time.Now()
+	defer func() { schemaValidationDuration.Observe(time.Since(start).Seconds()) }()
+	v, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return errors.New("message is not JSON")
+	}
+	return schemaError(s.Validate(v))
+}
+
+// validBroadcast reports whether a message from the backend may be
+// delivered on topic. With VALIDATE_BROADCASTS unset every message may.
+func (h *hub) validBroadcast(topic string, data []byte) bool {
+	if !h.validateBroadcasts {
+		return true
+	}
+	if err := h.checkSchema(topic, data); err != nil {
+		schemaRejections.WithLabelValues("broadcast").Inc()
+		slog.Warn("broadcast dropped: schema mismatch", "topic", topic, "err", err)
+		return false
+	}
+	return true
+}
+
+// loadTopicSchemas compiles the schema files named in entries such as
+// "orders:/etc/realtime/order.json". The topic ends at the last ':', so
+// tenant-scoped topics can be given but paths cannot contain one.
+func loadTopicSchemas(raw string) (map[string]*jsonschema.Schema, error) {
+	schemas := make(map[string]*jsonschema.Schema)
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndexByte(pair, ':')
+		if i <= 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("invalid entry %q; expected topic:path", pair)
+		}
+		topic, path := pair[:i], pair[i+1:]
+		s, err := compileSchema(path)
+		if err != nil {
+			return nil, err
+		}
+		schemas[topic] = s
+	}
+	return schemas, nil
+}
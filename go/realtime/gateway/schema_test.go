@@ -0,0 +1,216 @@
+package gateway
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// orderSchema requires a non-negative total and an id.
+const orderSchema = `{
+	"type": "object",
+	"required": ["id"],
+	"properties": {
+		"id": {"type": "string"},
+		"total": {"type": "number", "minimum": 0},
+		"lines": {"type": "array", "items": {"$ref": "line.json"}}
+	}
+}`
+
+// writeSchemas writes each named schema to a temporary directory and returns
+// the directory.
+func writeSchemas(t testing.TB, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// orderSchemas writes orderSchema and the line schema it refers to.
+func orderSchemas(t testing.TB) string {
+	return writeSchemas(t, map[string]string{
+		"order.json": orderSchema,
+		"line.json":  `{"type": "object", "required": ["sku"]}`,
+	})
+}
+
+// schemaValidations returns how many messages
+// realtime_schema_validation_duration_seconds has timed.
+func schemaValidations(t *testing.T) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := schemaValidationDuration.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestLoadTopicSchemasErrors(t *testing.T) {
+	dir := writeSchemas(t, map[string]string{
+		"broken.json":  `{"type": `,
+		"invalid.json": `{"type": 5}`,
+	})
+	tests := map[string]string{
+		"no path":      "orders",
+		"empty path":   "orders:",
+		"missing file": "orders:" + filepath.Join(dir, "missing.json"),
+		"not JSON":     "orders:" + filepath.Join(dir, "broken.json"),
+		"bad keyword":  "orders:" + filepath.Join(dir, "invalid.json"),
+	}
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadTopicSchemas(raw); err == nil {
+				t.Fatalf("loadTopicSchemas(%q) succeeded", raw)
+			}
+		})
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	dir := orderSchemas(t)
+	h := newTestHub(t, map[string]string{"TOPIC_SCHEMAS": "orders:" + filepath.Join(dir, "order.json")})
+	tests := []struct {
+		name, topic, data, err string
+	}{
+		{name: "valid", topic: "orders", data: `{"id":"o1","total":3.5}`},
+		{name: "below minimum", topic: "orders", data: `{"id":"o1","total":-1}`, err: "at /total: minimum: got -1, want 0"},
+		{name: "missing required", topic: "orders", data: `{"total":1}`, err: `at /: missing property 'id'`},
+		{name: "referenced file", topic: "orders", data: `{"id":"o1","lines":[{"sku":"a"},{}]}`, err: `at /lines/1: missing property 'sku'`},
+		{name: "not JSON", topic: "orders", data: `{"id":`, err: "message is not JSON"},
+		{name: "topic without schema", topic: "chat", data: `not json`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := h.checkSchema(tt.topic, []byte(tt.data))
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("checkSchema(%s) = %v, want nil", tt.data, err)
+			case tt.err != "" && (err == nil || err.Error() != tt.err):
+				t.Fatalf("checkSchema(%s) = %v, want %q", tt.data, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSchemaTenantFallback(t *testing.T) {
+	dir := orderSchemas(t)
+	scoped := writeSchemas(t, map[string]string{"acme.json": `{"type": "object", "required": ["region"]}`})
+	h := newTestHub(t, map[string]string{"TOPIC_SCHEMAS": "orders:" + filepath.Join(dir, "order.json") +
+		",tenant:acme:orders:" + filepath.Join(scoped, "acme.json")})
+
+	// A tenant without a schema of its own gets the unscoped topic's.
+	if err := h.checkSchema("tenant:globex:orders", []byte(`{"total":1}`)); err == nil {
+		t.Fatal("tenant:globex:orders skipped the orders schema")
+	}
+	if err := h.checkSchema("tenant:globex:orders", []byte(`{"id":"o1"}`)); err != nil {
+		t.Fatalf("tenant:globex:orders: %v", err)
+	}
+	// One that has a schema gets only its own.
+	if err := h.checkSchema("tenant:acme:orders", []byte(`{"region":"eu"}`)); err != nil {
+		t.Fatalf("tenant:acme:orders checked against the unscoped schema: %v", err)
+	}
+	if err := h.checkSchema("tenant:acme:orders", []byte(`{"id":"o1"}`)); err == nil {
+		t.Fatal("tenant:acme:orders skipped its own schema")
+	}
+}
+
+func TestSchemaValidationTimed(t *testing.T) {
+	dir := orderSchemas(t)
+	h := newTestHub(t, map[string]string{"TOPIC_SCHEMAS": "orders:" + filepath.Join(dir, "order.json")})
+	before := schemaValidations(t)
+	h.checkSchema("orders", []byte(`{"id":"o1"}`))
+	h.checkSchema("orders", []byte(`{"total":-1}`))
+	h.checkSchema("chat", []byte(`{}`))
+	if got := schemaValidations(t) - before; got != 2 {
+		t.Fatalf("validation duration observed %d times, want 2 for the orders messages", got)
+	}
+}
+
+func TestValidateBroadcasts(t *testing.T) {
+	dir := orderSchemas(t)
+	schemas := "orders:" + filepath.Join(dir, "order.json")
+	for _, validate := range []bool{false, true} {
+		name := "off"
+		if validate {
+			name = "on"
+		}
+		t.Run(name, func(t *testing.T) {
+			env := map[string]string{"TOPIC_SCHEMAS": schemas}
+			if validate {
+				env["VALIDATE_BROADCASTS"] = "true"
+			}
+			h := newTestHub(t, env)
+			c := testClient("c1", 4)
+			c.topics["orders"] = struct{}{}
+			h.add(c)
+
+			before := testutil.ToFloat64(schemaRejections.WithLabelValues("broadcast"))
+			h.broadcastTopic("orders", websocket.TextMessage, []byte(`{"total":-1}`))
+			h.broadcastTopic("orders", websocket.TextMessage, []byte(`{"id":"o1"}`))
+			want, rejected := 2, 0.0
+			if validate {
+				want, rejected = 1, 1
+			}
+			if len(c.send) != want {
+				t.Fatalf("queued %d frames, want %d", len(c.send), want)
+			}
+			if got := testutil.ToFloat64(schemaRejections.WithLabelValues("broadcast")) - before; got != rejected {
+				t.Fatalf("broadcast rejections rose by %v, want %v", got, rejected)
+			}
+		})
+	}
+}
+
+func TestPublishSchemaRejected(t *testing.T) {
+	dir := orderSchemas(t)
+	_, url := startRedis(t)
+	tg := startGateway(t, map[string]string{
+		"BACKEND":       "pubsub",
+		"REDIS_URL":     url,
+		"TOPIC_SCHEMAS": "orders:" + filepath.Join(dir, "order.json"),
+	})
+	waitFor(t, "subscription", tg.hub.subscribed.Load)
+	conn, _ := tg.connect("/ws", nil)
+
+	before := testutil.ToFloat64(schemaRejections.WithLabelValues("publish"))
+	sendJSON(t, conn, map[string]any{"action": "publish", "channel": "realtime:topic:orders", "data": map[string]any{"id": "o1", "total": -1}})
+	msg := readJSON(t, conn)
+	if msg["type"] != "error" || msg["code"] != "invalid_message" {
+		t.Fatalf("reply = %v, want invalid_message", msg)
+	}
+	if text, _ := msg["message"].(string); text != "data does not match the schema of orders: at /total: minimum: got -1, want 0" {
+		t.Fatalf("message = %q", text)
+	}
+	if strings.Contains(msg["message"].(string), dir) {
+		t.Fatal("error reveals the schema's path")
+	}
+	if got := testutil.ToFloat64(schemaRejections.WithLabelValues("publish")) - before; got != 1 {
+		t.Fatalf("publish rejections rose by %v, want 1", got)
+	}
+
+	sendJSON(t, conn, map[string]any{"action": "publish", "channel": "realtime:topic:orders", "data": map[string]any{"id": "o1", "total": 2}})
+	if msg := readJSON(t, conn); msg["type"] != "ack" {
+		t.Fatalf("reply = %v, want an ack for a valid order", msg)
+	}
+}
+
+func BenchmarkCheckSchema(b *testing.B) {
+	dir := orderSchemas(b)
+	h := newTestHub(b, map[string]string{"TOPIC_SCHEMAS": "orders:" + filepath.Join(dir, "order.json")})
+	data := []byte(`{"id":"o1","total":12.5,"lines":[{"sku":"a","qty":1},{"sku":"b","qty":3}]}`)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := h.checkSchema("orders", data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// publishSeqScript increments the channel's counter and publishes the
+// enveloped payload in one step, so sequence order always matches delivery
+// order even with several gateway instances publishing to the same channel.
+// ARGV[3], when set, is the JSON-quoted origin client ID, added as an outer
+// envelope that the gateway strips before delivery.
+var publishSeqScript = redis.NewScript(`
+local seq = redis.call("INCR", KEYS[1])
+local msg = '{"seq":' .. seq .. ',"data":' .. ARGV[2] .. '}'
+if ARGV[3] ~= "" then
+	msg = '{"origin":' .. ARGV[3] .. ',"data":' .. msg .. '}'
+end
+redis.call("PUBLISH", ARGV[1], msg)
+return seq
+`)
+
+// sequencer numbers client publishes per channel. Payloads are wrapped as
+// {"seq":123,"data":...}; the counter lives at <prefix><channel>.
+type sequencer struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+// publish sends data to channel wrapped in the next sequence number for that
+// channel and returns the number assigned. A non-empty origin keeps the
+// message from being echoed to that client.
+func (s *sequencer) publish(ctx context.Context, channel string, data []byte, origin string) (int64, error) {
+	if len(data) == 0 {
+		data = []byte("null")
+	}
+	var quoted []byte
+	if origin != "" {
+		quoted, _ = json.Marshal(origin)
+	}
+	return publishSeqScript.Run(ctx, s.rdb, []string{s.prefix + channel}, channel, data, quoted).Int64()
+}
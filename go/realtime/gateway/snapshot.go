@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxSnapshotSize bounds the snapshot body read from SNAPSHOT_URL.
+const maxSnapshotSize = 4 << 20
+
+// snapshotMessage carries a topic's current state, sent after the subscribe
+// ack and before the topic's live messages. JSON snapshots are embedded
+// as-is, anything else as a string.
+type snapshotMessage struct {
+	Type  string          `json:"type"`
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func encodeSnapshot(topic string, data []byte) []byte {
+	raw := json.RawMessage(data)
+	if !json.Valid(data) {
+		raw, _ = json.Marshal(string(data))
+	}
+	b, _ := json.Marshal(snapshotMessage{Type: "snapshot", Topic: topic, Data: raw})
+	return b
+}
+
+// snapshotSource fetches a topic's current state from SNAPSHOT_URL, whose
+// {topic} placeholder is replaced by the path-escaped topic.
+type snapshotSource struct {
+	url    string
+	client *http.Client
+}
+
+func newSnapshotSource(url string, timeout time.Duration) *snapshotSource {
+	return &snapshotSource{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// fetch returns the snapshot of topic, or nil when the service has none
+// (404).
+func (s *snapshotSource) fetch(ctx context.Context, topic string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(s.url, "{topic}", url.PathEscape(topic)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("snapshot service answered %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSnapshotSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSnapshotSize {
+		return nil, fmt.Errorf("snapshot exceeds %d bytes", maxSnapshotSize)
+	}
+	return body, nil
+}
+
+// snapshotHold collects a topic's live messages for one client while the
+// topic's snapshot is fetched, up to half the client's send buffer.
+type snapshotHold struct {
+	frames     []frame
+	overflowed bool
+}
+
+// holdTopic starts holding back topic's live messages for c until
+// sendSnapshot releases them. It reports false when a snapshot of topic is
+// already in flight.
+func (c *client) holdTopic(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.holds[topic]; ok {
+		return false
+	}
+	if c.holds == nil {
+		c.holds = make(map[string]*snapshotHold)
+	}
+	c.holds[topic] = &snapshotHold{}
+	return true
+}
+
+// holdBack keeps f for later and reports true while topic's snapshot is in
+// flight for c. The caller must hold c's shard lock.
+func (h *hub) holdBack(c *client, topic string, f frame) bool {
+	if h.snapshots == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hold := c.holds[topic]
+	if hold == nil {
+		return false
+	}
+	if len(hold.frames) < h.sendBuffer/2 {
+		hold.frames = append(hold.frames, f)
+	} else {
+		hold.overflowed = true
+	}
+	return true
+}
+
+// sendSnapshot fetches topic's snapshot and queues it for c, followed by the
+// live messages held back meanwhile; a failed fetch is reported with a
+// snapshot_failed error frame instead and live delivery carries on.
+func (h *hub) sendSnapshot(c *client, topic string) {
+	body, err := h.snapshots.fetch(c.ctx, topic)
+	switch {
+	case err != nil:
+		snapshotsFetched.WithLabelValues("error").Inc()
+		c.logger.Warn("ws snapshot fetch failed", "topic", topic, "err", err)
+	case body == nil:
+		snapshotsFetched.WithLabelValues("missing").Inc()
+	default:
+		snapshotsFetched.WithLabelValues("ok").Inc()
+	}
+
+	s := h.shardFor(c.id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c.mu.Lock()
+	hold := c.holds[topic]
+	delete(c.holds, topic)
+	if _, ok := s.clients[c]; !ok || hold == nil {
+		c.mu.Unlock()
+		return
+	}
+	// c.mu stays locked until the held messages are queued so no live
+	// message can overtake them.
+	switch {
+	case err != nil:
+		h.push(c, frame{messageType: websocket.TextMessage, data: encodeError(actionSubscribe, "snapshot_failed", "snapshot of "+c.unscope(topic)+" unavailable; live messages follow")})
+	case body != nil:
+		h.push(c, frame{messageType: websocket.TextMessage, data: encodeSnapshot(c.unscope(topic), body)})
+	}
+	for _, f := range hold.frames {
+		h.push(c, f)
+	}
+	c.mu.Unlock()
+	if hold.overflowed {
+		c.logger.Warn("ws live messages dropped while fetching snapshot", "topic", topic, "kept", len(hold.frames))
+	}
+}
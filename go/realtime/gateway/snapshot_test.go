@@ -0,0 +1,127 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// snapshotServer answers snapshot fetches with handler, reporting each
+// request's escaped path on requested.
+func snapshotServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) (url string, requested chan string) {
+	t.Helper()
+	requested = make(chan string, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.URL.EscapedPath()
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/state/{topic}", requested
+}
+
+// awaitRequest waits for the snapshot fetch of path.
+func awaitRequest(t *testing.T, requested chan string, path string) {
+	t.Helper()
+	select {
+	case got := <-requested:
+		if got != path {
+			t.Fatalf("snapshot fetched from %s, want %s", got, path)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no snapshot fetch of %s", path)
+	}
+}
+
+func TestSnapshotPrecedesLiveMessages(t *testing.T) {
+	release := make(chan struct{})
+	url, requested := snapshotServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, `{"price":100}`)
+	})
+	tg := startGateway(t, map[string]string{"SNAPSHOT_URL": url})
+	conn, _ := tg.connect("/ws", nil)
+	sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "prices"})
+	if msg := readJSON(t, conn); msg["type"] != "ack" {
+		t.Fatalf("reply = %v, want an ack", msg)
+	}
+	awaitRequest(t, requested, "/state/prices")
+	// Published while the snapshot is being fetched: held back, not lost.
+	for i := 1; i <= 3; i++ {
+		tg.hub.broadcastTopic("prices", websocket.TextMessage, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	close(release)
+
+	snap := readJSON(t, conn)
+	data, _ := snap["data"].(map[string]any)
+	if snap["type"] != "snapshot" || snap["topic"] != "prices" || data["price"] != float64(100) {
+		t.Fatalf("first frame = %v, want the snapshot", snap)
+	}
+	for want := 1; want <= 3; want++ {
+		if msg := readJSON(t, conn); msg["n"] != float64(want) {
+			t.Fatalf("frame = %v, want held message n=%d", msg, want)
+		}
+	}
+	tg.hub.broadcastTopic("prices", websocket.TextMessage, []byte(`{"n":4}`))
+	if msg := readJSON(t, conn); msg["n"] != float64(4) {
+		t.Fatalf("frame = %v, want live message n=4", msg)
+	}
+}
+
+func TestSnapshotOnConnectTopics(t *testing.T) {
+	url, requested := snapshotServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "plain state")
+	})
+	tg := startGateway(t, map[string]string{"SNAPSHOT_URL": url})
+	conn, _ := tg.connect("/ws?topics=orders/eu", nil)
+	awaitRequest(t, requested, "/state/orders%2Feu")
+	// A body that isn't JSON arrives as a string.
+	if msg := readJSON(t, conn); msg["type"] != "snapshot" || msg["topic"] != "orders/eu" || msg["data"] != "plain state" {
+		t.Fatalf("frame = %v, want the snapshot as a string", msg)
+	}
+}
+
+func TestSnapshotFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		result  string
+		// wantError is whether a snapshot_failed error frame precedes the
+		// live messages; a missing snapshot sends nothing.
+		wantError bool
+	}{
+		{name: "server error", handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) }, result: "error", wantError: true},
+		{name: "timeout", handler: func(w http.ResponseWriter, r *http.Request) { time.Sleep(500 * time.Millisecond) }, result: "error", wantError: true},
+		{name: "missing", handler: func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) }, result: "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, requested := snapshotServer(t, tt.handler)
+			tg := startGateway(t, map[string]string{"SNAPSHOT_URL": url, "SNAPSHOT_TIMEOUT": "100ms"})
+			before := testutil.ToFloat64(snapshotsFetched.WithLabelValues(tt.result))
+			conn, _ := tg.connect("/ws", nil)
+			sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "prices"})
+			readJSON(t, conn)
+			awaitRequest(t, requested, "/state/prices")
+			tg.hub.broadcastTopic("prices", websocket.TextMessage, []byte(`{"n":1}`))
+
+			msg := readJSON(t, conn)
+			if tt.wantError {
+				if msg["type"] != "error" || msg["code"] != "snapshot_failed" {
+					t.Fatalf("frame = %v, want a snapshot_failed error", msg)
+				}
+				msg = readJSON(t, conn)
+			}
+			if msg["n"] != float64(1) {
+				t.Fatalf("frame = %v, want the live message delivered anyway", msg)
+			}
+			if got := testutil.ToFloat64(snapshotsFetched.WithLabelValues(tt.result)) - before; got != 1 {
+				t.Fatalf("snapshots_fetched{result=%q} rose by %v, want 1", tt.result, got)
+			}
+		})
+	}
+}
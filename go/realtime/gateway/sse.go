@@ -0,0 +1,299 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// serveSSE serves GET /sse: the same messages as /ws, for the ?topics= given
+// on connect, as a text/event-stream for clients whose network blocks
+// WebSockets. Authentication, origin checks and connection limits are the
+// ones /ws applies. The stream is one-way, so topics are fixed for the life
+// of the connection and nothing the client would send is read.
+func (h *hub) serveSSE(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		reject(w, "draining", "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if h.starting.Load() {
+		w.Header().Set("Retry-After", "1")
+		reject(w, "starting", "server is starting; retry shortly", http.StatusServiceUnavailable)
+		return
+	}
+	if h.memoryPressured.Load() {
+		w.Header().Set("Retry-After", retryAfter)
+		reject(w, "memory", "server is under memory pressure; retry later", http.StatusServiceUnavailable)
+		return
+	}
+	if !h.upgrader.CheckOrigin(r) {
+		slog.Warn("sse origin refused", "remote", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+		reject(w, "origin", "origin not allowed", http.StatusForbidden)
+		return
+	}
+	ip := h.proxies.clientIP(r)
+	if h.acceptLimiter != nil && !h.acceptLimiter.Allow() {
+		w.Header().Set("Retry-After", strconv.Itoa(1+rand.IntN(maxAcceptRetryAfter)))
+		reject(w, "rate_limit", "too many new connections; retry later", http.StatusServiceUnavailable)
+		return
+	}
+	id, err := clientID(r.URL.Query().Get("client_id"))
+	if err != nil {
+		reject(w, "handshake", err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, taken := h.get(id); taken && h.rejectDuplicates {
+		reject(w, "duplicate", "client_id is already connected", http.StatusConflict)
+		return
+	}
+	var tenant string
+	if h.tenants != nil {
+		if tenant, err = h.tenants.resolve(r); err != nil {
+			reject(w, "handshake", err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	topics := parseTopics(r.URL.Query().Get("topics"))
+	if _, ok := topics[firehoseTopic]; ok {
+		reject(w, "handshake", "the firehose is only available over WebSocket", http.StatusBadRequest)
+		return
+	}
+	if h.maxSubscriptions > 0 && len(topics) > h.maxSubscriptions {
+		subscriptionsRejected.Inc()
+		reject(w, "handshake", fmt.Sprintf("at most %d subscriptions per connection", h.maxSubscriptions), http.StatusBadRequest)
+		return
+	}
+	var claims jwt.MapClaims
+	if h.auth != nil {
+		if claims, err = h.auth.authenticate(r); err != nil {
+			slog.Warn("sse auth failed", "remote", r.RemoteAddr, "ip", ip, "err", err)
+			if errors.Is(err, errAuthUnavailable) {
+				reject(w, "auth", "authentication is unavailable; retry later", http.StatusServiceUnavailable)
+				return
+			}
+			reject(w, "auth", "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	user, err := userID(r, claims, h.userClaim)
+	if err != nil {
+		reject(w, "handshake", err.Error(), http.StatusBadRequest)
+		return
+	}
+	var granted, denied []string
+	if h.topicAuth != nil {
+		granted, denied = h.authorizeTopics(r.Context(), claims, tenant, topics)
+		for _, t := range denied {
+			delete(topics, t)
+		}
+	}
+	if !h.acquire() {
+		w.Header().Set("Retry-After", retryAfter)
+		reject(w, "capacity", "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	if h.perIP != nil && !h.perIP.acquire(ip) {
+		h.release()
+		w.Header().Set("Retry-After", retryAfter)
+		reject(w, "rate_limit", "too many connections from your address", http.StatusTooManyRequests)
+		return
+	}
+
+	c := newClient(h.ctx, id, r.RemoteAddr, nil, h.sendBuffer)
+	c.ip = ip
+	c.logger = c.logger.With("transport", "sse")
+	if ip != remoteHost(c.remoteAddr) {
+		c.logger = c.logger.With("ip", ip)
+	}
+	if h.tags != nil {
+		c.tags = h.tags.capture(r)
+	}
+	c.protocol = protocolV1
+	c.userID = user
+	if user != "" {
+		c.logger = c.logger.With("user", user)
+	}
+	c.claims = claims
+	c.subject, _ = claims.GetSubject()
+	if tenant != "" {
+		c.tenant = tenant
+		c.logger = c.logger.With("tenant", tenant)
+	}
+	for t := range topics {
+		c.topics[c.scope(t)] = struct{}{}
+	}
+
+	// The stream outlives HTTP_READ_TIMEOUT, which would otherwise cancel
+	// the request context, and its writes get their own deadlines.
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	if origin := r.Header.Get("Origin"); origin != "" {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+		header.Add("Vary", "Origin")
+	}
+
+	c.logger.Info("sse client connected", "subject", c.subject)
+	var added bool
+	if h.retain != nil {
+		added = h.addRetaining(c, topics)
+	} else {
+		added = h.add(c)
+	}
+	if !added {
+		c.cancel()
+		h.release()
+		if h.perIP != nil {
+			h.perIP.release(ip)
+		}
+		reject(w, "duplicate", "client_id is already connected", http.StatusConflict)
+		return
+	}
+	sseConnections.Inc()
+	w.WriteHeader(http.StatusOK)
+	h.enqueue(c, encodeWelcome(c.id, c.protocol))
+	if len(granted) > 0 || len(denied) > 0 {
+		h.enqueue(c, encodeTopicsAck(granted, denied))
+	}
+	h.ssePump(c, w, rc, r.Context().Done())
+}
+
+// ssePump is writePump for an SSE client: it writes queued messages as
+// events, and a comment line every pingInterval so proxies keep the stream
+// open and a vanished client is noticed by a failed write. It returns once
+// the client is removed, the request ends or a write fails.
+func (h *hub) ssePump(c *client, w http.ResponseWriter, rc *http.ResponseController, done <-chan struct{}) {
+	reason := disconnectWriteError
+	defer func() { h.removeWithReason(c, reason) }()
+	keepAlive := time.NewTicker(h.pingInterval)
+	defer keepAlive.Stop()
+	var lifetimeEnd <-chan time.Time
+	if h.maxLifetime > 0 {
+		t := time.NewTimer(h.lifetime())
+		defer t.Stop()
+		lifetimeEnd = t.C
+	}
+	write := func(event []byte) bool {
+		rc.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+		_, err := w.Write(event)
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			if isTimeout(err) {
+				writeTimeouts.Inc()
+			}
+			c.logger.Debug("sse write error", "err", err)
+			return false
+		}
+		// The client never sends anything, so a write that went through
+		// is what keeps the reaper away.
+		c.heard()
+		return true
+	}
+	deliver := func(f frame) bool {
+		if !write(encodeEvent(f)) {
+			broadcastErrors.Inc()
+			return false
+		}
+		c.bytesSent.Add(int64(len(f.data)))
+		c.touch()
+		return true
+	}
+	// reconnect sends the reconnect hint as an event and sets the stream's
+	// retry delay to match, so EventSource waits as long before it
+	// reconnects on its own.
+	reconnect := func(why string) {
+		after := h.reconnectAfter()
+		event := fmt.Appendf(nil, "retry: %d\n", after.Milliseconds())
+		write(append(event, encodeEvent(frame{messageType: websocket.TextMessage, data: encodeReconnect(after, why)})...))
+	}
+
+	for {
+		select {
+		case f := <-c.priority:
+			if !deliver(f) {
+				return
+			}
+			continue
+		default:
+		}
+		select {
+		case f := <-c.priority:
+			if !deliver(f) {
+				return
+			}
+		case f, ok := <-c.send:
+			if !ok {
+				return
+			}
+			if !deliver(c.take(f)) {
+				return
+			}
+		case <-keepAlive.C:
+			if !write([]byte(": keep-alive\n\n")) {
+				return
+			}
+		case <-lifetimeEnd:
+			if h.draining.Load() {
+				continue
+			}
+			c.logger.Info("sse client reached MAX_CONNECTION_LIFETIME; asking it to reconnect", "connected_for", time.Since(c.connectedAt).Round(time.Second))
+			reconnect("max_lifetime")
+			reason = disconnectMaxLifetime
+			return
+		case <-done:
+			reason = disconnectClientClose
+			return
+		case <-c.ctx.Done():
+			if h.ctx.Err() != nil {
+				reconnect("server_shutdown")
+				reason = disconnectShutdown
+			}
+			return
+		}
+	}
+}
+
+// encodeEvent frames a message as a server-sent event. Every line of a text
+// message becomes a data line, so EventSource hands the message over
+// unchanged; a binary message is sent base64-encoded as a "binary" event.
+func encodeEvent(f frame) []byte {
+	var b bytes.Buffer
+	data := f.data
+	if f.messageType == websocket.BinaryMessage {
+		b.WriteString("event: binary\n")
+		data = []byte(base64.StdEncoding.EncodeToString(data))
+	}
+	for {
+		// SSE ends a line at CR, LF or CRLF.
+		i := bytes.IndexAny(data, "\r\n")
+		if i < 0 {
+			break
+		}
+		b.WriteString("data: ")
+		b.Write(data[:i])
+		b.WriteByte('\n')
+		if data[i] == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			i++
+		}
+		data = data[i+1:]
+	}
+	b.WriteString("data: ")
+	b.Write(data)
+	b.WriteString("\n\n")
+	return b.Bytes()
+}
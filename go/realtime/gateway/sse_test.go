@@ -0,0 +1,225 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// sseEvent is one event read off a stream: its fields, the data lines
+// joined with "\n" the way EventSource joins them.
+type sseEvent struct {
+	event, data, retry string
+}
+
+// sseStream is an open GET /sse, read in the background.
+type sseStream struct {
+	resp   *http.Response
+	events chan sseEvent
+	cancel context.CancelFunc
+}
+
+// openSSE opens path, e.g. "/sse?topics=a", and fails the test unless the
+// gateway answers 200.
+func (tg *testGateway) openSSE(path string, header http.Header) *sseStream {
+	tg.t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, tg.url(path), nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		tg.t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		cancel()
+		resp.Body.Close()
+		tg.t.Fatalf("GET %s = %d", path, resp.StatusCode)
+	}
+	s := &sseStream{resp: resp, events: make(chan sseEvent, 64), cancel: cancel}
+	tg.t.Cleanup(s.close)
+	go func() {
+		defer close(s.events)
+		scanner := bufio.NewScanner(resp.Body)
+		var ev sseEvent
+		var data []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if data != nil || ev.retry != "" {
+					ev.data = strings.Join(data, "\n")
+					s.events <- ev
+				}
+				ev, data = sseEvent{}, nil
+			case strings.HasPrefix(line, ":"):
+			case strings.HasPrefix(line, "data: "):
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			case strings.HasPrefix(line, "event: "):
+				ev.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "retry: "):
+				ev.retry = strings.TrimPrefix(line, "retry: ")
+			}
+		}
+	}()
+	return s
+}
+
+func (s *sseStream) close() {
+	s.cancel()
+	s.resp.Body.Close()
+}
+
+// next returns the next event, failing the test after a second or when the
+// stream has ended.
+func (s *sseStream) next(t *testing.T) sseEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-s.events:
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return sseEvent{}
+}
+
+// welcome reads the welcome event and returns the client ID it names.
+func (s *sseStream) welcome(t *testing.T) string {
+	t.Helper()
+	var msg map[string]any
+	ev := s.next(t)
+	if err := json.Unmarshal([]byte(ev.data), &msg); err != nil || msg["type"] != "welcome" {
+		t.Fatalf("first event = %+v, want a welcome", ev)
+	}
+	id, _ := msg["id"].(string)
+	return id
+}
+
+func TestSSEBroadcast(t *testing.T) {
+	tg := startGateway(t, nil)
+	before := testutil.ToFloat64(sseConnections)
+	s := tg.openSSE("/sse?topics=news", nil)
+	if ct := s.resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	s.welcome(t)
+	if got := testutil.ToFloat64(sseConnections) - before; got != 1 {
+		t.Fatalf("sse connections rose by %v, want 1", got)
+	}
+	tg.hub.broadcastTopic("sports", websocket.TextMessage, []byte(`{"n":0}`))
+	tg.hub.broadcastTopic("news", websocket.TextMessage, []byte("{\"n\":1,\n\"m\":2}"))
+	tg.hub.broadcast(websocket.TextMessage, []byte(`{"all":true}`))
+	if ev := s.next(t); ev.data != "{\"n\":1,\n\"m\":2}" || ev.event != "" {
+		t.Fatalf("event = %+v, want the news message with its line break", ev)
+	}
+	if ev := s.next(t); ev.data != `{"all":true}` {
+		t.Fatalf("event = %+v, want the broadcast to everyone", ev)
+	}
+}
+
+func TestSSEClientGoneIsRemoved(t *testing.T) {
+	tg := startGateway(t, nil)
+	s := tg.openSSE("/sse", nil)
+	id := s.welcome(t)
+	if _, ok := tg.hub.get(id); !ok {
+		t.Fatal("SSE client not registered")
+	}
+	before := testutil.ToFloat64(disconnects.WithLabelValues(disconnectClientClose))
+	s.close()
+	waitFor(t, "the client to be removed", func() bool {
+		_, ok := tg.hub.get(id)
+		return !ok
+	})
+	if got := testutil.ToFloat64(disconnects.WithLabelValues(disconnectClientClose)) - before; got != 1 {
+		t.Fatalf("client_close disconnects rose by %v, want 1", got)
+	}
+	waitFor(t, "the slot to be released", func() bool { return tg.hub.active.Load() == 0 })
+}
+
+func TestSSEAuth(t *testing.T) {
+	tg := startGateway(t, map[string]string{"JWT_SECRET": testSecret})
+	req, _ := http.NewRequest(http.MethodGet, tg.url("/sse"), nil)
+	if code, _ := status(t, req); code != http.StatusUnauthorized {
+		t.Fatalf("GET /sse without a token = %d, want 401", code)
+	}
+	token := signToken(t, testSecret, jwt.MapClaims{"sub": "u1", "exp": time.Now().Add(time.Hour).Unix()})
+	tg.openSSE("/sse?token="+token, nil).welcome(t)
+	tg.openSSE("/sse", http.Header{"Authorization": {"Bearer " + token}}).welcome(t)
+}
+
+func TestSSERefusals(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		path string
+		want int
+	}{
+		{name: "firehose", env: map[string]string{"ADMIN_TOKEN": "admin"}, path: "/sse?topics=" + firehoseTopic, want: http.StatusBadRequest},
+		{name: "too many topics", env: map[string]string{"MAX_SUBSCRIPTIONS_PER_CLIENT": "1"}, path: "/sse?topics=a,b", want: http.StatusBadRequest},
+		{name: "origin", env: map[string]string{"ALLOWED_ORIGINS": "https://app.example.com"}, path: "/sse", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := startGateway(t, tt.env)
+			req, _ := http.NewRequest(http.MethodGet, tg.url(tt.path), nil)
+			req.Header.Set("Origin", "https://evil.example.net")
+			if code, _ := status(t, req); code != tt.want {
+				t.Fatalf("GET %s = %d, want %d", tt.path, code, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSEReconnectOnLifetime(t *testing.T) {
+	tg := startGateway(t, map[string]string{
+		"MAX_CONNECTION_LIFETIME": "100ms", "MAX_CONNECTION_LIFETIME_JITTER": "0",
+		"RECONNECT_DELAY": "300ms", "RECONNECT_JITTER": "0",
+	})
+	s := tg.openSSE("/sse", nil)
+	s.welcome(t)
+	ev := s.next(t)
+	if ev.retry != "300" || ev.data != `{"type":"reconnect","after_ms":300,"reason":"max_lifetime"}` {
+		t.Fatalf("event = %+v, want a max_lifetime reconnect with retry 300", ev)
+	}
+	select {
+	case _, ok := <-s.events:
+		if ok {
+			t.Fatal("stream carried on after the reconnect hint")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream still open after the reconnect hint")
+	}
+}
+
+func TestEncodeEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		f    frame
+		want string
+	}{
+		{name: "text", f: frame{messageType: websocket.TextMessage, data: []byte(`{"n":1}`)}, want: "data: {\"n\":1}\n\n"},
+		{name: "line breaks", f: frame{messageType: websocket.TextMessage, data: []byte("a\nb\r\nc\rd")}, want: "data: a\ndata: b\ndata: c\ndata: d\n\n"},
+		{name: "trailing newline", f: frame{messageType: websocket.TextMessage, data: []byte("a\n")}, want: "data: a\ndata: \n\n"},
+		{name: "binary", f: frame{messageType: websocket.BinaryMessage, data: []byte{0, 0xff}}, want: "event: binary\ndata: AP8=\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(encodeEvent(tt.f)); got != tt.want {
+				t.Fatalf("encodeEvent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// statsTopic is the internal topic that receives this instance's periodic
+// stats. Tenant clients subscribe under their own scope and never get them.
+const statsTopic = "__stats__"
+
+// statsMessage is a periodic snapshot of one instance.
+type statsMessage struct {
+	Type             string           `json:"type"`
+	Instance         string           `json:"instance"`
+	TS               int64            `json:"ts"`
+	Clients          int              `json:"clients"`
+	Topics           map[string]int64 `json:"topics"`
+	BroadcastsPerSec float64          `json:"broadcasts_per_sec"`
+}
+
+// statsPublisher sends a statsMessage every interval to the statsTopic
+// subscribers and, when channel is set, to that Redis channel.
+type statsPublisher struct {
+	rdb      *redis.Client
+	channel  string
+	instance string
+	interval time.Duration
+}
+
+func (p *statsPublisher) run(ctx context.Context, h *hub) {
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	last, lastAt := h.broadcasts.Load(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			n := h.broadcasts.Load()
+			msg := statsMessage{
+				Type:             "stats",
+				Instance:         p.instance,
+				TS:               now.UnixMilli(),
+				Clients:          h.count(),
+				Topics:           h.topicCounts(),
+				BroadcastsPerSec: math.Round(float64(n-last)/now.Sub(lastAt).Seconds()*100) / 100,
+			}
+			last, lastAt = n, now
+			payload, _ := json.Marshal(msg)
+			h.each(func(c *client) {
+				if c.subscribed(statsTopic) {
+					h.push(c, frame{messageType: websocket.TextMessage, data: payload})
+				}
+			})
+			if p.channel != "" {
+				if err := p.rdb.Publish(ctx, p.channel, payload).Err(); err != nil && ctx.Err() == nil {
+					slog.Error("stats publish failed", "channel", p.channel, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// countBroadcast records one fan-out.
+func (h *hub) countBroadcast() {
+	messagesBroadcast.Inc()
+	h.broadcasts.Add(1)
+}
+
+// topicCounts returns how many clients joined each topic, walking one shard
+// at a time under its read lock.
+func (h *hub) topicCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for c := range s.clients {
+			c.mu.Lock()
+			for t := range c.topics {
+				counts[t]++
+			}
+			c.mu.Unlock()
+		}
+		s.mu.RUnlock()
+	}
+	return counts
+}
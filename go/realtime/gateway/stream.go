@@ -0,0 +1,479 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// streamBackend delivers messages from a Redis Stream instead of Pub/Sub
+// (BACKEND=stream), which lets clients catch up on entries they missed.
+// Publishers XADD entries with a "data" field and an optional "topic" field;
+// entries without a topic go to every client. Entries with a "to" field are
+// direct messages for that client ID and are never replayed.
+type streamBackend struct {
+	rdb        *redis.Client
+	key        string
+	replayMax  int64
+	maxBackoff time.Duration
+	maxSize    int
+	// head is the newest entry run has finished delivering, for cursors.
+	head atomic.Pointer[string]
+}
+
+// streamEntry is a decoded stream message.
+type streamEntry struct {
+	id    string
+	topic string
+	to    string
+	// toUser addresses every connection of a user, like to for one client.
+	toUser string
+	data   []byte
+	// filter, when set, limits delivery to the clients an envelope selects.
+	filter *deliveryFilter
+	// diag is the marker of a /diag probe entry, which is never delivered.
+	diag string
+}
+
+// replayRequest is the catch-up a client asked for on connect: every entry
+// after since, the last count entries, or, for an ack-mode client that
+// reconnects, every entry from its oldest unacknowledged one on. cursor is set
+// when since is the client's saved cursor rather than its own ?since=.
+type replayRequest struct {
+	since  string
+	count  int64
+	from   string
+	cursor bool
+}
+
+func (rq replayRequest) active() bool { return rq.since != "" || rq.count > 0 || rq.from != "" }
+
+// parseReplay reads ?since=<id> and ?replay=N.
+func parseReplay(q url.Values) (replayRequest, error) {
+	var rq replayRequest
+	if since := q.Get("since"); since != "" {
+		if _, _, ok := parseStreamID(since); !ok {
+			return rq, fmt.Errorf("invalid since %q", since)
+		}
+		rq.since = since
+	}
+	if n := q.Get("replay"); n != "" {
+		count, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || count <= 0 {
+			return rq, fmt.Errorf("invalid replay %q", n)
+		}
+		rq.count = count
+	}
+	return rq, nil
+}
+
+// run reads the stream from its current end, delivering entries to the hub
+// and resuming from the last seen ID after errors.
+func (s *streamBackend) run(ctx context.Context, h *hub) {
+	lastID := "$"
+	backoff := 500 * time.Millisecond
+	for ctx.Err() == nil {
+		// XRead blocks for up to 5s when the stream is idle, so confirm the
+		// connection up front instead of leaving /ready failing meanwhile.
+		if !h.subscribed.Load() && s.rdb.Ping(ctx).Err() == nil {
+			h.subscribed.Store(true)
+		}
+		res, err := s.rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{s.key, lastID},
+			Count:   100,
+			Block:   5 * time.Second,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			h.subscribed.Store(true)
+			continue
+		}
+		if err != nil {
+			h.subscribed.Store(false)
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("redis stream read failed; retrying", "stream", s.key, "backoff", backoff, "err", err)
+			redisReconnects.Inc()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, s.maxBackoff)
+			continue
+		}
+		backoff = 500 * time.Millisecond
+		h.subscribed.Store(true)
+		for _, stream := range res {
+			for _, msg := range stream.Messages {
+				lastID = msg.ID
+				messagesReceived.Inc()
+				e := decodeEntry(msg)
+				if e.diag != "" {
+					if h.diag != nil {
+						h.diag.receive(e.diag)
+					}
+					continue
+				}
+				if s.maxSize > 0 && len(e.data) > s.maxSize {
+					slog.Warn("skipping message over MAX_BROADCAST_SIZE", "stream", s.key, "id", e.id, "bytes", len(e.data))
+					continue
+				}
+				if e.to != "" {
+					h.sendTo(e.to, h.typeFor(""), e.data)
+					continue
+				}
+				if e.toUser != "" {
+					h.sendToUser(e.toUser, h.typeFor(""), e.data)
+					continue
+				}
+				h.broadcastEntry(e)
+			}
+		}
+		head := lastID
+		s.head.Store(&head)
+	}
+}
+
+// replay loads the entries rq asks for, oldest first.
+func (s *streamBackend) replay(ctx context.Context, rq replayRequest) ([]streamEntry, error) {
+	var msgs []redis.XMessage
+	var err error
+	switch {
+	case rq.since != "":
+		msgs, err = s.rdb.XRangeN(ctx, s.key, "("+rq.since, "+", s.replayMax).Result()
+	case rq.from != "":
+		msgs, err = s.rdb.XRangeN(ctx, s.key, rq.from, "+", s.replayMax).Result()
+	default:
+		msgs, err = s.rdb.XRevRangeN(ctx, s.key, "+", "-", min(rq.count, s.replayMax)).Result()
+		slices.Reverse(msgs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]streamEntry, 0, len(msgs))
+	for _, m := range msgs {
+		if e := decodeEntry(m); e.diag == "" {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func decodeEntry(msg redis.XMessage) streamEntry {
+	e := streamEntry{id: msg.ID}
+	if t, ok := msg.Values["topic"].(string); ok {
+		e.topic = t
+	}
+	if to, ok := msg.Values["to"].(string); ok {
+		e.to = to
+	}
+	if to, ok := msg.Values["to_user"].(string); ok {
+		e.toUser = to
+	}
+	if d, ok := msg.Values["diag"].(string); ok {
+		e.diag = d
+	}
+	if d, ok := msg.Values["data"].(string); ok {
+		e.filter, e.data = parseEnvelope([]byte(d), msg.ID)
+	}
+	return e
+}
+
+// expired reports whether e carries a ttl_ms that has run out by now,
+// counting from the time in its entry ID.
+func (e streamEntry) expired(now time.Time) bool {
+	if e.filter == nil || e.filter.ttl <= 0 {
+		return false
+	}
+	ms, _, ok := parseStreamID(e.id)
+	return ok && now.Sub(time.UnixMilli(int64(ms))) > e.filter.ttl
+}
+
+// wants reports whether e should be delivered to c.
+func (c *client) wants(e streamEntry) bool {
+	if !e.filter.matches(c) {
+		return false
+	}
+	return e.topic == "" || c.subscribed(e.topic)
+}
+
+// broadcastEntry delivers a live stream entry to every interested client.
+func (h *hub) broadcastEntry(e streamEntry) {
+	if !h.beginBroadcast(e.topic) {
+		return
+	}
+	defer h.endBroadcast()
+	h.countBroadcast()
+	span := h.startSpan(e.filter, e.topic)
+	if !h.validBroadcast(e.topic, e.data) {
+		span.End(0)
+		return
+	}
+	var ok bool
+	if e.data, ok = h.transform(e.topic, e.data); !ok {
+		span.End(0)
+		return
+	}
+	start := time.Now()
+	var recipients atomic.Int64
+	h.fanout(func(c *client) {
+		if c.wants(e) {
+			end := span.StartWrite(c.id)
+			h.pushEntry(c, e)
+			end()
+			recipients.Add(1)
+		}
+	})
+	observeBroadcast(start, recipients.Load())
+	span.End(int(recipients.Load()))
+	h.sendReceipt(e.filter, e.topic, e.id, recipients.Load())
+	if e.to == "" {
+		h.firehoseCopy(e.topic, h.typeFor(e.topic), e.data)
+	}
+	if h.msgLog != nil {
+		id := e.filter.messageID()
+		if id == "" {
+			id = e.id
+		}
+		h.msgLog.record(e.topic, id, e.data, recipients.Load())
+	}
+}
+
+// pushEntry queues a live entry, holding it back while the client is still
+// replaying and skipping anything the replay already covered. At most
+// sendBuffer entries are held; past that the client only keeps count, to be
+// told about the gap and closed once the replay is written. The caller must
+// hold the client's shard lock.
+func (h *hub) pushEntry(c *client, e streamEntry) {
+	c.streamMu.Lock()
+	if c.replaying {
+		switch {
+		case c.dropped.Count > 0:
+			c.dropped.To = e.id
+			c.dropped.Count++
+		case len(c.pending) >= h.sendBuffer:
+			first := e.id
+			if len(c.pending) > 0 {
+				first = c.pending[0].id
+			}
+			c.dropped = gapMessage{Type: "gap", Reason: "overflow", From: first, To: e.id, Count: len(c.pending) + 1}
+			c.pending = nil
+		default:
+			c.pending = append(c.pending, e)
+		}
+		c.streamMu.Unlock()
+		return
+	}
+	if c.lastID != "" && !streamIDAfter(e.id, c.lastID) {
+		c.streamMu.Unlock()
+		return
+	}
+	c.lastID = e.id
+	c.streamMu.Unlock()
+	h.queueEntry(c, e)
+}
+
+// queueEntry queues e for c the way broadcastTopic queues a live message:
+// behind an in-flight snapshot of its topic, and coalesced on TOPIC_COALESCE
+// topics unless c is in ack mode. The caller must hold c's shard lock.
+func (h *hub) queueEntry(c *client, e streamEntry) {
+	messageType := h.typeFor(e.topic)
+	if e.topic == "" {
+		f := c.ackable(messageType, "", e.id, e.data)
+		f.id = e.id
+		h.push(c, f)
+		return
+	}
+	if coalesce, _ := topicSetting(h.topicConfig().coalesce, e.topic); coalesce && c.acks == nil {
+		if f := (frame{messageType: messageType, data: e.data, id: e.id, payload: true}); !h.holdBack(c, e.topic, f) {
+			h.pushLatest(c, e.topic, f)
+		}
+		return
+	}
+	f := c.ackable(messageType, e.topic, e.id, e.data)
+	f.id = e.id
+	if !h.holdBack(c, e.topic, f) {
+		h.push(c, f)
+	}
+}
+
+// replayAndPump sends the welcome frame and the requested backlog directly on
+// the socket, then flushes live entries buffered meanwhile and hands over to
+// writePump. The client is registered before the backlog is read, so every
+// entry is either in the backlog or buffered, and duplicates are dropped by
+// ID.
+func (h *hub) replayAndPump(c *client, rq replayRequest) {
+	write := func(f frame) error {
+		c.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+		if err := h.writeMessage(c, f); err != nil {
+			return err
+		}
+		c.bytesSent.Add(int64(len(f.data)))
+		c.touch()
+		return nil
+	}
+	fail := func(err error) {
+		c.logger.Warn("ws replay failed", "err", err)
+		h.removeWithReason(c, disconnectWriteError)
+	}
+
+	if err := write(frame{messageType: websocket.TextMessage, data: encodeWelcome(c.id, c.protocol)}); err != nil {
+		fail(err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+	var entries []streamEntry
+	var missed gapMessage
+	var err error
+	if rq.cursor {
+		entries, missed, err = h.stream.catchUp(ctx, rq.since, h.cursors.maxCatchUp)
+	} else {
+		entries, err = h.stream.replay(ctx, rq)
+	}
+	cancel()
+	if err != nil {
+		fail(err)
+		return
+	}
+	if rq.cursor {
+		result := "resumed"
+		if missed.Reason != "" {
+			result = missed.Reason
+			c.logger.Info("ws cursor resume incomplete", "reason", missed.Reason, "cursor", rq.since, "resumed_at", missed.To)
+			if err := write(frame{messageType: websocket.TextMessage, data: encodeGap(missed)}); err != nil {
+				fail(err)
+				return
+			}
+		}
+		cursorResumes.WithLabelValues(result).Inc()
+	}
+
+	// Expired entries are replaced by one gap notice per run of them on the
+	// same topic.
+	var gap gapMessage
+	flushGap := func() error {
+		if gap.Count == 0 {
+			return nil
+		}
+		err := write(frame{messageType: websocket.TextMessage, data: encodeGap(gap)})
+		gap = gapMessage{}
+		return err
+	}
+	now := time.Now()
+	lastID := rq.since
+	for _, e := range entries {
+		if e.to == "" && e.toUser == "" && c.wants(e) {
+			if e.expired(now) {
+				messagesExpired.Inc()
+				if gap.Count > 0 && gap.Topic != c.unscope(e.topic) {
+					if err := flushGap(); err != nil {
+						fail(err)
+						return
+					}
+				}
+				if gap.Count == 0 {
+					gap = gapMessage{Type: "gap", Reason: "expired", Topic: c.unscope(e.topic), From: e.id}
+				}
+				gap.To = e.id
+				gap.Count++
+				lastID = e.id
+				continue
+			}
+			if err := flushGap(); err != nil {
+				fail(err)
+				return
+			}
+			var ok bool
+			if !h.validBroadcast(e.topic, e.data) {
+				lastID = e.id
+				continue
+			}
+			if e.data, ok = h.transform(e.topic, e.data); !ok {
+				lastID = e.id
+				continue
+			}
+			if err := write(c.ackable(h.typeFor(e.topic), e.topic, e.id, e.data)); err != nil {
+				fail(err)
+				return
+			}
+		}
+		lastID = e.id
+	}
+	if err := flushGap(); err != nil {
+		fail(err)
+		return
+	}
+
+	// Live entries held back meanwhile go through the same queue as those
+	// that follow, unless there were too many to hold.
+	sh := h.shardFor(c.id)
+	sh.mu.RLock()
+	c.streamMu.Lock()
+	dropped := c.dropped
+	if dropped.Count == 0 {
+		if _, ok := sh.clients[c]; ok {
+			for _, e := range c.pending {
+				if lastID != "" && !streamIDAfter(e.id, lastID) {
+					continue
+				}
+				h.queueEntry(c, e)
+				lastID = e.id
+			}
+		}
+	}
+	c.pending = nil
+	c.lastID = lastID
+	c.replaying = false
+	c.streamMu.Unlock()
+	sh.mu.RUnlock()
+	// Everything up to lastID was written, queued or deliberately skipped.
+	if c.cursorKey != "" && lastID != "" {
+		c.delivered.Store(&lastID)
+	}
+	if dropped.Count > 0 {
+		c.logger.Warn("ws live entries overflowed during replay", "dropped", dropped.Count, "from", dropped.From, "to", dropped.To)
+		if err := write(frame{messageType: websocket.TextMessage, data: encodeGap(dropped)}); err != nil {
+			fail(err)
+			return
+		}
+		c.sendClose(websocket.ClosePolicyViolation, "too many messages during replay", disconnectSlowConsumer, h.writeTimeout)
+		h.removeWithReason(c, disconnectSlowConsumer)
+		return
+	}
+
+	c.logger.Debug("ws replay complete", "entries", len(entries), "last_id", lastID)
+	h.writePump(c)
+}
+
+// parseStreamID splits a Redis stream ID ("ms-seq" or "ms") into its parts.
+func parseStreamID(id string) (ms, seq uint64, ok bool) {
+	msPart, seqPart, hasSeq := strings.Cut(id, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if hasSeq {
+		if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return ms, seq, true
+}
+
+// streamIDAfter reports whether stream ID a sorts after b.
+func streamIDAfter(a, b string) bool {
+	ams, aseq, _ := parseStreamID(a)
+	bms, bseq, _ := parseStreamID(b)
+	return ams > bms || (ams == bms && aseq > bseq)
+}
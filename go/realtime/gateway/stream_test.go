@@ -0,0 +1,148 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestPushEntryCapsPending(t *testing.T) {
+	tg := startGateway(t, map[string]string{"SEND_BUFFER": "4"})
+	c := newClient(context.Background(), "c1", "test", nil, tg.hub.sendBuffer)
+	c.replaying = true
+	for i := 1; i <= 4; i++ {
+		tg.hub.pushEntry(c, streamEntry{id: fmt.Sprintf("%d-0", i), data: []byte("x")})
+	}
+	if len(c.pending) != 4 || c.dropped.Count != 0 {
+		t.Fatalf("pending = %d, dropped = %+v; want 4 held", len(c.pending), c.dropped)
+	}
+	for i := 5; i <= 7; i++ {
+		tg.hub.pushEntry(c, streamEntry{id: fmt.Sprintf("%d-0", i), data: []byte("x")})
+	}
+	want := gapMessage{Type: "gap", Reason: "overflow", From: "1-0", To: "7-0", Count: 7}
+	if c.pending != nil || c.dropped != want {
+		t.Fatalf("pending = %d, dropped = %+v; want %+v", len(c.pending), c.dropped, want)
+	}
+}
+
+func TestPushEntryCoalesces(t *testing.T) {
+	tg := startGateway(t, map[string]string{"TOPIC_COALESCE": "prices:latest"})
+	c := newClient(context.Background(), "c1", "test", nil, tg.hub.sendBuffer)
+	tg.hub.pushEntry(c, streamEntry{id: "1-0", topic: "prices", data: []byte("1")})
+	tg.hub.pushEntry(c, streamEntry{id: "2-0", topic: "prices", data: []byte("2")})
+	tg.hub.pushEntry(c, streamEntry{id: "3-0", topic: "news", data: []byte("n")})
+	if len(c.send) != 2 {
+		t.Fatalf("queued %d frames, want the coalesced slot and news", len(c.send))
+	}
+	slot := <-c.send
+	if slot.messageType != coalescedMessage {
+		t.Fatalf("first frame = %+v, want the coalesced slot", slot)
+	}
+	if f := c.take(slot); string(f.data) != "2" || f.id != "2-0" {
+		t.Fatalf("latest = %q (%s), want 2 (2-0)", f.data, f.id)
+	}
+}
+
+func TestStreamReplayThenLive(t *testing.T) {
+	mr, url := startRedis(t)
+	defer mr.Close()
+	for i := 1; i <= 3; i++ {
+		mr.XAdd("realtime:stream", fmt.Sprintf("%d-0", i), []string{"data", fmt.Sprintf("m%d", i)})
+	}
+	tg := startGateway(t, map[string]string{"BACKEND": "stream", "REDIS_URL": url})
+	waitFor(t, "stream reader", tg.hub.subscribed.Load)
+	conn, _ := tg.connect("/ws?since=1-0", nil)
+	for _, want := range []string{"m2", "m3"} {
+		if _, data := readFrame(t, conn); string(data) != want {
+			t.Fatalf("replayed %q, want %q", data, want)
+		}
+	}
+	mr.XAdd("realtime:stream", "*", []string{"data", "live"})
+	if mt, data := readFrame(t, conn); mt != websocket.TextMessage || string(data) != "live" {
+		t.Fatalf("live frame = %d %q", mt, data)
+	}
+}
+
+func TestStreamEntryExpired(t *testing.T) {
+	now := time.UnixMilli(1_700_000_060_000)
+	tests := []struct {
+		id, data string
+		want     bool
+	}{
+		{id: "1700000000000-0", data: `{"ttl_ms":59999,"data":1}`, want: true},
+		{id: "1700000000000-0", data: `{"ttl_ms":60000,"data":1}`},
+		{id: "1700000000000-0", data: `{"data":1}`},
+		{id: "1700000000000-0", data: `1`},
+		{id: "1700000050000-0", data: `{"ttl_ms":20000,"data":1}`},
+	}
+	for _, tt := range tests {
+		e := decodeEntry(redis.XMessage{ID: tt.id, Values: map[string]any{"data": tt.data}})
+		if got := e.expired(now); got != tt.want {
+			t.Errorf("entry %s %s expired = %v, want %v", tt.id, tt.data, got, tt.want)
+		}
+	}
+}
+
+// addAged adds an entry to the stream whose ID dates it age ago.
+func addAged(mr *miniredis.Miniredis, age time.Duration, seq int, values ...string) string {
+	id := fmt.Sprintf("%d-%d", time.Now().Add(-age).UnixMilli(), seq)
+	mr.XAdd("realtime:stream", id, values)
+	return id
+}
+
+func TestReplaySkipsExpiredEntries(t *testing.T) {
+	mr, url := startRedis(t)
+	defer mr.Close()
+	const ttl = `"ttl_ms":60000`
+	first := addAged(mr, 10*time.Minute, 1, "topic", "room1", "data", `{`+ttl+`,"data":"old 1"}`)
+	second := addAged(mr, 10*time.Minute, 2, "topic", "room1", "data", `{`+ttl+`,"data":"old 2"}`)
+	third := addAged(mr, 10*time.Minute, 3, "topic", "room2", "data", `{`+ttl+`,"data":"old 3"}`)
+	addAged(mr, 10*time.Minute, 4, "topic", "room1", "data", `"old, no ttl"`)
+	addAged(mr, 0, 1, "topic", "room1", "data", `{`+ttl+`,"data":"fresh"}`)
+	tg := startGateway(t, map[string]string{"BACKEND": "stream", "REDIS_URL": url})
+	waitFor(t, "stream reader", tg.hub.subscribed.Load)
+	before := testutil.ToFloat64(messagesExpired)
+
+	conn, _ := tg.connect("/ws?since=0-1&topics=room1,room2", nil)
+	for _, want := range []map[string]any{
+		{"type": "gap", "reason": "expired", "topic": "room1", "from": first, "to": second, "count": 2.0},
+		{"type": "gap", "reason": "expired", "topic": "room2", "from": third, "to": third, "count": 1.0},
+	} {
+		if msg := readJSON(t, conn); fmt.Sprint(msg) != fmt.Sprint(want) {
+			t.Fatalf("got %v, want %v", msg, want)
+		}
+	}
+	for _, want := range []string{`"old, no ttl"`, `"fresh"`} {
+		if _, data := readFrame(t, conn); string(data) != want {
+			t.Fatalf("replayed %s, want %s", data, want)
+		}
+	}
+	if got := testutil.ToFloat64(messagesExpired) - before; got != 3 {
+		t.Fatalf("realtime_messages_expired_total rose by %v, want 3", got)
+	}
+}
+
+func TestAckRedeliverySkipsExpiredEntries(t *testing.T) {
+	mr, url := startRedis(t)
+	defer mr.Close()
+	stale := addAged(mr, time.Minute, 1, "data", `{"ttl_ms":1000,"data":"stale"}`)
+	kept := addAged(mr, time.Minute, 2, "data", `{"data":"kept"}`)
+	// dev1 disconnected without acknowledging either entry.
+	mr.Set("realtime:acks:dev1", stale)
+	tg := startGateway(t, map[string]string{"BACKEND": "stream", "REDIS_URL": url})
+	waitFor(t, "stream reader", tg.hub.subscribed.Load)
+
+	conn, _ := tg.connect("/ws?ack=1&client_id=dev1", nil)
+	if msg := readJSON(t, conn); msg["type"] != "gap" || msg["reason"] != "expired" || msg["from"] != stale {
+		t.Fatalf("got %v, want an expired gap for %s", msg, stale)
+	}
+	if msg := readJSON(t, conn); msg["id"] != kept {
+		t.Fatalf("redelivered %v, want entry %s", msg, kept)
+	}
+}
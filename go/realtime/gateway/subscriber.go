@@ -0,0 +1,192 @@
+package gateway
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// subscriber keeps a Redis Pub/Sub subscription alive, re-subscribing with
+// exponential backoff whenever it drops, until its context is cancelled.
+type subscriber struct {
+	rdb        *redis.Client
+	channels   []string
+	pattern    string
+	maxBackoff time.Duration
+	handle     func(*redis.Message)
+	// up is set while the subscription is established.
+	up *atomic.Bool
+	// changed, if set, is called whenever up flips.
+	changed func(up bool)
+
+	// With healthInterval set, the client is pinged that often, and after
+	// rebuildAfter failed pings in a row replaced by rebuilt, a new client
+	// with the same options, when that one answers.
+	healthInterval time.Duration
+	pingTimeout    time.Duration
+	rebuildAfter   int
+	rebuilt        atomic.Pointer[redis.Client]
+
+	mu     sync.Mutex
+	pubsub *redis.PubSub // the current subscription, if any
+}
+
+// client returns the client to subscribe with: rdb until it is rebuilt.
+func (s *subscriber) client() *redis.Client {
+	if c := s.rebuilt.Load(); c != nil {
+		return c
+	}
+	return s.rdb
+}
+
+// setUp records whether the subscription is established.
+func (s *subscriber) setUp(up bool) {
+	s.up.Store(up)
+	if s.changed != nil {
+		s.changed(up)
+	}
+}
+
+func (s *subscriber) run(ctx context.Context) {
+	if s.healthInterval > 0 {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.watch(ctx)
+		}()
+		defer func() { <-done }()
+	}
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ctx.Err() == nil; attempt++ {
+		if attempt > 0 {
+			slog.Warn("redis subscription lost; reconnecting", "redis", s.rdb.Options().Addr, "backoff", backoff, "attempt", attempt)
+			redisReconnects.Inc()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, s.maxBackoff)
+		}
+
+		if s.consume(ctx, attempt > 0) {
+			backoff = 500 * time.Millisecond
+			attempt = 0
+		}
+	}
+}
+
+// consume subscribes once and relays messages until the subscription fails.
+// It reports whether the subscription was established, so run can reset its
+// backoff after a healthy session.
+func (s *subscriber) consume(ctx context.Context, reconnecting bool) bool {
+	sub := s.client().Subscribe(ctx, s.channels...)
+	defer sub.Close()
+	s.mu.Lock()
+	s.pubsub = sub
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.pubsub = nil
+		s.mu.Unlock()
+	}()
+	// A blocked receive does not watch ctx, so closing the subscription is
+	// what ends it on shutdown.
+	stop := context.AfterFunc(ctx, func() { sub.Close() })
+	defer stop()
+	if err := sub.PSubscribe(ctx, s.pattern); err != nil {
+		slog.Error("redis psubscribe error", "err", err)
+		return false
+	}
+	// Wait for the subscription confirmations before declaring success.
+	for i := 0; i < len(s.channels)+1; i++ {
+		if _, err := sub.Receive(ctx); err != nil {
+			if ctx.Err() == nil {
+				slog.Error("redis subscribe error", "err", err)
+			}
+			return false
+		}
+	}
+	if reconnecting {
+		slog.Info("redis subscription restored; delivery resumed", "redis", s.rdb.Options().Addr)
+	}
+	s.setUp(true)
+	defer s.setUp(false)
+
+	for {
+		msg, err := sub.ReceiveMessage(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("redis receive error", "err", err)
+			}
+			return true
+		}
+		s.handle(msg)
+	}
+}
+
+// watch pings the client every healthInterval until ctx is done. A client
+// that keeps failing while a fresh one with its options answers is stuck, so
+// the subscription moves to the fresh one: watch swaps it in and closes the
+// current subscription, and run re-subscribes on the new client after its
+// usual backoff, so only run ever subscribes. rdb itself is shared with the
+// rest of the gateway and is never closed here; a replaced rebuild is.
+func (s *subscriber) watch(ctx context.Context) {
+	t := time.NewTicker(s.healthInterval)
+	defer t.Stop()
+	defer func() {
+		if c := s.rebuilt.Load(); c != nil {
+			c.Close()
+		}
+	}()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		err := s.ping(ctx, s.client())
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if failures++; failures < s.rebuildAfter {
+			continue
+		}
+		addr := s.rdb.Options().Addr
+		opt := *s.rdb.Options()
+		fresh := redis.NewClient(&opt)
+		if err := s.ping(ctx, fresh); err != nil {
+			// Redis itself is unreachable; a new client won't help.
+			fresh.Close()
+			slog.Warn("redis client unhealthy; rebuilt client failed too", "redis", addr, "failures", failures, "err", err)
+			continue
+		}
+		slog.Warn("redis client unhealthy; replaced it with a new client", "redis", addr, "failures", failures, "err", err)
+		redisClientRebuilds.Inc()
+		old := s.rebuilt.Swap(fresh)
+		s.mu.Lock()
+		if s.pubsub != nil {
+			s.pubsub.Close()
+		}
+		s.mu.Unlock()
+		if old != nil {
+			old.Close()
+		}
+		failures = 0
+	}
+}
+
+func (s *subscriber) ping(ctx context.Context, rdb *redis.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, s.pingTimeout)
+	defer cancel()
+	return rdb.Ping(ctx).Err()
+}
@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+// startSubscriber runs a subscriber to the news channel on rdb with a fast
+// health check and returns it with the channel its messages arrive on.
+func startSubscriber(t *testing.T, rdb *redis.Client) (*subscriber, <-chan string) {
+	t.Helper()
+	msgs := make(chan string, 16)
+	s := &subscriber{
+		rdb:            rdb,
+		channels:       []string{"news"},
+		pattern:        "topic:*",
+		maxBackoff:     100 * time.Millisecond,
+		handle:         func(m *redis.Message) { msgs <- m.Payload },
+		up:             new(atomic.Bool),
+		healthInterval: 20 * time.Millisecond,
+		pingTimeout:    100 * time.Millisecond,
+		rebuildAfter:   3,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "subscription", s.up.Load)
+	return s, msgs
+}
+
+func TestSubscriberRebuildsBrokenClient(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	s, msgs := startSubscriber(t, rdb)
+	before := testutil.ToFloat64(redisClientRebuilds)
+
+	// A closed client fails every command while Redis itself is fine, the
+	// state a fresh client gets out of.
+	rdb.Close()
+	waitFor(t, "the client to be rebuilt", func() bool { return s.rebuilt.Load() != nil })
+	if got := testutil.ToFloat64(redisClientRebuilds) - before; got != 1 {
+		t.Fatalf("client rebuilds rose by %v, want 1", got)
+	}
+	if s.client() == rdb {
+		t.Fatal("client() still returns the broken client")
+	}
+	// run re-subscribes on the new client.
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if n := mr.PubSubNumSub("news")["news"]; n == 1 && s.up.Load() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscription not restored on the rebuilt client")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mr.Publish("news", "hello")
+	select {
+	case got := <-msgs:
+		if got != "hello" {
+			t.Fatalf("handled %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message through the rebuilt client")
+	}
+}
+
+func TestSubscriberKeepsClientWhileRedisIsDown(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	s, _ := startSubscriber(t, rdb)
+	before := testutil.ToFloat64(redisClientRebuilds)
+
+	// With Redis unreachable, a fresh client fails too, so there is
+	// nothing to gain from replacing the current one.
+	mr.Close()
+	time.Sleep(10 * s.healthInterval)
+	if s.rebuilt.Load() != nil {
+		t.Fatal("client rebuilt while Redis was down")
+	}
+	if got := testutil.ToFloat64(redisClientRebuilds) - before; got != 0 {
+		t.Fatalf("client rebuilds rose by %v while Redis was down", got)
+	}
+}
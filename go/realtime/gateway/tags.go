@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// maxTagLength caps each tag value, in runes, so a client cannot bloat the
+// admin listing or lifecycle events with oversized headers.
+const maxTagLength = 128
+
+// tagSpec lists the query params and headers captured as connection tags on
+// upgrade.
+type tagSpec struct {
+	params  []string
+	headers []string
+}
+
+// capture returns the allowlisted values present on r, keyed by param name
+// or lowercased header name. It returns nil when none are present.
+func (s *tagSpec) capture(r *http.Request) map[string]string {
+	var tags map[string]string
+	set := func(key, value string) {
+		if value = sanitizeTag(value); value == "" {
+			return
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[key] = value
+	}
+	q := r.URL.Query()
+	for _, p := range s.params {
+		set(p, q.Get(p))
+	}
+	for _, h := range s.headers {
+		set(strings.ToLower(h), r.Header.Get(h))
+	}
+	return tags
+}
+
+// sanitizeTag drops control and non-printable characters, trims spaces and
+// truncates the result to maxTagLength runes.
+func sanitizeTag(v string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range v {
+		if !unicode.IsPrint(r) {
+			continue
+		}
+		if n == maxTagLength {
+			break
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// isCredentialHeader reports whether capturing header h as a tag would copy a
+// secret into the admin listing and lifecycle events.
+func isCredentialHeader(h string) bool {
+	switch http.CanonicalHeaderKey(h) {
+	case "Authorization", "Cookie", adminTokenHeader, publishTokenHeader:
+		return true
+	}
+	return false
+}
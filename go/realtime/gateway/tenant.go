@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// validTenant keeps tenant IDs free of the ':' that separates them from the
+// topic in scoped names.
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// tenantResolver derives a connection's tenant from the upgrade request.
+// Sources are tried in order: "header" reads the tenant header, "subdomain"
+// takes the label in front of domain in the Origin host, or the Host header
+// when there is no Origin (e.g. acme.example.com is tenant acme).
+type tenantResolver struct {
+	sources  []string
+	header   string
+	domain   string
+	required bool
+}
+
+var errTenantRequired = errors.New("tenant is required")
+
+// resolve returns the request's tenant, or "" when none was found and one is
+// not required.
+func (t *tenantResolver) resolve(r *http.Request) (string, error) {
+	for _, src := range t.sources {
+		var tenant string
+		switch src {
+		case "header":
+			tenant = strings.TrimSpace(r.Header.Get(t.header))
+		case "subdomain":
+			tenant = t.subdomain(r)
+		}
+		if tenant == "" {
+			continue
+		}
+		if !validTenant.MatchString(tenant) {
+			return "", errors.New("tenant must be 1-64 characters of letters, digits, '_' or '-'")
+		}
+		return tenant, nil
+	}
+	if t.required {
+		return "", errTenantRequired
+	}
+	return "", nil
+}
+
+// subdomain returns the single label in front of t.domain, or "".
+func (t *tenantResolver) subdomain(r *http.Request) string {
+	host := r.Host
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return ""
+		}
+		host = u.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	label, ok := strings.CutSuffix(strings.ToLower(host), "."+t.domain)
+	if !ok || strings.Contains(label, ".") {
+		return ""
+	}
+	return label
+}
+
+// tenantPrefix starts every topic name scoped to tenant.
+func tenantPrefix(tenant string) string {
+	return "tenant:" + tenant + ":"
+}
+
+// scope maps a topic the client names to its tenant's namespace; clients
+// without a tenant use topics as given.
+func (c *client) scope(topic string) string {
+	if c.tenant == "" {
+		return topic
+	}
+	return tenantPrefix(c.tenant) + topic
+}
+
+// unscope turns a scoped topic back into the name the client knows it by.
+func (c *client) unscope(topic string) string {
+	if c.tenant == "" {
+		return topic
+	}
+	return strings.TrimPrefix(topic, tenantPrefix(c.tenant))
+}
+
+// unscopedTopic strips any tenant's prefix from topic, as unscope does for
+// one client's own tenant.
+func unscopedTopic(topic string) string {
+	rest, ok := strings.CutPrefix(topic, "tenant:")
+	if !ok {
+		return topic
+	}
+	if _, name, ok := strings.Cut(rest, ":"); ok && name != "" {
+		return name
+	}
+	return topic
+}
@@ -0,0 +1,20 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// tlsConfig returns the server TLS settings for the given minimum version
+// ("1.2" or "1.3").
+func tlsConfig(minVersion string) (*tls.Config, error) {
+	versions := map[string]uint16{
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+	v, ok := versions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS_MIN_VERSION %q", minVersion)
+	}
+	return &tls.Config{MinVersion: v}, nil
+}
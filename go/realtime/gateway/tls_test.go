@@ -0,0 +1,134 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTLSConfig(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{in: "1.2", want: tls.VersionTLS12},
+		{in: "1.3", want: tls.VersionTLS13},
+		{in: "1.1", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		tc, err := tlsConfig(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("tlsConfig(%q) succeeded", tt.in)
+			}
+			continue
+		}
+		if err != nil || tc.MinVersion != tt.want {
+			t.Errorf("tlsConfig(%q) = %v, %v", tt.in, tc, err)
+		}
+	}
+}
+
+func TestWSSHandshake(t *testing.T) {
+	tg := startGateway(t, nil)
+	srv := httptest.NewTLSServer(tg.Handler())
+	defer srv.Close()
+	dialer := websocket.Dialer{TLSClientConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig}
+	conn, _, err := dialer.Dial("wss"+strings.TrimPrefix(srv.URL, "https")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if msg := readJSON(t, conn); msg["type"] != "welcome" {
+		t.Fatalf("first frame = %v", msg)
+	}
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and returns the
+// paths of the certificate and key and a pool that trusts it.
+func writeCert(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "realtime test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, pool := writeCert(t)
+	addr := freeAddr(t)
+	t.Setenv("BACKEND", "memory")
+	t.Setenv("BIND_ADDR", addr)
+	t.Setenv("TLS_CERT", certFile)
+	t.Setenv("TLS_KEY", keyFile)
+	t.Setenv("TLS_MIN_VERSION", "1.3")
+	// startGateway polls plain /healthz, which a TLS listener never answers,
+	// so run the gateway by hand.
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := New(cfg)
+	stop := runGateway(t, g)
+	defer stop()
+
+	var conn *websocket.Conn
+	waitFor(t, "wss handshake", func() bool {
+		dialer := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: pool}}
+		conn, _, err = dialer.Dial("wss://"+addr+"/ws", nil)
+		return err == nil
+	})
+	defer conn.Close()
+	if msg := readJSON(t, conn); msg["type"] != "welcome" {
+		t.Fatalf("first frame = %v", msg)
+	}
+
+	// TLS_MIN_VERSION=1.3 turns away TLS 1.2 clients.
+	old := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: pool, MaxVersion: tls.VersionTLS12}}
+	if c, _, err := old.Dial("wss://"+addr+"/ws", nil); err == nil {
+		c.Close()
+		t.Fatal("TLS 1.2 handshake succeeded with TLS_MIN_VERSION=1.3")
+	}
+}
@@ -0,0 +1,191 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// topicRule grants the topics matching pattern, a glob in which "{claim}"
+// stands for the client's value of that claim, e.g. "user.{sub}.*". With
+// claim set the client's claim must also hold one of values.
+type topicRule struct {
+	pattern string
+	claim   string
+	values  []string
+}
+
+// topicAuthorizer decides which topics a client may subscribe to. A topic is
+// granted when one of rules grants it or, failing that, when the callback
+// at url answers 200; everything else is denied.
+type topicAuthorizer struct {
+	rules  []topicRule
+	url    string // empty disables the callback
+	client *http.Client
+}
+
+func newTopicAuthorizer(rules []topicRule, url string, timeout time.Duration) *topicAuthorizer {
+	return &topicAuthorizer{rules: rules, url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// topicAuthRequest is the body POSTed to TOPIC_AUTH_URL.
+type topicAuthRequest struct {
+	Topic  string        `json:"topic"`
+	Tenant string        `json:"tenant,omitempty"`
+	Claims jwt.MapClaims `json:"claims"`
+}
+
+// allowed reports whether a client with claims in tenant may subscribe to
+// topic, as the client names it. A failing callback denies the topic.
+func (a *topicAuthorizer) allowed(ctx context.Context, claims jwt.MapClaims, tenant, topic string) bool {
+	for _, r := range a.rules {
+		if r.grants(claims, topic) {
+			topicAuthorizations.WithLabelValues("granted").Inc()
+			return true
+		}
+	}
+	if a.url == "" {
+		topicAuthorizations.WithLabelValues("denied").Inc()
+		return false
+	}
+	ok, err := a.ask(ctx, claims, tenant, topic)
+	switch {
+	case err != nil:
+		topicAuthorizations.WithLabelValues("error").Inc()
+		slog.Warn("topic authorization failed", "topic", topic, "err", err)
+	case ok:
+		topicAuthorizations.WithLabelValues("granted").Inc()
+	default:
+		topicAuthorizations.WithLabelValues("denied").Inc()
+	}
+	return ok
+}
+
+func (a *topicAuthorizer) ask(ctx context.Context, claims jwt.MapClaims, tenant, topic string) (bool, error) {
+	body, _ := json.Marshal(topicAuthRequest{Topic: topic, Tenant: tenant, Claims: claims})
+	ctx, cancel := context.WithTimeout(ctx, a.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxAuthResponse))
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true, nil
+	case resp.StatusCode >= 500:
+		return false, fmt.Errorf("topic auth service answered %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// grants reports whether r lets a client with claims subscribe to topic.
+func (r topicRule) grants(claims jwt.MapClaims, topic string) bool {
+	pattern, ok := expandClaims(r.pattern, claims)
+	if !ok || !globMatch(pattern, topic) {
+		return false
+	}
+	if r.claim == "" {
+		return true
+	}
+	for _, v := range r.values {
+		if claimMatches(claims[r.claim], v) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandClaims replaces each "{claim}" in pattern with the client's string
+// or integer value of that claim. It reports false when a claim is missing,
+// or holds a "*" that would widen the pattern.
+func expandClaims(pattern string, claims jwt.MapClaims) (string, bool) {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(pattern, '{')
+		if start < 0 {
+			b.WriteString(pattern)
+			return b.String(), true
+		}
+		end := strings.IndexByte(pattern[start:], '}')
+		if end < 0 {
+			b.WriteString(pattern)
+			return b.String(), true
+		}
+		var v string
+		switch c := claims[pattern[start+1:start+end]].(type) {
+		case string:
+			v = c
+		case float64:
+			v = strconv.FormatFloat(c, 'f', -1, 64)
+		}
+		if v == "" || strings.Contains(v, "*") {
+			return "", false
+		}
+		b.WriteString(pattern[:start])
+		b.WriteString(v)
+		pattern = pattern[start+end+1:]
+	}
+}
+
+// parseTopicAuthRules reads rules such as
+// "public.*,user.{sub}.*,orders.*@role=admin|ops".
+func parseTopicAuthRules(raw string) ([]topicRule, error) {
+	var rules []topicRule
+	for _, entry := range strings.Split(raw, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		pattern, cond, hasCond := strings.Cut(entry, "@")
+		r := topicRule{pattern: strings.TrimSpace(pattern)}
+		if r.pattern == "" {
+			return nil, fmt.Errorf("invalid TOPIC_AUTH_RULES entry %q; expected topic or topic@claim=value", entry)
+		}
+		if hasCond {
+			claim, values, ok := strings.Cut(cond, "=")
+			r.claim = strings.TrimSpace(claim)
+			if !ok || r.claim == "" || strings.TrimSpace(values) == "" {
+				return nil, fmt.Errorf("invalid TOPIC_AUTH_RULES condition %q; expected claim=value or claim=value|value", cond)
+			}
+			for _, v := range strings.Split(values, "|") {
+				r.values = append(r.values, strings.TrimSpace(v))
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// authorizeTopics splits the topics a client asked for at upgrade into the
+// ones it may join and the ones it may not, both sorted.
+func (h *hub) authorizeTopics(ctx context.Context, claims jwt.MapClaims, tenant string, topics map[string]struct{}) (granted, denied []string) {
+	for t := range topics {
+		if t == firehoseTopic {
+			continue
+		}
+		if h.topicAuth.allowed(ctx, claims, tenant, t) {
+			granted = append(granted, t)
+		} else {
+			denied = append(denied, t)
+		}
+	}
+	sort.Strings(granted)
+	sort.Strings(denied)
+	return granted, denied
+}
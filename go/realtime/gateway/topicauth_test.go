@@ -0,0 +1,201 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestParseTopicAuthRules(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []topicRule
+		wantErr bool
+	}{
+		{raw: ""},
+		{raw: "public.*, user.{sub}.*", want: []topicRule{{pattern: "public.*"}, {pattern: "user.{sub}.*"}}},
+		{raw: "orders.*@role=admin|ops", want: []topicRule{{pattern: "orders.*", claim: "role", values: []string{"admin", "ops"}}}},
+		{raw: "@role=admin", wantErr: true},
+		{raw: "orders.*@role", wantErr: true},
+		{raw: "orders.*@=admin", wantErr: true},
+		{raw: "orders.*@role=", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTopicAuthRules(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTopicAuthRules(%q) = %v, want an error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tt.want) {
+			t.Errorf("parseTopicAuthRules(%q) = %v, %v; want %v", tt.raw, got, err, tt.want)
+			continue
+		}
+		for i, r := range tt.want {
+			if got[i].pattern != r.pattern || got[i].claim != r.claim || strings.Join(got[i].values, "|") != strings.Join(r.values, "|") {
+				t.Errorf("parseTopicAuthRules(%q)[%d] = %+v, want %+v", tt.raw, i, got[i], r)
+			}
+		}
+	}
+}
+
+func TestTopicRuleGrants(t *testing.T) {
+	rules, err := parseTopicAuthRules("public.*,user.{sub}.*,orders.*@role=admin|ops,team.{team}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTopicAuthorizer(rules, "", time.Second)
+	tests := []struct {
+		claims jwt.MapClaims
+		topic  string
+		want   bool
+	}{
+		{topic: "public.news", want: true},
+		{claims: jwt.MapClaims{"sub": "u1"}, topic: "user.u1.inbox", want: true},
+		{claims: jwt.MapClaims{"sub": "u1"}, topic: "user.u2.inbox"},
+		{topic: "user..inbox"},
+		// A claim holding a wildcard must not widen the pattern.
+		{claims: jwt.MapClaims{"sub": "*"}, topic: "user.u2.inbox"},
+		{claims: jwt.MapClaims{"role": "ops"}, topic: "orders.eu", want: true},
+		{claims: jwt.MapClaims{"role": "user"}, topic: "orders.eu"},
+		{claims: jwt.MapClaims{"team": float64(7)}, topic: "team.7", want: true},
+		{topic: "admin"},
+	}
+	for _, tt := range tests {
+		if got := a.allowed(context.Background(), tt.claims, "", tt.topic); got != tt.want {
+			t.Errorf("allowed(%v, %q) = %v, want %v", tt.claims, tt.topic, got, tt.want)
+		}
+	}
+}
+
+// authHeader returns a bearer token header for claims, valid for an hour.
+func authHeader(t *testing.T, claims jwt.MapClaims) http.Header {
+	t.Helper()
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	return http.Header{"Authorization": {"Bearer " + signToken(t, testSecret, claims)}}
+}
+
+func TestHandshakeTopicsPartlyGranted(t *testing.T) {
+	tg := startGateway(t, map[string]string{
+		"JWT_SECRET":       testSecret,
+		"TOPIC_AUTH_RULES": "public.*,user.{sub}.*,orders.*@role=admin",
+	})
+	conn, id := tg.connect("/ws?topics=public.news,user.u1.inbox,user.u2.inbox,orders.eu", authHeader(t, jwt.MapClaims{"sub": "u1", "role": "user"}))
+	ack := readJSON(t, conn)
+	if ack["type"] != "ack" || ack["action"] != "subscribe" {
+		t.Fatalf("frame after welcome = %v, want the topics ack", ack)
+	}
+	if got := strings.Join(toStrings(ack["granted"]), ","); got != "public.news,user.u1.inbox" {
+		t.Fatalf("granted = %s, want public.news,user.u1.inbox", got)
+	}
+	if got := strings.Join(toStrings(ack["denied"]), ","); got != "orders.eu,user.u2.inbox" {
+		t.Fatalf("denied = %s, want orders.eu,user.u2.inbox", got)
+	}
+	c, _ := tg.hub.get(id)
+	if got := strings.Join(c.topicList(), ","); got != "public.news,user.u1.inbox" {
+		t.Fatalf("joined %s, want only the granted topics", got)
+	}
+}
+
+func TestHandshakeTopicsAllDenied(t *testing.T) {
+	tg := startGateway(t, map[string]string{
+		"JWT_SECRET":       testSecret,
+		"TOPIC_AUTH_RULES": "public.*",
+	})
+	conn, id := tg.connect("/ws?topics=admin,billing", authHeader(t, jwt.MapClaims{"sub": "u1"}))
+	ack := readJSON(t, conn)
+	if _, ok := ack["granted"]; ok || strings.Join(toStrings(ack["denied"]), ",") != "admin,billing" {
+		t.Fatalf("topics ack = %v, want both denied and no granted list", ack)
+	}
+	c, _ := tg.hub.get(id)
+	if topics := c.topicList(); len(topics) != 0 {
+		t.Fatalf("joined %v, want nothing", topics)
+	}
+	// The connection itself stays up.
+	sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "public.news"})
+	if msg := readJSON(t, conn); msg["type"] != "ack" {
+		t.Fatalf("reply = %v, want an ack", msg)
+	}
+}
+
+func TestSubscribeAuthorized(t *testing.T) {
+	tg := startGateway(t, map[string]string{
+		"JWT_SECRET":       testSecret,
+		"TOPIC_AUTH_RULES": "public.*",
+		"MAX_PATTERNS":     "4",
+	})
+	conn, _ := tg.connect("/ws", authHeader(t, jwt.MapClaims{"sub": "u1"}))
+	for _, tt := range []struct {
+		msg      map[string]string
+		wantType string
+	}{
+		{msg: map[string]string{"action": "subscribe", "topic": "public.news"}, wantType: "ack"},
+		{msg: map[string]string{"action": "subscribe", "topic": "admin"}, wantType: "error"},
+		// A pattern may match topics no rule grants.
+		{msg: map[string]string{"action": "subscribe", "pattern": "public.*"}, wantType: "error"},
+	} {
+		sendJSON(t, conn, tt.msg)
+		reply := readJSON(t, conn)
+		if reply["type"] != tt.wantType || (tt.wantType == "error" && reply["code"] != "forbidden") {
+			t.Fatalf("%v: reply = %v, want %s", tt.msg, reply, tt.wantType)
+		}
+	}
+}
+
+func TestTopicAuthCallback(t *testing.T) {
+	asked := make(chan topicAuthRequest, 8)
+	svc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req topicAuthRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		asked <- req
+		switch {
+		case strings.HasPrefix(req.Topic, "svc."):
+		case req.Topic == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer svc.Close()
+	tg := startGateway(t, map[string]string{
+		"JWT_SECRET":       testSecret,
+		"TOPIC_AUTH_RULES": "public.*",
+		"TOPIC_AUTH_URL":   svc.URL,
+	})
+	conn, _ := tg.connect("/ws?topics=public.news,svc.orders,other,broken", authHeader(t, jwt.MapClaims{"sub": "u1"}))
+	ack := readJSON(t, conn)
+	if got := strings.Join(toStrings(ack["granted"]), ","); got != "public.news,svc.orders" {
+		t.Fatalf("granted = %s, want the rule's topic and the one the service allows", got)
+	}
+	if got := strings.Join(toStrings(ack["denied"]), ","); got != "broken,other" {
+		t.Fatalf("denied = %s, want the refused and the failed topic", got)
+	}
+	// Topics a rule grants never reach the service.
+	close(asked)
+	for req := range asked {
+		if req.Topic == "public.news" {
+			t.Fatal("the service was asked about a topic a rule grants")
+		}
+		if req.Claims["sub"] != "u1" {
+			t.Fatalf("service asked with claims %v, want the client's", req.Claims)
+		}
+	}
+}
+
+// toStrings converts a decoded JSON array of strings.
+func toStrings(v any) []string {
+	items, _ := v.([]any)
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		s, _ := item.(string)
+		out = append(out, s)
+	}
+	return out
+}
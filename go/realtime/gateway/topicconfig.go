@@ -0,0 +1,250 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// topicOptions are one topic's entry in CONFIG_FILE's topics section:
+//
+//	topics:
+//	  prices.eu:
+//	    message_type: binary
+//	    coalesce: latest
+//	    schema: /etc/realtime/price.json
+//	    log_sample_rate: 0.01
+//	  status:
+//	    retained: true
+//
+// Unset fields leave the topic to the gateway-wide settings.
+type topicOptions struct {
+	MessageType   string
+	Coalesce      bool
+	Schema        string
+	LogSampleRate *float64
+	Retained      bool
+}
+
+// String lists the options as key=value pairs for logging.
+func (o topicOptions) String() string {
+	var parts []string
+	if o.MessageType != "" {
+		parts = append(parts, "message_type="+o.MessageType)
+	}
+	if o.Coalesce {
+		parts = append(parts, "coalesce=latest")
+	}
+	if o.Schema != "" {
+		parts = append(parts, "schema="+o.Schema)
+	}
+	if o.LogSampleRate != nil {
+		parts = append(parts, "log_sample_rate="+strconv.FormatFloat(*o.LogSampleRate, 'f', -1, 64))
+	}
+	if o.Retained {
+		parts = append(parts, "retained=true")
+	}
+	if len(parts) == 0 {
+		return "defaults"
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseTopicSection reads the topics section as decoded from the config
+// file.
+func parseTopicSection(doc any) (map[string]topicOptions, error) {
+	if doc == nil {
+		return nil, nil
+	}
+	topics, ok := doc.(map[string]any)
+	if !ok {
+		return nil, errors.New("topics must map topic names to their settings")
+	}
+	section := make(map[string]topicOptions, len(topics))
+	for topic, v := range topics {
+		fields, ok := v.(map[string]any)
+		if !ok && v != nil {
+			return nil, fmt.Errorf("topics.%s: expected a map of settings", topic)
+		}
+		var o topicOptions
+		for key, raw := range fields {
+			value, err := configScalar(raw)
+			if err == nil {
+				err = o.set(strings.ToLower(strings.ReplaceAll(key, "-", "_")), value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("topics.%s.%s: %w", topic, key, err)
+			}
+		}
+		section[topic] = o
+	}
+	return section, nil
+}
+
+func (o *topicOptions) set(key, value string) error {
+	switch key {
+	case "message_type":
+		if _, err := parseMessageType(value); err != nil {
+			return err
+		}
+		o.MessageType = strings.ToLower(strings.TrimSpace(value))
+	case "coalesce":
+		switch value {
+		case "latest", "true":
+			o.Coalesce = true
+		case "", "false":
+			o.Coalesce = false
+		default:
+			return fmt.Errorf("invalid value %q; expected latest", value)
+		}
+	case "schema":
+		o.Schema = value
+	case "log_sample_rate":
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid value %q; expected a number between 0 and 1", value)
+		}
+		o.LogSampleRate = &rate
+	case "retained":
+		switch value {
+		case "true":
+			o.Retained = true
+		case "", "false":
+			o.Retained = false
+		default:
+			return fmt.Errorf("invalid value %q; expected true or false", value)
+		}
+	default:
+		return errors.New("unknown setting")
+	}
+	return nil
+}
+
+// topicSettings are the per-topic settings in effect: the TOPIC_* variables
+// combined with CONFIG_FILE's topics section. They are replaced as a whole
+// on reload and never modified, so a broadcast sees one consistent set.
+type topicSettings struct {
+	types    map[string]int
+	coalesce map[string]bool
+	schemas  map[string]*jsonschema.Schema
+	logRates []logSampleRule
+	// retained are the topics whose last message is kept for new
+	// subscribers, from TOPIC_RETAIN and retained entries.
+	retained map[string]bool
+	// section is the file's part, kept to log what a reload changed.
+	section map[string]topicOptions
+}
+
+// topicSetting returns topic's entry in m. Broadcasts carry the topic as
+// published, tenant prefix included, while settings are usually keyed by the
+// name clients use, so a scoped topic without an entry of its own falls back
+// to the entry for its unscoped name.
+func topicSetting[V any](m map[string]V, topic string) (V, bool) {
+	if v, ok := m[topic]; ok {
+		return v, true
+	}
+	if base := unscopedTopic(topic); base != topic {
+		v, ok := m[base]
+		return v, ok
+	}
+	var zero V
+	return zero, false
+}
+
+// newTopicSettings combines the topic variables in cfg with section. For a
+// topic set both ways the variable wins, as environment variables win over
+// the file everywhere else.
+func newTopicSettings(cfg Config, section map[string]topicOptions) (*topicSettings, error) {
+	s := &topicSettings{
+		types:    make(map[string]int),
+		coalesce: make(map[string]bool),
+		schemas:  make(map[string]*jsonschema.Schema),
+		logRates: append([]logSampleRule(nil), cfg.MessageLogRates...),
+		retained: make(map[string]bool),
+		section:  section,
+	}
+	topics := make([]string, 0, len(section))
+	for t := range section {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	for _, t := range topics {
+		o := section[t]
+		if o.MessageType != "" {
+			s.types[t], _ = parseMessageType(o.MessageType)
+		}
+		if o.Coalesce {
+			s.coalesce[t] = true
+		}
+		if o.Schema != "" {
+			sch, err := compileSchema(o.Schema)
+			if err != nil {
+				return nil, fmt.Errorf("topics.%s.schema: %w", t, err)
+			}
+			s.schemas[t] = sch
+		}
+		if o.LogSampleRate != nil {
+			if cfg.MessageLogPath == "" {
+				return nil, fmt.Errorf("topics.%s.log_sample_rate: requires MESSAGE_LOG_PATH", t)
+			}
+			// After the MESSAGE_LOG_TOPIC_RATES rules, so those match first.
+			s.logRates = append(s.logRates, logSampleRule{pattern: t, rate: *o.LogSampleRate})
+		}
+		if o.Retained {
+			switch {
+			case cfg.Backend == "stream":
+				return nil, fmt.Errorf("topics.%s.retained: does not apply to BACKEND=stream; late joiners replay with ?since=", t)
+			case cfg.SnapshotURL != "":
+				return nil, fmt.Errorf("topics.%s.retained: cannot be combined with SNAPSHOT_URL", t)
+			}
+			s.retained[t] = true
+		}
+	}
+	for _, t := range cfg.TopicRetain {
+		s.retained[t] = true
+	}
+	maps.Copy(s.types, cfg.TopicMessageTypes)
+	maps.Copy(s.coalesce, cfg.TopicCoalesce)
+	maps.Copy(s.schemas, cfg.TopicSchemas)
+	return s, nil
+}
+
+// logTopicChanges logs each topic whose section entry a reload added,
+// removed or changed.
+func logTopicChanges(prev, next map[string]topicOptions) {
+	topics := make(map[string]bool)
+	for t := range prev {
+		topics[t] = true
+	}
+	for t := range next {
+		topics[t] = true
+	}
+	names := make([]string, 0, len(topics))
+	for t := range topics {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	changed := 0
+	for _, t := range names {
+		before, had := prev[t]
+		after, has := next[t]
+		switch {
+		case !had:
+			slog.Info("topic settings added", "topic", t, "settings", after.String())
+		case !has:
+			slog.Info("topic settings removed", "topic", t, "settings", before.String())
+		case before.String() != after.String():
+			slog.Info("topic settings changed", "topic", t, "from", before.String(), "to", after.String())
+		default:
+			continue
+		}
+		changed++
+	}
+	slog.Info("topic settings reloaded", "topics", len(next), "changed", changed)
+}
@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTopicSetting(t *testing.T) {
+	m := map[string]int{"prices": 1, "tenant:acme:prices": 2, "tenant:x": 3}
+	tests := []struct {
+		topic  string
+		want   int
+		wantOK bool
+	}{
+		{topic: "prices", want: 1, wantOK: true},
+		{topic: "tenant:acme:prices", want: 2, wantOK: true},
+		{topic: "tenant:beta:prices", want: 1, wantOK: true},
+		{topic: "tenant:beta:news"},
+		{topic: "tenant:x", want: 3, wantOK: true},
+		{topic: "news"},
+	}
+	for _, tt := range tests {
+		if got, ok := topicSetting(m, tt.topic); got != tt.want || ok != tt.wantOK {
+			t.Errorf("topicSetting(%q) = %d, %v; want %d, %v", tt.topic, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// writeConfig replaces the config file at path with body.
+func writeConfig(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadTopics(t *testing.T) {
+	dir := orderSchemas(t)
+	path := filepath.Join(t.TempDir(), "realtime.yaml")
+	writeConfig(t, path, "topics:\n  telemetry:\n    message_type: binary\n")
+	tg := startGateway(t, map[string]string{"CONFIG_FILE": path})
+	conn, _ := tg.connect("/ws?topics=telemetry", nil)
+	// Typed per message, as the backends do.
+	tg.hub.broadcastTopic("telemetry", tg.hub.typeFor("telemetry"), []byte("a"))
+	if mt, _ := readFrame(t, conn); mt != websocket.BinaryMessage {
+		t.Fatalf("frame type = %d before the reload, want binary", mt)
+	}
+
+	writeConfig(t, path, "topics:\n  telemetry:\n    message_type: text\n  orders:\n    schema: "+filepath.Join(dir, "order.json")+"\n")
+	before := testutil.ToFloat64(configReloads.WithLabelValues("ok"))
+	if err := tg.ReloadTopics(); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(configReloads.WithLabelValues("ok")) - before; got != 1 {
+		t.Fatalf("ok reloads rose by %v, want 1", got)
+	}
+	if err := tg.hub.checkSchema("orders", []byte(`{"total":1}`)); err == nil {
+		t.Fatal("the reloaded orders schema isn't applied")
+	}
+	// The connection and its subscription carry on under the new settings.
+	tg.hub.broadcastTopic("telemetry", tg.hub.typeFor("telemetry"), []byte("b"))
+	if mt, data := readFrame(t, conn); mt != websocket.TextMessage || string(data) != "b" {
+		t.Fatalf("frame after the reload = %d %q, want text b", mt, data)
+	}
+}
+
+func TestReloadTopicsKeepsSettingsOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "realtime.yaml")
+	const valid = "topics:\n  telemetry:\n    message_type: binary\n"
+	writeConfig(t, path, valid)
+	tg := startGateway(t, map[string]string{"CONFIG_FILE": path})
+	prev := tg.hub.topicConfig()
+
+	tests := map[string]string{
+		"syntax":         "topics: [\n",
+		"bad value":      "topics:\n  telemetry:\n    message_type: utf16\n",
+		"unknown key":    "topics:\n  telemetry:\n    colour: blue\n",
+		"bad retained":   "topics:\n  status:\n    retained: yes please\n",
+		"missing schema": "topics:\n  orders:\n    schema: " + filepath.Join(t.TempDir(), "missing.json") + "\n",
+	}
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			writeConfig(t, path, body)
+			before := testutil.ToFloat64(configReloads.WithLabelValues("error"))
+			if err := tg.ReloadTopics(); err == nil {
+				t.Fatal("invalid config reloaded")
+			}
+			if got := testutil.ToFloat64(configReloads.WithLabelValues("error")) - before; got != 1 {
+				t.Fatalf("error reloads rose by %v, want 1", got)
+			}
+			if tg.hub.topicConfig() != prev || tg.hub.typeFor("telemetry") != websocket.BinaryMessage {
+				t.Fatal("settings changed by a rejected reload")
+			}
+		})
+	}
+}
+
+func TestReloadRetainedTopics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "realtime.yaml")
+	writeConfig(t, path, "topics:\n  status:\n    retained: true\n")
+	tg := startGateway(t, map[string]string{"CONFIG_FILE": path, "TOPIC_RETAIN": "weather"})
+	tg.hub.broadcastTopic("status", websocket.TextMessage, []byte("up"))
+	conn, _ := tg.connect("/ws?topics=status", nil)
+	expectData(t, conn, "up")
+
+	// status stops being retained and news starts; TOPIC_RETAIN still holds.
+	writeConfig(t, path, "topics:\n  news:\n    retained: true\n")
+	if err := tg.ReloadTopics(); err != nil {
+		t.Fatal(err)
+	}
+	tg.hub.broadcastTopic("news", websocket.TextMessage, []byte("extra"))
+	tg.hub.broadcastTopic("weather", websocket.TextMessage, []byte("sunny"))
+	conn, _ = tg.connect("/ws?topics=news,weather", nil)
+	got := map[string]bool{}
+	for range 2 {
+		_, data := readFrame(t, conn)
+		got[string(data)] = true
+	}
+	if !got["extra"] || !got["sunny"] {
+		t.Fatalf("retained after the reload = %v, want extra and sunny", got)
+	}
+	conn, _ = tg.connect("/ws?topics=status", nil)
+	expectSilence(t, conn, 50*time.Millisecond)
+}
+
+func TestRetainedTopicConfig(t *testing.T) {
+	section := map[string]topicOptions{"status": {Retained: true}}
+	for _, cfg := range []Config{{Backend: "stream"}, {Backend: "memory", SnapshotURL: "http://snapshots"}} {
+		if _, err := newTopicSettings(cfg, section); err == nil {
+			t.Errorf("retained topic accepted with %+v", cfg)
+		}
+	}
+	s, err := newTopicSettings(Config{Backend: "memory", TopicRetain: []string{"weather"}}, section)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.retained["status"] || !s.retained["weather"] || len(s.retained) != 2 {
+		t.Fatalf("retained = %v, want status and weather", s.retained)
+	}
+}
+
+func TestReloadTopicsWithoutConfigFile(t *testing.T) {
+	tg := startGateway(t, nil)
+	if err := tg.ReloadTopics(); err == nil {
+		t.Fatal("reload without CONFIG_FILE succeeded")
+	}
+}
+
+func TestReloadSwapsLogRates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "realtime.yaml")
+	writeConfig(t, path, "topics:\n  prices.*:\n    log_sample_rate: 0.5\n")
+	tg := startGateway(t, map[string]string{
+		"CONFIG_FILE":      path,
+		"MESSAGE_LOG_PATH": filepath.Join(t.TempDir(), "messages.jsonl"),
+	})
+	if got := tg.hub.msgLog.rateFor("prices.eu"); got != 0.5 {
+		t.Fatalf("rate = %v, want 0.5 from the file", got)
+	}
+	writeConfig(t, path, "topics:\n  prices.*:\n    log_sample_rate: 0.01\n")
+	if err := tg.ReloadTopics(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tg.hub.msgLog.rateFor("prices.eu"); got != 0.01 {
+		t.Fatalf("rate after the reload = %v, want 0.01", got)
+	}
+}
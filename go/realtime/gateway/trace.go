@@ -0,0 +1,40 @@
+package gateway
+
+// Tracer hooks the publish-to-deliver path into a distributed tracing
+// system. Run sets up an OpenTelemetry one from the OTEL_* variables unless
+// the embedding program supplies its own in Config.Tracer. StartDelivery is
+// called once per broadcast, before the transformer and fan-out; topic is
+// "" for broadcasts to everyone. traceparent is the W3C trace context the
+// publisher put in the envelope's traceparent field, or "" when it sent
+// none. It must be safe for concurrent use.
+type Tracer interface {
+	StartDelivery(traceparent, topic string) DeliverySpan
+}
+
+// DeliverySpan is one broadcast's span. StartWrite is called during fan-out
+// for each client the message is queued for and returns the func that ends
+// that client's child span. End is called once the message is queued for
+// recipients clients, or with 0 when it was dropped.
+type DeliverySpan interface {
+	StartWrite(clientID string) (end func())
+	End(recipients int)
+}
+
+type noopSpan struct{}
+
+func noopEnd() {}
+
+func (noopSpan) StartWrite(string) func() { return noopEnd }
+func (noopSpan) End(int)                  {}
+
+// startSpan begins the span for a broadcast with envelope rules f.
+func (h *hub) startSpan(f *deliveryFilter, topic string) DeliverySpan {
+	if h.tracer == nil {
+		return noopSpan{}
+	}
+	var traceparent string
+	if f != nil {
+		traceparent = f.traceparent
+	}
+	return h.tracer.StartDelivery(traceparent, topic)
+}
@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Transformer rewrites or drops a broadcast payload before it is fanned out.
+// Transform returns the payload to deliver and false to drop the message.
+// It runs once per message, not per recipient, and must be safe for
+// concurrent use.
+type Transformer interface {
+	Transform(topic string, msg []byte) ([]byte, bool)
+}
+
+// fieldFilter is the built-in Transformer: it keeps only a topic's allowed
+// top-level JSON fields, or strips its denied ones. The "*" entry applies to
+// topics without their own rule, including untopiced broadcasts.
+type fieldFilter struct {
+	allow map[string]map[string]bool
+	deny  map[string]map[string]bool
+}
+
+// parseTopicFields reads per-topic field lists such as
+// "chat:text|user,*:debug". Topic names may contain ':', so the list is what
+// follows the last one.
+func parseTopicFields(raw string) (map[string]map[string]bool, error) {
+	rules := make(map[string]map[string]bool)
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndexByte(pair, ':')
+		if i <= 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("invalid entry %q; expected topic:field|field", pair)
+		}
+		topic, list := pair[:i], pair[i+1:]
+		fields := make(map[string]bool)
+		for _, name := range strings.Split(list, "|") {
+			if name = strings.TrimSpace(name); name != "" {
+				fields[name] = true
+			}
+		}
+		rules[topic] = fields
+	}
+	return rules, nil
+}
+
+// ruleFor returns topic's rule, falling back to its unscoped name and then
+// to "*".
+func ruleFor(rules map[string]map[string]bool, topic string) map[string]bool {
+	if r, ok := topicSetting(rules, topic); ok {
+		return r
+	}
+	return rules["*"]
+}
+
+// Transform applies the topic's rules. Under an allowlist, payloads that
+// aren't JSON objects are dropped rather than passed through unfiltered;
+// under a denylist they are delivered unchanged.
+func (f *fieldFilter) Transform(topic string, msg []byte) ([]byte, bool) {
+	allow, deny := ruleFor(f.allow, topic), ruleFor(f.deny, topic)
+	if allow == nil && deny == nil {
+		return msg, true
+	}
+	var obj map[string]json.RawMessage
+	if trimmed := bytes.TrimSpace(msg); len(trimmed) == 0 || trimmed[0] != '{' || json.Unmarshal(trimmed, &obj) != nil {
+		return msg, allow == nil
+	}
+	changed := false
+	for k := range obj {
+		if (allow != nil && !allow[k]) || deny[k] {
+			delete(obj, k)
+			changed = true
+		}
+	}
+	if !changed {
+		return msg, true
+	}
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return msg, allow == nil
+	}
+	return out, true
+}
+
+// transform runs the hub's Transformer, if any, and counts dropped messages.
+func (h *hub) transform(topic string, msg []byte) ([]byte, bool) {
+	if h.transformer == nil {
+		return msg, true
+	}
+	out, ok := h.transformer.Transform(topic, msg)
+	if !ok {
+		messagesTransformDropped.Inc()
+	}
+	return out, ok
+}
@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseTopicFields(t *testing.T) {
+	rules, err := parseTopicFields("chat:text|user, tenant:acme:orders:id , *:debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(rules); got != "map[*:map[debug:true] chat:map[text:true user:true] tenant:acme:orders:map[id:true]]" {
+		t.Fatalf("rules = %s", got)
+	}
+	for _, raw := range []string{"chat", ":text", "chat:"} {
+		if _, err := parseTopicFields(raw); err == nil {
+			t.Errorf("parseTopicFields(%q) succeeded", raw)
+		}
+	}
+}
+
+func TestFieldFilter(t *testing.T) {
+	allow, _ := parseTopicFields("chat:text|user")
+	deny, _ := parseTopicFields("*:debug,tenant:acme:chat:user")
+	f := &fieldFilter{allow: allow, deny: deny}
+	tests := []struct {
+		topic, in, want string
+		drop            bool
+	}{
+		{topic: "chat", in: `{"text":"hi","user":"u1","ip":"10.0.0.1"}`, want: `{"text":"hi","user":"u1"}`},
+		{topic: "chat", in: `{"text":"hi"}`, want: `{"text":"hi"}`},
+		{topic: "chat", in: `"hi"`, drop: true},
+		// The scoped topic has a deny rule of its own, and the allowlist of
+		// its unscoped name.
+		{topic: "tenant:acme:chat", in: `{"text":"hi","user":"u1","ip":"x"}`, want: `{"text":"hi"}`},
+		{topic: "tenant:other:chat", in: `{"text":"hi","ip":"x"}`, want: `{"text":"hi"}`},
+		{topic: "news", in: `{"title":"t","debug":1}`, want: `{"title":"t"}`},
+		{topic: "", in: `{"title":"t","debug":1}`, want: `{"title":"t"}`},
+		{topic: "news", in: `[1,2]`, want: `[1,2]`},
+	}
+	for _, tt := range tests {
+		out, ok := f.Transform(tt.topic, []byte(tt.in))
+		if ok == tt.drop || (ok && string(out) != tt.want) {
+			t.Errorf("Transform(%q, %s) = %s, %v; want %s, %v", tt.topic, tt.in, out, ok, tt.want, !tt.drop)
+		}
+	}
+}
+
+// countingTransformer counts its calls, marks what it passes and drops the
+// message "drop".
+type countingTransformer struct{ calls atomic.Int64 }
+
+func (c *countingTransformer) Transform(topic string, msg []byte) ([]byte, bool) {
+	c.calls.Add(1)
+	return append([]byte("seen:"), msg...), string(msg) != "drop"
+}
+
+func TestTransformRunsOncePerMessage(t *testing.T) {
+	h := newTestHub(t, nil)
+	tr := &countingTransformer{}
+	h.transformer = tr
+	clients := make([]*client, 10)
+	for i := range clients {
+		clients[i] = testClient(fmt.Sprint(i), 2)
+		h.add(clients[i])
+	}
+	h.broadcast(websocket.TextMessage, []byte("hello"))
+	h.broadcast(websocket.TextMessage, []byte("drop"))
+	if n := tr.calls.Load(); n != 2 {
+		t.Fatalf("Transform ran %d times for 2 messages to %d clients", n, len(clients))
+	}
+	for _, c := range clients {
+		if len(c.send) != 1 {
+			t.Fatalf("client %s holds %d frames, want the transformed message only", c.id, len(c.send))
+		}
+		if f := <-c.send; string(f.data) != "seen:hello" {
+			t.Fatalf("delivered %q", f.data)
+		}
+	}
+}
+
+func TestTopicFieldsOnTheWire(t *testing.T) {
+	tg := startGateway(t, map[string]string{"TOPIC_FIELDS_DENY": "users:email|phone"})
+	conn, _ := tg.connect("/ws?topics=users", nil)
+	tg.hub.broadcastTopic("users", websocket.TextMessage, []byte(`{"id":1,"email":"a@b.c","phone":"1"}`))
+	if _, data := readFrame(t, conn); string(data) != `{"id":1}` {
+		t.Fatalf("delivered %s", data)
+	}
+}
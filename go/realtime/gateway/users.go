@@ -0,0 +1,88 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// userIndex maps user IDs to their connections on this instance, so a
+// message for a user reaches every device they are connected from.
+type userIndex struct {
+	mu     sync.RWMutex
+	byUser map[string][]*client
+}
+
+func newUserIndex() *userIndex {
+	return &userIndex{byUser: make(map[string][]*client)}
+}
+
+func (u *userIndex) add(c *client) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.byUser[c.userID] = append(u.byUser[c.userID], c)
+}
+
+func (u *userIndex) remove(c *client) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	clients := u.byUser[c.userID]
+	for i, other := range clients {
+		if other == c {
+			clients = append(clients[:i], clients[i+1:]...)
+			break
+		}
+	}
+	if len(clients) == 0 {
+		delete(u.byUser, c.userID)
+	} else {
+		u.byUser[c.userID] = clients
+	}
+}
+
+// clients returns a copy of the user's connections.
+func (u *userIndex) clients(userID string) []*client {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return append([]*client(nil), u.byUser[userID]...)
+}
+
+// userID returns the user a connection belongs to: the claim named by
+// claim when the request was authenticated, or ?user_id= when
+// authentication is disabled. A string or integer claim is accepted.
+func userID(r *http.Request, claims jwt.MapClaims, claim string) (string, error) {
+	if claims == nil {
+		id := r.URL.Query().Get("user_id")
+		if id != "" && !validClientID.MatchString(id) {
+			return "", errors.New("user_id must be 1-64 characters of letters, digits, '_', '.', ':' or '-'")
+		}
+		return id, nil
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", nil
+}
+
+// sendToUser queues message for every connection of userID on this
+// instance and returns how many it was queued for.
+func (h *hub) sendToUser(userID string, messageType int, message []byte) int {
+	n := 0
+	for _, c := range h.users.clients(userID) {
+		s := h.shardFor(c.id)
+		s.mu.RLock()
+		if _, ok := s.clients[c]; ok {
+			h.push(c, frame{messageType: messageType, data: message, payload: true})
+			n++
+		}
+		s.mu.RUnlock()
+	}
+	messagesDirect.Add(float64(n))
+	return n
+}
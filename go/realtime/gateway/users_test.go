@@ -0,0 +1,116 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// userClient returns a test client belonging to user.
+func userClient(id, user string) *client {
+	c := testClient(id, 4)
+	c.userID = user
+	return c
+}
+
+func TestSendToUser(t *testing.T) {
+	h := newTestHub(t, nil)
+	phone, laptop, other, anonymous := userClient("phone", "u1"), userClient("laptop", "u1"), userClient("other", "u2"), testClient("anon", 4)
+	for _, c := range []*client{phone, laptop, other, anonymous} {
+		h.add(c)
+	}
+	if n := h.sendToUser("u1", websocket.TextMessage, []byte("hi")); n != 2 {
+		t.Fatalf("sendToUser reached %d connections, want 2", n)
+	}
+	for _, c := range []*client{phone, laptop} {
+		if len(c.send) != 1 {
+			t.Fatalf("%s holds %d frames, want 1", c.id, len(c.send))
+		}
+	}
+	if len(other.send) != 0 || len(anonymous.send) != 0 {
+		t.Fatal("a connection of another user got the message")
+	}
+	if n := h.sendToUser("nobody", websocket.TextMessage, []byte("hi")); n != 0 {
+		t.Fatalf("sendToUser reached %d connections of an unknown user", n)
+	}
+}
+
+func TestUserIndexCleanup(t *testing.T) {
+	h := newTestHub(t, nil)
+	phone, laptop := userClient("phone", "u1"), userClient("laptop", "u1")
+	h.add(phone)
+	h.add(laptop)
+	h.remove(phone)
+	if got := h.users.clients("u1"); len(got) != 1 || got[0] != laptop {
+		t.Fatalf("u1's connections = %v, want the laptop only", got)
+	}
+	if n := h.sendToUser("u1", websocket.TextMessage, []byte("hi")); n != 1 {
+		t.Fatalf("sendToUser reached %d connections after one left, want 1", n)
+	}
+	h.remove(laptop)
+	if len(h.users.byUser) != 0 {
+		t.Fatalf("index = %v after every connection left, want it empty", h.users.byUser)
+	}
+}
+
+// TestUserIndexReplacedClient checks that a connection replaced under the
+// same client_id leaves the index along with the old one.
+func TestUserIndexReplacedClient(t *testing.T) {
+	h := newTestHub(t, nil)
+	old, replacement := userClient("dev", "u1"), userClient("dev", "u1")
+	h.add(old)
+	h.add(replacement)
+	if got := h.users.clients("u1"); len(got) != 1 || got[0] != replacement {
+		t.Fatalf("u1's connections = %v, want the replacement only", got)
+	}
+}
+
+func TestUserID(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		claims  jwt.MapClaims
+		want    string
+		wantErr bool
+	}{
+		{name: "query without auth", query: "?user_id=u1", want: "u1"},
+		{name: "invalid query", query: "?user_id=a%20b", wantErr: true},
+		{name: "none", want: ""},
+		{name: "string claim", claims: jwt.MapClaims{"sub": "u1"}, want: "u1"},
+		{name: "numeric claim", claims: jwt.MapClaims{"sub": float64(42)}, want: "42"},
+		{name: "claim wins over query", query: "?user_id=spoofed", claims: jwt.MapClaims{"sub": "u1"}, want: "u1"},
+		{name: "missing claim", claims: jwt.MapClaims{"role": "admin"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws"+tt.query, nil)
+			got, err := userID(r, tt.claims, "sub")
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("userID = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestToUserAcrossInstances(t *testing.T) {
+	mr, url := startRedis(t)
+	env := map[string]string{"BACKEND": "pubsub", "REDIS_URL": url}
+	a := startGateway(t, env)
+	b := startGateway(t, env)
+	waitFor(t, "subscriptions", func() bool { return a.hub.subscribed.Load() && b.hub.subscribed.Load() })
+	phone, _ := a.connect("/ws?user_id=u1", nil)
+	laptop, _ := b.connect("/ws?user_id=u1", nil)
+	other, _ := a.connect("/ws?user_id=u2", nil)
+
+	mr.Publish("realtime:direct", `{"to_user":"u1","data":{"text":"hi"}}`)
+	for name, conn := range map[string]*websocket.Conn{"phone": phone, "laptop": laptop} {
+		if _, data := readFrame(t, conn); string(data) != `{"text":"hi"}` {
+			t.Fatalf("%s got %s", name, data)
+		}
+	}
+	expectSilence(t, other, 50*time.Millisecond)
+}
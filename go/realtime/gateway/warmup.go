@@ -0,0 +1,58 @@
+package gateway
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// warmup paces broadcasts for a while after startup. A freshly started
+// instance that clients pile onto would otherwise wake every writePump at
+// once on each broadcast; during warmup fan-out walks the clients batch by
+// batch with a short pause in between.
+type warmup struct {
+	until time.Time
+	batch int
+	delay time.Duration
+	// paced counts the broadcasts fanned out in batches, for the log line
+	// at the end.
+	paced atomic.Int64
+}
+
+// start begins the warmup window and logs when it ends.
+func (w *warmup) start(ctx context.Context, duration time.Duration) {
+	w.until = time.Now().Add(duration)
+	slog.Info("warmup: pacing broadcasts", "duration", duration, "batch", w.batch, "delay", w.delay)
+	go func() {
+		t := time.NewTimer(duration)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			slog.Info("warmup over; broadcasting at full speed", "paced_broadcasts", w.paced.Load())
+		case <-ctx.Done():
+		}
+	}()
+}
+
+func (w *warmup) active() bool {
+	return time.Now().Before(w.until)
+}
+
+// fanout calls fn for every client like each, pacing the walk while the
+// warmup is active.
+func (h *hub) fanout(fn func(c *client)) {
+	if h.warmup == nil || !h.warmup.active() {
+		h.each(fn)
+		return
+	}
+	h.warmup.paced.Add(1)
+	// Work from a snapshot so no shard lock is held across the pauses;
+	// clients that left meanwhile are skipped.
+	for i, c := range h.snapshot() {
+		if i > 0 && i%h.warmup.batch == 0 {
+			time.Sleep(h.warmup.delay)
+		}
+		h.ifRegistered(c, fn)
+	}
+}
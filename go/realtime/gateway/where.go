@@ -0,0 +1,367 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Bounds on a where expression, so a publisher cannot make every instance
+// do unbounded work per client.
+const (
+	maxWhereLength = 1024
+	maxWhereNodes  = 64
+	maxWhereDepth  = 16
+)
+
+// whereExpr is a compiled filter over connection tags, e.g.
+// `platform == "ios" && app_version >= v2.0`. The grammar:
+//
+//	expr       = and { ("||" | "or") and }
+//	and        = unary { ("&&" | "and") unary }
+//	unary      = ("!" | "not") unary | "(" expr ")" | comparison
+//	comparison = tag op literal
+//	op         = "==" | "!=" | "<" | "<=" | ">" | ">="
+//	literal    = "string" | 'string' | number | v1.2.3
+//
+// A number compares numerically with a tag that parses as one, a v-prefixed
+// version component by component with a dotted tag such as "2.10.1", and a
+// string lexically. A comparison on a tag the client doesn't have, or whose
+// value doesn't fit the literal, is false.
+type whereExpr struct {
+	root whereNode
+}
+
+type whereNode interface {
+	eval(tags map[string]string) bool
+}
+
+type whereAnd struct{ left, right whereNode }
+type whereOr struct{ left, right whereNode }
+type whereNot struct{ operand whereNode }
+
+// whereNever stands in for an expression that failed to compile, so a bad
+// filter reaches nobody rather than everybody.
+type whereNever struct{}
+
+type whereCompare struct {
+	tag string
+	op  string
+	lit whereLiteral
+}
+
+type whereLiteral struct {
+	kind    byte // 's' string, 'n' number, 'v' version
+	str     string
+	num     float64
+	version []int
+}
+
+func (n whereAnd) eval(tags map[string]string) bool { return n.left.eval(tags) && n.right.eval(tags) }
+func (n whereOr) eval(tags map[string]string) bool  { return n.left.eval(tags) || n.right.eval(tags) }
+func (n whereNot) eval(tags map[string]string) bool { return !n.operand.eval(tags) }
+func (whereNever) eval(map[string]string) bool      { return false }
+
+func (n whereCompare) eval(tags map[string]string) bool {
+	v, ok := tags[n.tag]
+	if !ok {
+		return false
+	}
+	var cmp int
+	switch n.lit.kind {
+	case 'n':
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return false
+		}
+		cmp = compareFloat(f, n.lit.num)
+	case 'v':
+		parts, ok := parseVersion(strings.TrimPrefix(v, "v"))
+		if !ok {
+			return false
+		}
+		cmp = compareVersion(parts, n.lit.version)
+	default:
+		cmp = strings.Compare(v, n.lit.str)
+	}
+	switch n.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// parseVersion splits a dotted version such as "2.10.1" into its numbers.
+func parseVersion(s string) ([]int, bool) {
+	var parts []int
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
+
+// compareVersion compares component by component, missing ones counting
+// as 0, so 2.0 and 2 are equal.
+func compareVersion(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return compareFloat(float64(x), float64(y))
+		}
+	}
+	return 0
+}
+
+// matches reports whether a client with tags passes the expression.
+func (w *whereExpr) matches(tags map[string]string) bool {
+	return w.root.eval(tags)
+}
+
+// neverWhere is what an envelope with a malformed where gets.
+var neverWhere = &whereExpr{root: whereNever{}}
+
+// compileWhere parses a where expression.
+func compileWhere(src string) (*whereExpr, error) {
+	if len(src) > maxWhereLength {
+		return nil, fmt.Errorf("where exceeds %d bytes", maxWhereLength)
+	}
+	tokens, err := lexWhere(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &whereParser{tokens: tokens}
+	root, err := p.or(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return &whereExpr{root: root}, nil
+}
+
+type whereToken struct {
+	kind byte // 'i' identifier, 'o' operator, 's' string, 'n' number, 'v' version, '(' or ')'
+	text string
+}
+
+func lexWhere(src string) ([]whereToken, error) {
+	var tokens []whereToken
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '(' || ch == ')':
+			tokens = append(tokens, whereToken{kind: ch, text: string(ch)})
+			i++
+		case ch == '"' || ch == '\'':
+			end := strings.IndexByte(src[i+1:], ch)
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, whereToken{kind: 's', text: src[i+1 : i+1+end]})
+			i += end + 2
+		case strings.ContainsRune("=!<>&|", rune(ch)):
+			j := i + 1
+			if j < len(src) && strings.ContainsRune("=&|", rune(src[j])) {
+				j++
+			}
+			op := src[i:j]
+			switch op {
+			case "==", "!=", "<", "<=", ">", ">=", "&&", "||", "!":
+			default:
+				return nil, fmt.Errorf("unknown operator %q", op)
+			}
+			tokens = append(tokens, whereToken{kind: 'o', text: op})
+			i = j
+		case ch == '-' || ch == '.' || (ch >= '0' && ch <= '9'):
+			j := i + 1
+			for j < len(src) && (src[j] == '.' || (src[j] >= '0' && src[j] <= '9')) {
+				j++
+			}
+			tokens = append(tokens, whereToken{kind: 'n', text: src[i:j]})
+			i = j
+		case isWhereIdent(ch):
+			j := i + 1
+			for j < len(src) && (isWhereIdent(src[j]) || src[j] == '-' || src[j] == '.' || (src[j] >= '0' && src[j] <= '9')) {
+				j++
+			}
+			word := src[i:j]
+			switch {
+			case word == "and":
+				tokens = append(tokens, whereToken{kind: 'o', text: "&&"})
+			case word == "or":
+				tokens = append(tokens, whereToken{kind: 'o', text: "||"})
+			case word == "not":
+				tokens = append(tokens, whereToken{kind: 'o', text: "!"})
+			case len(word) > 1 && word[0] == 'v' && word[1] >= '0' && word[1] <= '9':
+				tokens = append(tokens, whereToken{kind: 'v', text: word[1:]})
+			default:
+				tokens = append(tokens, whereToken{kind: 'i', text: word})
+			}
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q", ch)
+		}
+	}
+	return tokens, nil
+}
+
+func isWhereIdent(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+type whereParser struct {
+	tokens []whereToken
+	pos    int
+	nodes  int
+}
+
+func (p *whereParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == 'o' && p.tokens[p.pos].text == text
+}
+
+func (p *whereParser) node() error {
+	if p.nodes++; p.nodes > maxWhereNodes {
+		return fmt.Errorf("where has more than %d terms", maxWhereNodes)
+	}
+	return nil
+}
+
+func (p *whereParser) or(depth int) (whereNode, error) {
+	left, err := p.and(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("||") {
+		p.pos++
+		right, err := p.and(depth)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.node(); err != nil {
+			return nil, err
+		}
+		left = whereOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *whereParser) and(depth int) (whereNode, error) {
+	left, err := p.unary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("&&") {
+		p.pos++
+		right, err := p.unary(depth)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.node(); err != nil {
+			return nil, err
+		}
+		left = whereAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *whereParser) unary(depth int) (whereNode, error) {
+	if depth > maxWhereDepth {
+		return nil, fmt.Errorf("where nests deeper than %d", maxWhereDepth)
+	}
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	if err := p.node(); err != nil {
+		return nil, err
+	}
+	switch t := p.tokens[p.pos]; {
+	case t.kind == 'o' && t.text == "!":
+		p.pos++
+		operand, err := p.unary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return whereNot{operand}, nil
+	case t.kind == '(':
+		p.pos++
+		inner, err := p.or(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != ')' {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return inner, nil
+	case t.kind == 'i':
+		return p.comparison()
+	default:
+		return nil, fmt.Errorf("expected a tag name, got %q", t.text)
+	}
+}
+
+func (p *whereParser) comparison() (whereNode, error) {
+	if p.pos+2 >= len(p.tokens) {
+		return nil, fmt.Errorf("incomplete comparison on %q", p.tokens[p.pos].text)
+	}
+	tag, op, lit := p.tokens[p.pos], p.tokens[p.pos+1], p.tokens[p.pos+2]
+	switch op.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("expected a comparison after %q", tag.text)
+	}
+	c := whereCompare{tag: tag.text, op: op.text}
+	switch lit.kind {
+	case 's':
+		c.lit = whereLiteral{kind: 's', str: lit.text}
+	case 'n':
+		f, err := strconv.ParseFloat(lit.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", lit.text)
+		}
+		c.lit = whereLiteral{kind: 'n', num: f}
+	case 'v':
+		parts, ok := parseVersion(lit.text)
+		if !ok {
+			return nil, fmt.Errorf("invalid version v%s", lit.text)
+		}
+		c.lit = whereLiteral{kind: 'v', version: parts}
+	default:
+		return nil, fmt.Errorf("expected a string, number or version after %s, got %q", op.text, lit.text)
+	}
+	p.pos += 3
+	return c, nil
+}
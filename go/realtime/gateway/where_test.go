@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWhereMatches(t *testing.T) {
+	ios := map[string]string{"platform": "ios", "app_version": "2.10.1", "build": "412"}
+	android := map[string]string{"platform": "android", "app_version": "v1.9", "build": "97"}
+	tests := []struct {
+		expr          string
+		ios, android  bool
+		untaggedMatch bool
+	}{
+		{expr: `platform == "ios"`, ios: true},
+		{expr: `platform == 'ios' && app_version >= v2.0`, ios: true},
+		{expr: `platform == 'android' and app_version >= v2.0`},
+		{expr: `platform == 'android' || app_version >= v2.0`, ios: true, android: true},
+		{expr: `app_version < v2.2`, android: true},
+		{expr: `app_version == v2.10.1.0`, ios: true},
+		{expr: `build > 100`, ios: true},
+		{expr: `build <= 97`, android: true},
+		{expr: `build != 412`, android: true},
+		{expr: `platform > "b"`, ios: true},
+		// A tag that isn't a number doesn't match a numeric literal.
+		{expr: `platform >= 0`},
+		// A missing tag fails the comparison but not its negation.
+		{expr: `!(platform == 'ios')`, android: true, untaggedMatch: true},
+		{expr: `not platform == 'ios'`, android: true, untaggedMatch: true},
+		{expr: `platform != 'ios'`, android: true},
+		{expr: `(platform == 'ios' || platform == 'android') && !(build < 100)`, ios: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			w, err := compileWhere(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.matches(ios); got != tt.ios {
+				t.Errorf("ios client: %v, want %v", got, tt.ios)
+			}
+			if got := w.matches(android); got != tt.android {
+				t.Errorf("android client: %v, want %v", got, tt.android)
+			}
+			if got := w.matches(nil); got != tt.untaggedMatch {
+				t.Errorf("untagged client: %v, want %v", got, tt.untaggedMatch)
+			}
+		})
+	}
+}
+
+func TestWhereMalformed(t *testing.T) {
+	tests := map[string]string{
+		"empty":                "",
+		"unterminated string":  `platform == "ios`,
+		"unknown operator":     `platform = "ios"`,
+		"missing literal":      `platform ==`,
+		"tag as literal":       `platform == other`,
+		"literal first":        `"ios" == platform`,
+		"trailing tokens":      `platform == "ios" "android"`,
+		"unbalanced paren":     `(platform == "ios"`,
+		"stray paren":          `platform == "ios")`,
+		"bad number":           `build > 1.2.3`,
+		"dangling and":         `platform == "ios" &&`,
+		"unexpected character": `platform == "ios" ; drop`,
+		"too long":             `platform == "` + strings.Repeat("x", maxWhereLength) + `"`,
+		"too many terms":       strings.Repeat(`a == 1 || `, maxWhereNodes) + `a == 1`,
+		"too deep":             strings.Repeat("(", maxWhereDepth+1) + `a == 1` + strings.Repeat(")", maxWhereDepth+1),
+	}
+	for name, expr := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := compileWhere(expr); err == nil {
+				t.Fatalf("compileWhere(%q) succeeded", expr)
+			}
+		})
+	}
+}
+
+func TestWhereEnvelope(t *testing.T) {
+	h := newTestHub(t, nil)
+	ios, android := testClient("ios", 4), testClient("android", 4)
+	ios.tags = map[string]string{"platform": "ios"}
+	android.tags = map[string]string{"platform": "android"}
+	h.add(ios)
+	h.add(android)
+
+	h.broadcast(websocket.TextMessage, []byte(`{"where":"platform == 'ios'","data":{"text":"hi"}}`))
+	if len(ios.send) != 1 || len(android.send) != 0 {
+		t.Fatalf("queued ios %d, android %d; want only ios", len(ios.send), len(android.send))
+	}
+	if f := <-ios.send; !bytes.Equal(f.data, []byte(`{"text":"hi"}`)) {
+		t.Fatalf("delivered %s, want only data", f.data)
+	}
+	// A where that doesn't compile reaches no one.
+	h.broadcast(websocket.TextMessage, []byte(`{"where":"platform ==","data":1}`))
+	if len(ios.send) != 0 || len(android.send) != 0 {
+		t.Fatal("an invalid where was delivered")
+	}
+}
+
+func TestPublishWhere(t *testing.T) {
+	tg := startGateway(t, map[string]string{"TAG_QUERY_PARAMS": "platform", "ADMIN_TOKEN": "admin"})
+	ios, _ := tg.connect("/ws?platform=ios", nil)
+	android, _ := tg.connect("/ws?platform=android", nil)
+	publish := func(query, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, tg.url("/publish?"+query), strings.NewReader(body))
+		req.Header.Set(adminTokenHeader, "admin")
+		return status(t, req)
+	}
+
+	if code, _ := publish("where="+url.QueryEscape("platform == 'ios'"), `{"text":"update ready"}`); code != http.StatusAccepted {
+		t.Fatalf("publish = %d, want 202", code)
+	}
+	if _, data := readFrame(t, ios); string(data) != `{"text":"update ready"}` {
+		t.Fatalf("ios got %s", data)
+	}
+	if code, body := publish("where="+url.QueryEscape("platform =="), `{}`); code != http.StatusBadRequest || !strings.Contains(body, "invalid where") {
+		t.Fatalf("malformed where = %d %s, want 400", code, body)
+	}
+	if code, _ := publish("where="+url.QueryEscape("platform == 'ios'"), `not json`); code != http.StatusBadRequest {
+		t.Fatalf("where on a non-JSON body = %d, want 400", code)
+	}
+	expectSilence(t, android, 50*time.Millisecond)
+}
@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// retryListener hands out connections whose writes get WRITE_RETRIES more
+// attempts after a transient failure. Retrying has to happen below the
+// WebSocket and TLS layers: both treat any failed write as fatal, and a write
+// cut short leaves a frame half sent, so only the socket itself can pick up
+// where it stopped.
+type retryListener struct {
+	net.Listener
+	retries int
+	backoff time.Duration
+}
+
+func (l retryListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &retryConn{Conn: conn, retries: l.retries, backoff: l.backoff}, nil
+}
+
+// retryConn retries a write that timed out or would block, continuing after
+// the bytes that did go out. Each retry waits backoff, doubling every time,
+// and gets a fresh deadline as long as the one the caller set.
+type retryConn struct {
+	net.Conn
+	retries int
+	backoff time.Duration
+
+	mu sync.Mutex
+	// window is how long the caller's current write deadline allowed; 0
+	// without one, in which case a write never times out.
+	window time.Duration
+}
+
+func (c *retryConn) SetDeadline(t time.Time) error {
+	c.setWindow(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *retryConn) SetWriteDeadline(t time.Time) error {
+	c.setWindow(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *retryConn) setWindow(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.window = 0
+	if !t.IsZero() {
+		c.window = time.Until(t)
+	}
+}
+
+func (c *retryConn) Write(b []byte) (int, error) {
+	written := 0
+	for attempt := 0; ; attempt++ {
+		n, err := c.Conn.Write(b[written:])
+		written += n
+		if err == nil || !transientWriteError(err) {
+			return written, err
+		}
+		if attempt == c.retries {
+			if attempt > 0 {
+				writeRetriesFailed.Inc()
+			}
+			return written, err
+		}
+		writeRetries.Inc()
+		time.Sleep(c.backoff << attempt)
+		c.mu.Lock()
+		window := c.window
+		c.mu.Unlock()
+		if window > 0 {
+			if err := c.Conn.SetWriteDeadline(time.Now().Add(window)); err != nil {
+				return written, err
+			}
+		}
+	}
+}
+
+// transientWriteError reports whether a write may succeed if tried again: it
+// timed out or the socket buffer was full. A closed or reset connection is
+// fatal.
+func transientWriteError(err error) bool {
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+		return false
+	}
+	return isTimeout(err) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOBUFS)
+}
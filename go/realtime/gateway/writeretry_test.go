@@ -0,0 +1,157 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// flakyConn fails its first len(fails) writes with the given errors, each
+// after writing half of what it was handed, and records every write
+// deadline it's given.
+type flakyConn struct {
+	net.Conn
+	fails     []error
+	written   bytes.Buffer
+	deadlines []time.Time
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if len(c.fails) == 0 {
+		return c.written.Write(b)
+	}
+	err := c.fails[0]
+	c.fails = c.fails[1:]
+	n, _ := c.written.Write(b[:len(b)/2])
+	return n, err
+}
+
+func (c *flakyConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func TestRetryConnResumesAfterTransientFailure(t *testing.T) {
+	inner := &flakyConn{fails: []error{os.ErrDeadlineExceeded, syscall.EAGAIN}}
+	c := &retryConn{Conn: inner, retries: 2, backoff: time.Millisecond}
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	retries, failed := testutil.ToFloat64(writeRetries), testutil.ToFloat64(writeRetriesFailed)
+
+	n, err := c.Write([]byte("0123456789"))
+	if err != nil || n != 10 {
+		t.Fatalf("Write = %d, %v; want 10, nil", n, err)
+	}
+	if got := inner.written.String(); got != "0123456789" {
+		t.Fatalf("socket got %q, want every byte once in order", got)
+	}
+	// The caller's deadline, then a fresh one for each retry.
+	if len(inner.deadlines) != 3 {
+		t.Fatalf("set %d write deadlines, want 3", len(inner.deadlines))
+	}
+	if got := testutil.ToFloat64(writeRetries) - retries; got != 2 {
+		t.Fatalf("write retries rose by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(writeRetriesFailed) - failed; got != 0 {
+		t.Fatalf("failed retries rose by %v, want 0", got)
+	}
+}
+
+func TestRetryConnGivesUp(t *testing.T) {
+	inner := &flakyConn{fails: []error{os.ErrDeadlineExceeded, os.ErrDeadlineExceeded, os.ErrDeadlineExceeded}}
+	c := &retryConn{Conn: inner, retries: 2, backoff: time.Millisecond}
+	retries, failed := testutil.ToFloat64(writeRetries), testutil.ToFloat64(writeRetriesFailed)
+
+	if _, err := c.Write([]byte("01234567")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write error = %v, want the timeout", err)
+	}
+	if got := testutil.ToFloat64(writeRetries) - retries; got != 2 {
+		t.Fatalf("write retries rose by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(writeRetriesFailed) - failed; got != 1 {
+		t.Fatalf("failed retries rose by %v, want 1", got)
+	}
+	// Without a deadline from the caller none is set on a retry.
+	if len(inner.deadlines) != 0 {
+		t.Fatalf("set %d write deadlines, want none", len(inner.deadlines))
+	}
+}
+
+func TestRetryConnFatalErrors(t *testing.T) {
+	for _, fatal := range []error{net.ErrClosed, syscall.EPIPE, syscall.ECONNRESET, errors.New("boom")} {
+		t.Run(fmt.Sprint(fatal), func(t *testing.T) {
+			inner := &flakyConn{fails: []error{&net.OpError{Op: "write", Net: "tcp", Err: fatal}}}
+			c := &retryConn{Conn: inner, retries: 3, backoff: time.Millisecond}
+			retries := testutil.ToFloat64(writeRetries)
+			n, err := c.Write([]byte("0123"))
+			if !errors.Is(err, fatal) || n != 2 {
+				t.Fatalf("Write = %d, %v; want 2 and the error", n, err)
+			}
+			if got := testutil.ToFloat64(writeRetries) - retries; got != 0 {
+				t.Fatalf("retried a fatal error %v times", got)
+			}
+		})
+	}
+}
+
+func TestRetryConnDisabled(t *testing.T) {
+	inner := &flakyConn{fails: []error{os.ErrDeadlineExceeded}}
+	c := &retryConn{Conn: inner, backoff: time.Millisecond}
+	failed := testutil.ToFloat64(writeRetriesFailed)
+	if _, err := c.Write([]byte("01")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write error = %v, want the timeout", err)
+	}
+	// A write that was never retried isn't a failed retry.
+	if got := testutil.ToFloat64(writeRetriesFailed) - failed; got != 0 {
+		t.Fatalf("failed retries rose by %v, want 0", got)
+	}
+}
+
+func TestTransientWriteError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: os.ErrDeadlineExceeded, want: true},
+		{err: &net.OpError{Op: "write", Err: syscall.EAGAIN}, want: true},
+		{err: &net.OpError{Op: "write", Err: syscall.ENOBUFS}, want: true},
+		{err: net.ErrClosed},
+		{err: &net.OpError{Op: "write", Err: syscall.EPIPE}},
+		{err: &net.OpError{Op: "write", Err: syscall.ECONNRESET}},
+		{err: errors.New("boom")},
+	}
+	for _, tt := range tests {
+		if got := transientWriteError(tt.err); got != tt.want {
+			t.Errorf("transientWriteError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryListenerWrapsConnections(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := retryListener{Listener: ln, retries: 3, backoff: 20 * time.Millisecond}
+	defer rl.Close()
+	go func() {
+		if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			defer c.Close()
+		}
+	}()
+	conn, err := rl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rc, ok := conn.(*retryConn)
+	if !ok || rc.retries != 3 || rc.backoff != 20*time.Millisecond {
+		t.Fatalf("Accept = %#v, want a retryConn with the listener's settings", conn)
+	}
+}
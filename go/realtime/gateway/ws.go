@@ -0,0 +1,365 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// retryAfter is the Retry-After hint, in seconds, sent when the gateway is
+// at capacity.
+const retryAfter = "5"
+
+// maxAcceptRetryAfter bounds the jittered Retry-After, in seconds, sent when
+// ACCEPT_RATE is exceeded.
+const maxAcceptRetryAfter = 10
+
+// upgradeError is the upgrader's error hook: it logs why a handshake failed
+// and tells the client in the response body, e.g. 400 for a missing
+// Sec-WebSocket-Key or 403 for a rejected origin.
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	slog.Warn("ws upgrade error", "remote", r.RemoteAddr, "status", status, "err", reason)
+	// The upgrader answers 403 only when CheckOrigin refused the request.
+	if status == http.StatusForbidden {
+		upgradesRejected.WithLabelValues("origin").Inc()
+	} else {
+		upgradesRejected.WithLabelValues("handshake").Inc()
+	}
+	w.Header().Set("Sec-Websocket-Version", "13")
+	http.Error(w, "websocket handshake failed: "+reason.Error(), status)
+}
+
+// reject refuses an upgrade with status and counts it under reason, one of
+// the realtime_upgrade_rejected_total labels.
+func reject(w http.ResponseWriter, reason, msg string, status int) {
+	upgradesRejected.WithLabelValues(reason).Inc()
+	http.Error(w, msg, status)
+}
+
+// validRejectCode reports whether code may be sent when refusing an upgrade:
+// one of the registered codes that fit a refusal, or an application code.
+func validRejectCode(code int) bool {
+	switch code {
+	case websocket.ClosePolicyViolation, websocket.CloseInternalServerErr, websocket.CloseServiceRestart, websocket.CloseTryAgainLater:
+		return true
+	}
+	return code >= 4000 && code <= 4999
+}
+
+// refuse turns down an upgrade like reject. With REJECT_WITH_CLOSE, capacity
+// and rate limit refusals instead complete the handshake and close with the
+// reason's close code, since browser clients never see the HTTP status of a
+// failed handshake.
+func (h *hub) refuse(w http.ResponseWriter, r *http.Request, reason, msg string, status int) {
+	code, ok := h.rejectCodes[reason]
+	if !ok {
+		reject(w, reason, msg, status)
+		return
+	}
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// upgradeError has already answered and counted the failure.
+		return
+	}
+	upgradesRejected.WithLabelValues(reason).Inc()
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, msg), time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// serveWS authenticates and upgrades a client connection, then starts its
+// pumps.
+func (h *hub) serveWS(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		reject(w, "draining", "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if h.starting.Load() {
+		w.Header().Set("Retry-After", "1")
+		reject(w, "starting", "server is starting; retry shortly", http.StatusServiceUnavailable)
+		return
+	}
+	if h.memoryPressured.Load() {
+		w.Header().Set("Retry-After", retryAfter)
+		reject(w, "memory", "server is under memory pressure; retry later", http.StatusServiceUnavailable)
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		// Most likely a browser or curl hitting the endpoint directly.
+		w.Header().Set("Upgrade", "websocket")
+		reject(w, "handshake", "this endpoint only speaks WebSocket; connect with a WebSocket client (ws:// or wss://)", http.StatusUpgradeRequired)
+		return
+	}
+	ip := h.proxies.clientIP(r)
+	topics := parseTopics(r.URL.Query().Get("topics"))
+	if h.acceptLimiter != nil && !h.acceptLimiter.Allow() {
+		// Spread the retries so the rejected clients don't come back as
+		// one wave.
+		w.Header().Set("Retry-After", strconv.Itoa(1+rand.IntN(maxAcceptRetryAfter)))
+		h.refuse(w, r, "rate_limit", "too many new connections; retry later", http.StatusServiceUnavailable)
+		return
+	}
+	id, err := clientID(r.URL.Query().Get("client_id"))
+	if err != nil {
+		reject(w, "handshake", err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, taken := h.get(id); taken && h.rejectDuplicates {
+		slog.Info("ws duplicate client_id refused", "client", id, "remote", r.RemoteAddr, "ip", ip)
+		h.refuse(w, r, "duplicate", "client_id is already connected", http.StatusConflict)
+		return
+	}
+	var tenant string
+	if h.tenants != nil {
+		if tenant, err = h.tenants.resolve(r); err != nil {
+			slog.Warn("ws tenant rejected", "remote", r.RemoteAddr, "ip", ip, "err", err)
+			reject(w, "handshake", err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var rq replayRequest
+	if h.stream != nil {
+		if rq, err = parseReplay(r.URL.Query()); err != nil {
+			reject(w, "handshake", err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var ackMode bool
+	if v := r.URL.Query().Get("ack"); v != "" {
+		if ackMode, err = strconv.ParseBool(v); err != nil {
+			reject(w, "handshake", fmt.Sprintf("invalid ack %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	var batch bool
+	if v := r.URL.Query().Get("batch"); v != "" {
+		if batch, err = strconv.ParseBool(v); err != nil {
+			reject(w, "handshake", fmt.Sprintf("invalid batch %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	format := formatJSON
+	switch v := r.URL.Query().Get("format"); v {
+	case "", formatJSON:
+	case formatMsgpack:
+		format = formatMsgpack
+	default:
+		reject(w, "handshake", fmt.Sprintf("invalid format %q; expected json or msgpack", v), http.StatusBadRequest)
+		return
+	}
+	// An ack-mode client that reconnects under the same client_id resumes
+	// from the oldest entry it never acknowledged, unless it asked for a
+	// specific replay.
+	var ackKey string
+	if ackMode && h.stream != nil && r.URL.Query().Get("client_id") != "" {
+		ackKey = h.ackKeyPrefix + id
+		if !rq.active() {
+			if rq.from, err = h.loadAckCursor(r.Context(), ackKey); err != nil {
+				slog.Warn("loading ack position failed", "client", id, "err", err)
+			}
+		}
+	}
+	// Any other client_id resumes from its saved cursor with
+	// CURSOR_SAVE_INTERVAL set, again unless it asked for a specific replay.
+	var cursorKey string
+	if h.cursors != nil && ackKey == "" && r.URL.Query().Get("client_id") != "" {
+		cursorKey = h.cursors.prefix + id
+		if !rq.active() {
+			if rq.since, err = h.cursors.load(r.Context(), cursorKey); err != nil {
+				slog.Warn("loading stream cursor failed", "client", id, "err", err)
+			}
+			rq.cursor = rq.since != ""
+		}
+	}
+	// ?resume= names the session from an earlier welcome frame.
+	session := r.URL.Query().Get("resume")
+	if session != "" && !validClientID.MatchString(session) {
+		reject(w, "handshake", "resume must be a session from an earlier welcome frame", http.StatusBadRequest)
+		return
+	}
+	if offered := websocket.Subprotocols(r); len(offered) > 0 && !supportsAny(offered) {
+		reject(w, "handshake", "unsupported subprotocol; supported: "+strings.Join(subprotocols, ", "), http.StatusBadRequest)
+		return
+	}
+	if h.maxSubscriptions > 0 && len(topics) > h.maxSubscriptions {
+		subscriptionsRejected.Inc()
+		reject(w, "handshake", fmt.Sprintf("at most %d subscriptions per connection", h.maxSubscriptions), http.StatusBadRequest)
+		return
+	}
+	// The firehose can also be joined with ?topics=, which is refused
+	// outright without the admin token.
+	admin := h.firehose != nil && h.firehose.authorized(r)
+	var tailFirehose bool
+	if _, ok := topics[firehoseTopic]; ok && !admin {
+		slog.Warn("ws firehose upgrade refused", "remote", r.RemoteAddr, "ip", ip)
+		reject(w, "auth", "the firehose requires the admin token", http.StatusForbidden)
+		return
+	}
+	var claims jwt.MapClaims
+	if h.auth != nil {
+		if claims, err = h.auth.authenticate(r); err != nil {
+			slog.Warn("ws auth failed", "remote", r.RemoteAddr, "ip", ip, "err", err)
+			if errors.Is(err, errAuthUnavailable) {
+				reject(w, "auth", "authentication is unavailable; retry later", http.StatusServiceUnavailable)
+				return
+			}
+			reject(w, "auth", "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	user, err := userID(r, claims, h.userClaim)
+	if err != nil {
+		reject(w, "handshake", err.Error(), http.StatusBadRequest)
+		return
+	}
+	// With topic authorization only the granted ?topics= are joined; an ack
+	// after the welcome tells the client which were denied.
+	var granted, denied []string
+	if h.topicAuth != nil {
+		granted, denied = h.authorizeTopics(r.Context(), claims, tenant, topics)
+		for _, t := range denied {
+			delete(topics, t)
+		}
+		if len(denied) > 0 {
+			slog.Info("ws topics denied", "remote", r.RemoteAddr, "ip", ip, "topics", denied)
+		}
+	}
+	// Reserve the slot before upgrading so concurrent upgrades cannot push
+	// the hub past maxConnections.
+	if !h.acquire() {
+		w.Header().Set("Retry-After", retryAfter)
+		h.refuse(w, r, "capacity", "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	if h.perIP != nil && !h.perIP.acquire(ip) {
+		h.release()
+		slog.Warn("ws rejected: too many connections from IP", "ip", ip, "limit", h.perIP.limit)
+		w.Header().Set("Retry-After", retryAfter)
+		h.refuse(w, r, "rate_limit", "too many connections from your address", http.StatusTooManyRequests)
+		return
+	}
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// upgradeError has already answered and logged the failure.
+		h.release()
+		if h.perIP != nil {
+			h.perIP.release(ip)
+		}
+		return
+	}
+	upgradesSucceeded.Inc()
+	if h.upgrader.EnableCompression {
+		// Compression is only used when the client negotiated it; with a
+		// minimum size, writeMessage turns it on per frame.
+		conn.EnableWriteCompression(h.compressionMinSize == 0)
+		if err := conn.SetCompressionLevel(h.compressionLevel); err != nil {
+			slog.Warn("ws compression level rejected", "level", h.compressionLevel, "err", err)
+		}
+	}
+	c := newClient(h.ctx, id, conn.RemoteAddr().String(), conn, h.sendBuffer)
+	c.compress = h.upgrader.EnableCompression && h.compressionMinSize > 0
+	c.ip = ip
+	if ip != remoteHost(c.remoteAddr) {
+		c.logger = c.logger.With("ip", ip)
+	}
+	if h.tags != nil {
+		c.tags = h.tags.capture(r)
+	}
+	c.protocol = conn.Subprotocol()
+	if c.protocol == "" {
+		c.protocol = protocolV1
+	}
+	if ackMode {
+		c.acks = &ackTracker{key: ackKey}
+	}
+	c.cursorKey = cursorKey
+	c.batched = batch && h.batchWindow > 0
+	c.format = format
+	c.admin = admin
+	c.userID = user
+	if user != "" {
+		c.logger = c.logger.With("user", user)
+	}
+	c.claims = claims
+	c.subject, _ = claims.GetSubject()
+	if tenant != "" {
+		c.tenant = tenant
+		c.logger = c.logger.With("tenant", tenant)
+	}
+	for t := range topics {
+		if t == firehoseTopic {
+			tailFirehose = true
+			continue
+		}
+		c.topics[c.scope(t)] = struct{}{}
+	}
+	if h.resume != nil && !h.startSession(c, session) {
+		h.abandon(c, websocket.CloseTryAgainLater, "resumed session overflows the send queue")
+		return
+	}
+	c.replaying = rq.active()
+	// A replay already brings the client up to date, so only live starts
+	// get snapshots of their ?topics=.
+	var snapshots []string
+	if h.snapshots != nil && !c.replaying {
+		for t := range c.topics {
+			if c.holdTopic(t) {
+				snapshots = append(snapshots, t)
+			}
+		}
+	}
+	c.logger.Info("ws client connected", "subject", c.subject, "protocol", c.protocol)
+	var added bool
+	if h.retain != nil && !c.replaying {
+		added = h.addRetaining(c, topics)
+	} else {
+		added = h.add(c)
+	}
+	if !added {
+		// Another connection claimed the same client_id since the check
+		// above.
+		c.logger.Info("ws duplicate client_id refused")
+		upgradesRejected.WithLabelValues("duplicate").Inc()
+		h.abandon(c, closeDuplicateID, "client_id is already connected")
+		return
+	}
+	if tailFirehose {
+		c.logger.Info("ws client tailing the firehose")
+		h.firehose.join(c)
+	}
+	if c.replaying {
+		go h.replayAndPump(c, rq)
+	} else {
+		if c.session == "" {
+			h.enqueue(c, encodeWelcome(c.id, c.protocol))
+		}
+		go h.writePump(c)
+	}
+	if len(granted) > 0 || len(denied) > 0 {
+		h.enqueue(c, encodeTopicsAck(granted, denied))
+	}
+	for _, t := range snapshots {
+		go h.sendSnapshot(c, t)
+	}
+	go h.readPump(c)
+}
+
+// abandon closes a client that was upgraded but never registered with code
+// and text, and gives back its connection slots.
+func (h *hub) abandon(c *client, code int, text string) {
+	msg := websocket.FormatCloseMessage(code, text)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.conn.Close()
+	c.cancel()
+	h.release()
+	if h.perIP != nil {
+		h.perIP.release(c.ip)
+	}
+}
@@ -0,0 +1,455 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingConn counts the bytes read from the wire.
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// dialCounting dials path with permessage-deflate offered and returns the
+// connection, the negotiated extensions and a count of bytes received.
+func dialCounting(t testing.TB, tg *testGateway, path string) (*websocket.Conn, string, *atomic.Int64) {
+	t.Helper()
+	var n atomic.Int64
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			return countingConn{conn, &n}, err
+		},
+	}
+	conn, resp, err := dialer.Dial("ws://"+tg.addr+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if msg := readJSON(t, conn); msg["type"] != "welcome" {
+		t.Fatalf("first frame = %v", msg)
+	}
+	return conn, resp.Header.Get("Sec-WebSocket-Extensions"), &n
+}
+
+func TestCompression(t *testing.T) {
+	large := []byte(`{"items":"` + strings.Repeat("abcdefgh", 8<<10) + `"}`)
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantDeflate bool
+		wantRatio   int64
+	}{
+		{name: "disabled", env: nil},
+		{name: "enabled", env: map[string]string{"ENABLE_COMPRESSION": "true", "COMPRESSION_LEVEL": "9"}, wantDeflate: true, wantRatio: 10},
+		{name: "every frame", env: map[string]string{"ENABLE_COMPRESSION": "true", "COMPRESSION_MIN_SIZE": "0"}, wantDeflate: true, wantRatio: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := startGateway(t, tt.env)
+			conn, ext, n := dialCounting(t, tg, "/ws")
+			if got := strings.Contains(ext, "permessage-deflate"); got != tt.wantDeflate {
+				t.Fatalf("Sec-WebSocket-Extensions = %q, deflate negotiated = %v, want %v", ext, got, tt.wantDeflate)
+			}
+			before := n.Load()
+			tg.hub.broadcast(websocket.TextMessage, large)
+			if _, data := readFrame(t, conn); !bytes.Equal(data, large) {
+				t.Fatalf("received %d bytes, want the %d-byte payload intact", len(data), len(large))
+			}
+			wire := n.Load() - before
+			if tt.wantRatio > 0 && wire*tt.wantRatio > int64(len(large)) {
+				t.Fatalf("%d bytes on the wire for a %d-byte payload, want under 1/%d", wire, len(large), tt.wantRatio)
+			}
+			if tt.wantRatio == 0 && wire < int64(len(large)) {
+				t.Fatalf("%d bytes on the wire for a %d-byte payload without compression", wire, len(large))
+			}
+		})
+	}
+}
+
+func TestCompressionSkipsSmallFrames(t *testing.T) {
+	tg := startGateway(t, map[string]string{"ENABLE_COMPRESSION": "true", "COMPRESSION_MIN_SIZE": "4096"})
+	conn, _, n := dialCounting(t, tg, "/ws")
+	small := []byte(strings.Repeat("a", 1000))
+	before := n.Load()
+	tg.hub.broadcast(websocket.TextMessage, small)
+	if _, data := readFrame(t, conn); !bytes.Equal(data, small) {
+		t.Fatalf("received %q", data)
+	}
+	// Uncompressed: the payload plus a 4-byte frame header.
+	if wire := n.Load() - before; wire != int64(len(small))+4 {
+		t.Fatalf("%d bytes on the wire for a %d-byte frame below COMPRESSION_MIN_SIZE", wire, len(small))
+	}
+}
+
+// BenchmarkCompressionMinSize broadcasts a mix of message sizes, mostly
+// small updates with the odd large document, to 10 clients with compression
+// off, on for every frame and on from COMPRESSION_MIN_SIZE=1024. ns/op
+// covers compressing and inflating on both ends; wire-B/op is what the
+// clients received. Deflating the small frames costs CPU while saving
+// next to nothing, and some come out larger.
+func BenchmarkCompressionMinSize(b *testing.B) {
+	const clients = 10
+	var workload [][]byte
+	for i := range 40 {
+		workload = append(workload, []byte(fmt.Sprintf(`{"type":"tick","symbol":"EURUSD","bid":1.08%03d,"seq":%d}`, i, i)))
+	}
+	for i := range 4 {
+		var doc bytes.Buffer
+		for j := 0; doc.Len() < 8<<10; j++ {
+			fmt.Fprintf(&doc, `{"id":%d,"name":"item-%d","price":%d.%02d},`, j, (i+j)*7919%100003, j%997, j%100)
+		}
+		workload = append(workload, doc.Bytes())
+	}
+	for _, tc := range []struct{ name, compression, minSize string }{
+		{"compression=off", "false", "0"},
+		{"min_size=0", "true", "0"},
+		{"min_size=1024", "true", "1024"},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			tg := startGateway(b, map[string]string{
+				"ENABLE_COMPRESSION":   tc.compression,
+				"COMPRESSION_MIN_SIZE": tc.minSize,
+				"SEND_BUFFER":          strconv.Itoa(2 * len(workload)),
+			})
+			conns := make([]*websocket.Conn, clients)
+			counts := make([]*atomic.Int64, clients)
+			for i := range conns {
+				conns[i], _, counts[i] = dialCounting(b, tg, "/ws")
+			}
+			var before int64
+			for _, n := range counts {
+				before += n.Load()
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				for _, msg := range workload {
+					tg.hub.broadcast(websocket.TextMessage, msg)
+				}
+				for _, conn := range conns {
+					for range workload {
+						readFrame(b, conn)
+					}
+				}
+			}
+			b.StopTimer()
+			var wire int64
+			for _, n := range counts {
+				wire += n.Load()
+			}
+			b.ReportMetric(float64(wire-before)/float64(b.N), "wire-B/op")
+		})
+	}
+}
+
+func TestUpgradeFailures(t *testing.T) {
+	tg := startGateway(t, nil)
+	handshake := map[string]string{
+		"Connection":            "Upgrade",
+		"Upgrade":               "websocket",
+		"Sec-WebSocket-Version": "13",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+	}
+	tests := []struct {
+		name       string
+		method     string
+		header     map[string]string
+		drop       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "plain GET", method: http.MethodGet, wantStatus: http.StatusUpgradeRequired, wantBody: "only speaks WebSocket"},
+		{name: "missing key", method: http.MethodGet, header: handshake, drop: "Sec-WebSocket-Key", wantStatus: http.StatusBadRequest, wantBody: "Sec-WebSocket-Key"},
+		{name: "bad key", method: http.MethodGet, header: map[string]string{"Sec-WebSocket-Key": "short"}, wantStatus: http.StatusBadRequest, wantBody: "Sec-WebSocket-Key"},
+		{name: "unsupported version", method: http.MethodGet, header: map[string]string{"Sec-WebSocket-Version": "8"}, wantStatus: http.StatusBadRequest, wantBody: "version"},
+		{name: "wrong method", method: http.MethodPost, header: handshake, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, tg.url("/ws"), nil)
+			if tt.header != nil {
+				for k, v := range handshake {
+					req.Header.Set(k, v)
+				}
+				for k, v := range tt.header {
+					req.Header.Set(k, v)
+				}
+				req.Header.Del(tt.drop)
+			}
+			code, body := status(t, req)
+			if code != tt.wantStatus || !strings.Contains(body, tt.wantBody) {
+				t.Fatalf("%s /ws = %d %q, want %d mentioning %q", tt.method, code, body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestUpgradeRejectsForeignOrigin(t *testing.T) {
+	tg := startGateway(t, map[string]string{"ALLOWED_ORIGINS": "https://app.example.com"})
+	_, resp, err := tg.tryDial("/ws", http.Header{"Origin": {"https://evil.example.net"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("foreign origin: err = %v, response = %v; want 403", err, resp)
+	}
+	tg.connect("/ws", http.Header{"Origin": {"https://app.example.com"}})
+}
+
+func TestAcceptRateLimitsBursts(t *testing.T) {
+	tg := startGateway(t, map[string]string{"ACCEPT_RATE": "0.1", "ACCEPT_BURST": "3"})
+	var conns []*websocket.Conn
+	for range 3 {
+		conn, _ := tg.connect("/ws", nil)
+		conns = append(conns, conn)
+	}
+	waits := make(map[string]bool)
+	for range 20 {
+		_, resp, err := tg.tryDial("/ws", nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("upgrade past ACCEPT_BURST: err = %v, response = %v; want 503", err, resp)
+		}
+		wait := resp.Header.Get("Retry-After")
+		if n, err := strconv.Atoi(wait); err != nil || n < 1 || n > maxAcceptRetryAfter {
+			t.Fatalf("Retry-After = %q, want 1-%d seconds", wait, maxAcceptRetryAfter)
+		}
+		waits[wait] = true
+	}
+	if len(waits) < 2 {
+		t.Fatalf("every rejection said Retry-After %v, want them spread", waits)
+	}
+	// The connections accepted before the burst carry on.
+	for _, conn := range conns {
+		sendJSON(t, conn, map[string]string{"action": "subscribe", "topic": "a"})
+		if msg := readJSON(t, conn); msg["type"] != "ack" {
+			t.Fatalf("reply = %v, want an ack", msg)
+		}
+	}
+}
+
+func TestUpgradeRejectionReasons(t *testing.T) {
+	tests := []struct {
+		reason string
+		env    map[string]string
+		// setup runs before the refused upgrade.
+		setup  func(tg *testGateway)
+		path   string
+		header http.Header
+		// closeCode is set for refusals that complete the handshake and
+		// close the connection instead of answering with an HTTP status.
+		closeCode int
+	}{
+		{reason: "origin", env: map[string]string{"ALLOWED_ORIGINS": "https://app.example.com"}, header: http.Header{"Origin": {"https://evil.example.net"}}},
+		{reason: "auth", env: map[string]string{"JWT_SECRET": testSecret}},
+		{reason: "capacity", env: map[string]string{"MAX_CONNECTIONS": "1"}, setup: func(tg *testGateway) { tg.connect("/ws", nil) }},
+		{reason: "rate_limit", env: map[string]string{"ACCEPT_RATE": "0.1", "ACCEPT_BURST": "1"}, setup: func(tg *testGateway) { tg.connect("/ws", nil) }},
+		{reason: "rate_limit", env: map[string]string{"MAX_CONN_PER_IP": "1"}, setup: func(tg *testGateway) { tg.connect("/ws", nil) }},
+		{reason: "draining", setup: func(tg *testGateway) { tg.hub.draining.Store(true) }},
+		{reason: "starting", setup: func(tg *testGateway) { tg.hub.starting.Store(true) }},
+		{reason: "memory", setup: func(tg *testGateway) { tg.hub.memoryPressured.Store(true) }},
+		{reason: "duplicate", env: map[string]string{"DUPLICATE_ID_POLICY": "reject"}, setup: func(tg *testGateway) { tg.connect("/ws?client_id=c1", nil) }, path: "?client_id=c1", closeCode: 4009},
+		{reason: "handshake", path: "?batch=sometimes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			tg := startGateway(t, tt.env)
+			if tt.setup != nil {
+				tt.setup(tg)
+			}
+			rejected, succeeded := testutil.ToFloat64(upgradesRejected.WithLabelValues(tt.reason)), testutil.ToFloat64(upgradesSucceeded)
+			conn, _, err := tg.tryDial("/ws"+tt.path, tt.header)
+			switch {
+			case err == nil && tt.closeCode == 0:
+				conn.Close()
+				t.Fatal("upgrade succeeded")
+			case err == nil:
+				defer conn.Close()
+				if code := closeCode(t, conn); code != tt.closeCode {
+					t.Fatalf("close code = %d, want %d", code, tt.closeCode)
+				}
+			case tt.closeCode != 0:
+				t.Fatalf("upgrade failed: %v; want a close frame", err)
+			}
+			if got := testutil.ToFloat64(upgradesRejected.WithLabelValues(tt.reason)) - rejected; got != 1 {
+				t.Fatalf("realtime_upgrade_rejected_total{reason=%q} rose by %v, want 1", tt.reason, got)
+			}
+			if got := testutil.ToFloat64(upgradesSucceeded) - succeeded; got != 0 {
+				t.Fatalf("realtime_upgrade_success_total rose by %v on a refused upgrade", got)
+			}
+		})
+	}
+}
+
+func TestUpgradeSuccessCounted(t *testing.T) {
+	tg := startGateway(t, nil)
+	before := testutil.ToFloat64(upgradesSucceeded)
+	tg.connect("/ws", nil)
+	tg.connect("/ws", nil)
+	if got := testutil.ToFloat64(upgradesSucceeded) - before; got != 2 {
+		t.Fatalf("realtime_upgrade_success_total rose by %v, want 2", got)
+	}
+}
+
+func TestRejectWithClose(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		reason   string
+		wantCode int
+		wantText string
+	}{
+		{name: "capacity", env: map[string]string{"MAX_CONNECTIONS": "1"}, reason: "capacity", wantCode: websocket.CloseTryAgainLater, wantText: "too many connections"},
+		{name: "capacity custom code", env: map[string]string{"MAX_CONNECTIONS": "1", "CAPACITY_CLOSE_CODE": "4503"}, reason: "capacity", wantCode: 4503, wantText: "too many connections"},
+		{name: "accept rate", env: map[string]string{"ACCEPT_RATE": "0.1", "ACCEPT_BURST": "1"}, reason: "rate_limit", wantCode: 4029},
+		{name: "per IP", env: map[string]string{"MAX_CONN_PER_IP": "1"}, reason: "rate_limit", wantCode: 4029, wantText: "too many connections from your address"},
+		{name: "rate custom code", env: map[string]string{"MAX_CONN_PER_IP": "1", "RATE_LIMIT_CLOSE_CODE": "1008"}, reason: "rate_limit", wantCode: websocket.ClosePolicyViolation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.env["REJECT_WITH_CLOSE"] = "true"
+			tg := startGateway(t, tt.env)
+			tg.connect("/ws", nil)
+			rejected := testutil.ToFloat64(upgradesRejected.WithLabelValues(tt.reason))
+			conn, _, err := tg.tryDial("/ws", nil)
+			if err != nil {
+				t.Fatalf("upgrade failed: %v; want it completed and closed", err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err = conn.ReadMessage()
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) {
+				t.Fatalf("read = %v, want a close frame", err)
+			}
+			if ce.Code != tt.wantCode || (tt.wantText != "" && ce.Text != tt.wantText) {
+				t.Fatalf("closed with %d %q, want %d %q", ce.Code, ce.Text, tt.wantCode, tt.wantText)
+			}
+			if got := testutil.ToFloat64(upgradesRejected.WithLabelValues(tt.reason)) - rejected; got != 1 {
+				t.Fatalf("realtime_upgrade_rejected_total{reason=%q} rose by %v, want 1", tt.reason, got)
+			}
+		})
+	}
+}
+
+func TestRejectWithCloseKeepsOtherStatuses(t *testing.T) {
+	// Only capacity and rate limits are refused with a close frame.
+	tg := startGateway(t, map[string]string{"REJECT_WITH_CLOSE": "true", "JWT_SECRET": testSecret})
+	if _, resp, err := tg.tryDial("/ws", nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated upgrade: err = %v, response = %v; want 401", err, resp)
+	}
+}
+
+func TestRejectCloseCodeValidation(t *testing.T) {
+	for _, code := range []string{"1000", "1006", "3000", "5000"} {
+		for _, key := range []string{"CAPACITY_CLOSE_CODE", "RATE_LIMIT_CLOSE_CODE"} {
+			t.Setenv("BACKEND", "memory")
+			t.Setenv(key, code)
+			if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), key) {
+				t.Errorf("%s=%s: err = %v, want it rejected", key, code, err)
+			}
+			t.Setenv(key, "")
+		}
+	}
+}
+
+func TestDuplicateIDReplaced(t *testing.T) {
+	tg := startGateway(t, map[string]string{"DUPLICATE_ID_POLICY": "replace"})
+	old, _ := tg.connect("/ws?client_id=c1&topics=news", nil)
+	conn, id := tg.connect("/ws?client_id=c1&topics=news", nil)
+	if id != "c1" {
+		t.Fatalf("new connection got ID %s", id)
+	}
+	if code := closeCode(t, old); code != closeDuplicateID {
+		t.Fatalf("replaced connection closed with %d, want %d", code, closeDuplicateID)
+	}
+	waitFor(t, "the replaced client to go", func() bool { return tg.hub.count() == 1 })
+	tg.hub.broadcastTopic("news", websocket.TextMessage, []byte(`{"n":1}`))
+	if msg := readJSON(t, conn); msg["n"] != float64(1) {
+		t.Fatalf("frame = %v, want the broadcast on the new connection", msg)
+	}
+}
+
+// duplicateOutcome reads conn until it is closed or quiet for a while and
+// reports whether it was welcomed and the close code it got, 0 for none.
+func duplicateOutcome(conn *websocket.Conn) (welcomed bool, code int) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, data, err := conn.ReadMessage()
+		var ce *websocket.CloseError
+		switch {
+		case errors.As(err, &ce):
+			return welcomed, ce.Code
+		case err != nil:
+			return welcomed, 0
+		case bytes.Contains(data, []byte(`"type":"welcome"`)):
+			welcomed = true
+		}
+	}
+}
+
+// TestDuplicateIDConcurrentConnects races connections claiming one
+// client_id; under either policy exactly one is left holding it.
+func TestDuplicateIDConcurrentConnects(t *testing.T) {
+	const n = 10
+	for _, policy := range []string{"reject", "replace"} {
+		t.Run(policy, func(t *testing.T) {
+			tg := startGateway(t, map[string]string{"DUPLICATE_ID_POLICY": policy})
+			var wg sync.WaitGroup
+			conns := make([]*websocket.Conn, n)
+			for i := range conns {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					conn, _, err := tg.tryDial("/ws?client_id=c1", nil)
+					if err != nil {
+						t.Errorf("dial: %v", err)
+						return
+					}
+					conns[i] = conn
+				}()
+			}
+			wg.Wait()
+			survivors := 0
+			for _, conn := range conns {
+				if conn == nil {
+					continue
+				}
+				defer conn.Close()
+				welcomed, code := duplicateOutcome(conn)
+				switch {
+				case code == 0 && welcomed:
+					survivors++
+				case code != closeDuplicateID:
+					t.Fatalf("connection ended with close code %d, welcomed %v", code, welcomed)
+				case policy == "reject" && welcomed:
+					t.Fatal("a refused duplicate was welcomed")
+				}
+			}
+			if survivors != 1 {
+				t.Fatalf("%d connections hold c1, want 1", survivors)
+			}
+			if _, ok := tg.hub.get("c1"); !ok || tg.hub.count() != 1 {
+				t.Fatalf("hub holds %d clients, c1 registered: %v; want just c1", tg.hub.count(), ok)
+			}
+		})
+	}
+}
@@ -1,109 +1,75 @@
-// Package main provides a Redis-backed WebSocket fanout gateway.
+// Package main runs the realtime gateway as a standalone service.
 package main
 
 import (
 	"context"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
+	"time"
 
-	"github.com/gorilla/websocket"
-	"github.com/redis/go-redis/v9"
+	"realtime/gateway"
 )
 
-// Allow cross-origin WS connections; enforce auth at the API gateway if needed.
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
-// hub tracks live connections and broadcasts payloads to all clients.
-type hub struct {
-	clients map[*websocket.Conn]struct{}
-	mu      sync.RWMutex
-}
-
-func newHub() *hub {
-	return &hub{clients: make(map[*websocket.Conn]struct{})}
-}
-
-func (h *hub) add(conn *websocket.Conn) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	h.clients[conn] = struct{}{}
-}
-
-func (h *hub) remove(conn *websocket.Conn) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	delete(h.clients, conn)
-	conn.Close()
-}
-
-func (h *hub) broadcast(message []byte) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	for c := range h.clients {
-		if err := c.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Printf("ws write error: %v", err)
-			go h.remove(c)
-		}
-	}
-}
-
 func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	// Read Redis Pub/Sub settings for external fanout.
-	redisURL := getenv("REDIS_URL", "redis://localhost:6379/0")
-	opt, err := redis.ParseURL(redisURL)
+	cfg, err := gateway.LoadConfig()
 	if err != nil {
-		log.Fatalf("invalid REDIS_URL: %v", err)
+		fatal("invalid configuration", "err", err)
 	}
-	rdb := redis.NewClient(opt)
-	sub := rdb.Subscribe(ctx, getenv("REDIS_CHANNEL", "realtime:broadcast"))
-
-	h := newHub()
-
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Printf("upgrade error: %v", err)
-			return
-		}
-		h.add(conn)
-	})
+	logger, err := gateway.NewLogger(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		fatal(err.Error())
+	}
+	slog.SetDefault(logger)
 
-	go func() {
-		ch := sub.Channel()
-		for msg := range ch {
-			h.broadcast([]byte(msg.Payload))
-		}
-	}()
+	g := gateway.New(cfg)
+	go drainOnSignal(g, cfg.DrainTimeout, stop)
+	go reloadOnSignal(g)
+	if err := g.Run(ctx); err != nil {
+		fatal(err.Error())
+	}
+}
 
-	addr := getenv("BIND_ADDR", ":8081")
-	server := &http.Server{Addr: addr}
+// drainOnSignal stops new upgrades on the first SIGUSR1 while existing
+// clients keep being served. A second SIGUSR1, or drainTimeout if set,
+// triggers the full shutdown through shutdown.
+func drainOnSignal(g *gateway.Gateway, drainTimeout time.Duration, shutdown context.CancelFunc) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	<-usr1
+	g.Drain()
+
+	var timeout <-chan time.Time
+	if drainTimeout > 0 {
+		timeout = time.After(drainTimeout)
+	}
+	select {
+	case <-usr1:
+		slog.Info("second SIGUSR1 received; shutting down")
+	case <-timeout:
+		slog.Info("drain timeout elapsed; shutting down")
+	}
+	shutdown()
+}
 
-	go func() {
-		log.Printf("realtime gateway listening on %s", addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("http server error: %v", err)
+// reloadOnSignal reloads the per-topic settings from CONFIG_FILE on every
+// SIGHUP, keeping the current ones when the file is invalid.
+func reloadOnSignal(g *gateway.Gateway) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := g.ReloadTopics(); err != nil {
+			slog.Error("config reload failed; keeping the current topic settings", "err", err)
 		}
-	}()
-
-	<-ctx.Done()
-	log.Println("shutting down realtime gateway")
-	server.Close()
-	sub.Close()
-	rdb.Close()
+	}
 }
 
-func getenv(key, fallback string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
-	}
-	return fallback
+// fatal logs msg at error level and exits. It is used for startup failures.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }